@@ -223,6 +223,23 @@ func defaultMux(path string) corehttp.ServeOption {
 	}
 }
 
+// analyticsMux serves one of the node's local analytics reports at path.
+func analyticsMux(path string, handler func(*core.IpfsNode) http.Handler) corehttp.ServeOption {
+	return func(node *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		mux.Handle(path, handler(node))
+		return mux, nil
+	}
+}
+
+// analyticsAPICalls counts the API commands served by the options after it for analytics.
+func analyticsAPICalls() corehttp.ServeOption {
+	return func(node *core.IpfsNode, _ net.Listener, mux *http.ServeMux) (*http.ServeMux, error) {
+		childMux := http.NewServeMux()
+		mux.Handle("/", spin.CountAPICalls(node, childMux))
+		return childMux, nil
+	}
+}
+
 func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment) (_err error) {
 
 	cctx := env.(*oldcmds.Context)
@@ -556,7 +573,23 @@ func daemonFunc(req *cmds.Request, re cmds.ResponseEmitter, env cmds.Environment
 	if err != nil {
 		return err
 	}
-	spin.Analytics(api, cctx.ConfigRoot, node, version.CurrentVersionNumber, hValue)
+	// analytics is not needed to run the node, so failing to start it is not fatal
+	analytics, err := spin.Analytics(req.Context, api, cctx.ConfigRoot, node, version.CurrentVersionNumber, hValue)
+	if err != nil {
+		log.Errorf("Analytics did not start: %s", err)
+	}
+	defer analytics.Stop()
+	if analytics != nil {
+		// pick up analytics config changes without restarting the daemon
+		utilmain.SetReloadHandler(func() {
+			if err := analytics.ReloadConfig(); err != nil {
+				log.Errorf("Failed to reload the analytics config: %s", err)
+				return
+			}
+			log.Info("Reloaded the analytics config")
+		})
+		defer utilmain.SetReloadHandler(nil)
+	}
 	spin.Hosts(node, env)
 	spin.Contracts(node, req, env, nodepb.ContractStat_HOST.String())
 	if params, err := helper.ExtractContextParams(req, env); err == nil {
@@ -650,6 +683,7 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 
 	var opts = []corehttp.ServeOption{
 		corehttp.MetricsCollectionOption("api"),
+		analyticsAPICalls(),
 		corehttp.CheckVersionOption(),
 		corehttp.CommandsOption(*cctx),
 		corehttp.WebUIOption,
@@ -660,6 +694,9 @@ func serveHTTPApi(req *cmds.Request, cctx *oldcmds.Context) (<-chan error, error
 		defaultMux("/debug/pprof/"),
 		corehttp.MutexFractionOption("/debug/pprof-mutex/"),
 		corehttp.MetricsScrapingOption("/debug/metrics/prometheus"),
+		analyticsMux("/debug/analytics", spin.AnalyticsHandler),
+		analyticsMux("/api/v0/analytics/stream", spin.AnalyticsStreamHandler),
+		analyticsMux("/metrics", spin.PrometheusHandler),
 		corehttp.LogOption(),
 	}
 
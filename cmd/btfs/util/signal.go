@@ -55,6 +55,19 @@ func (ih *IntrHandler) Handle(handler func(count int, ih *IntrHandler), sigs ...
 	}()
 }
 
+var (
+	reloadMu      sync.Mutex
+	reloadHandler func()
+)
+
+// SetReloadHandler makes the reload signal, SIGUSR1 where there is one, call reload
+// until it is called again with nil.
+func SetReloadHandler(reload func()) {
+	reloadMu.Lock()
+	reloadHandler = reload
+	reloadMu.Unlock()
+}
+
 func SetupInterruptHandler(ctx context.Context) (io.Closer, context.Context) {
 	intrh := NewIntrHandler()
 	ctx, cancelFunc := context.WithCancel(ctx)
@@ -77,6 +90,17 @@ func SetupInterruptHandler(ctx context.Context) (io.Closer, context.Context) {
 	}
 
 	intrh.Handle(handlerFunc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	// notifying of no signals at all would notify of every signal
+	if len(reloadSignals) != 0 {
+		intrh.Handle(func(_ int, _ *IntrHandler) {
+			reloadMu.Lock()
+			reload := reloadHandler
+			reloadMu.Unlock()
+			if reload != nil {
+				reload()
+			}
+		}, reloadSignals...)
+	}
 
 	return intrh, ctx
 }
@@ -0,0 +1,11 @@
+// +build !windows,!wasm
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals reload the settings that can change without restarting the daemon
+var reloadSignals = []os.Signal{syscall.SIGUSR1}
@@ -16,3 +16,6 @@ func SetupInterruptHandler(ctx context.Context) (io.Closer, context.Context) {
 	ctx, cancel := context.WithCancel(ctx)
 	return ctxCloser(cancel), ctx
 }
+
+// SetReloadHandler does nothing, there are no signals to handle.
+func SetReloadHandler(reload func()) {}
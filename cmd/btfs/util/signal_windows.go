@@ -0,0 +1,8 @@
+// +build windows
+
+package util
+
+import "os"
+
+// reloadSignals is empty, windows has no signal to spare for reloading
+var reloadSignals []os.Signal
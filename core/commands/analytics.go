@@ -0,0 +1,232 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core/commands/cmdenv"
+	"github.com/TRON-US/go-btfs/spin"
+
+	cmds "github.com/TRON-US/go-btfs-cmds"
+)
+
+var AnalyticsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Interact with the analytics reported to the status server.",
+		ShortDescription: `
+The subcommands here are mostly for debugging the analytics collected by the
+daemon when Experimental.Analytics or Experimental.StorageHostEnabled is on.`,
+	},
+	Subcommands: map[string]*cmds.Command{
+		"send":          analyticsSendCmd,
+		"status":        analyticsStatusCmd,
+		"replay":        analyticsReplayCmd,
+		"export-config": analyticsConfigCmd,
+	},
+}
+
+const replayFileOptionName = "file"
+
+var analyticsSendCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Send the analytics to the status server now.",
+		ShortDescription: `
+Collects the latest analytics and sends them to the status server right away
+instead of waiting for the next heartbeat. The send is attempted once, a heartbeat
+that could not be delivered is retried with the next one. It is attempted even
+while failed heartbeats paused sending, and takes the ones buffered meanwhile along.`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if !n.IsDaemon {
+			return cmds.Errorf(cmds.ErrClient, "daemon not running")
+		}
+		agent := spin.GetAgent(n)
+		if agent == nil {
+			return cmds.Errorf(cmds.ErrClient, "analytics is not running")
+		}
+		return agent.SendDataNow()
+	},
+}
+
+var analyticsStatusCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Show whether analytics is enabled and how the last heartbeat went.",
+		ShortDescription: `
+Prints whether the config consents to sending analytics, the heartbeat interval,
+and when the last heartbeat was attempted together with its error, if any.`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if !n.IsDaemon {
+			return cmds.Errorf(cmds.ErrClient, "daemon not running")
+		}
+		agent := spin.GetAgent(n)
+		if agent == nil {
+			return cmds.Errorf(cmds.ErrClient, "analytics is not running")
+		}
+		st, err := agent.Status()
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, st)
+	},
+	Type: spin.AnalyticsStatus{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *spin.AnalyticsStatus) error {
+			last, lastErr := "never", "none"
+			if !out.LastSendTime.IsZero() {
+				last = out.LastSendTime.Format(time.RFC3339)
+			}
+			if out.LastSendError != "" {
+				lastErr = out.LastSendError
+			}
+			tw := tabwriter.NewWriter(w, 4, 4, 2, ' ', 0)
+			fmt.Fprintf(tw, "Enabled\t%t\n", out.Enabled)
+			fmt.Fprintf(tw, "Heartbeat interval\t%s\n", out.HeartbeatInterval)
+			fmt.Fprintf(tw, "Last heartbeat\t%s\n", last)
+			fmt.Fprintf(tw, "Last error\t%s\n", lastErr)
+			return tw.Flush()
+		}),
+	},
+}
+
+var analyticsConfigCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Print the analytics configuration the daemon runs with.",
+		ShortDescription: `
+Prints every analytics setting as the running agent resolved it, with whether it
+came from the config file, an environment variable or the default. Secrets are
+redacted.`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if !n.IsDaemon {
+			return cmds.Errorf(cmds.ErrClient, "daemon not running")
+		}
+		agent := spin.GetAgent(n)
+		if agent == nil {
+			return cmds.Errorf(cmds.ErrClient, "analytics is not running")
+		}
+		cfg, err := agent.EffectiveConfig()
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, &cfg)
+	},
+	Type: map[string]spin.ConfigValue{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *map[string]spin.ConfigValue) error {
+			keys := make([]string, 0, len(*out))
+			for k := range *out {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			tw := tabwriter.NewWriter(w, 4, 4, 2, ' ', 0)
+			for _, k := range keys {
+				v := (*out)[k]
+				fmt.Fprintf(tw, "%s\t%v\t%s\n", k, v.Value, v.Source)
+			}
+			return tw.Flush()
+		}),
+	},
+}
+
+var analyticsReplayCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Send the heartbeats of a local analytics export to the status server.",
+		ShortDescription: `
+Reads the CSV file written by Analytics.LocalExportPath and sends its heartbeats
+to the status server in order, in batches, to backfill the analytics of a node
+that could not reach it for a while. Only the fields the status server accepts
+are sent, signed again with the node's key. Replaying stops at the first batch
+that could not be delivered.`,
+	},
+	Options: []cmds.Option{
+		cmds.StringOption(replayFileOptionName, "f", "Path of the CSV analytics export to replay."),
+	},
+	PreRun: func(req *cmds.Request, env cmds.Environment) error {
+		path, _ := req.Options[replayFileOptionName].(string)
+		if path == "" {
+			return fmt.Errorf("missing --%s", replayFileOptionName)
+		}
+		// the daemon reads the file, from its own working directory
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		req.Options[replayFileOptionName] = abs
+		return nil
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if !n.IsDaemon {
+			return cmds.Errorf(cmds.ErrClient, "daemon not running")
+		}
+		agent := spin.GetAgent(n)
+		if agent == nil {
+			return cmds.Errorf(cmds.ErrClient, "analytics is not running")
+		}
+		path, _ := req.Options[replayFileOptionName].(string)
+		out, err := agent.Replay(req.Context, path)
+		if err != nil {
+			if out != nil && out.Replayed > 0 {
+				return fmt.Errorf("replayed %d heartbeats: %s", out.Replayed, err)
+			}
+			return err
+		}
+		return cmds.EmitOnce(res, out)
+	},
+	Type: spin.ReplayResult{},
+	Encoders: cmds.EncoderMap{
+		cmds.Text: cmds.MakeTypedEncoder(func(req *cmds.Request, w io.Writer, out *spin.ReplayResult) error {
+			_, err := fmt.Fprintf(w, "Replayed %d heartbeats\n", out.Replayed)
+			return err
+		}),
+	},
+}
+
+var diagAnalyticsCmd = &cmds.Command{
+	Helptext: cmds.HelpText{
+		Tagline: "Print the health of the analytics reported to the status server.",
+		ShortDescription: `
+Reports when the analytics were last sent and why that failed if it did, whether
+the status server can be reached, and the size of the payload that would be sent.
+Nothing is sent to the status server.`,
+	},
+	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		n, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
+		if !n.IsDaemon {
+			return cmds.Errorf(cmds.ErrClient, "daemon not running")
+		}
+		agent := spin.GetAgent(n)
+		if agent == nil {
+			return cmds.Errorf(cmds.ErrClient, "analytics is not running")
+		}
+		h, err := agent.HealthCheck(req.Context)
+		if err != nil {
+			return err
+		}
+		return cmds.EmitOnce(res, h)
+	},
+	Type: spin.AnalyticsHealth{},
+}
@@ -0,0 +1,213 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	oldcmds "github.com/TRON-US/go-btfs/commands"
+	"github.com/TRON-US/go-btfs/core"
+	"github.com/TRON-US/go-btfs/core/commands/storage/helper"
+	"github.com/TRON-US/go-btfs/core/coreapi"
+	unixtest "github.com/TRON-US/go-btfs/core/coreunix/test"
+	"github.com/TRON-US/go-btfs/spin"
+
+	cmdshttp "github.com/TRON-US/go-btfs-cmds/http"
+	config "github.com/TRON-US/go-btfs-config"
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/gogo/protobuf/types"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"google.golang.org/grpc"
+)
+
+type analyticsTestServer struct {
+	pb.UnimplementedStatusServiceServer
+
+	mu       sync.Mutex
+	fail     bool
+	received int
+}
+
+func (s *analyticsTestServer) UpdateMetricsAndDiscovery(ctx context.Context, sm *pb.SignedMetrics) (*types.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return nil, errors.New("status server unavailable")
+	}
+	s.received++
+	return &types.Empty{}, nil
+}
+
+func (s *analyticsTestServer) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *analyticsTestServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+// startAnalyticsDaemon runs analytics for a mock daemon reporting to a test status
+// server, and returns the server and the daemon's API handler.
+func startAnalyticsDaemon(t *testing.T) (*analyticsTestServer, http.Handler) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	ss := &analyticsTestServer{}
+	pb.RegisterStatusServiceServer(srv, ss)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	cfg := &config.Config{}
+	cfg.Experimental.Analytics = true
+	cfg.Services.StatusServerDomain = lis.Addr().String()
+	node := unixtest.HelpTestMockRepo(t, cfg)
+	node.IsDaemon = true
+	if node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.PutHostStorageConfig(node, &nodepb.Node_Settings{}); err != nil {
+		t.Fatal(err)
+	}
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := spin.Analytics(context.Background(), api, t.TempDir(), node, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(agent.Stop)
+
+	env := &oldcmds.Context{ReqLog: &oldcmds.ReqLog{}, ConstructNode: func() (*core.IpfsNode, error) {
+		return node, nil
+	}}
+	srvCfg := cmdshttp.NewServerConfig()
+	srvCfg.APIPath = "/api/v0"
+	h := cmdshttp.NewHandler(env, Root, srvCfg)
+	return ss, h
+}
+
+func TestAnalyticsSend(t *testing.T) {
+	ss, h := startAnalyticsDaemon(t)
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v0/analytics/send", nil))
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v0/diag/analytics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var health spin.AnalyticsHealth
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if !health.ServerReachable || health.CurrentPayloadBytes == 0 {
+		t.Fatalf("unexpected analytics health %+v", health)
+	}
+
+	before := ss.count()
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if ss.count() <= before {
+		t.Fatal("status server did not receive the analytics")
+	}
+
+	ss.setFail(true)
+	rec = send()
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(rec.Body.String(), "status server unavailable") {
+		t.Fatalf("error does not say why sending failed: %s", rec.Body.String())
+	}
+}
+
+func TestAnalyticsStatus(t *testing.T) {
+	_, h := startAnalyticsDaemon(t)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v0/analytics/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"LastSendTime", "LastSendError", "HeartbeatInterval", "Enabled"} {
+		if _, ok := fields[k]; !ok {
+			t.Errorf("analytics status has no %s: %s", k, rec.Body.String())
+		}
+	}
+	if fields["Enabled"] != true {
+		t.Errorf("analytics reported disabled: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v0/analytics/status?encoding=text", nil))
+	for _, row := range []string{"Enabled", "Heartbeat interval", "Last heartbeat", "Last error"} {
+		if !strings.Contains(rec.Body.String(), row) {
+			t.Errorf("analytics status table has no %q row: %s", row, rec.Body.String())
+		}
+	}
+}
+
+func TestAnalyticsConfig(t *testing.T) {
+	_, h := startAnalyticsDaemon(t)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v0/analytics/export-config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var cfg map[string]spin.ConfigValue
+	if err := json.Unmarshal(rec.Body.Bytes(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{
+		"Experimental.Analytics",
+		"Services.StatusServerDomain",
+		"Analytics.StatusServerHeartbeat",
+		"Analytics.SamplingRate",
+		"Analytics.DryRun",
+		"Analytics.PrivacyMode",
+		"Analytics.HMACKey",
+	} {
+		v, ok := cfg[k]
+		if !ok {
+			t.Errorf("analytics config has no %s: %s", k, rec.Body.String())
+			continue
+		}
+		if v.Source == "" {
+			t.Errorf("%s has no source", k)
+		}
+	}
+	if v := cfg["Analytics.StatusServerHeartbeat"]; v.Value != "15m0s" || v.Source != "default" {
+		t.Errorf("got heartbeat %+v, want the default", v)
+	}
+	if v := cfg["Experimental.Analytics"]; v.Value != true || v.Source != "config file" {
+		t.Errorf("got analytics enabled %+v, want true from the config file", v)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v0/analytics/export-config?encoding=text", nil))
+	if !strings.Contains(rec.Body.String(), "Analytics.SamplingRate") {
+		t.Errorf("analytics config table has no sampling rate: %s", rec.Body.String())
+	}
+}
@@ -71,6 +71,11 @@ func TestCommands(t *testing.T) {
 	list := []string{
 		"/add",
 		"/addAndUpload",
+		"/analytics",
+		"/analytics/export-config",
+		"/analytics/replay",
+		"/analytics/send",
+		"/analytics/status",
 		"/bitswap",
 		"/bitswap/ledger",
 		"/bitswap/reprovide",
@@ -112,6 +117,7 @@ func TestCommands(t *testing.T) {
 		"/dht/put",
 		"/dht/query",
 		"/diag",
+		"/diag/analytics",
 		"/diag/cmds",
 		"/diag/cmds/clear",
 		"/diag/cmds/set-time",
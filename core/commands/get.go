@@ -12,6 +12,7 @@ import (
 	cmds "github.com/TRON-US/go-btfs-cmds"
 	"github.com/TRON-US/go-btfs/core/commands/cmdenv"
 	"github.com/TRON-US/go-btfs/core/commands/e"
+	"github.com/TRON-US/go-btfs/spin"
 
 	"github.com/whyrusleeping/tar-utils"
 	"gopkg.in/cheggaaa/pb.v1"
@@ -69,6 +70,11 @@ If '--meta' or '-m' is enabled, this option is ignored.
 	},
 	RunTimeout: 5 * time.Minute,
 	Run: func(req *cmds.Request, res cmds.ResponseEmitter, env cmds.Environment) error {
+		start := time.Now()
+		node, err := cmdenv.GetNode(env)
+		if err != nil {
+			return err
+		}
 		api, err := cmdenv.GetApi(env, req)
 		if err != nil {
 			return err
@@ -88,7 +94,7 @@ If '--meta' or '-m' is enabled, this option is ignored.
 			return err
 		}
 
-		return res.Emit(reader)
+		return res.Emit(spin.TimeRetrieval(node, start, reader))
 	},
 	PostRun: cmds.PostRunMap{
 		cmds.CLI: func(res cmds.Response, re cmds.ResponseEmitter) error {
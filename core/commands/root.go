@@ -121,6 +121,7 @@ var CommandsDaemonCmd = CommandsCmd(Root)
 var rootSubcommands = map[string]*cmds.Command{
 	"add":          AddCmd,
 	"addAndUpload": AddAndUploadCmd,
+	"analytics":    AnalyticsCmd,
 	"bitswap":      BitswapCmd,
 	"block":        BlockCmd,
 	"cat":          CatCmd,
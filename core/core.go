@@ -72,6 +72,7 @@ type IpfsNode struct {
 	Blockstore      bstore.GCBlockstore       // the block store (lower level)
 	Filestore       *filestore.Filestore      `optional:"true"` // the filestore blockstore
 	BaseBlocks      node.BaseBlocks           // the raw blockstore, no filestore wrapping
+	BlockCache      *node.BlockCache          `optional:"true"` // hits and misses of the blockstore caches
 	GCLocker        bstore.GCLocker           // the locker used to protect the blockstore during gc
 	Blocks          bserv.BlockService        // the block service, get/add blocks.
 	DAG             ipld.DAGService           // the merkle dag service, get/add objects.
@@ -88,6 +89,7 @@ type IpfsNode struct {
 	Bootstrapper  io.Closer               `optional:"true"` // the periodic bootstrapper
 	Routing       routing.Routing         `optional:"true"` // the routing system. recommend ipfs-dht
 	Exchange      exchange.Interface      // the block exchange + strategy (bitswap)
+	Traffic       *node.BitswapTraffic    `optional:"true"` // block counts of the exchange, if bitswap
 	Namesys       namesys.NameSystem      // the name system, resolves paths to hashes
 	Provider      provider.System         // the value provider system
 	IpnsRepub     *ipnsrp.Republisher     `optional:"true"`
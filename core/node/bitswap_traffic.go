@@ -0,0 +1,258 @@
+package node
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-bitswap"
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	"github.com/ipfs/go-bitswap/network"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// maxTrackedWants caps the wants tracked at once, the ones past it are not
+	// counted if they fail
+	maxTrackedWants = 100000
+	// wantExpiry is how long a want is tracked for, one the partners neither
+	// answered nor were cancelled for by then is forgotten
+	wantExpiry = 10 * time.Minute
+)
+
+// BitswapTraffic counts the blocks bitswap exchanges with its partners, so they
+// can be read often without taking the locks bitswap.Stat needs.
+type BitswapTraffic struct {
+	blocksSent     uint64
+	dataSent       uint64
+	blocksReceived uint64
+	dataReceived   uint64
+	// blocks that could not be sent, and wanted blocks no partner could provide
+	failedUploads   uint64
+	failedDownloads uint64
+
+	wantsMu sync.Mutex
+	// wants holds the blocks wanted from partners until they are received, cancelled
+	// or expire
+	wants map[cid.Cid]*want
+	// peers maps the bitswap partners to their encoded ids
+	peers sync.Map
+}
+
+// NewBitswapTraffic creates the counters for the node's bitswap exchange
+func NewBitswapTraffic() *BitswapTraffic {
+	return &BitswapTraffic{wants: make(map[cid.Cid]*want)}
+}
+
+// want is a block wanted from some partners
+type want struct {
+	since time.Time
+	// the partners it was wanted from, true once they answered they do not have it
+	dontHave map[peer.ID]bool
+}
+
+// Stat returns the counted traffic as a bitswap.Stat. Only the block and data
+// counts and the peers are set.
+func (t *BitswapTraffic) Stat() *bitswap.Stat {
+	st := &bitswap.Stat{
+		BlocksSent:     atomic.LoadUint64(&t.blocksSent),
+		DataSent:       atomic.LoadUint64(&t.dataSent),
+		BlocksReceived: atomic.LoadUint64(&t.blocksReceived),
+		DataReceived:   atomic.LoadUint64(&t.dataReceived),
+		Peers:          make([]string, 0),
+	}
+	t.peers.Range(func(_, id interface{}) bool {
+		st.Peers = append(st.Peers, id.(string))
+		return true
+	})
+	sort.Strings(st.Peers)
+	return st
+}
+
+// Failed returns the blocks that failed to upload and download so far. An upload
+// fails when the message carrying the block cannot be sent. A download fails when
+// the want is cancelled after every partner it was wanted from answered they do
+// not have the block, or when the last of them disconnects before it arrives. A
+// want cancelled while a partner may still send the block, as when the request is
+// given up, is not a failure.
+func (t *BitswapTraffic) Failed() (uploads, downloads uint64) {
+	t.expireWants(time.Now())
+	return atomic.LoadUint64(&t.failedUploads), atomic.LoadUint64(&t.failedDownloads)
+}
+
+// trackWants records the blocks msg wants from p and counts the cancelled wants no
+// partner had as failed downloads.
+func (t *BitswapTraffic) trackWants(p peer.ID, msg bsmsg.BitSwapMessage) {
+	t.wantsMu.Lock()
+	defer t.wantsMu.Unlock()
+	for _, e := range msg.Wantlist() {
+		w, wanted := t.wants[e.Cid]
+		if e.Cancel {
+			if !wanted {
+				continue
+			}
+			if w.nobodyHas() {
+				atomic.AddUint64(&t.failedDownloads, 1)
+				delete(t.wants, e.Cid)
+			} else if delete(w.dontHave, p); len(w.dontHave) == 0 {
+				delete(t.wants, e.Cid)
+			}
+			continue
+		}
+		if !wanted {
+			if len(t.wants) >= maxTrackedWants {
+				continue
+			}
+			w = &want{since: time.Now(), dontHave: make(map[peer.ID]bool)}
+			t.wants[e.Cid] = w
+		}
+		if _, ok := w.dontHave[p]; !ok {
+			w.dontHave[p] = false
+		}
+	}
+}
+
+// nobodyHas tells whether every partner the block was wanted from answered they do
+// not have it.
+func (w *want) nobodyHas() bool {
+	for _, dontHave := range w.dontHave {
+		if !dontHave {
+			return false
+		}
+	}
+	return true
+}
+
+// received clears the wants for the blocks msg from p carries, and records the
+// ones p does not have.
+func (t *BitswapTraffic) received(p peer.ID, msg bsmsg.BitSwapMessage) {
+	t.wantsMu.Lock()
+	defer t.wantsMu.Unlock()
+	for _, b := range msg.Blocks() {
+		delete(t.wants, b.Cid())
+	}
+	for _, c := range msg.DontHaves() {
+		if w, ok := t.wants[c]; ok {
+			if _, asked := w.dontHave[p]; asked {
+				w.dontHave[p] = true
+			}
+		}
+	}
+}
+
+// disconnected forgets the wants sent to p, counting the blocks no other partner
+// was asked for as failed downloads.
+func (t *BitswapTraffic) disconnected(p peer.ID) {
+	t.wantsMu.Lock()
+	defer t.wantsMu.Unlock()
+	for c, w := range t.wants {
+		if _, asked := w.dontHave[p]; !asked {
+			continue
+		}
+		if delete(w.dontHave, p); len(w.dontHave) == 0 {
+			atomic.AddUint64(&t.failedDownloads, 1)
+			delete(t.wants, c)
+		}
+	}
+}
+
+// expireWants forgets the wants tracked for longer than wantExpiry.
+func (t *BitswapTraffic) expireWants(now time.Time) {
+	t.wantsMu.Lock()
+	defer t.wantsMu.Unlock()
+	for c, w := range t.wants {
+		if now.Sub(w.since) > wantExpiry {
+			delete(t.wants, c)
+		}
+	}
+}
+
+func (t *BitswapTraffic) count(blocks, data *uint64, msg bsmsg.BitSwapMessage) {
+	blks := msg.Blocks()
+	if len(blks) == 0 {
+		return
+	}
+	size := 0
+	for _, b := range blks {
+		size += len(b.RawData())
+	}
+	atomic.AddUint64(blocks, uint64(len(blks)))
+	atomic.AddUint64(data, uint64(size))
+}
+
+// Network wraps net so that the blocks bitswap sends and receives over it are counted
+func (t *BitswapTraffic) Network(net network.BitSwapNetwork) network.BitSwapNetwork {
+	return &countingNetwork{BitSwapNetwork: net, traffic: t}
+}
+
+// countingNetwork counts the blocks of every message sent successfully, and those
+// that fail to send. Bitswap only sends blocks with SendMessage, message senders
+// carry wants.
+type countingNetwork struct {
+	network.BitSwapNetwork
+	traffic *BitswapTraffic
+}
+
+func (n *countingNetwork) SendMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+	if err := n.BitSwapNetwork.SendMessage(ctx, p, msg); err != nil {
+		atomic.AddUint64(&n.traffic.failedUploads, uint64(len(msg.Blocks())))
+		return err
+	}
+	n.traffic.count(&n.traffic.blocksSent, &n.traffic.dataSent, msg)
+	n.traffic.trackWants(p, msg)
+	return nil
+}
+
+func (n *countingNetwork) NewMessageSender(ctx context.Context, p peer.ID, opts *network.MessageSenderOpts) (network.MessageSender, error) {
+	s, err := n.BitSwapNetwork.NewMessageSender(ctx, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &countingSender{MessageSender: s, traffic: n.traffic, peer: p}, nil
+}
+
+// countingSender tracks the wants sent to a partner, see BitswapTraffic.trackWants
+type countingSender struct {
+	network.MessageSender
+	traffic *BitswapTraffic
+	peer    peer.ID
+}
+
+func (s *countingSender) SendMsg(ctx context.Context, msg bsmsg.BitSwapMessage) error {
+	if err := s.MessageSender.SendMsg(ctx, msg); err != nil {
+		return err
+	}
+	s.traffic.trackWants(s.peer, msg)
+	return nil
+}
+
+func (n *countingNetwork) SetDelegate(r network.Receiver) {
+	n.BitSwapNetwork.SetDelegate(&countingReceiver{Receiver: r, traffic: n.traffic})
+}
+
+// countingReceiver counts the blocks received, duplicates included like bitswap.Stat,
+// clears their wants and tracks the peers bitswap keeps a ledger for.
+type countingReceiver struct {
+	network.Receiver
+	traffic *BitswapTraffic
+}
+
+func (r *countingReceiver) ReceiveMessage(ctx context.Context, p peer.ID, incoming bsmsg.BitSwapMessage) {
+	r.traffic.count(&r.traffic.blocksReceived, &r.traffic.dataReceived, incoming)
+	r.traffic.received(p, incoming)
+	r.Receiver.ReceiveMessage(ctx, p, incoming)
+}
+
+func (r *countingReceiver) PeerConnected(p peer.ID) {
+	r.traffic.peers.Store(p, p.Pretty())
+	r.Receiver.PeerConnected(p)
+}
+
+func (r *countingReceiver) PeerDisconnected(p peer.ID) {
+	r.traffic.peers.Delete(p)
+	r.traffic.disconnected(p)
+	r.Receiver.PeerDisconnected(p)
+}
@@ -0,0 +1,66 @@
+package node
+
+import (
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// BlockCache counts the blockstore reads, Has, Get and GetSize calls, that the
+// ARC and bloom filter caches answer without going to the datastore.
+type BlockCache struct {
+	reads  uint64
+	misses uint64
+	// whether the blockstore has a cache to count
+	cached bool
+}
+
+// NewBlockCache creates the counters for the node's blockstore caches
+func NewBlockCache() *BlockCache {
+	return &BlockCache{}
+}
+
+// CacheStats returns the reads the caches answered and those that went to the
+// datastore. ok is false if the blockstore is not cached.
+func (c *BlockCache) CacheStats() (hits, misses uint64, ok bool) {
+	// misses are counted after their read, so load them first
+	misses = atomic.LoadUint64(&c.misses)
+	reads := atomic.LoadUint64(&c.reads)
+	if reads < misses {
+		reads = misses
+	}
+	return reads - misses, misses, c.cached
+}
+
+// wrap caches bs with cache, counting the reads to the cache and to bs
+func (c *BlockCache) wrap(bs blockstore.Blockstore, cache func(blockstore.Blockstore) (blockstore.Blockstore, error)) (blockstore.Blockstore, error) {
+	cached, err := cache(&countingBlockstore{Blockstore: bs, reads: &c.misses})
+	if err != nil {
+		return nil, err
+	}
+	c.cached = true
+	return &countingBlockstore{Blockstore: cached, reads: &c.reads}, nil
+}
+
+// countingBlockstore counts the reads of the blockstore it wraps
+type countingBlockstore struct {
+	blockstore.Blockstore
+	reads *uint64
+}
+
+func (bs *countingBlockstore) Has(c cid.Cid) (bool, error) {
+	atomic.AddUint64(bs.reads, 1)
+	return bs.Blockstore.Has(c)
+}
+
+func (bs *countingBlockstore) Get(c cid.Cid) (blocks.Block, error) {
+	atomic.AddUint64(bs.reads, 1)
+	return bs.Blockstore.Get(c)
+}
+
+func (bs *countingBlockstore) GetSize(c cid.Cid) (int, error) {
+	atomic.AddUint64(bs.reads, 1)
+	return bs.Blockstore.GetSize(c)
+}
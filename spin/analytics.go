@@ -2,9 +2,17 @@ package spin
 
 import (
 	"context"
+	crand "crypto/rand"
+	"database/sql"
+	"encoding/binary"
 	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/TRON-US/go-btfs/core"
@@ -14,7 +22,6 @@ import (
 	iface "github.com/TRON-US/interface-go-btfs-core"
 	nodepb "github.com/tron-us/go-btfs-common/protos/node"
 	pb "github.com/tron-us/go-btfs-common/protos/status"
-	cgrpc "github.com/tron-us/go-btfs-common/utils/grpc"
 
 	"github.com/alecthomas/units"
 	"github.com/cenkalti/backoff/v4"
@@ -23,13 +30,141 @@ import (
 	logging "github.com/ipfs/go-log"
 	ic "github.com/libp2p/go-libp2p-crypto"
 	"github.com/shirou/gopsutil/v3/cpu"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type dcWrap struct {
-	node   *core.IpfsNode
-	api    iface.CoreAPI
-	pn     *nodepb.Node
-	config *config.Config
+	// mu guards pn and extra. Setting them needs it for writing, once the slow
+	// sources are read, see gather, and reading the collected analytics concurrently
+	// from the agent and the local handlers only for reading
+	mu sync.RWMutex
+	// sendMu serializes heartbeats sent by the agent and on demand
+	sendMu sync.Mutex
+	// connMu guards conns, the connections to the status servers kept between
+	// heartbeats, and dialing, which lets one dial run per status server outside
+	// connMu. connGen counts closeConn calls, so a dial that outlived one is dropped.
+	connMu  sync.Mutex
+	conns   map[string]*grpc.ClientConn
+	dialing map[string]chan struct{}
+	connGen uint64
+
+	node  *core.IpfsNode
+	api   iface.CoreAPI
+	stats StatsProvider
+	// bandwidth reports the swarm traffic per protocol, nil without a bandwidth counter
+	bandwidth protocolBandwidth
+	// peers reports the connected peers and what they identified as, nil without a host
+	peers peerVersionSource
+	// blockCache counts the blockstore cache hits, nil without the node's counters
+	blockCache blockCacheStats
+	// contracts lists the host contracts, nil unless the node is a storage host
+	contracts contractStore
+	pn        *nodepb.Node
+
+	// settingsMu guards the settings below, which ReloadConfig can change while
+	// the agent runs
+	settingsMu sync.RWMutex
+	config     *config.Config
+	heartbeat  time.Duration
+	// the first heartbeat is delayed by a random amount up to jitter, heartbeat if unset
+	jitter time.Duration
+	// every heartbeat goes to all of these
+	statusServerDomains []string
+	retryMaxInterval    time.Duration
+	maxRetries          int
+	dialTimeout         time.Duration
+	callTimeout         time.Duration
+
+	// snapshotPath keeps the transfer totals last sent so they survive restarts
+	snapshotPath string
+	// versionPath keeps the version that last reported, to detect upgrades
+	versionPath string
+	version     string
+	// tlsMarkerPath records that the status servers were dialed over TLS, see statusServerTLS
+	tlsMarkerPath string
+	// configPath is the repo's config file, see updateConfigModified
+	configPath string
+	// repoPath is the repo root its version file is read from, see updateRepoVersion
+	repoPath string
+	// privacySecretPath keys the pseudonymous node id reported in privacy mode,
+	// privacyMu guards the secret loaded from it
+	privacySecretPath string
+	privacyMu         sync.Mutex
+	privacySecret     []byte
+	// prev is a copy of pn as of the last heartbeat the status server took, which
+	// the epoch transfers are measured from, and statTime when it was collected.
+	// prepared is the copy for the heartbeat being sent, which replaces them once it
+	// is delivered, and preparedTime when it was collected.
+	prev         *nodepb.Node
+	statTime     time.Time
+	prepared     *nodepb.Node
+	preparedTime time.Time
+	// collected is the report of the latest update, which the local analytics views
+	// serve, as collecting for them would start a new epoch
+	collected *dcReport
+	// transfer totals (KiB) restored from the snapshot, added to the bitswap counters
+	baseUpload   uint64
+	baseDownload uint64
+
+	extra extraMetrics
+	// health alerts of the latest epochs, for ErrorRate
+	alerts alertWindow
+	// peers connected at the previous update, once peersSeen, see updatePeerChange
+	prevPeers uint64
+	peersSeen bool
+	// updates in a row with high CPU usage, and whether any peers were connected
+	// yet, see updateAnomalies
+	cpuHighEpochs int
+	hadPeers      bool
+	// cumulative failed block transfers from the previous update
+	failedUploads   uint64
+	failedDownloads uint64
+	// cumulative io counters as of the last delivered heartbeat
+	diskSample ioSample
+	netSample  ioSample
+	// IP to country table loaded on first use from countryDBPath
+	countryDBPath   string
+	countries       countryDB
+	countriesLoaded bool
+	// apiCallsMu guards apiCalls, the API commands called since the last heartbeat
+	// was delivered, and apiCallsSample, their counts when it was collected
+	apiCallsMu     sync.Mutex
+	apiCalls       map[string]uint64
+	apiCallsSample map[string]uint64
+	// aggregatorSrv serves the worker reports, kept in workerReports, if this node
+	// is the aggregator
+	aggregatorSrv *http.Server
+	workersMu     sync.Mutex
+	workerReports map[string]*workerReport
+	// exporter of the analytics spans in builds with the otel tag
+	tracing tracingState
+	// historyMu guards the local history database opened from historyPath
+	historyMu   sync.Mutex
+	historyDB   *sql.DB
+	historyPath string
+	// streamsMu guards streams, the server-sent event streams every update is
+	// published to, see AnalyticsStreamHandler
+	streamsMu sync.Mutex
+	streams   map[chan []byte]struct{}
+	// time to first byte of the latest retrievals, see TimeRetrieval
+	retrievals *RetrievalStats
+	// cumulative GC statistics of the process as of the last delivered heartbeat
+	gcSample gcSample
+
+	// signed metrics not yet accepted by the status server, oldest first
+	pending *metricsBuffer
+	// circuit pauses sending to a dead status server, sendMu guards it
+	circuit circuitBreaker
+	// heartbeats in a row that were not delivered, stretching the heartbeat
+	// interval, sendMu guards it
+	failedSends int
+	// number of heartbeats prepared so far
+	epoch uint64
+	// when the last heartbeat was attempted and why it failed, if it did
+	lastSend    time.Time
+	lastSendErr error
 }
 
 //Server URL for data collection
@@ -37,20 +172,154 @@ var (
 	log = logging.Logger("spin")
 )
 
+// running analytics agents, looked up by the local analytics handlers and commands
+var (
+	agentsLock sync.Mutex
+	agents     = make(map[*core.IpfsNode]*Agent)
+)
+
 // other constants
 const (
-	// HeartBeat is how often we send data to server, at the moment set to 15 Minutes
+	// HeartBeat is how often we send data to server by default, at the moment set to 15 Minutes
 	heartBeat = 15 * time.Minute
 
 	// Expotentially delayed retries will be capped at this total time
 	maxRetryTotal = 10 * time.Minute
 
+	// Longest wait between two retries by default
+	defaultRetryMaxInterval = 5 * time.Second
+
+	// Retries after a heartbeat failed to send by default, within maxRetryTotal
+	defaultMaxRetries = 3
+
 	// Timeout to retrieve settings/config
 	updateTimeout = 30 * time.Second
+
+	// How many unsent heartbeats are kept during outages, about 24 hours worth by default
+	defaultBufferSize = 96
+
+	// How often to check whether analytics was turned on in between heartbeats
+	configPollInterval = 10 * time.Second
+)
+
+// analyticsEnv set to 0 or false turns analytics off whatever the config says,
+// for environments where the config file is not managed
+const analyticsEnv = "BTFS_ANALYTICS"
+
+// analyticsOptedOut reports whether analyticsEnv turns analytics off.
+func analyticsOptedOut() bool {
+	v := strings.TrimSpace(os.Getenv(analyticsEnv))
+	return v == "0" || strings.EqualFold(v, "false")
+}
+
+// optional config keys, read from the raw config file since go-btfs-config
+// does not define them. They all live in the Analytics section, which go-btfs-config
+// has no field for, so fsrepo keeps it when SetConfig rewrites the sections it defines.
+const (
+	// duration string such as "1m" overriding heartBeat
+	heartbeatKey = "Analytics.StatusServerHeartbeat"
+	// duration string for the window the first heartbeat is randomly delayed within,
+	// the heartbeat interval by default
+	jitterKey = "Analytics.StatusServerJitter"
+	// list of status servers to send to, Services.StatusServerDomain if unset
+	statusServerDomainsKey = "Analytics.StatusServerDomains"
+	// dial the status server over TLS even if its domain is not https
+	statusTLSKey = "Analytics.StatusServerTLS"
+	// PEM CA bundle to verify the status server with, system cert pool if unset
+	statusTLSCACertKey = "Analytics.StatusServerTLSCACert"
+	// PEM certificate and key presented to the status server, both are needed for mutual TLS
+	statusClientCertKey = "Analytics.StatusServerClientCert"
+	statusClientKeyKey  = "Analytics.StatusServerClientKey"
+	// socks5://host:port proxy to reach the status server through
+	statusServerProxyKey = "Analytics.StatusServerProxy"
+	// "grpc" (default) or "http" to post heartbeats to the status server REST API
+	statusServerProtocolKey = "Analytics.StatusServerProtocol"
+	// with the grpc protocol, "grpc" (default) or "websocket" for networks that block gRPC
+	statusServerTransportKey = "Analytics.StatusServerTransport"
+	// tcp://, ssl:// or ws:// URL of an MQTT broker to publish the heartbeats to
+	// instead of sending them to the status servers
+	statusServerMQTTBrokerKey = "Analytics.StatusServerMQTTBroker"
+	// duration string for how long heartbeats are paused after the status server
+	// failed circuitThreshold in a row, overriding defaultCircuitCooldown
+	circuitCooldownKey = "Analytics.StatusServerCooldown"
+	// number of retrievals the TTFB percentiles cover, overriding defaultRetrievalSamples
+	retrievalSamplesKey = "Analytics.RetrievalSamples"
+	// number of unsent heartbeats to keep, overriding defaultBufferSize
+	bufferSizeKey = "Analytics.StatusServerBufferSize"
+	// duration string capping the wait between retries, overriding defaultRetryMaxInterval
+	retryMaxIntervalKey = "Analytics.StatusServerRetryMaxInterval"
+	// number of retries after a heartbeat failed to send, overriding defaultMaxRetries
+	maxRetriesKey = "Analytics.StatusServerMaxRetries"
+	// duration strings overriding dialTimeout and callTimeout
+	dialTimeoutKey = "Analytics.StatusServerDialTimeout"
+	callTimeoutKey = "Analytics.StatusServerCallTimeout"
+	// report which peers bitswap is connected to, off by default for privacy
+	includePeerListKey = "Analytics.IncludePeerList"
+	// report the node's public announced addresses, off by default
+	reportAddressesKey = "Analytics.ReportAddresses"
+	// report how many connected peers run each version, off by default
+	reportPeerVersionsKey = "Analytics.ReportPeerVersions"
+	// raise a health alert when the connected peers change by more than this many
+	// between heartbeats, overriding defaultPeerChangeThreshold
+	peerChangeThresholdKey = "Analytics.PeerChangeThreshold"
+	// report the country of the node's first public IPv4 address, off by default
+	reportCountryKey = "Analytics.ReportCountry"
+	// IP2Location LITE DB1 CSV file, countryDBFile in the repo if unset
+	countryDBKey = "Analytics.CountryDB"
+	// write heartbeats to the log, or the file at Analytics.DryRunOutputPath, instead of sending them
+	dryRunKey           = "Analytics.DryRun"
+	dryRunOutputPathKey = "Analytics.DryRunOutputPath"
+	// append every heartbeat to this CSV file, rotated once it grows past
+	// Analytics.LocalExportMaxSize bytes, defaultExportMaxSize if unset
+	localExportPathKey    = "Analytics.LocalExportPath"
+	localExportMaxSizeKey = "Analytics.LocalExportMaxSize"
+	// InfluxDB server every heartbeat is also written to, in the bucket with the
+	// token, see exportInflux. Query parameters such as org are passed on.
+	influxDBURLKey    = "Analytics.InfluxDBURL"
+	influxDBBucketKey = "Analytics.InfluxDBBucket"
+	influxDBTokenKey  = "Analytics.InfluxDBToken"
+	// SQLite database every heartbeat is recorded in, see QueryHistory
+	localDBPathKey = "Analytics.LocalDBPath"
+	// Unix socket of the node that sends one heartbeat for a group of workers, which
+	// report to it instead of the status server. The node with Analytics.Aggregator
+	// set listens on it.
+	aggregatorAddrKey = "Analytics.AggregatorAddr"
+	aggregatorKey     = "Analytics.Aggregator"
+	// report a hash of the config without secrets, so nodes can be grouped by config profile
+	reportConfigHashKey = "Analytics.ReportConfigHash"
+	// add up the sizes of the pinned DAGs, off by default as it reads a block per pin
+	reportPinnedBytesKey = "Analytics.ReportPinnedBytes"
+	// report a hash of the bootstrap peers, so nodes off the standard list can be flagged
+	reportBootstrapHashKey = "Analytics.ReportBootstrapHash"
+	// report the masked TRON wallet address the node is paid to, see maskWalletAddress
+	reportWalletKey = "Analytics.ReportWallet"
+	// CPU percentage above which scheduled heartbeats are skipped, see overloaded
+	loadThresholdKey = "Analytics.LoadThreshold"
+	// host:port of the OTLP collector the send spans are exported to, only in
+	// builds with the otel tag
+	otlpEndpointKey = "Analytics.OTLPEndpoint"
+	// fraction from 0 to 1 of the scheduled heartbeats sent, see sampled
+	samplingRateKey = "Analytics.SamplingRate"
+	// report a pseudonym instead of the node id, see reportedNodeID
+	privacyModeKey = "Analytics.PrivacyMode"
+	// add Laplace noise to the peers, storage and transfers sent, see noised, with
+	// the privacy budget Analytics.DifferentialPrivacyEpsilon, defaultPrivacyEpsilon
+	// if unset
+	differentialPrivacyKey = "Analytics.DifferentialPrivacy"
+	privacyEpsilonKey      = "Analytics.DifferentialPrivacyEpsilon"
+	// gzip payloads before signing them, see payloadEncodingKey
+	compressPayloadKey = "Analytics.CompressPayload"
+	// group name such as "datacenter-us-east" to segment a fleet of nodes by
+	nodeGroupKey = "Analytics.NodeGroup"
+	// sign payloads with the HMAC-SHA256 of this key instead of the node's private key
+	hmacKeyKey = "Analytics.HMACKey"
 )
 
 //Go doesn't have a built in Max function? simple function to not have negatives values
 func valOrZero(x uint64) uint64 {
+	// x < 0 is never true for a uint64, an underflowed difference has already wrapped
+	// around by the time it gets here. The branch is kept to document the intent,
+	// use counterDelta for differences that may go negative.
 	if x < 0 {
 		return 0
 	}
@@ -58,6 +327,14 @@ func valOrZero(x uint64) uint64 {
 	return x
 }
 
+// counterDelta returns how much a cumulative counter grew since prev, 0 if it was reset.
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return 0
+	}
+	return cur - prev
+}
+
 func durationToSeconds(duration time.Duration) uint64 {
 	return uint64(duration.Nanoseconds() / int64(time.Second/time.Nanosecond))
 }
@@ -66,36 +343,123 @@ func isAnalyticsEnabled(cfg *config.Config) bool {
 	return cfg.Experimental.StorageHostEnabled || cfg.Experimental.Analytics
 }
 
-// Analytics starts the process to collect data and starts the GoRoutine for constant collection
-func Analytics(api iface.CoreAPI, cfgRoot string, node *core.IpfsNode, BTFSVersion, hValue string) {
+// Agent is a running analytics collection goroutine
+type Agent struct {
+	dc     *dcWrap
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed once collectionAgent has returned
+	done chan struct{}
+}
+
+// loadSettings applies the status servers, timeouts and heartbeat interval of cfg
+// and the analytics config keys.
+func (dc *dcWrap) loadSettings(cfg *config.Config) {
+	domains := configStrings(dc.node.Repo, statusServerDomainsKey, nil)
+	if len(domains) == 0 {
+		domains = []string{cfg.Services.StatusServerDomain}
+	}
+	for _, domain := range domains {
+		if _, _, err := parseStatusServerDomain(domain); err != nil {
+			log.Warningf("Analytics will not reach the status server: %s", err)
+		}
+	}
+	dc.settingsMu.Lock()
+	defer dc.settingsMu.Unlock()
+	dc.config = cfg
+	dc.heartbeat = configDuration(dc.node.Repo, heartbeatKey, heartBeat)
+	dc.statusServerDomains = domains
+	dc.retryMaxInterval = configDuration(dc.node.Repo, retryMaxIntervalKey, defaultRetryMaxInterval)
+	dc.maxRetries = configInt(dc.node.Repo, maxRetriesKey, defaultMaxRetries)
+	dc.dialTimeout = configDuration(dc.node.Repo, dialTimeoutKey, dialTimeout)
+	dc.callTimeout = configDuration(dc.node.Repo, callTimeoutKey, callTimeout)
+	dc.jitter = configDuration(dc.node.Repo, jitterKey, 0)
+}
+
+// ReloadConfig re-reads the config and applies the status servers, timeouts and
+// heartbeat interval to the running agent, as the daemon does on SIGUSR1. The
+// connections to the status servers are closed, so the next heartbeat dials them
+// with the new settings. A new heartbeat interval applies from the next heartbeat on.
+func (a *Agent) ReloadConfig() error {
+	if a == nil {
+		return fmt.Errorf("analytics is not running")
+	}
+	cfg, err := a.dc.node.Repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to read the config for analytics: %s", err.Error())
+	}
+	a.dc.loadSettings(cfg)
+	a.dc.closeConn()
+	return nil
+}
+
+// Analytics starts the process to collect data and starts the GoRoutine for constant collection,
+// which reports that it stopped once ctx is done. It returns a nil Agent and no error if
+// analytics is turned off by analyticsEnv.
+func Analytics(ctx context.Context, api iface.CoreAPI, cfgRoot string, node *core.IpfsNode, BTFSVersion, hValue string) (*Agent, error) {
 	if node == nil {
-		return
+		return nil, fmt.Errorf("cannot start analytics without a node")
+	}
+	if analyticsOptedOut() {
+		log.Infof("Analytics is turned off by %s=%s", analyticsEnv, os.Getenv(analyticsEnv))
+		return nil, nil
+	}
+	if node.Repo == nil {
+		return nil, fmt.Errorf("cannot start analytics without a repo")
 	}
 	configuration, err := node.Repo.Config()
 	if err != nil {
-		return
+		return nil, fmt.Errorf("failed to read the config for analytics: %s", err.Error())
 	}
 
 	dc := new(dcWrap)
 	dc.node = node
 	dc.api = api
+	dc.stats = exchangeStats{node: node}
+	if node.Reporter != nil {
+		dc.bandwidth = node.Reporter
+	}
+	if node.PeerHost != nil {
+		dc.peers = hostPeers{node.PeerHost}
+	}
+	if node.BlockCache != nil {
+		dc.blockCache = node.BlockCache
+	}
 	dc.pn = new(nodepb.Node)
-	dc.config = configuration
+	dc.loadSettings(configuration)
+	dc.circuit.cooldown = configDuration(node.Repo, circuitCooldownKey, defaultCircuitCooldown)
+	dc.pending = newMetricsBuffer(configInt(node.Repo, bufferSizeKey, defaultBufferSize))
+	dc.retrievals = newRetrievalStats(configInt(node.Repo, retrievalSamplesKey, defaultRetrievalSamples))
+	dc.snapshotPath = filepath.Join(cfgRoot, snapshotFile)
+	dc.privacySecretPath = filepath.Join(cfgRoot, privacySecretFile)
+	dc.versionPath = filepath.Join(cfgRoot, versionFile)
+	dc.tlsMarkerPath = filepath.Join(cfgRoot, tlsMarkerFile)
+	if dc.configPath, err = config.Filename(cfgRoot); err != nil {
+		log.Warning(err.Error())
+	}
+	dc.repoPath = cfgRoot
+	dc.version = BTFSVersion
+	if err := dc.detectUpgrade(BTFSVersion); err != nil {
+		log.Warning(err.Error())
+	}
+	dc.countryDBPath = configString(node.Repo, countryDBKey, filepath.Join(cfgRoot, countryDBFile))
+	if err := dc.loadSnapshot(); err != nil {
+		log.Warning(err.Error())
+	}
 
 	if isAnalyticsEnabled(dc.config) {
 		if dc.config.Experimental.Analytics != dc.config.Experimental.StorageHostEnabled {
 			fmt.Println("Experimental.Analytics is overridden by Experimental.StorageHostEnabled")
 		}
-		infoStats, err := cpu.Info()
-		if err == nil {
-			dc.pn.CpuInfo = infoStats[0].ModelName
+		if model, err := cpuModel(); err == nil {
+			dc.pn.CpuInfo = model
 		} else {
 			log.Warning(err.Error())
 		}
 
 		dc.pn.TimeCreated = time.Now()
 		if node.Identity == "" {
-			return
+			return nil, fmt.Errorf("cannot report analytics for a node without an identity")
 		}
 		dc.pn.NodeId = node.Identity.Pretty()
 		dc.pn.HVal = hValue
@@ -121,6 +485,10 @@ func Analytics(api iface.CoreAPI, cfgRoot string, node *core.IpfsNode, BTFSVersi
 		dc.pn.ShardingEnabled = dc.config.Experimental.ShardingEnabled
 		dc.pn.StorageClientEnabled = dc.config.Experimental.StorageClientEnabled
 		dc.pn.StorageHostEnabled = dc.config.Experimental.StorageHostEnabled
+		if dc.pn.StorageHostEnabled {
+			// synced from the hub by Contracts
+			dc.contracts = hostContractStore{node}
+		}
 		dc.pn.StrategicProviding = dc.config.Experimental.StrategicProviding
 		dc.pn.UrlStoreEnabled = dc.config.Experimental.UrlstoreEnabled
 		dc.pn.RepairHostEnabled = dc.config.Experimental.HostRepairEnabled
@@ -128,7 +496,81 @@ func Analytics(api iface.CoreAPI, cfgRoot string, node *core.IpfsNode, BTFSVersi
 	}
 
 	dc.setRoles()
-	go dc.collectionAgent(node)
+	dc.extra.EventType = eventStart
+	if err := dc.startAggregator(); err != nil {
+		log.Warning(err.Error())
+	}
+	return dc.start(ctx), nil
+}
+
+// start registers dc and runs its collection agent until ctx is done or the agent is stopped.
+func (dc *dcWrap) start(ctx context.Context) *Agent {
+	ctx, cancel := context.WithCancel(ctx)
+	a := &Agent{dc: dc, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	agentsLock.Lock()
+	agents[dc.node] = a
+	agentsLock.Unlock()
+	go func() {
+		defer close(a.done)
+		dc.collectionAgent(ctx)
+	}()
+	return a
+}
+
+// Stop shuts down the collection agent, abandoning any heartbeat in flight, and
+// waits for it to send its stop event and exit.
+func (a *Agent) Stop() {
+	if a == nil {
+		return
+	}
+	a.cancel()
+	<-a.done
+	a.dc.closeConn()
+	a.dc.closeHistory()
+	a.dc.stopAggregator()
+	a.dc.stopTracing(context.Background())
+	agentsLock.Lock()
+	if agents[a.dc.node] == a {
+		delete(agents, a.dc.node)
+	}
+	agentsLock.Unlock()
+}
+
+// SendDataNow collects and sends a heartbeat right away instead of waiting for the
+// next tick. It tries only once and returns why the heartbeat could not be sent, in
+// which case it stays buffered for the next tick. An open circuit lets it through
+// as a trial, together with the heartbeats buffered meanwhile. Delivering the
+// heartbeat starts a new status server latency histogram.
+func (a *Agent) SendDataNow() error {
+	if a == nil {
+		return fmt.Errorf("analytics is not running")
+	}
+	a.dc.sendMu.Lock()
+	a.dc.circuit.trial()
+	a.dc.sendMu.Unlock()
+	if err := a.dc.sendData(a.ctx, a.dc.node, &backoff.StopBackOff{}); err != nil {
+		return err
+	}
+	a.dc.mu.Lock()
+	a.dc.extra.StatusServerLatency = LatencyHistogram{}
+	a.dc.mu.Unlock()
+	return nil
+}
+
+// GetAgent returns the analytics agent running for node, nil if there is none.
+func GetAgent(node *core.IpfsNode) *Agent {
+	agentsLock.Lock()
+	defer agentsLock.Unlock()
+	return agents[node]
+}
+
+// getDcWrap returns the analytics collector started for node, if any.
+func getDcWrap(node *core.IpfsNode) (*dcWrap, bool) {
+	a := GetAgent(node)
+	if a == nil {
+		return nil, false
+	}
+	return a.dc, true
 }
 
 func (dc *dcWrap) setRoles() {
@@ -148,21 +590,70 @@ func (dc *dcWrap) setRoles() {
 	dc.pn.Node_Settings.Roles = roles
 }
 
-// update gets the latest analytics and returns a list of errors for reporting if available
-func (dc *dcWrap) update(node *core.IpfsNode) []error {
-	var res []error
+// updateInputs are the analytics an update reads with I/O that may take up to
+// updateTimeout, gathered before taking mu so the local views and the events sent
+// in between are not held up by them. A nil field could not be read.
+type updateInputs struct {
+	mem      runtime.MemStats
+	settings *nodepb.Node_Settings
+	storage  *uint64
+	blocks   *uint64
+	pins     *pinCount
+	stat     *bitswap.Stat
+	errs     []error
+}
 
-	var (
-		m  runtime.MemStats
-		ns *nodepb.Node_Settings
-	)
-	runtime.ReadMemStats(&m)
+// gather reads the inputs of an update. It needs no lock.
+func (dc *dcWrap) gather(node *core.IpfsNode) *updateInputs {
+	in := new(updateInputs)
+	runtime.ReadMemStats(&in.mem)
 	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
 	defer cancel()
-	ns, err := helper.GetHostStorageConfig(ctx, node)
-	if err != nil {
-		res = append(res, fmt.Errorf("failed to get node storage config: %s", err.Error()))
+	if ns, err := helper.GetHostStorageConfig(ctx, node); err != nil {
+		in.errs = append(in.errs, fmt.Errorf("failed to get node storage config: %s", err.Error()))
+	} else {
+		in.settings = ns
+	}
+	if storage, err := dc.node.Repo.GetStorageUsage(); err != nil {
+		in.errs = append(in.errs, fmt.Errorf("failed to get storage usage: %s", err.Error()))
+	} else {
+		in.storage = &storage
+	}
+	if n, err := dc.countBlocks(); err != nil {
+		in.errs = append(in.errs, err)
 	} else {
+		in.blocks = n
+	}
+	var err error
+	if in.pins, err = dc.countPins(); err != nil {
+		in.errs = append(in.errs, err)
+	}
+	if in.stat, err = dc.stats.Stat(); err != nil {
+		in.errs = append(in.errs, err)
+	}
+	return in
+}
+
+// update gets the latest analytics and returns a list of errors for reporting if
+// available. It reads the slow ones without holding mu, see gather, and takes mu
+// for writing to set them.
+func (dc *dcWrap) update(node *core.IpfsNode) []error {
+	in := dc.gather(node)
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.apply(in)
+}
+
+// apply sets the analytics from in and the rest of the sources, which are quick to
+// read. The caller must hold mu for writing.
+func (dc *dcWrap) apply(in *updateInputs) []error {
+	res := in.errs
+
+	m := &in.mem
+	dc.extra.Goroutines = uint64(runtime.NumGoroutine())
+	dc.updateGC(m)
+	dc.updateMemOverhead()
+	if ns := in.settings; ns != nil {
 		dc.pn.StoragePriceAsk = ns.StoragePriceAsk
 		dc.pn.StoragePriceDefault = ns.StoragePriceDefault
 		dc.pn.CustomizedPricing = ns.CustomizedPricing
@@ -179,123 +670,579 @@ func (dc *dcWrap) update(node *core.IpfsNode) []error {
 	}
 
 	dc.pn.UpTime = durationToSeconds(time.Since(dc.pn.TimeCreated))
-	if cpus, err := cpu.Percent(0, false); err != nil {
+	if used, err := cpuPercent(); err != nil {
 		res = append(res, fmt.Errorf("failed to get uptime: %s", err.Error()))
 	} else {
-		if dc.pn.CpuUsed = 0; len(cpus) >= 1 {
-			dc.pn.CpuUsed = cpus[0]
-		}
+		dc.pn.CpuUsed = used
 	}
-	dc.pn.MemoryUsed = m.HeapAlloc / uint64(units.KiB)
-	if storage, err := dc.node.Repo.GetStorageUsage(); err != nil {
-		res = append(res, fmt.Errorf("failed to get storage usage: %s", err.Error()))
-	} else {
-		dc.pn.StorageUsed = storage / uint64(units.KiB)
+	// Sys covers the stacks and runtime structures HeapAlloc leaves out
+	dc.pn.MemoryUsed = m.Sys / uint64(units.KiB)
+	dc.extra.StackInUse = m.StackInuse / uint64(units.KiB)
+	dc.extra.HeapIdle = m.HeapIdle / uint64(units.KiB)
+	if err := dc.updateSystemMemory(); err != nil {
+		res = append(res, err)
+	}
+	if in.storage != nil {
+		dc.pn.StorageUsed = *in.storage / uint64(units.KiB)
+	}
+	if in.blocks != nil {
+		dc.extra.BlockCount = *in.blocks
+	}
+	dc.updateCacheHitRate()
+	if p := in.pins; p != nil {
+		dc.extra.PinnedObjects, dc.extra.PinnedBytes = p.objects, p.bytes
+	}
+	if err := dc.updateContracts(); err != nil {
+		res = append(res, err)
+	}
+	if err := dc.updateReputation(); err != nil {
+		res = append(res, err)
+	}
+	if err := dc.updateFingerprint(); err != nil {
+		res = append(res, err)
+	}
+	dc.updateNodeGroup()
+	if err := dc.updateDiskIO(); err != nil {
+		res = append(res, err)
+	}
+	if err := dc.updateNetIO(); err != nil {
+		res = append(res, err)
+	}
+	if err := dc.updateOpenFDs(); err != nil {
+		res = append(res, err)
+	}
+	dc.updateAddresses()
+	dc.updateRelay()
+	dc.updateProtocolStats()
+	dc.updatePeerVersions()
+	dc.updateDuplicateID()
+	dc.updatePluginFields()
+	dc.updateAPICalls()
+	dc.updateRetrievals()
+	if err := dc.updateCountry(); err != nil {
+		res = append(res, err)
+	}
+	if err := dc.updateConfigHash(); err != nil {
+		res = append(res, err)
+	}
+	if err := dc.updateDatastoreType(); err != nil {
+		res = append(res, err)
+	}
+	if err := dc.updateConfigModified(); err != nil {
+		res = append(res, err)
+	}
+	dc.updateRepoVersion()
+	if err := dc.updateBootstrapHash(); err != nil {
+		res = append(res, err)
+	}
+	if err := dc.updateWalletAddress(); err != nil {
+		res = append(res, err)
 	}
 
-	bs, ok := dc.node.Exchange.(*bitswap.Bitswap)
-	if !ok {
-		res = append(res, fmt.Errorf("failed to perform dc.node.Exchange.(*bitswap.Bitswap) type assertion"))
-		return res
+	if st := in.stat; st != nil {
+		dc.setBitswapStat(st)
+		dc.updatePeerChange()
+		dc.updateFailedTransfers()
+		dc.updateThroughput(time.Now())
+		dc.setPeerIDs(st.Peers)
 	}
 
+	dc.updateAnomalies()
+	dc.collected = &dcReport{Node: clonePayload(dc.pn), extraMetrics: dc.extra}
+	dc.publishUpdate()
+	return res
+}
+
+// StatsProvider reports the transfer statistics of a node's exchange
+type StatsProvider interface {
+	Stat() (*bitswap.Stat, error)
+}
+
+// exchangeStats gets the statistics from the node's exchange if it is bitswap,
+// reading the node's traffic counters rather than locking bitswap if it has them
+type exchangeStats struct {
+	node *core.IpfsNode
+}
+
+func (s exchangeStats) Stat() (*bitswap.Stat, error) {
+	if s.node.Traffic != nil {
+		return s.node.Traffic.Stat(), nil
+	}
+	bs, ok := s.node.Exchange.(*bitswap.Bitswap)
+	if !ok {
+		return nil, fmt.Errorf("failed to perform dc.node.Exchange.(*bitswap.Bitswap) type assertion")
+	}
 	st, err := bs.Stat()
 	if err != nil {
-		res = append(res, fmt.Errorf("failed to perform bs.Stat() call: %s", err.Error()))
-	} else {
-		dc.pn.Upload = valOrZero(st.DataSent-dc.pn.TotalUpload) / uint64(units.KiB)
-		dc.pn.Download = valOrZero(st.DataReceived-dc.pn.TotalDownload) / uint64(units.KiB)
-		dc.pn.TotalUpload = st.DataSent / uint64(units.KiB)
-		dc.pn.TotalDownload = st.DataReceived / uint64(units.KiB)
-		dc.pn.BlocksUp = st.BlocksSent
-		dc.pn.BlocksDown = st.BlocksReceived
-		dc.pn.PeersConnected = uint64(len(st.Peers))
+		return nil, fmt.Errorf("failed to perform bs.Stat() call: %s", err.Error())
 	}
+	return st, nil
+}
 
-	return res
+// clonePayload returns a copy of pn sharing no memory with it.
+func clonePayload(pn *nodepb.Node) *nodepb.Node {
+	n := *pn
+	n.Roles = append([]nodepb.NodeRole(nil), pn.Roles...)
+	n.XXX_unrecognized = append([]byte(nil), pn.XXX_unrecognized...)
+	n.Node_Settings.XXX_unrecognized = append([]byte(nil), pn.Node_Settings.XXX_unrecognized...)
+	n.Node_Geo.XXX_unrecognized = append([]byte(nil), pn.Node_Geo.XXX_unrecognized...)
+	n.Node_ExperimentalFlags.XXX_unrecognized = append([]byte(nil), pn.Node_ExperimentalFlags.XXX_unrecognized...)
+	return &n
 }
 
-func (dc *dcWrap) sendData(node *core.IpfsNode, config *config.Config) {
+// setBitswapStat updates the transfer analytics, whose totals include the ones
+// restored from the last snapshot. The epoch transfers are the totals since the
+// last heartbeat delivered, so none are lost to heartbeats that were not.
+func (dc *dcWrap) setBitswapStat(st *bitswap.Stat) {
+	totalUpload := dc.baseUpload + st.DataSent/uint64(units.KiB)
+	totalDownload := dc.baseDownload + st.DataReceived/uint64(units.KiB)
+	prev := dc.prev
+	if prev == nil {
+		prev = new(nodepb.Node)
+	}
+	dc.pn.Upload = counterDelta(totalUpload, prev.TotalUpload)
+	dc.pn.Download = counterDelta(totalDownload, prev.TotalDownload)
+	dc.pn.TotalUpload = totalUpload
+	dc.pn.TotalDownload = totalDownload
+	dc.pn.BlocksUp = st.BlocksSent
+	dc.pn.BlocksDown = st.BlocksReceived
+	dc.pn.PeersConnected = uint64(len(st.Peers))
+}
+
+// sendData prepares a heartbeat and sends it, retrying according to bo. It returns
+// the error that kept the heartbeat from being prepared or delivered.
+func (dc *dcWrap) sendData(ctx context.Context, node *core.IpfsNode, bo backoff.BackOff) (err error) {
+	dc.sendMu.Lock()
+	defer dc.sendMu.Unlock()
+	defer func() {
+		if err != nil {
+			dc.failedSends++
+		} else {
+			dc.failedSends = 0
+		}
+		dc.mu.Lock()
+		dc.lastSend, dc.lastSendErr = time.Now(), err
+		dc.mu.Unlock()
+	}()
+	if addr := dc.aggregator(); addr != "" {
+		return dc.sendToAggregator(ctx, node, addr, bo)
+	}
 	sm, errs, err := dc.doPrepData(node)
 	if errs == nil {
 		errs = make([]error, 0)
 	}
-	var sb strings.Builder
 	if err != nil {
 		errs = append(errs, err)
 	}
+	logErrors(errs)
+	// If complete prep failure we return
+	if err != nil {
+		dc.reportHealthAlert(err.Error())
+		return err
+	}
+
+	dc.epoch++
+	return dc.send(ctx, sm, bo)
+}
+
+// send delivers sm after any heartbeats buffered earlier, retrying according to bo.
+// Whatever could not be delivered stays buffered for the next epoch.
+func (dc *dcWrap) send(ctx context.Context, sm *pb.SignedMetrics, bo backoff.BackOff) error {
+	// heartbeats that could not be sent earlier go first, so the server gets them in order
+	dc.pending.push(sm)
+	if !dc.circuit.allow(time.Now()) {
+		return fmt.Errorf("status server circuit is open until %s, heartbeat buffered",
+			dc.circuit.openUntil().Format(time.RFC3339))
+	}
+	attempt := 0
+	err := backoff.Retry(func() error {
+		attempt++
+		start := time.Now()
+		err := dc.flushPending(ctx)
+		log.Debugw("analytics send attempt", "epoch", dc.epoch, "attempt", attempt,
+			"bytes", len(sm.Payload), "duration", time.Since(start).String(), "error", err)
+		return err
+	}, backoff.WithContext(bo, ctx))
+	if ctx.Err() == nil {
+		// an abandoned heartbeat says nothing about the status server
+		dc.circuit.record(err, time.Now())
+	}
+	if err != nil {
+		log.Warnw("analytics send retries exhausted", "epoch", dc.epoch, "attempts", attempt,
+			"pending", dc.pending.len(), "error", err)
+		dc.reportHealthAlert(err.Error())
+		return err
+	}
+	dc.delivered()
+	return nil
+}
+
+// delivered starts the next epoch once the status server, or the aggregator of a
+// worker, got the analytics prepared for the current one.
+func (dc *dcWrap) delivered() {
+	dc.mu.Lock()
+	if dc.extra.IsUpgrade {
+		// the server knows about the upgrade now
+		if err := dc.saveVersion(dc.version); err != nil {
+			log.Warning(err.Error())
+		}
+	}
+	// the server got this epoch, a stalled agent must not send its values again
+	if dc.prepared != nil {
+		dc.prev, dc.statTime = dc.prepared, dc.preparedTime
+		dc.prepared = nil
+		dc.diskSample.commit()
+		dc.netSample.commit()
+		dc.gcSample.commit()
+	}
+	dc.reset()
+	err := dc.saveSnapshot()
+	dc.mu.Unlock()
+	if err != nil {
+		log.Warning(err.Error())
+	}
+}
+
+// prepare keeps pn and the latest counter samples as what the heartbeat being sent
+// covers, which delivered measures the next epoch from. The caller must hold mu.
+func (dc *dcWrap) prepare(pn *nodepb.Node) {
+	dc.prepared, dc.preparedTime = pn, time.Now()
+	dc.diskSample.prepare()
+	dc.netSample.prepare()
+	dc.gcSample.prepare()
+}
+
+// reset zeroes the per-epoch analytics, leaving the cumulative ones and the samples
+// the next epoch is measured from. The caller must hold mu.
+func (dc *dcWrap) reset() {
+	if dc.pn != nil {
+		dc.pn.Upload = 0
+		dc.pn.Download = 0
+	}
+	dc.extra.DiskRead, dc.extra.DiskWrite = 0, 0
+	dc.extra.NetIn, dc.extra.NetOut = 0, 0
+	dc.extra.UploadBPS, dc.extra.DownloadBPS = 0, 0
+	dc.extra.GCPauseTotal, dc.extra.GCCount = 0, 0
+	dc.extra.HealthAlerts = 0
+	dc.extra.IsUpgrade, dc.extra.PreviousVersion = false, ""
+	dc.extra.EventType = ""
+	dc.extra.APICalls = nil
+	dc.resetAPICalls()
+}
+
+// logErrors writes the reporting errors gathered by update to the debug log.
+func logErrors(errs []error) {
+	var sb strings.Builder
 	for _, err := range errs {
 		sb.WriteString(err.Error())
 		sb.WriteRune('\n')
 	}
 	log.Debug(sb.String())
-	// If complete prep failure we return
+}
+
+// collect updates the analytics and exports them locally. It returns the report
+// of the update, a copy that needs no lock, if it is valid to send, in which case it
+// is the heartbeat being prepared, see prepare. Only setting the analytics holds mu.
+func (dc *dcWrap) collect(btfsNode *core.IpfsNode) (*dcReport, []error, error) {
+	in := dc.gather(btfsNode)
+	dc.mu.Lock()
+	errs := dc.apply(in)
+	dc.updateErrorRate()
+	report := &dcReport{Node: clonePayload(dc.pn), extraMetrics: dc.extra}
+	err := dc.validate()
+	if err == nil {
+		dc.prepare(report.Node)
+	}
+	dc.mu.Unlock()
+	errs = append(errs, dc.export(report)...)
 	if err != nil {
-		return
+		log.Warnw("analytics not sent, invalid data collected", "epoch", dc.epoch, "error", err)
+		return nil, errs, fmt.Errorf("invalid analytics: %s", err.Error())
 	}
+	return report, errs, nil
+}
 
-	bo := backoff.NewExponentialBackOff()
-	bo.MaxElapsedTime = maxRetryTotal
-	backoff.Retry(func() error {
-		err := dc.doSendData(node.Context(), config, sm)
-		if err != nil {
-			log.Error("failed to send data to status server: ", err)
-		} else {
-			log.Debug("sent analytics to status server")
-		}
-		return err
-	}, bo)
+// export writes report to the local export, InfluxDB and history the operator set up.
+func (dc *dcWrap) export(report *dcReport) []error {
+	var errs []error
+	if err := dc.exportCSV(report); err != nil {
+		errs = append(errs, err)
+	}
+	if err := dc.exportInflux(report); err != nil {
+		errs = append(errs, err)
+	}
+	if err := dc.recordHistory(report); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
 }
 
 // doPrepData gathers the latest analytics and returns (signed object, list of reporting errors, failure)
 func (dc *dcWrap) doPrepData(btfsNode *core.IpfsNode) (*pb.SignedMetrics, []error, error) {
-	errs := dc.update(btfsNode)
-	payload, err := dc.getPayload(btfsNode)
+	report, errs, err := dc.collect(btfsNode)
+	if err != nil {
+		return nil, errs, err
+	}
+	payload, err := dc.aggregatedPayload(btfsNode.Identity.Pretty(), report)
 	if err != nil {
 		return nil, errs, fmt.Errorf("failed to marshal dataCollection object to a byte array: %s", err.Error())
 	}
-	if dc.node.PrivateKey == nil {
-		return nil, errs, fmt.Errorf("node's private key is null")
+	sm, err := dc.signPayload(payload)
+	if err != nil {
+		return nil, errs, err
+	}
+	return sm, errs, nil
+}
+
+// signPayload compresses payload if the operator opted in and signs it, with
+// Analytics.HMACKey if set and the node's key otherwise. Privacy mode requires
+// Analytics.HMACKey.
+func (dc *dcWrap) signPayload(payload []byte) (*pb.SignedMetrics, error) {
+	if dc.compressionEnabled() {
+		var err error
+		if payload, err = compressPayload(payload); err != nil {
+			return nil, err
+		}
+	}
+	if key := configString(dc.node.Repo, hmacKeyKey, ""); key != "" {
+		return buildHMACSignedMetrics(key, payload), nil
+	}
+	if dc.privacyMode() {
+		// the public key sent along would reveal the peer id
+		return nil, fmt.Errorf("%s needs %s, as signing with the node's key reveals its peer id",
+			privacyModeKey, hmacKeyKey)
+	}
+	return buildSignedMetrics(dc.node.PrivateKey, payload)
+}
+
+// buildSignedMetrics signs payload with the node's key. The result is sent as is
+// over any transport.
+func buildSignedMetrics(key ic.PrivKey, payload []byte) (*pb.SignedMetrics, error) {
+	if key == nil {
+		return nil, fmt.Errorf("node's private key is null")
 	}
 
-	signature, err := dc.node.PrivateKey.Sign(payload)
+	signature, err := key.Sign(payload)
 	if err != nil {
-		return nil, errs, fmt.Errorf("failed to sign raw data with node private key: %s", err.Error())
+		return nil, fmt.Errorf("failed to sign raw data with node private key: %s", err.Error())
 	}
 
-	publicKey, err := ic.MarshalPublicKey(dc.node.PrivateKey.GetPublic())
+	publicKey, err := ic.MarshalPublicKey(key.GetPublic())
 	if err != nil {
-		return nil, errs, fmt.Errorf("failed to marshal node public key: %s", err.Error())
+		return nil, fmt.Errorf("failed to marshal node public key: %s", err.Error())
 	}
 
 	sm := new(pb.SignedMetrics)
 	sm.Payload = payload
 	sm.Signature = signature
 	sm.PublicKey = publicKey
-	return sm, errs, nil
+	return sm, nil
 }
 
-func (dc *dcWrap) doSendData(ctx context.Context, config *config.Config, sm *pb.SignedMetrics) error {
-	cb := cgrpc.StatusClient(config.Services.StatusServerDomain)
-	return cb.WithContext(ctx, func(ctx context.Context, client pb.StatusServiceClient) error {
-		_, err := client.UpdateMetricsAndDiscovery(ctx, sm)
-		return err
+// cappedBackOff never waits longer than max between two retries, randomization included
+type cappedBackOff struct {
+	*backoff.ExponentialBackOff
+	max time.Duration
+}
+
+func (b *cappedBackOff) NextBackOff() time.Duration {
+	next := b.ExponentialBackOff.NextBackOff()
+	if next != backoff.Stop && next > b.max {
+		return b.max
+	}
+	return next
+}
+
+// newBackoff returns the retry policy for sending to the status server, giving up
+// after Analytics.StatusServerMaxRetries retries or maxRetryTotal.
+func (dc *dcWrap) newBackoff() backoff.BackOff {
+	dc.settingsMu.RLock()
+	max := durationOr(dc.retryMaxInterval, defaultRetryMaxInterval)
+	retries := dc.maxRetries
+	dc.settingsMu.RUnlock()
+	if retries == 0 {
+		retries = defaultMaxRetries
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxElapsedTime = maxRetryTotal
+	bo.MaxInterval = max
+	return backoff.WithMaxRetries(&cappedBackOff{ExponentialBackOff: bo, max: max}, uint64(retries))
+}
+
+// flushPending sends the buffered metrics oldest first to every status server, or
+// the MQTT broker if one is set, keeping whatever none of them took.
+func (dc *dcWrap) flushPending(ctx context.Context) error {
+	if dc.pending.len() == 0 {
+		return nil
+	}
+	if dc.dryRun() {
+		for sm := dc.pending.peek(); sm != nil; sm = dc.pending.peek() {
+			if err := dc.writeDryRun(sm); err != nil {
+				return err
+			}
+			dc.pending.pop()
+		}
+		return nil
+	}
+	sms := dc.pending.all()
+	var sent int
+	var err error
+	if broker := configString(dc.node.Repo, statusServerMQTTBrokerKey, ""); broker != "" {
+		sent, err = dc.flushMQTT(ctx, broker, sms)
+	} else {
+		sent, err = dc.fanout(ctx, func(ctx context.Context, domain string) (int, error) {
+			return dc.flushTo(ctx, domain, sms)
+		})
+	}
+	for i := 0; i < sent; i++ {
+		dc.pending.pop()
+	}
+	return err
+}
+
+// flushTo sends sms to the status server at domain and returns how many it took,
+// in a span when tracing is built in.
+func (dc *dcWrap) flushTo(ctx context.Context, domain string, sms []*pb.SignedMetrics) (int, error) {
+	ctx, end := dc.traceSend(ctx, domain, sms)
+	n, err := dc.deliver(ctx, domain, sms)
+	end(err)
+	return n, err
+}
+
+// deliver sends sms to the status server at domain over one connection and returns
+// how many it took. Several metrics go out in a single batch if the server supports it.
+func (dc *dcWrap) deliver(ctx context.Context, domain string, sms []*pb.SignedMetrics) (int, error) {
+	transport, err := dc.transport()
+	if err != nil {
+		return 0, err
+	}
+	switch transport {
+	case websocketTransport:
+		return dc.flushWebSocket(ctx, domain, sms)
+	case httpProtocol:
+		return dc.flushHTTP(ctx, domain, sms)
+	}
+	conn, err := dc.grpcConn(ctx, domain)
+	if err != nil {
+		return 0, err
+	}
+	if len(sms) > 1 {
+		err := dc.call(ctx, func(ctx context.Context) error {
+			return updateMetricsBatch(withPayloadMetadata(ctx, sms...), conn, sms)
+		})
+		if err == nil {
+			return len(sms), nil
+		}
+		if status.Code(err) != codes.Unimplemented {
+			dc.dropConn(domain, conn)
+			return 0, err
+		}
+	}
+	n, err := flushSender(ctx, &grpcSender{dc: dc, conn: conn}, sms)
+	if err != nil {
+		dc.dropConn(domain, conn)
+	}
+	return n, err
+}
+
+// call runs a status server rpc with the payload schema version and any upgrade or
+// lifecycle event not reported yet, giving up after the call timeout.
+func (dc *dcWrap) call(ctx context.Context, rpc func(context.Context) error) error {
+	dc.settingsMu.RLock()
+	timeout := durationOr(dc.callTimeout, callTimeout)
+	dc.settingsMu.RUnlock()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	err := rpc(dc.withMetadata(ctx))
+	dc.mu.Lock()
+	dc.extra.StatusServerLatency.observe(time.Since(start))
+	dc.mu.Unlock()
+	return err
+}
+
+// withMetadata adds the payload schema version, the public key fingerprint, the node
+// group and any upgrade or lifecycle event not reported yet to the outgoing metadata of ctx.
+func (dc *dcWrap) withMetadata(ctx context.Context) context.Context {
+	return dc.withNodeGroup(dc.withFingerprint(dc.withEvent(dc.withUpgrade(withSchemaVersion(ctx)))))
+}
+
+func (dc *dcWrap) doSendData(ctx context.Context, sm *pb.SignedMetrics) error {
+	if dc.dryRun() {
+		return dc.writeDryRun(sm)
+	}
+	_, err := dc.fanout(ctx, func(ctx context.Context, domain string) (int, error) {
+		return dc.flushTo(ctx, domain, []*pb.SignedMetrics{sm})
 	})
+	return err
 }
 
+// getPayload serializes the collected analytics. The caller must hold mu, reading is enough.
 func (dc *dcWrap) getPayload(btfsNode *core.IpfsNode) ([]byte, error) {
+	return dc.payloadOf(btfsNode.Identity.Pretty(), dc.pn, &dc.extra)
+}
+
+// payloadOf serializes pn and extra collected for the node with id raw, with its
+// swarm peers as the discovery nodes. Listing them can take up to a minute, so
+// callers that copied pn and extra need not hold mu.
+func (dc *dcWrap) payloadOf(raw string, pn *nodepb.Node, extra *extraMetrics) ([]byte, error) {
 	dn, err := dc.getDiscoveryNodes()
 	if err != nil {
 		dn = make([]*nodepb.DiscoveryNode, 0)
 		log.Debug(err)
 	}
-	pn := &nodepb.PayLoadInfo{
-		NodeId:         btfsNode.Identity.Pretty(),
-		Node:           dc.pn,
+	return dc.marshalBoundedPayload(raw, pn, extra, dn, time.Now())
+}
+
+// maxPayloadBytes caps a serialized payload well below the 4MB gRPC message limit
+const maxPayloadBytes = 1 << 20
+
+// marshalBoundedPayload is marshalPayload for payloads of at most maxPayloadBytes.
+// The discovery nodes, one per connected peer, are dropped from payloads that are
+// too large, as they are the only part that grows with the node's connections.
+func (dc *dcWrap) marshalBoundedPayload(raw string, pn *nodepb.Node, extra *extraMetrics, dn []*nodepb.DiscoveryNode, at time.Time) ([]byte, error) {
+	payload, err := dc.marshalPayload(raw, pn, extra, dn, at)
+	if err != nil || len(payload) <= maxPayloadBytes {
+		return payload, err
+	}
+	log.Warnw("analytics payload too large, dropping the discovery nodes", "epoch", dc.epoch,
+		"bytes", len(payload), "max", maxPayloadBytes, "discovery_nodes", len(dn))
+	if payload, err = dc.marshalPayload(raw, pn, extra, nil, at); err != nil {
+		return nil, err
+	}
+	if len(payload) > maxPayloadBytes {
+		return nil, fmt.Errorf("analytics payload of %d bytes exceeds %d", len(payload), maxPayloadBytes)
+	}
+	return payload, nil
+}
+
+// marshalPayload serializes pn and extra, if not nil, collected at the given time for
+// the node with id raw, reporting the id its privacy mode calls for. extra is sent as
+// the extension field extraMetricsField.
+func (dc *dcWrap) marshalPayload(raw string, pn *nodepb.Node, extra *extraMetrics, dn []*nodepb.DiscoveryNode, at time.Time) ([]byte, error) {
+	id, err := dc.reportedNodeID(raw)
+	if err != nil {
+		return nil, err
+	}
+	// the local analytics endpoints keep the exact figures and real id
+	node := dc.noised(pn)
+	if id != raw {
+		copied := *node
+		copied.NodeId = id
+		node = &copied
+	}
+	payload := &nodepb.PayLoadInfo{
+		NodeId:         id,
+		Node:           node,
 		DiscoveryNodes: dn,
-		LastTime:       time.Now(),
+		LastTime:       at,
 	}
-	bytes, err := proto.Marshal(pn)
+	if extra != nil {
+		if payload.XXX_unrecognized, err = encodeExtraMetrics(dc.noisedExtra(extra)); err != nil {
+			return nil, err
+		}
+	}
+	bytes, err := proto.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
@@ -304,6 +1251,9 @@ func (dc *dcWrap) getPayload(btfsNode *core.IpfsNode) ([]byte, error) {
 
 func (dc *dcWrap) getDiscoveryNodes() ([]*nodepb.DiscoveryNode, error) {
 	ns := make([]*nodepb.DiscoveryNode, 0)
+	if dc.api == nil {
+		return ns, fmt.Errorf("no core api to list the swarm peers with")
+	}
 	ctx, cf := context.WithTimeout(context.Background(), time.Minute)
 	defer cf()
 	peers, err := dc.api.Swarm().Peers(ctx)
@@ -323,20 +1273,195 @@ func (dc *dcWrap) getDiscoveryNodes() ([]*nodepb.DiscoveryNode, error) {
 	return ns, nil
 }
 
-func (dc *dcWrap) collectionAgent(node *core.IpfsNode) {
-	tick := time.NewTicker(heartBeat)
+func (dc *dcWrap) collectionAgent(ctx context.Context) {
+	dc.startAgent(ctx, func() {
+		dc.sendHeartbeat(ctx)
+	})
+	dc.sendStopEvent()
+}
+
+// cpuPercent returns the CPU usage of the machine since it was last called
+var cpuPercent = defaultCPUPercent
+
+func defaultCPUPercent() (float64, error) {
+	cpus, err := cpu.Percent(0, false)
+	if err != nil || len(cpus) < 1 {
+		return 0, err
+	}
+	return cpus[0], nil
+}
+
+// sendHeartbeat sends a scheduled heartbeat, unless the node is too busy for it or
+// sampling leaves it out. A delivered heartbeat, or one left out on purpose, tells
+// the systemd watchdog the node is alive.
+func (dc *dcWrap) sendHeartbeat(ctx context.Context) {
+	if dc.overloaded() {
+		return
+	}
+	if !dc.sampled() {
+		// still collected for the local analytics endpoints and export
+		errs := dc.update(dc.node)
+		dc.mu.RLock()
+		report := dc.localReport()
+		dc.mu.RUnlock()
+		logErrors(append(errs, dc.export(report)...))
+		notifyWatchdog()
+		return
+	}
+	if err := dc.sendData(ctx, dc.node, dc.newBackoff()); err == nil {
+		notifyWatchdog()
+	}
+}
+
+// overloaded reports whether the CPU usage of the last epoch is above
+// Analytics.LoadThreshold, so collecting a heartbeat would add to the load. A
+// skipped heartbeat only takes a new CPU reading, for the next one to go by.
+func (dc *dcWrap) overloaded() bool {
+	threshold := configFloat(dc.node.Repo, loadThresholdKey, 0)
+	if threshold == 0 {
+		return false
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	used := dc.pn.CpuUsed
+	if used <= threshold {
+		return false
+	}
+	log.Debugw("analytics heartbeat skipped under load", "cpu", used, "threshold", threshold)
+	if used, err := cpuPercent(); err == nil {
+		dc.pn.CpuUsed = used
+	}
+	return true
+}
+
+// sampleRand returns a uniform random number in [0, 1)
+var sampleRand = func() float64 {
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return jitterRand.Float64()
+}
+
+// sampled reports whether a scheduled heartbeat is to be sent under
+// Analytics.SamplingRate, so a large fleet of nodes only sends that fraction of
+// them. All heartbeats are sent if it is unset.
+func (dc *dcWrap) sampled() bool {
+	rate := configFraction(dc.node.Repo, samplingRateKey, 1)
+	if rate >= 1 || sampleRand() < rate {
+		return true
+	}
+	log.Debugw("analytics heartbeat skipped by sampling", "rate", rate)
+	return false
+}
+
+// startAgent waits a random part of the jitter window, so nodes restarted together
+// do not all hit the status server at once, then runs the agent on the heartbeat
+// timer and config poll ticker. Every heartbeat sent schedules the next one after
+// nextHeartbeat. A tick while analytics is disabled leaves the timer stopped until
+// the poll sends a heartbeat for turning it on again.
+func (dc *dcWrap) startAgent(ctx context.Context, send func()) {
+	dc.settingsMu.RLock()
+	jitter := durationOr(dc.jitter, dc.heartbeat)
+	dc.settingsMu.RUnlock()
+	select {
+	case <-time.After(heartbeatJitter(jitter)):
+	case <-ctx.Done():
+		return
+	}
+	tick := time.NewTimer(dc.nextHeartbeat())
 	defer tick.Stop()
-	// Force tick on immediate start
-	// make the configuration available in the for loop
-	for ; true; <-tick.C {
-		config, err := dc.node.Repo.Config()
-		if err != nil {
-			continue
+	poll := time.NewTicker(configPollInterval)
+	defer poll.Stop()
+	dc.runAgent(ctx, tick.C, poll.C, func() {
+		send()
+		if !tick.Stop() {
+			// fired without being received if the heartbeat was sent on a poll
+			select {
+			case <-tick.C:
+			default:
+			}
 		}
-		// check config for explicit consent to data collect
-		// consent can be changed without reinitializing data collection
-		if isAnalyticsEnabled(config) {
-			dc.sendData(node, config)
+		tick.Reset(dc.nextHeartbeat())
+	})
+}
+
+// maxHeartbeat caps how far failed heartbeats stretch the heartbeat interval
+const maxHeartbeat = 24 * time.Hour
+
+// nextHeartbeat returns the configured heartbeat interval, doubled for every
+// heartbeat in a row after the first that was not delivered, up to maxHeartbeat.
+// A node whose status server is down does not keep trying every heartbeat.
+func (dc *dcWrap) nextHeartbeat() time.Duration {
+	dc.sendMu.Lock()
+	failed := dc.failedSends
+	dc.sendMu.Unlock()
+	dc.settingsMu.RLock()
+	heartbeat := dc.heartbeat
+	dc.settingsMu.RUnlock()
+	interval := heartbeat
+	for i := 1; i < failed && interval < maxHeartbeat; i++ {
+		interval *= 2
+	}
+	if interval > maxHeartbeat && heartbeat <= maxHeartbeat {
+		return maxHeartbeat
+	}
+	return interval
+}
+
+var (
+	// jitterRand is seeded from crypto/rand, so nodes started at the same time
+	// still pick different delays
+	jitterRand = rand.New(rand.NewSource(cryptoSeed()))
+	jitterMu   sync.Mutex
+)
+
+// cryptoSeed returns a random seed, the current time if crypto/rand fails.
+func cryptoSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// heartbeatJitter returns a random delay in [0, max).
+func heartbeatJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(max)))
+}
+
+// runAgent calls send on every tick received from c as long as analytics is enabled,
+// until ctx is done. The config is also checked on every tick from poll, so a
+// heartbeat is sent as soon as analytics is turned on rather than on the next tick.
+func (dc *dcWrap) runAgent(ctx context.Context, c, poll <-chan time.Time, send func()) {
+	// first send happens on immediate start
+	enabled := dc.analyticsEnabled()
+	if enabled {
+		send()
+	}
+	for {
+		select {
+		case <-c:
+			if enabled = dc.analyticsEnabled(); enabled {
+				send()
+			}
+		case <-poll:
+			wasEnabled := enabled
+			if enabled = dc.analyticsEnabled(); enabled && !wasEnabled {
+				send()
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
+
+// analyticsEnabled checks the config for explicit consent to data collection.
+// Consent can be changed without reinitializing data collection.
+func (dc *dcWrap) analyticsEnabled() bool {
+	config, err := dc.node.Repo.Config()
+	return err == nil && isAnalyticsEnabled(config)
+}
@@ -0,0 +1,230 @@
+package spin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// path the aggregator accepts worker reports on
+const workerReportPath = "/report"
+
+// workerReport is the analytics a worker sends the aggregator instead of the
+// status server
+type workerReport struct {
+	Node           *nodepb.Node            `json:"node"`
+	DiscoveryNodes []*nodepb.DiscoveryNode `json:"discovery_nodes,omitempty"`
+}
+
+// aggregator returns the Unix socket of the aggregator this node reports to, ""
+// if it reports to the status server itself.
+func (dc *dcWrap) aggregator() string {
+	if configBool(dc.node.Repo, aggregatorKey, false) {
+		return ""
+	}
+	return configString(dc.node.Repo, aggregatorAddrKey, "")
+}
+
+// startAggregator listens for worker reports on Analytics.AggregatorAddr if this
+// node is the aggregator. A socket left behind by an earlier run is replaced. Only
+// the user running the node may connect to it.
+func (dc *dcWrap) startAggregator() error {
+	addr := configString(dc.node.Repo, aggregatorAddrKey, "")
+	if !configBool(dc.node.Repo, aggregatorKey, false) || addr == "" {
+		return nil
+	}
+	if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(addr)
+	}
+	lis, err := net.Listen("unix", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for analytics workers: %s", err.Error())
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		lis.Close()
+		return fmt.Errorf("failed to restrict the analytics workers socket: %s", err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(workerReportPath, dc.serveWorkerReport)
+	srv := &http.Server{Handler: mux}
+	dc.workersMu.Lock()
+	dc.aggregatorSrv = srv
+	dc.workersMu.Unlock()
+	go srv.Serve(lis)
+	return nil
+}
+
+// stopAggregator stops listening for worker reports, which removes the socket.
+func (dc *dcWrap) stopAggregator() {
+	dc.workersMu.Lock()
+	srv := dc.aggregatorSrv
+	dc.aggregatorSrv = nil
+	dc.workersMu.Unlock()
+	if srv != nil {
+		srv.Close()
+	}
+}
+
+// serveWorkerReport keeps the latest report of each worker for the next heartbeat,
+// with the transfers of the epochs it reported since the last one added up.
+func (dc *dcWrap) serveWorkerReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a worker report", http.StatusMethodNotAllowed)
+		return
+	}
+	report := new(workerReport)
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPayloadBytes)).Decode(report); err != nil {
+		http.Error(w, fmt.Sprintf("invalid worker report: %s", err), http.StatusBadRequest)
+		return
+	}
+	if report.Node == nil || report.Node.NodeId == "" {
+		http.Error(w, "worker report without a node id", http.StatusBadRequest)
+		return
+	}
+	dc.workersMu.Lock()
+	if dc.workerReports == nil {
+		dc.workerReports = make(map[string]*workerReport)
+	}
+	if prev, ok := dc.workerReports[report.Node.NodeId]; ok {
+		report.Node.Upload += prev.Node.Upload
+		report.Node.Download += prev.Node.Download
+	}
+	dc.workerReports[report.Node.NodeId] = report
+	dc.workersMu.Unlock()
+}
+
+// takeWorkerReports returns the worker reports received since the last heartbeat
+// and starts collecting new ones.
+func (dc *dcWrap) takeWorkerReports() map[string]*workerReport {
+	dc.workersMu.Lock()
+	defer dc.workersMu.Unlock()
+	reports := dc.workerReports
+	dc.workerReports = nil
+	return reports
+}
+
+// aggregatedPayload serializes report, collected for the node with id raw, with
+// the analytics of the workers that reported since the last heartbeat added in, see
+// addNode. Their discovery nodes are joined with the node's own, one per peer.
+func (dc *dcWrap) aggregatedPayload(raw string, report *dcReport) ([]byte, error) {
+	reports := dc.takeWorkerReports()
+	if len(reports) == 0 {
+		return dc.payloadOf(raw, report.Node, &report.extraMetrics)
+	}
+	dn, err := dc.getDiscoveryNodes()
+	if err != nil {
+		log.Debug(err)
+	}
+	combined := *report.Node
+	seen := make(map[string]bool, len(dn))
+	for _, n := range dn {
+		seen[n.ToNodeId] = true
+	}
+	for _, r := range reports {
+		addNode(&combined, r.Node)
+		for _, n := range r.DiscoveryNodes {
+			if n != nil && !seen[n.ToNodeId] {
+				seen[n.ToNodeId] = true
+				dn = append(dn, n)
+			}
+		}
+	}
+	return dc.marshalBoundedPayload(raw, &combined, &report.extraMetrics, dn, time.Now())
+}
+
+// addNode adds the usage and transfer counters of a worker to the ones of dst. The
+// rest, such as the version, uptime and prices, stay those of the aggregator. The
+// CPU use of the workers is added up too, capped at 100%.
+func addNode(dst, src *nodepb.Node) {
+	dst.StorageUsed += src.StorageUsed
+	dst.StorageVolumeCap += src.StorageVolumeCap
+	dst.MemoryUsed += src.MemoryUsed
+	dst.CpuUsed += src.CpuUsed
+	if dst.CpuUsed > 100 {
+		dst.CpuUsed = 100
+	}
+	dst.Upload += src.Upload
+	dst.Download += src.Download
+	dst.TotalUpload += src.TotalUpload
+	dst.TotalDownload += src.TotalDownload
+	dst.BlocksUp += src.BlocksUp
+	dst.BlocksDown += src.BlocksDown
+	dst.PeersConnected += src.PeersConnected
+}
+
+// sendToAggregator collects a heartbeat and sends it to the aggregator at addr
+// instead of the status server, retrying according to bo.
+func (dc *dcWrap) sendToAggregator(ctx context.Context, node *core.IpfsNode, addr string, bo backoff.BackOff) error {
+	collected, errs, err := dc.collect(node)
+	if err != nil {
+		logErrors(append(errs, err))
+		dc.reportHealthAlert(err.Error())
+		return err
+	}
+	logErrors(errs)
+	report := &workerReport{Node: collected.Node}
+	if report.DiscoveryNodes, err = dc.getDiscoveryNodes(); err != nil {
+		log.Debug(err)
+	}
+	return dc.deliverWorkerReport(ctx, addr, report, bo)
+}
+
+// deliverWorkerReport posts report to the aggregator listening on addr, retrying
+// according to bo, and starts the next epoch once it got it.
+func (dc *dcWrap) deliverWorkerReport(ctx context.Context, addr string, report *workerReport, bo backoff.BackOff) error {
+	dc.epoch++
+	err := backoff.Retry(func() error {
+		return postWorkerReport(ctx, addr, report)
+	}, backoff.WithContext(bo, ctx))
+	if err != nil {
+		dc.reportHealthAlert(err.Error())
+		return err
+	}
+	dc.delivered()
+	return nil
+}
+
+// postWorkerReport sends report to the aggregator listening on the Unix socket addr.
+func postWorkerReport(ctx context.Context, addr string, report *workerReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode worker report: %s", err.Error())
+	}
+	var d net.Dialer
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", addr)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	// the host is ignored, the socket is dialed whatever it is
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://aggregator"+workerReportPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the analytics aggregator: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBody))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("analytics aggregator rejected the report: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package spin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gogo/protobuf/proto"
+)
+
+// startTestAggregator returns an aggregator sending to the status server at addr
+// and the socket its workers report to.
+func startTestAggregator(t *testing.T, addr string) (*dcWrap, string) {
+	sock := filepath.Join(t.TempDir(), "aggregator.sock")
+	dc := newTestSendingDcWrap(t, addr)
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{aggregatorAddrKey: sock, aggregatorKey: true}
+	if err := dc.startAggregator(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(dc.stopAggregator)
+	return dc, sock
+}
+
+func TestAggregation(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	agg, sock := startTestAggregator(t, addr)
+	workers := []*workerReport{
+		{
+			Node: &nodepb.Node{NodeId: "worker1", StorageUsed: 100, MemoryUsed: 10, CpuUsed: 30,
+				Upload: 1, TotalUpload: 1000, BlocksUp: 5, PeersConnected: 2},
+			DiscoveryNodes: []*nodepb.DiscoveryNode{{ToNodeId: "peerA"}, {ToNodeId: "peerB"}},
+		},
+		{
+			Node: &nodepb.Node{NodeId: "worker2", StorageUsed: 200, MemoryUsed: 20, CpuUsed: 40,
+				Upload: 2, TotalUpload: 2000, BlocksUp: 7, PeersConnected: 3},
+			DiscoveryNodes: []*nodepb.DiscoveryNode{{ToNodeId: "peerB"}, {ToNodeId: "peerC"}},
+		},
+	}
+	for _, w := range workers {
+		if err := postWorkerReport(context.Background(), sock, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := agg.sendData(context.Background(), agg.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	sms := ss.metrics()
+	if len(sms) != 1 {
+		t.Fatalf("status server received %d heartbeats, want 1 for the group", len(sms))
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(sms[0].Payload, info); err != nil {
+		t.Fatal(err)
+	}
+	own, got := agg.pn, info.Node
+	if got.NodeId != own.NodeId {
+		t.Errorf("got node id %q, want the aggregator's %q", got.NodeId, own.NodeId)
+	}
+	for _, f := range []struct {
+		name      string
+		got, want uint64
+	}{
+		{"storage used", got.StorageUsed, own.StorageUsed + 300},
+		{"memory used", got.MemoryUsed, own.MemoryUsed + 30},
+		{"upload", got.Upload, own.Upload + 3},
+		{"total upload", got.TotalUpload, own.TotalUpload + 3000},
+		{"blocks up", got.BlocksUp, own.BlocksUp + 12},
+		{"peers", got.PeersConnected, own.PeersConnected + 5},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s: got %d, want %d", f.name, f.got, f.want)
+		}
+	}
+	if want := own.CpuUsed + 70; got.CpuUsed != want && !(want > 100 && got.CpuUsed == 100) {
+		t.Errorf("got cpu %v, want %v capped at 100", got.CpuUsed, want)
+	}
+	var peers []string
+	for _, n := range info.DiscoveryNodes {
+		peers = append(peers, n.ToNodeId)
+	}
+	sort.Strings(peers)
+	if len(peers) != 3 || peers[0] != "peerA" || peers[1] != "peerB" || peers[2] != "peerC" {
+		t.Errorf("got discovery nodes %v, want the union of the workers'", peers)
+	}
+
+	// reports are used once, the next heartbeat is the aggregator's alone
+	if n := len(agg.takeWorkerReports()); n != 0 {
+		t.Errorf("%d worker reports left after the heartbeat", n)
+	}
+}
+
+func TestWorkerSendsToAggregator(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	agg, sock := startTestAggregator(t, addr)
+	worker := newTestSendingDcWrap(t, addr)
+	worker.node.Repo.(*testRepo).keys = map[string]interface{}{aggregatorAddrKey: sock}
+	worker.extra.EventType = eventStart
+	if err := worker.sendData(context.Background(), worker.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ss.metrics()); n != 0 {
+		t.Fatalf("worker sent %d heartbeats to the status server", n)
+	}
+	// the aggregator got the epoch, the next one starts
+	if worker.prev == nil || worker.prepared != nil || worker.extra.EventType != "" {
+		t.Fatalf("worker did not start the next epoch, baseline %v and event %q", worker.prev, worker.extra.EventType)
+	}
+	reports := agg.takeWorkerReports()
+	if r, ok := reports[worker.pn.NodeId]; !ok || r.Node.BtfsVersion != worker.pn.BtfsVersion {
+		t.Fatalf("aggregator got reports %v, want the worker's", reports)
+	}
+
+	agg.stopAggregator()
+	if err := worker.sendData(context.Background(), worker.node, &backoff.StopBackOff{}); err == nil {
+		t.Fatal("expected an error without an aggregator")
+	}
+}
+
+func TestWorkerReportsAddUp(t *testing.T) {
+	_, addr := startTestStatusServer(t)
+	agg, sock := startTestAggregator(t, addr)
+	for _, n := range []*nodepb.Node{
+		{NodeId: "worker1", StorageUsed: 100, Upload: 1, Download: 10, TotalUpload: 1001},
+		{NodeId: "worker1", StorageUsed: 90, Upload: 2, Download: 20, TotalUpload: 1003},
+	} {
+		if err := postWorkerReport(context.Background(), sock, &workerReport{Node: n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := agg.takeWorkerReports()["worker1"].Node
+	// the epoch transfers add up, the rest is the latest
+	if got.Upload != 3 || got.Download != 30 || got.TotalUpload != 1003 || got.StorageUsed != 90 {
+		t.Fatalf("got %+v, want the transfers of both epochs and the latest totals", got)
+	}
+}
+
+func TestAggregatorSocketMode(t *testing.T) {
+	_, addr := startTestStatusServer(t)
+	_, sock := startTestAggregator(t, addr)
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Fatalf("got socket mode %o, want 600", mode)
+	}
+}
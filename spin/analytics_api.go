@@ -0,0 +1,101 @@
+package spin
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/TRON-US/go-btfs/core"
+)
+
+const (
+	// maxAPICalls caps the commands reported, the ones called most often
+	maxAPICalls = 10
+	// maxTrackedAPICalls caps the commands counted between heartbeats, so requests
+	// for made up commands cannot grow the counters without bound
+	maxTrackedAPICalls = 256
+	// counts the calls of the commands beyond maxTrackedAPICalls
+	otherAPICall = "other"
+)
+
+// CountAPICalls counts the API commands served by next for the analytics of node.
+// Requests outside of the API, such as the gateway, are not counted.
+func CountAPICalls(node *core.IpfsNode, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := apiCommand(r.URL.Path); ok {
+			if dc, ok := getDcWrap(node); ok {
+				dc.countAPICall(name)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiCommand returns the name of the command served at path, files/ls for
+// /api/v1/files/ls, if path is in the API.
+func apiCommand(path string) (string, bool) {
+	if !strings.HasPrefix(path, "/api/") {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/api/"), "/", 2)
+	if len(parts) < 2 {
+		return "", false
+	}
+	name := strings.Trim(parts[1], "/")
+	return name, name != ""
+}
+
+func (dc *dcWrap) countAPICall(name string) {
+	dc.apiCallsMu.Lock()
+	defer dc.apiCallsMu.Unlock()
+	if dc.apiCalls == nil {
+		dc.apiCalls = make(map[string]uint64)
+	}
+	if _, ok := dc.apiCalls[name]; !ok && len(dc.apiCalls) >= maxTrackedAPICalls {
+		name = otherAPICall
+	}
+	dc.apiCalls[name]++
+}
+
+// updateAPICalls reports the commands called most often since the last heartbeat
+// was delivered, and remembers all counts to take them off once this one is.
+func (dc *dcWrap) updateAPICalls() {
+	dc.apiCallsMu.Lock()
+	defer dc.apiCallsMu.Unlock()
+	dc.apiCallsSample = make(map[string]uint64, len(dc.apiCalls))
+	names := make([]string, 0, len(dc.apiCalls))
+	for name, n := range dc.apiCalls {
+		dc.apiCallsSample[name] = n
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if ci, cj := dc.apiCalls[names[i]], dc.apiCalls[names[j]]; ci != cj {
+			return ci > cj
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > maxAPICalls {
+		names = names[:maxAPICalls]
+	}
+	dc.extra.APICalls = nil
+	if len(names) > 0 {
+		dc.extra.APICalls = make(map[string]uint64, len(names))
+	}
+	for _, name := range names {
+		dc.extra.APICalls[name] = dc.apiCalls[name]
+	}
+}
+
+// resetAPICalls takes the counts of the delivered heartbeat off the counters,
+// keeping the calls made since it was collected.
+func (dc *dcWrap) resetAPICalls() {
+	dc.apiCallsMu.Lock()
+	defer dc.apiCallsMu.Unlock()
+	// the counters only grew since they were sampled
+	for name, n := range dc.apiCallsSample {
+		if dc.apiCalls[name] -= n; dc.apiCalls[name] == 0 {
+			delete(dc.apiCalls, name)
+		}
+	}
+	dc.apiCallsSample = nil
+}
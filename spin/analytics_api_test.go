@@ -0,0 +1,76 @@
+package spin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCountAPICalls(t *testing.T) {
+	dc := newTestDcWrap(t)
+	served := 0
+	h := CountAPICalls(dc.node, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+	get := func(path string, n int) {
+		for i := 0; i < n; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+		}
+	}
+	get("/api/v1/id", 3)
+	get("/api/v1/files/ls?arg=/", 2)
+	get("/api/v0/files/ls/", 1)
+	get("/api/v1/", 1)
+	get("/btfs/QmHash", 4)
+	get("/webui", 1)
+	if served != 12 {
+		t.Fatalf("next served %d requests, want 12", served)
+	}
+	dc.updateAPICalls()
+	if want := map[string]uint64{"id": 3, "files/ls": 3}; !reflect.DeepEqual(dc.extra.APICalls, want) {
+		t.Fatalf("got api calls %v, want %v", dc.extra.APICalls, want)
+	}
+
+	// calls after the heartbeat was collected count towards the next one
+	get("/api/v1/id", 1)
+	dc.mu.Lock()
+	dc.reset()
+	dc.mu.Unlock()
+	if dc.extra.APICalls != nil {
+		t.Fatalf("api calls %v not reset", dc.extra.APICalls)
+	}
+	dc.updateAPICalls()
+	if want := map[string]uint64{"id": 1}; !reflect.DeepEqual(dc.extra.APICalls, want) {
+		t.Fatalf("got api calls %v after reset, want %v", dc.extra.APICalls, want)
+	}
+}
+
+func TestUpdateAPICallsCaps(t *testing.T) {
+	dc := &dcWrap{}
+	for i := 0; i < maxTrackedAPICalls; i++ {
+		for j := 0; j <= i%20; j++ {
+			dc.countAPICall(fmt.Sprintf("cmd%d", i))
+		}
+	}
+	// commands beyond the cap are counted together
+	for i := 0; i < 5; i++ {
+		dc.countAPICall(fmt.Sprintf("made-up%d", i))
+	}
+	if len(dc.apiCalls) != maxTrackedAPICalls+1 {
+		t.Fatalf("tracking %d commands, want %d", len(dc.apiCalls), maxTrackedAPICalls+1)
+	}
+	if got, want := dc.apiCalls[otherAPICall], uint64(5); got != want {
+		t.Fatalf("got %d calls of untracked commands, want %d", got, want)
+	}
+	dc.updateAPICalls()
+	if len(dc.extra.APICalls) != maxAPICalls {
+		t.Fatalf("got %d commands, want %d", len(dc.extra.APICalls), maxAPICalls)
+	}
+	for name, n := range dc.extra.APICalls {
+		if n != 20 {
+			t.Errorf("got %s called %d times among the top commands", name, n)
+		}
+	}
+}
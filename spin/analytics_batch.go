@@ -0,0 +1,41 @@
+package spin
+
+import (
+	"context"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+)
+
+// updateMetricsBatchMethod streams several signed metrics to the status server in
+// one call. status.proto does not define it yet, so servers without it answer
+// Unimplemented and the metrics are sent one by one instead.
+const updateMetricsBatchMethod = "/status.StatusService/UpdateMetricsBatch"
+
+var updateMetricsBatchDesc = &grpc.StreamDesc{
+	StreamName:    "UpdateMetricsBatch",
+	ClientStreams: true,
+}
+
+// updateMetricsBatch sends sms in order over a single client stream and waits for
+// the server to acknowledge all of them.
+func updateMetricsBatch(ctx context.Context, conn *grpc.ClientConn, sms []*pb.SignedMetrics) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, updateMetricsBatchDesc, updateMetricsBatchMethod)
+	if err != nil {
+		return err
+	}
+	for _, sm := range sms {
+		if err := stream.SendMsg(sm); err != nil {
+			// the real error, such as Unimplemented, is reported on receive
+			break
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(new(types.Empty))
+}
@@ -0,0 +1,57 @@
+package spin
+
+import (
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+)
+
+// metricsBuffer is a fixed size ring buffer of signed metrics. When full, pushing
+// drops the oldest entry.
+type metricsBuffer struct {
+	items []*pb.SignedMetrics
+	head  int
+	n     int
+}
+
+func newMetricsBuffer(size int) *metricsBuffer {
+	return &metricsBuffer{items: make([]*pb.SignedMetrics, size)}
+}
+
+func (b *metricsBuffer) len() int {
+	return b.n
+}
+
+// push appends sm as the newest entry.
+func (b *metricsBuffer) push(sm *pb.SignedMetrics) {
+	if b.n == len(b.items) {
+		b.pop()
+	}
+	b.items[(b.head+b.n)%len(b.items)] = sm
+	b.n++
+}
+
+// peek returns the oldest entry, nil if empty.
+func (b *metricsBuffer) peek() *pb.SignedMetrics {
+	if b.n == 0 {
+		return nil
+	}
+	return b.items[b.head]
+}
+
+// pop removes the oldest entry.
+func (b *metricsBuffer) pop() {
+	if b.n == 0 {
+		return
+	}
+	b.items[b.head] = nil
+	b.head = (b.head + 1) % len(b.items)
+	b.n--
+}
+
+// all returns the entries oldest first.
+func (b *metricsBuffer) all() []*pb.SignedMetrics {
+	res := make([]*pb.SignedMetrics, 0, b.n)
+	for i := 0; i < b.n; i++ {
+		res = append(res, b.items[(b.head+i)%len(b.items)])
+	}
+	return res
+}
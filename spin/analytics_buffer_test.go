@@ -0,0 +1,111 @@
+package spin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+)
+
+func testMetrics(i int) *pb.SignedMetrics {
+	return &pb.SignedMetrics{Payload: []byte(fmt.Sprint(i))}
+}
+
+func TestMetricsBufferDropsOldest(t *testing.T) {
+	b := newMetricsBuffer(3)
+	for i := 0; i < 5; i++ {
+		b.push(testMetrics(i))
+	}
+	if b.len() != 3 {
+		t.Fatalf("got %d buffered, want 3", b.len())
+	}
+	for want := 2; want < 5; want++ {
+		if got := string(b.peek().Payload); got != fmt.Sprint(want) {
+			t.Fatalf("got %s, want %d", got, want)
+		}
+		b.pop()
+	}
+	if b.peek() != nil {
+		t.Fatal("expected empty buffer")
+	}
+}
+
+func TestFlushPendingInOrder(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+		statusServerDomains: []string{addr},
+		pending:             newMetricsBuffer(defaultBufferSize),
+	}
+
+	ss.setFail(true)
+	for i := 0; i < 3; i++ {
+		dc.pending.push(testMetrics(i))
+		if err := dc.flushPending(context.Background()); err == nil {
+			t.Fatal("expected send to fail")
+		}
+	}
+	ss.setFail(false)
+	dc.pending.push(testMetrics(3))
+	if err := dc.flushPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := ss.metrics()
+	if len(got) != 4 {
+		t.Fatalf("status server received %d heartbeats, want 4", len(got))
+	}
+	for i, sm := range got {
+		if string(sm.Payload) != fmt.Sprint(i) {
+			t.Errorf("heartbeat %d has payload %s", i, sm.Payload)
+		}
+	}
+	if dc.pending.len() != 0 {
+		t.Fatalf("%d heartbeats left in buffer", dc.pending.len())
+	}
+}
+
+func TestFlushPendingBatch(t *testing.T) {
+	for _, noBatch := range []bool{false, true} {
+		ss, addr := startTestStatusServer(t)
+		ss.setNoBatch(noBatch)
+		dc := &dcWrap{
+			node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+			statusServerDomains: []string{addr},
+			pending:             newMetricsBuffer(defaultBufferSize),
+		}
+		for i := 0; i < 5; i++ {
+			dc.pending.push(testMetrics(i))
+		}
+		if err := dc.flushPending(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		got := ss.metrics()
+		if len(got) != 5 {
+			t.Fatalf("noBatch %v: status server received %d heartbeats, want 5", noBatch, len(got))
+		}
+		for i, sm := range got {
+			if string(sm.Payload) != fmt.Sprint(i) {
+				t.Errorf("noBatch %v: heartbeat %d has payload %s", noBatch, i, sm.Payload)
+			}
+		}
+		wantBatches := 1
+		if noBatch {
+			wantBatches = 0
+		}
+		batches, conns := ss.counts()
+		if batches != wantBatches {
+			t.Errorf("noBatch %v: got %d batches, want %d", noBatch, batches, wantBatches)
+		}
+		if conns != 1 {
+			t.Errorf("noBatch %v: heartbeats sent over %d connections, want 1", noBatch, conns)
+		}
+		if dc.pending.len() != 0 {
+			t.Errorf("noBatch %v: %d heartbeats left in buffer", noBatch, dc.pending.len())
+		}
+	}
+}
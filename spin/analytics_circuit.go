@@ -0,0 +1,93 @@
+package spin
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// heartbeats in a row that must exhaust their retries to open the circuit
+	circuitThreshold = 3
+	// how long an open circuit keeps heartbeats from being sent
+	defaultCircuitCooldown = time.Hour
+)
+
+type circuitState int
+
+const (
+	// heartbeats are sent
+	circuitClosed circuitState = iota
+	// heartbeats are buffered without trying to send them until the cooldown is over
+	circuitOpen
+	// the next heartbeat is a trial, it closes the circuit or opens it again
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("circuitState(%d)", int(s))
+	}
+}
+
+// circuitBreaker stops sending to status servers that did not take circuitThreshold
+// heartbeats in a row, so a dead server is not retried every heartbeat. The
+// heartbeats of the cooldown are buffered and go out with the trial after it, so a
+// server back sooner gets them late, unless a heartbeat sent on demand is let
+// through as an early trial, see trial.
+type circuitBreaker struct {
+	state    circuitState
+	failures int
+	openedAt time.Time
+	cooldown time.Duration
+}
+
+// allow reports whether a heartbeat may be sent at now. An open circuit whose
+// cooldown is over becomes half open and lets one heartbeat through.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b.state == circuitOpen {
+		if now.Sub(b.openedAt) < durationOr(b.cooldown, defaultCircuitCooldown) {
+			return false
+		}
+		b.state = circuitHalfOpen
+	}
+	return true
+}
+
+// trial makes an open circuit half open so the next heartbeat tries the status
+// server before the cooldown is over.
+func (b *circuitBreaker) trial() {
+	if b.state == circuitOpen {
+		b.state = circuitHalfOpen
+	}
+}
+
+// record updates the circuit with the outcome of a heartbeat sent at now.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	if err == nil {
+		if b.state != circuitClosed {
+			log.Infow("analytics circuit closed, the status server is back")
+		}
+		b.state, b.failures = circuitClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= circuitThreshold {
+		if b.state != circuitOpen {
+			log.Warnw("analytics circuit opened, pausing heartbeats", "failures", b.failures,
+				"cooldown", durationOr(b.cooldown, defaultCircuitCooldown).String(), "error", err)
+		}
+		b.state, b.openedAt = circuitOpen, now
+	}
+}
+
+// openUntil returns when the cooldown of an open circuit is over.
+func (b *circuitBreaker) openUntil() time.Time {
+	return b.openedAt.Add(durationOr(b.cooldown, defaultCircuitCooldown))
+}
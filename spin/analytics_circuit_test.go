@@ -0,0 +1,138 @@
+package spin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 100 * time.Millisecond
+	ss, addr := startTestStatusServer(t)
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+		statusServerDomains: []string{addr},
+		pending:             newMetricsBuffer(defaultBufferSize),
+		circuit:             circuitBreaker{cooldown: cooldown},
+	}
+	defer dc.closeConn()
+	send := func(i int) error {
+		return dc.send(context.Background(), testMetrics(i), &backoff.StopBackOff{})
+	}
+	expect := func(state circuitState) {
+		t.Helper()
+		if dc.circuit.state != state {
+			t.Fatalf("circuit is %s, want %s", dc.circuit.state, state)
+		}
+	}
+
+	ss.setFail(true)
+	for i := 0; i < circuitThreshold; i++ {
+		expect(circuitClosed)
+		if err := send(i); err == nil {
+			t.Fatal("expected failing status server to fail")
+		}
+	}
+	expect(circuitOpen)
+
+	// an open circuit buffers without calling the recovered server
+	ss.setFail(false)
+	if err := send(circuitThreshold); err == nil {
+		t.Fatal("expected open circuit to refuse sending")
+	}
+	if got := len(ss.metrics()); got != 0 {
+		t.Fatalf("open circuit sent %d metrics", got)
+	}
+	if dc.pending.len() != circuitThreshold+1 {
+		t.Fatalf("got %d buffered metrics, want %d", dc.pending.len(), circuitThreshold+1)
+	}
+
+	// a failed trial after the cooldown opens the circuit again right away
+	time.Sleep(cooldown)
+	ss.setFail(true)
+	if err := send(circuitThreshold + 1); err == nil {
+		t.Fatal("expected failing status server to fail")
+	}
+	expect(circuitOpen)
+
+	// a successful trial closes it and delivers everything buffered
+	time.Sleep(cooldown)
+	ss.setFail(false)
+	if err := send(circuitThreshold + 2); err != nil {
+		t.Fatal(err)
+	}
+	expect(circuitClosed)
+	if got := len(ss.metrics()); got != circuitThreshold+3 {
+		t.Fatalf("status server received %d metrics, want %d", got, circuitThreshold+3)
+	}
+}
+
+func TestCircuitBreakerResetsOnSuccess(t *testing.T) {
+	var b circuitBreaker
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		// failures in between successes never add up to the threshold
+		if i%circuitThreshold == circuitThreshold-1 {
+			b.record(nil, now)
+		} else {
+			b.record(context.DeadlineExceeded, now)
+		}
+		if !b.allow(now) {
+			t.Fatalf("circuit opened after %d heartbeats without %d failures in a row", i+1, circuitThreshold)
+		}
+	}
+	if b.state != circuitClosed {
+		t.Fatalf("circuit is %s, want closed", b.state)
+	}
+}
+
+func TestSendDataNowThroughOpenCircuit(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	defer dc.closeConn()
+	send := func(i int) error {
+		return dc.send(context.Background(), testMetrics(i), &backoff.StopBackOff{})
+	}
+
+	// the default cooldown keeps the scheduled heartbeats buffered for an hour
+	ss.setFail(true)
+	for i := 0; i < circuitThreshold; i++ {
+		if err := send(i); err == nil {
+			t.Fatal("expected the send to fail")
+		}
+	}
+	if err := send(circuitThreshold); err == nil || dc.circuit.state != circuitOpen {
+		t.Fatalf("got %v with the circuit %s, want it open", err, dc.circuit.state)
+	}
+	if got := len(ss.metrics()); got != 0 || dc.pending.len() != circuitThreshold+1 {
+		t.Fatalf("got %d received and %d buffered, want 0 and %d", got, dc.pending.len(), circuitThreshold+1)
+	}
+
+	// a failed trial opens the circuit again
+	a := GetAgent(dc.node)
+	if err := a.SendDataNow(); err == nil || dc.circuit.state != circuitOpen {
+		t.Fatalf("got %v with the circuit %s, want the trial to fail", err, dc.circuit.state)
+	}
+
+	// a trial on demand delivers the buffered heartbeats in order
+	ss.setFail(false)
+	if err := a.SendDataNow(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.circuit.state != circuitClosed || dc.pending.len() != 0 {
+		t.Fatalf("circuit is %s with %d buffered, want closed and none", dc.circuit.state, dc.pending.len())
+	}
+	got := ss.metrics()
+	if len(got) != circuitThreshold+3 {
+		t.Fatalf("status server received %d heartbeats, want %d", len(got), circuitThreshold+3)
+	}
+	for i := 0; i <= circuitThreshold; i++ {
+		if want := string(testMetrics(i).Payload); string(got[i].Payload) != want {
+			t.Errorf("heartbeat %d has payload %q, want %q", i, got[i].Payload, want)
+		}
+	}
+}
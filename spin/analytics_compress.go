@@ -0,0 +1,87 @@
+package spin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// gRPC metadata key listing the encoding of every payload sent in a call, in order
+	payloadEncodingKey = "btfs-payload-encoding"
+	gzipEncoding       = "gzip"
+	identityEncoding   = "identity"
+)
+
+// gzipMagic starts every gzip stream. A serialized PayLoadInfo never starts with
+// it, 0x1f would be field 3 with the invalid wire type 7.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// compressionEnabled reports whether payloads are gzipped before signing.
+func (dc *dcWrap) compressionEnabled() bool {
+	return configBool(dc.node.Repo, compressPayloadKey, false)
+}
+
+// compressPayload gzips payload, returning it unchanged if that does not make it
+// smaller, as happens with small payloads.
+func compressPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, fmt.Errorf("failed to compress analytics payload: %s", err.Error())
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress analytics payload: %s", err.Error())
+	}
+	if buf.Len() >= len(payload) {
+		return payload, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// isCompressed reports whether payload was gzipped by compressPayload.
+func isCompressed(payload []byte) bool {
+	return bytes.HasPrefix(payload, gzipMagic)
+}
+
+// decompressPayload returns the serialized PayLoadInfo of a payload, gzipped or not.
+func decompressPayload(payload []byte) ([]byte, error) {
+	if !isCompressed(payload) {
+		return payload, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress analytics payload: %s", err.Error())
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress analytics payload: %s", err.Error())
+	}
+	return b, nil
+}
+
+// withPayloadEncoding adds the encoding of each of sms to the outgoing metadata of
+// ctx. Calls without compressed payloads are left as they were, so servers that
+// predate compression see no difference.
+func withPayloadEncoding(ctx context.Context, sms ...*pb.SignedMetrics) context.Context {
+	encodings := make([]string, 0, 2*len(sms))
+	compressed := false
+	for _, sm := range sms {
+		enc := identityEncoding
+		if isCompressed(sm.Payload) {
+			enc, compressed = gzipEncoding, true
+		}
+		encodings = append(encodings, payloadEncodingKey, enc)
+	}
+	if !compressed {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, encodings...)
+}
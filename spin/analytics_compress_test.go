@@ -0,0 +1,134 @@
+package spin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// testPayload returns a serialized payload like the one of a node with peers discovery nodes
+func testPayload(t testing.TB, peers int) []byte {
+	info := &nodepb.PayLoadInfo{
+		NodeId: "16Uiu2HAmGziL6oze6vrrUQBKhnnW8mxS85R2u8UFcP6F5RiHMrsd",
+		Node: &nodepb.Node{
+			NodeId:      "16Uiu2HAmGziL6oze6vrrUQBKhnnW8mxS85R2u8UFcP6F5RiHMrsd",
+			BtfsVersion: "1.5.0",
+			OsType:      "linux",
+			ArchType:    "amd64",
+			CpuInfo:     "Intel(R) Xeon(R) CPU E5-2686 v4 @ 2.30GHz",
+			UpTime:      86400,
+			TimeCreated: time.Unix(1600000000, 0),
+		},
+		LastTime: time.Unix(1600086400, 0),
+	}
+	for i := 0; i < peers; i++ {
+		info.DiscoveryNodes = append(info.DiscoveryNodes, &nodepb.DiscoveryNode{
+			// hex of a hash is about as incompressible as a real base58 peer id
+			ToNodeId:           fmt.Sprintf("16Uiu2HAm%.44x", sha256.Sum256([]byte{byte(i), byte(i >> 8)})),
+			NodeConnectLatency: int32(20 + i%180),
+		})
+	}
+	b, err := proto.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCompressPayloadRoundTrip(t *testing.T) {
+	payload := testPayload(t, 50)
+	compressed, err := compressPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isCompressed(compressed) || len(compressed) >= len(payload) {
+		t.Fatalf("payload of %d bytes compressed to %d", len(payload), len(compressed))
+	}
+	got, err := decompressPayload(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("decompressed payload differs from the original")
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(got, info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.DiscoveryNodes) != 50 {
+		t.Errorf("got %d discovery nodes, want 50", len(info.DiscoveryNodes))
+	}
+}
+
+func TestCompressPayloadSmall(t *testing.T) {
+	payload := []byte{0x0a, 0x01, 'a'}
+	got, err := compressPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) || isCompressed(got) {
+		t.Fatalf("small payload was not kept uncompressed: %x", got)
+	}
+	if got, err := decompressPayload(payload); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("uncompressed payload changed to %x (%v)", got, err)
+	}
+}
+
+func TestSendCompressedPayloadEncoding(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+		statusServerDomains: []string{addr},
+		pending:             newMetricsBuffer(defaultBufferSize),
+	}
+	defer dc.closeConn()
+
+	compressed, err := compressPayload(testPayload(t, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.doSendData(context.Background(), &pb.SignedMetrics{Payload: compressed}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.doSendData(context.Background(), testMetrics(0)); err != nil {
+		t.Fatal(err)
+	}
+	// buffered heartbeats are batched, with one encoding per payload
+	dc.pending.push(testMetrics(1))
+	dc.pending.push(&pb.SignedMetrics{Payload: compressed})
+	if err := dc.flushPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{gzipEncoding}, nil, {identityEncoding, gzipEncoding}}
+	if got := ss.metadata(payloadEncodingKey); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got payload encodings %q, want %q", got, want)
+	}
+}
+
+func BenchmarkCompressPayload(b *testing.B) {
+	for _, peers := range []int{0, 10, 100, 1000} {
+		payload := testPayload(b, peers)
+		b.Run(fmt.Sprintf("peers=%d", peers), func(b *testing.B) {
+			var compressed []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if compressed, err = compressPayload(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(payload)), "raw-bytes")
+			b.ReportMetric(float64(len(compressed)), "sent-bytes")
+		})
+	}
+}
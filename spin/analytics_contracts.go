@@ -0,0 +1,48 @@
+package spin
+
+import (
+	"fmt"
+
+	"github.com/TRON-US/go-btfs/core"
+	"github.com/TRON-US/go-btfs/core/commands/storage/contracts"
+	"github.com/TRON-US/go-btfs/core/commands/storage/helper"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+)
+
+// contractStore is implemented by hostContractStore, and by fakes in tests
+type contractStore interface {
+	// HostContracts returns the contracts the node hosts
+	HostContracts() ([]*nodepb.Contracts_Contract, error)
+}
+
+// hostContractStore reads the host contracts synced into the repo by Contracts
+type hostContractStore struct {
+	node *core.IpfsNode
+}
+
+func (s hostContractStore) HostContracts() ([]*nodepb.Contracts_Contract, error) {
+	return contracts.ListContracts(s.node.Repo.Datastore(), s.node.Identity.Pretty(),
+		nodepb.ContractStat_HOST.String())
+}
+
+// updateContracts counts the active host contracts and the bytes of the shards
+// they store, if the node is a storage host.
+func (dc *dcWrap) updateContracts() error {
+	if dc.contracts == nil {
+		return nil
+	}
+	cs, err := dc.contracts.HostContracts()
+	if err != nil {
+		return fmt.Errorf("failed to list host contracts: %s", err.Error())
+	}
+	var n, size uint64
+	for _, c := range cs {
+		if helper.ContractFilterMap["active"][c.Status] {
+			n++
+			size += uint64(c.ShardSize)
+		}
+	}
+	dc.extra.ActiveContracts, dc.extra.TotalContractBytes = n, size
+	return nil
+}
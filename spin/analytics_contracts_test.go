@@ -0,0 +1,69 @@
+package spin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/core/commands/storage/contracts"
+	unixtest "github.com/TRON-US/go-btfs/core/coreunix/test"
+
+	guardpb "github.com/tron-us/go-btfs-common/protos/guard"
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+)
+
+// testContracts is a contract store holding fixed contracts
+type testContracts struct {
+	cs  []*nodepb.Contracts_Contract
+	err error
+}
+
+func (s *testContracts) HostContracts() ([]*nodepb.Contracts_Contract, error) {
+	return s.cs, s.err
+}
+
+func TestUpdateContracts(t *testing.T) {
+	dc := &dcWrap{}
+	if err := dc.updateContracts(); err != nil || dc.extra.ActiveContracts != 0 {
+		t.Fatalf("got %d active contracts, %v without being a storage host", dc.extra.ActiveContracts, err)
+	}
+
+	store := &testContracts{cs: []*nodepb.Contracts_Contract{
+		{Status: guardpb.Contract_UPLOADED, ShardSize: 1000},
+		{Status: guardpb.Contract_RENEWED, ShardSize: 2000},
+		{Status: guardpb.Contract_WARN, ShardSize: 300},
+		{Status: guardpb.Contract_CLOSED, ShardSize: 40000},
+		{Status: guardpb.Contract_DRAFT, ShardSize: 500000},
+	}}
+	dc.contracts = store
+	if err := dc.updateContracts(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.ActiveContracts != 3 || dc.extra.TotalContractBytes != 3300 {
+		t.Fatalf("got %d active contracts of %d bytes, want 3 of 3300",
+			dc.extra.ActiveContracts, dc.extra.TotalContractBytes)
+	}
+
+	store.err = errors.New("datastore closed")
+	if err := dc.updateContracts(); err == nil {
+		t.Fatal("expected failing contract store to be reported")
+	}
+}
+
+func TestHostContractStore(t *testing.T) {
+	node := unixtest.HelpTestMockRepo(t, nil)
+	id := node.Identity.Pretty()
+	if err := contracts.Save(node.Repo.Datastore(), []*nodepb.Contracts_Contract{
+		{ContractId: "a", HostId: id, Status: guardpb.Contract_UPLOADED, ShardSize: 10},
+		{ContractId: "b", HostId: id, Status: guardpb.Contract_CLOSED, ShardSize: 20},
+	}, nodepb.ContractStat_HOST.String()); err != nil {
+		t.Fatal(err)
+	}
+	dc := &dcWrap{contracts: hostContractStore{node}}
+	if err := dc.updateContracts(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.ActiveContracts != 1 || dc.extra.TotalContractBytes != 10 {
+		t.Fatalf("got %d active contracts of %d bytes, want 1 of 10",
+			dc.extra.ActiveContracts, dc.extra.TotalContractBytes)
+	}
+}
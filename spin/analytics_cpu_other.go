@@ -0,0 +1,8 @@
+// +build !windows
+
+package spin
+
+// processorIdentifier has no fallback outside of Windows.
+func processorIdentifier() string {
+	return ""
+}
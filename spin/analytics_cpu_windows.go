@@ -0,0 +1,11 @@
+// +build windows
+
+package spin
+
+import "os"
+
+// processorIdentifier describes the CPU when gopsutil cannot, as set by Windows for
+// every process.
+func processorIdentifier() string {
+	return os.Getenv("PROCESSOR_IDENTIFIER")
+}
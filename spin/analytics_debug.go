@@ -0,0 +1,149 @@
+package spin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+)
+
+// AnalyticsHandler serves the latest analytics collected for node as JSON. It is
+// meant for the local API mux so operators can inspect exactly what is reported to
+// the status server.
+func AnalyticsHandler(node *core.IpfsNode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dc, ok := getDcWrap(node)
+		if !ok {
+			http.Error(w, "analytics is not running", http.StatusServiceUnavailable)
+			return
+		}
+		dc.serveHTTP(w, r)
+	})
+}
+
+func (dc *dcWrap) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dc.localReport()); err != nil {
+		log.Errorf("Failed to encode analytics: %s", err)
+	}
+}
+
+// localReport returns the report of the latest update, or what is known of the node
+// before the first one. The local views never update the analytics themselves, as
+// that would move the baselines the next heartbeat's epoch deltas are taken from.
+// The caller must hold mu, reading is enough.
+func (dc *dcWrap) localReport() *dcReport {
+	if dc.collected != nil {
+		return dc.collected
+	}
+	return &dcReport{Node: dc.pn, extraMetrics: dc.extra}
+}
+
+// streamInterval is the longest an analytics stream goes without sending anything,
+// so proxies do not drop idle streams between heartbeats
+const streamInterval = 5 * time.Second
+
+// AnalyticsStreamHandler streams the analytics collected for node to local dashboards
+// as server-sent events. The stream starts with the report AnalyticsHandler serves
+// and sends it again after every update. A comment keeps it alive if no update
+// happened for streamInterval.
+func AnalyticsStreamHandler(node *core.IpfsNode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dc, ok := getDcWrap(node)
+		if !ok {
+			http.Error(w, "analytics is not running", http.StatusServiceUnavailable)
+			return
+		}
+		dc.serveStream(w, r, streamInterval)
+	})
+}
+
+func (dc *dcWrap) serveStream(w http.ResponseWriter, r *http.Request, interval time.Duration) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events := dc.subscribe()
+	defer dc.unsubscribe(events)
+	dc.mu.RLock()
+	data, err := json.Marshal(dc.localReport())
+	dc.mu.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(event string) bool {
+		if _, err := io.WriteString(w, event); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if !write("data: " + string(data) + "\n\n") {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if !write(": keepalive\n\n") {
+				return
+			}
+		case data := <-events:
+			if !write("data: " + string(data) + "\n\n") {
+				return
+			}
+		}
+	}
+}
+
+// subscribe returns a channel getting the JSON report of every update. An update
+// is dropped for a stream that has not taken the previous one yet.
+func (dc *dcWrap) subscribe() chan []byte {
+	ch := make(chan []byte, 1)
+	dc.streamsMu.Lock()
+	defer dc.streamsMu.Unlock()
+	if dc.streams == nil {
+		dc.streams = make(map[chan []byte]struct{})
+	}
+	dc.streams[ch] = struct{}{}
+	return ch
+}
+
+func (dc *dcWrap) unsubscribe(ch chan []byte) {
+	dc.streamsMu.Lock()
+	defer dc.streamsMu.Unlock()
+	delete(dc.streams, ch)
+}
+
+// publishUpdate sends the collected analytics to the streams. The caller must hold mu.
+func (dc *dcWrap) publishUpdate() {
+	dc.streamsMu.Lock()
+	defer dc.streamsMu.Unlock()
+	if len(dc.streams) == 0 {
+		return
+	}
+	data, err := json.Marshal(dc.collected)
+	if err != nil {
+		log.Errorf("Failed to encode analytics: %s", err)
+		return
+	}
+	for ch := range dc.streams {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
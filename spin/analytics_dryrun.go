@@ -0,0 +1,48 @@
+package spin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// dryRun reports whether heartbeats are written out locally instead of sent.
+func (dc *dcWrap) dryRun() bool {
+	return configBool(dc.node.Repo, dryRunKey, false)
+}
+
+// writeDryRun logs the payload of sm as JSON, or appends it as a line to the file at
+// Analytics.DryRunOutputPath if set.
+func (dc *dcWrap) writeDryRun(sm *pb.SignedMetrics) error {
+	payload, err := decompressPayload(sm.Payload)
+	if err != nil {
+		return err
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(payload, info); err != nil {
+		return fmt.Errorf("failed to unmarshal analytics payload: %s", err.Error())
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode analytics payload: %s", err.Error())
+	}
+	path := configString(dc.node.Repo, dryRunOutputPathKey, "")
+	if path == "" {
+		log.Infow("analytics dry run", "epoch", dc.epoch, "payload", string(b))
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open analytics dry run output: %s", err.Error())
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write analytics dry run output: %s", err.Error())
+	}
+	return f.Close()
+}
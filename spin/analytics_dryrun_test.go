@@ -0,0 +1,72 @@
+package spin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/core/coreapi"
+	"github.com/TRON-US/go-btfs/repo"
+
+	"github.com/cenkalti/backoff/v4"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+func TestSendDataDryRun(t *testing.T) {
+	dc := newTestDcWrap(t)
+	out := filepath.Join(t.TempDir(), "analytics.jsonl")
+	dc.node.Repo = &testRepo{Mock: dc.node.Repo.(*repo.Mock), keys: map[string]interface{}{
+		dryRunKey:           true,
+		dryRunOutputPathKey: out,
+	}}
+	api, err := coreapi.NewCoreAPI(dc.node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.api = api
+	if dc.node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	dc.pending = newMetricsBuffer(defaultBufferSize)
+
+	// no status server is configured, so anything but a dry run fails
+	for i := 0; i < 2; i++ {
+		if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+		var payload struct {
+			NodeID string `json:"node_id"`
+			Node   struct {
+				Settings struct {
+					StoragePriceAsk uint64 `json:"storage_price_ask"`
+				} `json:"settings"`
+			} `json:"node"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.NodeID != dc.pn.NodeId || payload.Node.Settings.StoragePriceAsk != 125 {
+			t.Errorf("unexpected dry run payload %s", scanner.Text())
+		}
+	}
+	if lines != 2 {
+		t.Fatalf("got %d dry run payloads, want 2", lines)
+	}
+	if dc.pending.len() != 0 {
+		t.Fatalf("%d heartbeats left in buffer", dc.pending.len())
+	}
+}
@@ -0,0 +1,154 @@
+package spin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"google.golang.org/grpc/metadata"
+)
+
+// gRPC metadata key marking the heartbeats sent when the agent starts and stops,
+// so the status server can tell a clean restart from a crash, and the alerts sent
+// out of band
+const eventTypeKey = "btfs-event-type"
+
+const (
+	// carried by the first heartbeat delivered after the agent started
+	eventStart = "START"
+	// carried by the final heartbeat sent when the agent is stopped
+	eventStop = "STOP"
+	// the alert sent out of band when the connected peers change by more than
+	// Analytics.PeerChangeThreshold between updates
+	eventPeerChange = "PEER_CHANGE"
+)
+
+// gRPC metadata keys of a peer change alert: the change in connected peers, negative
+// when they fell, and its direction, peerRise or peerFall
+const (
+	peerDeltaKey     = "btfs-peer-delta"
+	peerDirectionKey = "btfs-peer-direction"
+
+	peerRise = "rise"
+	peerFall = "fall"
+)
+
+// stopEventTimeout bounds the whole stop path, so an unreachable status server
+// does not hold up shutting down the node
+const stopEventTimeout = callTimeout
+
+// withEvent adds the lifecycle event to the outgoing metadata of ctx until the
+// heartbeat carrying it is delivered. An alert sent out of band carries its own.
+func (dc *dcWrap) withEvent(ctx context.Context) context.Context {
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(eventTypeKey)) != 0 {
+		return ctx
+	}
+	dc.mu.RLock()
+	event := dc.extra.EventType
+	dc.mu.RUnlock()
+	if event == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, eventTypeKey, event)
+}
+
+// sendStopEvent sends a final heartbeat with the analytics as of the last update,
+// without retrying it, if analytics is enabled.
+func (dc *dcWrap) sendStopEvent() {
+	if !dc.analyticsEnabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopEventTimeout)
+	defer cancel()
+	if err := dc.sendStopData(ctx); err != nil {
+		log.Warnf("Failed to report that analytics stopped: %s", err)
+	}
+}
+
+// sendStopData sends the analytics collected so far, without the discovery nodes.
+// Updating them or listing the swarm peers could take minutes, so nothing but the
+// delivery has to fit in ctx.
+func (dc *dcWrap) sendStopData(ctx context.Context) error {
+	dc.sendMu.Lock()
+	defer dc.sendMu.Unlock()
+	dc.mu.Lock()
+	dc.extra.EventType = eventStop
+	pn := clonePayload(dc.pn)
+	var (
+		payload []byte
+		err     error
+	)
+	addr := dc.aggregator()
+	if addr == "" {
+		payload, err = dc.marshalBoundedPayload(dc.node.Identity.Pretty(), pn, &dc.extra, nil, time.Now())
+	}
+	dc.prepare(pn)
+	dc.mu.Unlock()
+	if addr != "" {
+		return dc.deliverWorkerReport(ctx, addr, &workerReport{Node: pn}, &backoff.StopBackOff{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal dataCollection object to a byte array: %s", err.Error())
+	}
+	sm, err := dc.signPayload(payload)
+	if err != nil {
+		return err
+	}
+	dc.epoch++
+	return dc.send(ctx, sm, &backoff.StopBackOff{})
+}
+
+// sendPeerAlert sends the analytics collected so far right away, apart from the
+// heartbeats, as a peer change alert for the given change in connected peers, if
+// analytics is enabled. It does not wait for the alert to be delivered, nor retry
+// it. The alert takes sendMu like the heartbeats, and is dropped while the circuit
+// is open or heartbeats are buffered, as the status server is not taking them. How
+// it went counts towards the circuit, but it neither is buffered nor starts an
+// epoch. The caller must hold mu.
+func (dc *dcWrap) sendPeerAlert(delta int64) {
+	if !dc.analyticsEnabled() {
+		return
+	}
+	extra := dc.extra
+	extra.EventType = eventPeerChange
+	payload, err := dc.marshalPayload(dc.node.Identity.Pretty(), dc.pn, &extra, nil, time.Now())
+	if err != nil {
+		log.Warnf("Failed to report the change in connected peers: %s", err)
+		return
+	}
+	direction := peerRise
+	if delta < 0 {
+		direction = peerFall
+	}
+	go func() {
+		if err := dc.sendAlert(payload, delta, direction); err != nil {
+			log.Warnf("Failed to report the change in connected peers: %s", err)
+		}
+	}()
+}
+
+// sendAlert signs and sends the peer change alert payload, see sendPeerAlert.
+func (dc *dcWrap) sendAlert(payload []byte, delta int64, direction string) error {
+	sm, err := dc.signPayload(payload)
+	if err != nil {
+		return err
+	}
+	dc.sendMu.Lock()
+	defer dc.sendMu.Unlock()
+	if !dc.circuit.allow(time.Now()) {
+		return fmt.Errorf("status server circuit is open until %s, alert dropped",
+			dc.circuit.openUntil().Format(time.RFC3339))
+	}
+	if dc.pending != nil && dc.pending.len() > 0 {
+		return fmt.Errorf("%d heartbeats not delivered yet, alert dropped", dc.pending.len())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, eventTypeKey, eventPeerChange,
+		peerDeltaKey, strconv.FormatInt(delta, 10), peerDirectionKey, direction)
+	err = dc.doSendData(ctx, sm)
+	dc.circuit.record(err, time.Now())
+	return err
+}
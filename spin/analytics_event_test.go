@@ -0,0 +1,176 @@
+package spin
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitMetrics waits until ss received n metrics.
+func waitMetrics(t *testing.T, ss *testStatusServer, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); len(ss.metrics()) < n; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("status server received %d metrics, want %d", len(ss.metrics()), n)
+		}
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	dc.extra.EventType = eventStart
+	ctx, cancel := context.WithCancel(context.Background())
+	a := dc.start(ctx)
+	defer a.Stop()
+	waitMetrics(t, ss, 1)
+	if got, want := ss.metadata(eventTypeKey), [][]string{{eventStart}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+
+	// the stop event is delivered before the agent exits
+	cancel()
+	select {
+	case <-a.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	if got, want := ss.metadata(eventTypeKey), [][]string{{eventStart}, {eventStop}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	if len(ss.metrics()) != 2 {
+		t.Fatalf("status server received %d metrics, want 2", len(ss.metrics()))
+	}
+	if dc.extra.EventType != "" {
+		t.Fatalf("event %s still pending after it was delivered", dc.extra.EventType)
+	}
+}
+
+func TestStopWaitsForStopEvent(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	dc.extra.EventType = eventStart
+	a := dc.start(context.Background())
+	waitMetrics(t, ss, 1)
+	ss.setDelay(200 * time.Millisecond)
+	a.Stop()
+	if got := ss.metadata(eventTypeKey); len(got) != 2 || !reflect.DeepEqual(got[1], []string{eventStop}) {
+		t.Fatalf("Stop returned before the stop event was delivered, got events %q", got)
+	}
+
+	// nothing is reported while analytics is disabled. The start heartbeat goes out
+	// again with the stop event if Stop cancelled it before the server's answer came.
+	sent := len(ss.metrics())
+	dc = newTestSendingDcWrap(t, addr)
+	dc.node.Repo.(*testRepo).C.Experimental.Analytics = false
+	dc.start(context.Background()).Stop()
+	if n := len(ss.metrics()); n != sent {
+		t.Fatalf("disabled agent sent %d metrics", n-sent)
+	}
+}
+
+func TestStopEventSkipsCollection(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	// listing the swarm peers never finishes
+	api := &slowSwarmAPI{listing: make(chan struct{}), release: make(chan struct{})}
+	defer close(api.release)
+	dc.api = api
+
+	stopped := make(chan struct{})
+	go func() {
+		dc.sendStopEvent()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop event waited for the swarm peers")
+	}
+	if got, want := ss.metadata(eventTypeKey), [][]string{{eventStop}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+	if dc.extra.EventType != "" {
+		t.Fatalf("event %s still pending after it was delivered", dc.extra.EventType)
+	}
+}
+
+func TestPeerChangeAlert(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{peerChangeThresholdKey: float64(10)}
+	dc.extra.EventType = eventStart
+
+	dc.mu.Lock()
+	for _, peers := range []uint64{30, 35, 5} {
+		dc.pn.PeersConnected = peers
+		dc.updatePeerChange()
+	}
+	dc.mu.Unlock()
+	waitMetrics(t, ss, 1)
+	for key, want := range map[string][]string{
+		eventTypeKey:     {eventPeerChange},
+		peerDeltaKey:     {"-30"},
+		peerDirectionKey: {peerFall},
+	} {
+		if got := ss.metadata(key); !reflect.DeepEqual(got, [][]string{want}) {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+	// the alert is not a heartbeat, the event pending stays for the next one
+	if dc.extra.EventType != eventStart || dc.pending.len() != 0 {
+		t.Fatalf("alert took the place of a heartbeat, got event %q and %d pending", dc.extra.EventType, dc.pending.len())
+	}
+}
+
+func TestPeerChangeAlertGoesThroughSendMu(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	defer dc.closeConn()
+	payload := testMetrics(0).Payload
+
+	// it waits for the heartbeat being sent
+	dc.sendMu.Lock()
+	done := make(chan error, 1)
+	go func() { done <- dc.sendAlert(payload, 20, peerRise) }()
+	time.Sleep(50 * time.Millisecond)
+	if got := len(ss.metrics()); got != 0 {
+		dc.sendMu.Unlock()
+		t.Fatalf("alert sent while a heartbeat held sendMu, got %d metrics", got)
+	}
+	dc.sendMu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// a failure counts towards the circuit
+	ss.setFail(true)
+	if err := dc.sendAlert(payload, 20, peerRise); err == nil {
+		t.Fatal("expected the alert to fail")
+	}
+	if dc.circuit.failures != 1 {
+		t.Fatalf("got %d failures on the circuit, want 1", dc.circuit.failures)
+	}
+	ss.setFail(false)
+
+	// buffered heartbeats go first, the alert is dropped
+	dc.pending.push(testMetrics(1))
+	if err := dc.sendAlert(payload, 20, peerRise); err == nil {
+		t.Fatal("expected the alert to be dropped while heartbeats are buffered")
+	}
+	dc.pending.pop()
+
+	// and so while the circuit is open
+	now := time.Now()
+	for i := 0; i < circuitThreshold; i++ {
+		dc.circuit.record(errors.New("down"), now)
+	}
+	if err := dc.sendAlert(payload, 20, peerRise); err == nil {
+		t.Fatal("expected the alert to be dropped while the circuit is open")
+	}
+	if got := len(ss.metrics()); got != 1 {
+		t.Fatalf("status server received %d alerts, want 1", got)
+	}
+}
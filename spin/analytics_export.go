@@ -0,0 +1,154 @@
+package spin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultExportMaxSize is the size in bytes past which the local export is rotated
+const defaultExportMaxSize = 10 << 20
+
+// exportCSV appends report as a row to the CSV file at Analytics.LocalExportPath,
+// if set. A new file starts with a header. A file reaching
+// Analytics.LocalExportMaxSize, or written with other columns by another version,
+// is moved to the same path with .1 appended.
+func (dc *dcWrap) exportCSV(report *dcReport) error {
+	path := configString(dc.node.Repo, localExportPathKey, "")
+	if path == "" {
+		return nil
+	}
+	header, row := csvRecord(report)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(row)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to encode analytics export: %s", err.Error())
+	}
+
+	maxSize := int64(configInt(dc.node.Repo, localExportMaxSizeKey, defaultExportMaxSize))
+	if st, err := os.Stat(path); err == nil && st.Size() > 0 {
+		same, err := hasCSVHeader(path, header)
+		if err != nil {
+			return err
+		}
+		if !same || st.Size()+int64(buf.Len()) > maxSize {
+			if err := os.Rename(path, path+".1"); err != nil {
+				return fmt.Errorf("failed to rotate analytics export: %s", err.Error())
+			}
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open analytics export: %s", err.Error())
+	}
+	if st, err := f.Stat(); err == nil && st.Size() == 0 {
+		hw := csv.NewWriter(f)
+		hw.Write(header)
+		if hw.Flush(); hw.Error() != nil {
+			f.Close()
+			return fmt.Errorf("failed to write analytics export: %s", hw.Error().Error())
+		}
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write analytics export: %s", err.Error())
+	}
+	return f.Close()
+}
+
+// hasCSVHeader reports whether the first record of the CSV file at path is header.
+func hasCSVHeader(path string, header []string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open analytics export: %s", err.Error())
+	}
+	defer f.Close()
+	got, err := csv.NewReader(bufio.NewReader(f)).Read()
+	if err != nil {
+		// not a CSV file this wrote, rotate it out of the way
+		return false, nil
+	}
+	return reflect.DeepEqual(got, header), nil
+}
+
+// csvRecord returns the column names and values of report, one per JSON field.
+// Nested objects such as the settings are flattened into settings.field columns,
+// lists and maps are written as JSON.
+func csvRecord(report *dcReport) (header, row []string) {
+	walkCSVFields(reflect.ValueOf(report).Elem(), "", func(name string, v reflect.Value) {
+		header = append(header, name)
+		row = append(row, csvValue(v))
+	})
+	return header, row
+}
+
+func walkCSVFields(v reflect.Value, prefix string, f func(string, reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				// keep the columns of a missing struct
+				fv = reflect.Zero(fv.Type().Elem())
+			} else {
+				fv = fv.Elem()
+			}
+		}
+		isStruct := fv.Kind() == reflect.Struct && fv.Type() != reflect.TypeOf(time.Time{})
+		switch {
+		case sf.Anonymous && name == "" && isStruct:
+			walkCSVFields(fv, prefix, f)
+		case isStruct:
+			walkCSVFields(fv, prefix+name+".", f)
+		default:
+			if name == "" {
+				name = sf.Name
+			}
+			f(prefix+name, fv)
+		}
+	}
+}
+
+func csvValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			return ""
+		}
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.UTC().Format(time.RFC3339)
+	}
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
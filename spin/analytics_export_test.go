@@ -0,0 +1,100 @@
+package spin
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// readCSV returns the records of the CSV file at path.
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestExportCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.csv")
+	dc := newTestSendingDcWrap(t, "")
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{localExportPathKey: path}
+	for i := 0; i < 3; i++ {
+		if _, _, err := dc.doPrepData(dc.node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := readCSV(t, path)
+	if len(records) != 4 {
+		t.Fatalf("got %d lines, want a header and 3 rows", len(records))
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, name := range []string{"node_id", "btfs_version", "up_time", "settings.storage_price_ask",
+		"time_created", "goroutines", "block_count", "status_server_latency.under_100ms"} {
+		if _, ok := columns[name]; !ok {
+			t.Errorf("missing column %q in %q", name, records[0])
+		}
+	}
+	for _, row := range records[1:] {
+		if len(row) != len(records[0]) {
+			t.Fatalf("got %d values for %d columns", len(row), len(records[0]))
+		}
+		if got := row[columns["node_id"]]; got != dc.node.Identity.Pretty() {
+			t.Errorf("got node id %q, want %q", got, dc.node.Identity.Pretty())
+		}
+		if got := row[columns["settings.storage_price_ask"]]; got != "125" {
+			t.Errorf("got storage price ask %q, want 125", got)
+		}
+		if n, err := strconv.ParseUint(row[columns["goroutines"]], 10, 64); err != nil || n == 0 {
+			t.Errorf("got goroutines %q, want a count", row[columns["goroutines"]])
+		}
+	}
+}
+
+func TestExportCSVRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.csv")
+	dc := newTestSendingDcWrap(t, "")
+	r := dc.node.Repo.(*testRepo)
+
+	// a file from another version is moved away rather than mixed with new columns
+	if err := ioutil.WriteFile(path, []byte("old,columns\n1,2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r.keys = map[string]interface{}{localExportPathKey: path}
+	if err := dc.exportCSV(&dcReport{Node: dc.pn, extraMetrics: dc.extra}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCSV(t, path+".1"); len(got) != 2 || got[0][0] != "old" {
+		t.Fatalf("old export not rotated, got %q", got)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// room for the header and a single row
+	r.keys[localExportMaxSizeKey] = float64(st.Size() + 1)
+	for i := 0; i < 3; i++ {
+		if err := dc.exportCSV(&dcReport{Node: dc.pn, extraMetrics: dc.extra}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{path, path + ".1"} {
+		if got := readCSV(t, p); len(got) != 2 {
+			t.Errorf("got %d lines in %s, want a header and a row", len(got), p)
+		}
+	}
+}
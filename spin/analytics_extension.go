@@ -0,0 +1,80 @@
+package spin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// extraMetricsField is the PayLoadInfo field number the extra metrics are signed
+// and sent under, as the JSON the local analytics endpoints serve. node.proto has no
+// such field, so status servers built from go-btfs-common skip it as an unknown
+// field, and those that know about it read it with decodeExtraMetrics.
+const extraMetricsField = 100
+
+// encodeExtraMetrics returns extra encoded as the PayLoadInfo field extraMetricsField.
+func encodeExtraMetrics(extra *extraMetrics) ([]byte, error) {
+	b, err := json.Marshal(extra)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode extra metrics: %s", err)
+	}
+	buf := proto.NewBuffer(nil)
+	if err := buf.EncodeVarint(uint64(extraMetricsField)<<3 | proto.WireBytes); err != nil {
+		return nil, err
+	}
+	if err := buf.EncodeRawBytes(b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeExtraMetrics reads the extra metrics from the unknown fields of payload. ok
+// is false if it has none.
+func decodeExtraMetrics(payload *nodepb.PayLoadInfo) (extra *extraMetrics, ok bool, err error) {
+	b := payload.XXX_unrecognized
+	for len(b) > 0 {
+		key, n := proto.DecodeVarint(b)
+		if n == 0 {
+			return nil, false, fmt.Errorf("invalid payload field key")
+		}
+		b = b[n:]
+		field, wire := key>>3, key&7
+		var size uint64
+		switch wire {
+		case proto.WireVarint:
+			_, n = proto.DecodeVarint(b)
+			size = uint64(n)
+			if n == 0 {
+				return nil, false, fmt.Errorf("invalid varint in payload field %d", field)
+			}
+		case proto.WireFixed64:
+			size = 8
+		case proto.WireFixed32:
+			size = 4
+		case proto.WireBytes:
+			l, n := proto.DecodeVarint(b)
+			if n == 0 {
+				return nil, false, fmt.Errorf("invalid length of payload field %d", field)
+			}
+			b = b[n:]
+			size = l
+		default:
+			return nil, false, fmt.Errorf("unsupported wire type %d of payload field %d", wire, field)
+		}
+		if size > uint64(len(b)) {
+			return nil, false, fmt.Errorf("payload field %d is truncated", field)
+		}
+		if field == extraMetricsField && wire == proto.WireBytes {
+			extra = new(extraMetrics)
+			if err := json.Unmarshal(b[:size], extra); err != nil {
+				return nil, false, fmt.Errorf("invalid extra metrics: %s", err)
+			}
+			return extra, true, nil
+		}
+		b = b[size:]
+	}
+	return nil, false, nil
+}
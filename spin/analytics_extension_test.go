@@ -0,0 +1,81 @@
+package spin
+
+import (
+	"context"
+	"testing"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestExtraMetricsExtension(t *testing.T) {
+	ext, err := encodeExtraMetrics(&extraMetrics{Goroutines: 12, NodeGroup: "eu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a field of a later node.proto goes before the extension
+	other := proto.NewBuffer(nil)
+	other.EncodeVarint(99<<3 | proto.WireVarint)
+	other.EncodeVarint(7)
+	b, err := proto.Marshal(&nodepb.PayLoadInfo{
+		NodeId:           testNodeID,
+		XXX_unrecognized: append(other.Bytes(), ext...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(b, info); err != nil {
+		t.Fatal(err)
+	}
+	if info.NodeId != testNodeID {
+		t.Fatalf("extension broke the known fields: %+v", info)
+	}
+	extra, ok, err := decodeExtraMetrics(info)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if extra.Goroutines != 12 || extra.NodeGroup != "eu" {
+		t.Fatalf("got extra metrics %+v", extra)
+	}
+
+	if _, ok, err := decodeExtraMetrics(&nodepb.PayLoadInfo{NodeId: testNodeID}); ok || err != nil {
+		t.Fatalf("got %v, %v for a payload without the extension", ok, err)
+	}
+}
+
+func TestExtraMetricsSent(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	defer dc.closeConn()
+	dc.reportHealthAlert("status server unreachable")
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	got := ss.metrics()
+	if len(got) != 1 {
+		t.Fatalf("status server received %d metrics", len(got))
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(got[0].Payload, info); err != nil {
+		t.Fatal(err)
+	}
+	extra, ok, err := decodeExtraMetrics(info)
+	if err != nil || !ok {
+		t.Fatalf("payload has no extra metrics: %v, %v", ok, err)
+	}
+	want := dc.collected.extraMetrics
+	if extra.Goroutines == 0 || extra.Goroutines != want.Goroutines || extra.StackInUse != want.StackInUse {
+		t.Errorf("got goroutines %d and stack %d KiB, want %d and %d", extra.Goroutines, extra.StackInUse,
+			want.Goroutines, want.StackInUse)
+	}
+	if extra.HealthAlerts != 1 {
+		t.Errorf("got %d health alerts on the wire, want 1", extra.HealthAlerts)
+	}
+	if extra.EventType != want.EventType || extra.RepoVersion != want.RepoVersion {
+		t.Errorf("got event %q and repo version %d, want %q and %d", extra.EventType, extra.RepoVersion,
+			want.EventType, want.RepoVersion)
+	}
+}
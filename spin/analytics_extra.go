@@ -0,0 +1,986 @@
+package spin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
+	mfsr "github.com/TRON-US/go-btfs/repo/fsrepo/migrations"
+
+	config "github.com/TRON-US/go-btfs-config"
+	"github.com/tron-us/go-btfs-common/crypto"
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/alecthomas/units"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	_ "github.com/ipfs/go-merkledag" // decoders for dagSize
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+	psnet "github.com/shirou/gopsutil/v3/net"
+)
+
+// extraMetrics are analytics that node.proto has no field for yet. They are
+// collected on every update together with pn, served by the local analytics
+// endpoints and signed with the payload as the extension field extraMetricsField.
+type extraMetrics struct {
+	// KiB read from and written to disk during the last epoch
+	DiskRead  uint64 `json:"disk_read"`
+	DiskWrite uint64 `json:"disk_write"`
+	// KiB received and sent on the swarm interfaces during the last epoch,
+	// including libp2p and DHT traffic that bitswap does not see
+	NetIn  uint64 `json:"net_in"`
+	NetOut uint64 `json:"net_out"`
+	// average bytes per second sent and received by bitswap during the last epoch
+	UploadBPS   float64 `json:"upload_bps"`
+	DownloadBPS float64 `json:"download_bps"`
+	// KiB of memory and swap in use on the whole machine, swap is 0 where unavailable
+	SystemMemUsed uint64 `json:"system_mem_used"`
+	SwapUsed      uint64 `json:"swap_used"`
+	// KiB of the daemon's memory in goroutine stacks, and in heap spans holding no objects
+	StackInUse uint64 `json:"stack_in_use"`
+	HeapIdle   uint64 `json:"heap_idle"`
+	// total bytes sent on the maxProtocolStats protocols sending the most, such as bitswap and the DHT
+	ProtocolStats map[string]uint64 `json:"protocol_stats,omitempty"`
+	// goroutines running when the analytics were collected, to spot leaking builds
+	Goroutines uint64 `json:"goroutines"`
+	// file descriptors held by the daemon, to spot connection leaks, 0 where unsupported
+	OpenFDs uint64 `json:"open_fds"`
+	// GC cycles and their total pause in nanoseconds during the last epoch
+	GCPauseTotal uint64 `json:"gc_pause_total"`
+	GCCount      uint64 `json:"gc_count"`
+	// ids of the first maxPeerIDs bitswap peers, only if Analytics.IncludePeerList is set
+	PeerIDs []string `json:"peer_ids,omitempty"`
+	// active host contracts and the bytes of their shards, only on storage hosts
+	ActiveContracts    uint64 `json:"active_contracts"`
+	TotalContractBytes uint64 `json:"total_contract_bytes"`
+	// blocks in the repo, to compare with storage_used for deduplication
+	BlockCount uint64 `json:"block_count"`
+	// share of the blockstore reads the ARC and bloom filter caches answered since
+	// the daemon started, -1 if the blockstore is not cached
+	CacheHitRate float64 `json:"cache_hit_rate"`
+	// recursive pins, and the bytes of the DAGs they pin if Analytics.ReportPinnedBytes
+	// is set. DAGs sharing blocks count them again.
+	PinnedObjects uint64 `json:"pinned_objects"`
+	PinnedBytes   uint64 `json:"pinned_bytes,omitempty"`
+	// sha256 of the config without identity and secrets, only if Analytics.ReportConfigHash is set
+	ConfigHash string `json:"config_hash,omitempty"`
+	// datastore backends of the repo, such as flatfs,levelds, see datastoreType
+	DatastoreType string `json:"datastore_type,omitempty"`
+	// Analytics.NodeGroup, also sent in the call metadata, see withNodeGroup
+	NodeGroup string `json:"node_group,omitempty"`
+	// version of the repo's datastore format, 0 if unknown, to spot nodes that
+	// never migrated
+	RepoVersion uint32 `json:"repo_version"`
+	// unix time the config file was last written, to spot forgotten configs
+	ConfigLastModified int64 `json:"config_last_modified,omitempty"`
+	// sha256 of the sorted bootstrap peers, only if Analytics.ReportBootstrapHash is set
+	BootstrapHash string `json:"bootstrap_hash,omitempty"`
+	// hex sha256 of the node's DER public key, also sent to the status server as
+	// publicKeyFingerprintKey to detect rotated keys. Left out in privacy mode.
+	PublicKeyFingerprint string `json:"public_key_fingerprint,omitempty"`
+	// masked TRON wallet address, only if Analytics.ReportWallet is set
+	WalletAddress string `json:"wallet_address,omitempty"`
+	// whether the node is connected to a peer with its own id, so another node shares
+	// its private key
+	DuplicateIDDetected bool `json:"duplicate_id_detected"`
+	// connected peers per agent version reported by identify, at most maxPeerVersions
+	// entries, only if Analytics.ReportPeerVersions is set
+	PeerVersions map[string]uint64 `json:"peer_versions,omitempty"`
+	// up to maxAddresses public addresses the node announces, only if Analytics.ReportAddresses is set
+	ListenAddresses []string `json:"listen_addresses,omitempty"`
+	// whether the node announces circuit relay addresses, the most relays any of them
+	// goes through and the first maxRelayPeerIDs relays, which are left out in
+	// privacy mode
+	IsRelay      bool     `json:"is_relay"`
+	RelayHops    uint64   `json:"relay_hops"`
+	RelayPeerIDs []string `json:"relay_peer_ids,omitempty"`
+	// set until the first heartbeat after the node was upgraded from PreviousVersion is delivered
+	IsUpgrade       bool   `json:"is_upgrade"`
+	PreviousVersion string `json:"previous_version,omitempty"`
+	// eventStart or eventStop until the heartbeat sent when the agent started or stopped is delivered
+	EventType string `json:"event_type,omitempty"`
+	// round trip times of the status server calls since the last successful SendDataNow
+	StatusServerLatency LatencyHistogram `json:"status_server_latency"`
+	// calls of the maxAPICalls API commands called most often during the last epoch
+	APICalls map[string]uint64 `json:"api_calls,omitempty"`
+	// time to first byte percentiles in milliseconds of the latest retrievals,
+	// see TimeRetrieval
+	P50TTFB uint64 `json:"p50_ttfb_ms"`
+	P95TTFB uint64 `json:"p95_ttfb_ms"`
+	P99TTFB uint64 `json:"p99_ttfb_ms"`
+	// metrics added by the registered MetricsPlugins
+	PluginFields map[string]string `json:"plugin_fields,omitempty"`
+	// health alerts reported since the last heartbeat was delivered
+	HealthAlerts uint64 `json:"health_alerts"`
+	// health alerts per heartbeat over the latest errorRateEpochs epochs, to spot
+	// flapping nodes
+	ErrorRate float64 `json:"error_rate"`
+	// bytes held by the analytics agent itself, see updateMemOverhead
+	AnalyticsMemOverhead uint64 `json:"analytics_mem_overhead"`
+	// change in connected peers since the previous heartbeat
+	PeerDelta int64 `json:"peer_delta"`
+	// blocks that failed to send and wanted blocks given up on during the last
+	// epoch, see BitswapTraffic.Failed
+	FailedUploads   uint64 `json:"failed_uploads"`
+	FailedDownloads uint64 `json:"failed_downloads"`
+	// anomalyCPU, anomalyPeersLost and anomalyMemorySpike bits of the unusual
+	// values in this update, see updateAnomalies
+	AnomalyFlags uint32 `json:"anomaly_flags"`
+}
+
+// LatencyHistogram counts status server round trips by duration
+type LatencyHistogram struct {
+	Under100ms uint64 `json:"under_100ms"`
+	Under500ms uint64 `json:"under_500ms"`
+	Under1s    uint64 `json:"under_1s"`
+	Over1s     uint64 `json:"over_1s"`
+}
+
+// observe counts a round trip that took d.
+func (h *LatencyHistogram) observe(d time.Duration) {
+	switch {
+	case d < 100*time.Millisecond:
+		h.Under100ms++
+	case d < 500*time.Millisecond:
+		h.Under500ms++
+	case d < time.Second:
+		h.Under1s++
+	default:
+		h.Over1s++
+	}
+}
+
+// dcReport is the JSON view of everything collected for the node
+type dcReport struct {
+	*nodepb.Node
+	extraMetrics
+}
+
+// maxPeerIDs caps the peer ids reported to keep the payload small
+const maxPeerIDs = 50
+
+// setPeerIDs records the first maxPeerIDs of peers if the operator opted in.
+func (dc *dcWrap) setPeerIDs(peers []string) {
+	if !configBool(dc.node.Repo, includePeerListKey, false) {
+		dc.extra.PeerIDs = nil
+		return
+	}
+	if len(peers) > maxPeerIDs {
+		peers = peers[:maxPeerIDs]
+	}
+	dc.extra.PeerIDs = append([]string(nil), peers...)
+}
+
+// blockCountTimeout caps how long counting the repo blocks may delay a heartbeat
+const blockCountTimeout = 10 * time.Second
+
+// countBlocks counts the blocks in the node's blockstore, nil if it has none. A
+// count that could not finish in time is not reported and the previous one is kept.
+func (dc *dcWrap) countBlocks() (*uint64, error) {
+	if dc.node.Blockstore == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), blockCountTimeout)
+	defer cancel()
+	keys, err := dc.node.Blockstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repo blocks: %s", err.Error())
+	}
+	var n uint64
+	for range keys {
+		n++
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count repo blocks: %s", err.Error())
+	}
+	return &n, nil
+}
+
+// reputationSource is implemented by repos that know the node's reputation in
+// the BTFS network
+type reputationSource interface {
+	Reputation() (float64, error)
+}
+
+// noReputation is reported when the repo does not know the node's reputation
+const noReputation = -1
+
+// updateReputation sets the node's reputation if its repo knows it, noReputation if not.
+func (dc *dcWrap) updateReputation() error {
+	dc.pn.Reputation = noReputation
+	src, ok := dc.node.Repo.(reputationSource)
+	if !ok {
+		return nil
+	}
+	score, err := src.Reputation()
+	if err != nil {
+		return fmt.Errorf("failed to get reputation: %s", err.Error())
+	}
+	dc.pn.Reputation = score
+	return nil
+}
+
+// pinCountTimeout caps how long reading the pins may delay a heartbeat
+const pinCountTimeout = 10 * time.Second
+
+// pinCount is the number of recursive pins and the bytes they pin, if reported
+type pinCount struct {
+	objects, bytes uint64
+}
+
+// countPins counts the recursive pins and, if the operator opted in, adds up the
+// sizes of the DAGs they pin. Every pinned DAG takes reading its root block. The pins
+// are counted without their bytes if adding those up failed, and not at all, nil,
+// if they could not be listed or the node has none.
+func (dc *dcWrap) countPins() (*pinCount, error) {
+	if dc.node.Pinning == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pinCountTimeout)
+	defer cancel()
+	keys, err := dc.node.Pinning.RecursiveKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recursive pins: %s", err.Error())
+	}
+	count := &pinCount{objects: uint64(len(keys))}
+	if !configBool(dc.node.Repo, reportPinnedBytesKey, false) || dc.node.Blockstore == nil {
+		return count, nil
+	}
+	var total uint64
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return count, fmt.Errorf("failed to add up pinned bytes: %s", err.Error())
+		}
+		size, err := dagSize(dc.node.Blockstore, k)
+		if err != nil {
+			return count, fmt.Errorf("failed to get size of pin %s: %s", k, err.Error())
+		}
+		total += size
+	}
+	count.bytes = total
+	return count, nil
+}
+
+// dagSize returns the size of the DAG rooted at c as recorded in its root block,
+// which bs must hold.
+func dagSize(bs bstore.Blockstore, c cid.Cid) (uint64, error) {
+	blk, err := bs.Get(c)
+	if err != nil {
+		return 0, err
+	}
+	nd, err := ipld.Decode(blk)
+	if err != nil {
+		return 0, err
+	}
+	return nd.Size()
+}
+
+// updateConfigHash sets the hash of the current config if the operator opted in.
+func (dc *dcWrap) updateConfigHash() error {
+	if !configBool(dc.node.Repo, reportConfigHashKey, false) {
+		dc.extra.ConfigHash = ""
+		return nil
+	}
+	cfg, err := dc.node.Repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to get config: %s", err.Error())
+	}
+	h, err := configHash(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to hash config: %s", err.Error())
+	}
+	dc.extra.ConfigHash = h
+	return nil
+}
+
+// updateDatastoreType sets the datastore backends the repo config describes.
+func (dc *dcWrap) updateDatastoreType() error {
+	cfg, err := dc.node.Repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to get config: %s", err.Error())
+	}
+	dc.extra.DatastoreType = datastoreType(cfg.Datastore.Spec)
+	return nil
+}
+
+// updateConfigModified sets when the repo's config file was last written.
+func (dc *dcWrap) updateConfigModified() error {
+	if dc.configPath == "" {
+		return nil
+	}
+	fi, err := os.Stat(dc.configPath)
+	if err != nil {
+		dc.extra.ConfigLastModified = 0
+		return fmt.Errorf("failed to stat config file: %s", err.Error())
+	}
+	dc.extra.ConfigLastModified = fi.ModTime().Unix()
+	return nil
+}
+
+// updateRepoVersion sets the version in the repo's version file. A version that
+// cannot be read is reported as 0 rather than holding up the heartbeat.
+func (dc *dcWrap) updateRepoVersion() {
+	dc.extra.RepoVersion = 0
+	if dc.repoPath == "" {
+		return
+	}
+	v, err := mfsr.RepoPath(dc.repoPath).Version()
+	if err != nil || v < 0 {
+		log.Debugf("failed to read the repo version: %v", err)
+		return
+	}
+	dc.extra.RepoVersion = uint32(v)
+}
+
+// datastoreType returns the backends of a datastore spec, such as "badgerds".
+// Wrappers like measure and log are looked through, and the backends of a mount
+// spec are joined in mount order, "flatfs,levelds" for the default spec.
+func datastoreType(spec map[string]interface{}) string {
+	typ, _ := spec["type"].(string)
+	switch typ {
+	case "mount":
+		mounts, _ := spec["mounts"].([]interface{})
+		types := make([]string, 0, len(mounts))
+		for _, m := range mounts {
+			if m, ok := m.(map[string]interface{}); ok {
+				if t := datastoreType(m); t != "" {
+					types = append(types, t)
+				}
+			}
+		}
+		return strings.Join(types, ",")
+	case "measure", "log":
+		child, _ := spec["child"].(map[string]interface{})
+		return datastoreType(child)
+	}
+	return typ
+}
+
+// configHash returns the hex sha256 of cfg serialized without its identity, which
+// is unique to every node and holds the private key. A custom swarm key only counts
+// as being custom.
+func configHash(cfg *config.Config) (string, error) {
+	masked := *cfg
+	masked.Identity = config.Identity{}
+	if k := masked.Swarm.SwarmKey; k != "" && k != config.DefaultSwarmKey && k != config.DefaultTestnetSwarmKey {
+		masked.Swarm.SwarmKey = "custom"
+	}
+	b, err := json.Marshal(&masked)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// updateBootstrapHash records the hash of the configured bootstrap peers if the operator opted in.
+func (dc *dcWrap) updateBootstrapHash() error {
+	if !configBool(dc.node.Repo, reportBootstrapHashKey, false) {
+		dc.extra.BootstrapHash = ""
+		return nil
+	}
+	cfg, err := dc.node.Repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to get config: %s", err.Error())
+	}
+	dc.extra.BootstrapHash = bootstrapHash(cfg.Bootstrap)
+	return nil
+}
+
+// bootstrapHash returns the hex sha256 of the newline separated peers, which are
+// sorted first so the hash does not depend on their order in the config.
+func bootstrapHash(peers []string) string {
+	sorted := append([]string(nil), peers...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// updateWalletAddress records the masked wallet address of the node if the operator opted in.
+func (dc *dcWrap) updateWalletAddress() error {
+	if !configBool(dc.node.Repo, reportWalletKey, false) {
+		dc.extra.WalletAddress = ""
+		return nil
+	}
+	cfg, err := dc.node.Repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to get config: %s", err.Error())
+	}
+	keys, err := crypto.FromPrivateKey(cfg.Identity.PrivKey)
+	if err != nil {
+		return fmt.Errorf("failed to get wallet address: %s", err.Error())
+	}
+	dc.extra.WalletAddress = maskWalletAddress(keys.Base58Address)
+	return nil
+}
+
+// maskWalletAddress keeps the first 6 and last 4 characters of a base58 address,
+// enough to match it against payments without reporting the whole address.
+// Addresses too short to mask are not reported.
+func maskWalletAddress(addr string) string {
+	if len(addr) <= 10 {
+		return ""
+	}
+	return addr[:6] + "..." + addr[len(addr)-4:]
+}
+
+// updateThroughput turns the epoch transfer totals into rates over the time since
+// the last heartbeat delivered was collected. Until one is there is nothing to
+// measure from and no throughput is reported.
+func (dc *dcWrap) updateThroughput(now time.Time) {
+	secs := uint64(0)
+	if !dc.statTime.IsZero() {
+		secs = durationToSeconds(now.Sub(dc.statTime))
+	}
+	if secs == 0 {
+		dc.extra.UploadBPS, dc.extra.DownloadBPS = 0, 0
+		return
+	}
+	dc.extra.UploadBPS = float64(dc.pn.Upload*uint64(units.KiB)) / float64(secs)
+	dc.extra.DownloadBPS = float64(dc.pn.Download*uint64(units.KiB)) / float64(secs)
+}
+
+// updateOpenFDs records the file descriptors held by the daemon, keeping the
+// previous count if they cannot be listed.
+func (dc *dcWrap) updateOpenFDs() error {
+	n, err := openFDs()
+	if err != nil {
+		return fmt.Errorf("failed to count open file descriptors: %s", err.Error())
+	}
+	dc.extra.OpenFDs = n
+	return nil
+}
+
+// blockCacheStats is implemented by node.BlockCache
+type blockCacheStats interface {
+	// CacheStats returns the reads the caches answered and those they did not,
+	// ok is false if the blockstore is not cached
+	CacheStats() (hits, misses uint64, ok bool)
+}
+
+// updateCacheHitRate sets the share of the blockstore reads the caches answered.
+func (dc *dcWrap) updateCacheHitRate() {
+	dc.extra.CacheHitRate = -1
+	if dc.blockCache == nil {
+		return
+	}
+	hits, misses, ok := dc.blockCache.CacheStats()
+	if !ok {
+		return
+	}
+	dc.extra.CacheHitRate = 0
+	if reads := hits + misses; reads != 0 {
+		dc.extra.CacheHitRate = float64(hits) / float64(reads)
+	}
+}
+
+// protocolBandwidth is implemented by the libp2p bandwidth counter
+type protocolBandwidth interface {
+	GetBandwidthByProtocol() map[protocol.ID]metrics.Stats
+}
+
+// maxProtocolStats caps the protocols reported
+const maxProtocolStats = 5
+
+// updateProtocolStats records the total bytes sent on the protocols sending the most.
+func (dc *dcWrap) updateProtocolStats() {
+	if dc.bandwidth == nil {
+		return
+	}
+	byProto := dc.bandwidth.GetBandwidthByProtocol()
+	protos := make([]protocol.ID, 0, len(byProto))
+	for p := range byProto {
+		protos = append(protos, p)
+	}
+	sort.Slice(protos, func(i, j int) bool {
+		if oi, oj := byProto[protos[i]].TotalOut, byProto[protos[j]].TotalOut; oi != oj {
+			return oi > oj
+		}
+		return protos[i] < protos[j]
+	})
+	if len(protos) > maxProtocolStats {
+		protos = protos[:maxProtocolStats]
+	}
+	dc.extra.ProtocolStats = make(map[string]uint64, len(protos))
+	for _, p := range protos {
+		dc.extra.ProtocolStats[string(p)] = uint64(byProto[p].TotalOut)
+	}
+}
+
+// peerVersionSource is implemented by hostPeers, and by fakes in tests
+type peerVersionSource interface {
+	// Peers returns the connected peers
+	Peers() []peer.ID
+	// Get returns what the peerstore knows about p under key
+	Get(p peer.ID, key string) (interface{}, error)
+}
+
+// hostPeers reads the connected peers and their identify info from a libp2p host
+type hostPeers struct {
+	host host.Host
+}
+
+func (h hostPeers) Peers() []peer.ID {
+	return h.host.Network().Peers()
+}
+
+func (h hostPeers) Get(p peer.ID, key string) (interface{}, error) {
+	return h.host.Peerstore().Get(p, key)
+}
+
+const (
+	// maxPeerVersions caps the distinct versions reported, the least common are
+	// counted as otherPeerVersion
+	maxPeerVersions  = 20
+	otherPeerVersion = "other"
+	// reported for peers that did not finish identify yet
+	unknownPeerVersion = "unknown"
+)
+
+// updatePeerVersions counts the connected peers per agent version if the operator opted in.
+func (dc *dcWrap) updatePeerVersions() {
+	if !configBool(dc.node.Repo, reportPeerVersionsKey, false) || dc.peers == nil {
+		dc.extra.PeerVersions = nil
+		return
+	}
+	counts := make(map[string]uint64)
+	for _, p := range dc.peers.Peers() {
+		v, err := dc.peers.Get(p, "AgentVersion")
+		s, ok := v.(string)
+		if err != nil || !ok || s == "" {
+			s = unknownPeerVersion
+		}
+		counts[s]++
+	}
+	dc.extra.PeerVersions = capPeerVersions(counts)
+}
+
+// updateDuplicateID checks whether the node is connected to a peer with its own id,
+// which happens when a node was cloned along with its private key.
+func (dc *dcWrap) updateDuplicateID() {
+	detected := false
+	if dc.peers != nil {
+		for _, p := range dc.peers.Peers() {
+			if p == dc.node.Identity {
+				detected = true
+				break
+			}
+		}
+	}
+	if detected && !dc.extra.DuplicateIDDetected {
+		log.Errorf("Connected to another node with this node's id %s, its private key is shared", dc.node.Identity.Pretty())
+	}
+	dc.extra.DuplicateIDDetected = detected
+}
+
+// capPeerVersions keeps the maxPeerVersions-1 most common versions of counts and
+// adds up the rest as otherPeerVersion.
+func capPeerVersions(counts map[string]uint64) map[string]uint64 {
+	if len(counts) <= maxPeerVersions {
+		return counts
+	}
+	versions := make([]string, 0, len(counts))
+	for v := range counts {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if ci, cj := counts[versions[i]], counts[versions[j]]; ci != cj {
+			return ci > cj
+		}
+		return versions[i] < versions[j]
+	})
+	res := make(map[string]uint64, maxPeerVersions)
+	for i, v := range versions {
+		if i < maxPeerVersions-1 {
+			res[v] = counts[v]
+		} else {
+			res[otherPeerVersion] += counts[v]
+		}
+	}
+	return res
+}
+
+// maxAddresses caps the announced addresses reported
+const maxAddresses = 10
+
+// updateAddresses records the node's public announced addresses if the operator opted in.
+func (dc *dcWrap) updateAddresses() {
+	if !configBool(dc.node.Repo, reportAddressesKey, false) || dc.node.PeerHost == nil {
+		dc.extra.ListenAddresses = nil
+		return
+	}
+	dc.extra.ListenAddresses = publicAddrs(dc.node.PeerHost.Addrs())
+}
+
+// publicAddrs returns the first maxAddresses publicly routable addresses of addrs.
+func publicAddrs(addrs []ma.Multiaddr) []string {
+	var res []string
+	for _, a := range addrs {
+		if len(res) == maxAddresses {
+			break
+		}
+		if manet.IsPublicAddr(a) && !manet.IsIPLoopback(a) {
+			res = append(res, a.String())
+		}
+	}
+	return res
+}
+
+// gcSample is the cumulative GC statistics of the process as of the last delivered
+// heartbeat, the latest update and the heartbeat being sent. The runtime counts from
+// the process start, which is the first baseline.
+type gcSample struct {
+	pauseTotal, latestPause, prepPause uint64
+	count, latestCount, prepCount      uint32
+	prepOk                             bool
+}
+
+// prepare keeps the latest sample as the one the heartbeat being sent covers
+func (s *gcSample) prepare() {
+	s.prepPause, s.prepCount, s.prepOk = s.latestPause, s.latestCount, true
+}
+
+// commit moves the baseline to the sample of the heartbeat just delivered
+func (s *gcSample) commit() {
+	if s.prepOk {
+		s.pauseTotal, s.count, s.prepOk = s.prepPause, s.prepCount, false
+	}
+}
+
+// updateGC sets the GC statistics since the last delivered heartbeat from m.
+func (dc *dcWrap) updateGC(m *runtime.MemStats) {
+	dc.extra.GCPauseTotal = counterDelta(m.PauseTotalNs, dc.gcSample.pauseTotal)
+	dc.extra.GCCount = counterDelta(uint64(m.NumGC), uint64(dc.gcSample.count))
+	dc.gcSample.latestPause, dc.gcSample.latestCount = m.PauseTotalNs, m.NumGC
+}
+
+// updateMemOverhead sets the bytes the analytics agent allocates up front: dcWrap
+// and the slots of its ring buffers of unsent heartbeats and retrieval samples. The
+// heartbeats held in the buffer and the maps filled by updates are not counted.
+func (dc *dcWrap) updateMemOverhead() {
+	size := uint64(unsafe.Sizeof(*dc))
+	if b := dc.pending; b != nil {
+		size += uint64(unsafe.Sizeof(*b)) + uint64(cap(b.items))*uint64(unsafe.Sizeof(b.items[0]))
+	}
+	if r := dc.retrievals; r != nil {
+		size += uint64(unsafe.Sizeof(*r)) + uint64(cap(r.samples))*uint64(unsafe.Sizeof(r.samples[0]))
+	}
+	dc.extra.AnalyticsMemOverhead = size
+}
+
+// reportHealthAlert logs a problem with the node's analytics reporting and counts
+// it towards the current epoch.
+func (dc *dcWrap) reportHealthAlert(msg string) {
+	dc.mu.Lock()
+	dc.healthAlert(msg)
+	dc.mu.Unlock()
+}
+
+// healthAlert is reportHealthAlert for callers that hold mu. The alert is traced
+// apart, as exporting the span must not hold up the callers.
+func (dc *dcWrap) healthAlert(msg string) {
+	log.Warnw("analytics health alert", "epoch", dc.epoch, "alert", msg)
+	go dc.traceHealthAlert(msg)
+	dc.extra.HealthAlerts++
+	dc.alerts.current++
+}
+
+// defaultPeerChangeThreshold is how many peers may connect or drop between
+// heartbeats before updatePeerChange raises a health alert
+const defaultPeerChangeThreshold = 50
+
+// updatePeerChange sets the change in connected peers since the previous update and
+// raises a health alert, sent to the status server right away, when it passes
+// Analytics.PeerChangeThreshold, as a sudden change points to a network partition or
+// routing table churn. The caller must hold mu.
+func (dc *dcWrap) updatePeerChange() {
+	peers := dc.pn.PeersConnected
+	if !dc.peersSeen {
+		dc.prevPeers, dc.peersSeen = peers, true
+		return
+	}
+	delta := int64(peers) - int64(dc.prevPeers)
+	dc.extra.PeerDelta = delta
+	threshold := int64(configInt(dc.node.Repo, peerChangeThresholdKey, defaultPeerChangeThreshold))
+	if delta > threshold {
+		dc.healthAlert(fmt.Sprintf("connected peers rose by %d, from %d to %d", delta, dc.prevPeers, peers))
+		dc.sendPeerAlert(delta)
+	} else if -delta > threshold {
+		dc.healthAlert(fmt.Sprintf("connected peers fell by %d, from %d to %d", -delta, dc.prevPeers, peers))
+		dc.sendPeerAlert(delta)
+	}
+	dc.prevPeers = peers
+}
+
+// updateFailedTransfers sets the failed block transfers since the previous update
+// from the node's traffic counters, if it has them.
+func (dc *dcWrap) updateFailedTransfers() {
+	if dc.node.Traffic == nil {
+		return
+	}
+	up, down := dc.node.Traffic.Failed()
+	dc.extra.FailedUploads = counterDelta(up, dc.failedUploads)
+	dc.extra.FailedDownloads = counterDelta(down, dc.failedDownloads)
+	dc.failedUploads, dc.failedDownloads = up, down
+}
+
+// bits of AnomalyFlags
+const (
+	// CPU usage above anomalyCPUPercent for anomalyCPUEpochs updates in a row
+	anomalyCPU uint32 = 1 << iota
+	// no peers left after the node had some
+	anomalyPeersLost
+	// memory in use grew by more than anomalyMemoryGrowth since the previous update
+	anomalyMemorySpike
+)
+
+const (
+	anomalyCPUPercent   = 95
+	anomalyCPUEpochs    = 3
+	anomalyMemoryGrowth = 0.5
+)
+
+// updateAnomalies flags the unusual values collected in this update, comparing them
+// with the previous one. It must run after the other updates and before collected
+// is replaced.
+func (dc *dcWrap) updateAnomalies() {
+	var flags uint32
+	if dc.pn.CpuUsed > anomalyCPUPercent {
+		dc.cpuHighEpochs++
+	} else {
+		dc.cpuHighEpochs = 0
+	}
+	if dc.cpuHighEpochs >= anomalyCPUEpochs {
+		flags |= anomalyCPU
+	}
+	if dc.pn.PeersConnected != 0 {
+		dc.hadPeers = true
+	} else if dc.hadPeers {
+		flags |= anomalyPeersLost
+	}
+	if last := dc.collected; last != nil && last.MemoryUsed != 0 &&
+		float64(dc.pn.MemoryUsed) > float64(last.MemoryUsed)*(1+anomalyMemoryGrowth) {
+		flags |= anomalyMemorySpike
+	}
+	dc.extra.AnomalyFlags = flags
+}
+
+// errorRateEpochs is how many heartbeats ErrorRate is averaged over
+const errorRateEpochs = 5
+
+// alertWindow counts the health alerts of the latest errorRateEpochs epochs
+type alertWindow struct {
+	counts [errorRateEpochs]uint64
+	next   int
+	n      int
+	// alerts reported since the last epoch ended
+	current uint64
+}
+
+// endEpoch records the alerts of the epoch that just ended and starts a new one.
+func (w *alertWindow) endEpoch() {
+	w.counts[w.next] = w.current
+	w.next = (w.next + 1) % len(w.counts)
+	if w.n < len(w.counts) {
+		w.n++
+	}
+	w.current = 0
+}
+
+// rate returns the average alerts per epoch recorded, 0 before the first one.
+func (w *alertWindow) rate() float64 {
+	if w.n == 0 {
+		return 0
+	}
+	var sum uint64
+	for _, c := range w.counts[:w.n] {
+		sum += c
+	}
+	return float64(sum) / float64(w.n)
+}
+
+// updateErrorRate ends the epoch a heartbeat is being prepared for and sets the
+// rolling error rate. The caller must hold mu.
+func (dc *dcWrap) updateErrorRate() {
+	dc.alerts.endEpoch()
+	dc.extra.ErrorRate = dc.alerts.rate()
+}
+
+// ioSample remembers a pair of cumulative byte counters: the baseline at the last
+// delivered heartbeat, the latest sample and the one the heartbeat being sent has
+type ioSample struct {
+	in, out             uint64
+	ok                  bool
+	latestIn, latestOut uint64
+	prepIn, prepOut     uint64
+	prepOk              bool
+}
+
+// since records the new counters and returns the KiB they grew by since the
+// baseline, so updates that are not delivered add up. The first sample is only the
+// baseline since counters may be cumulative since boot.
+func (s *ioSample) since(in, out uint64) (uint64, uint64) {
+	s.latestIn, s.latestOut = in, out
+	if !s.ok {
+		s.in, s.out, s.ok = in, out, true
+		return 0, 0
+	}
+	return counterDelta(in, s.in) / uint64(units.KiB), counterDelta(out, s.out) / uint64(units.KiB)
+}
+
+// prepare keeps the latest sample as the one the heartbeat being sent covers
+func (s *ioSample) prepare() {
+	s.prepIn, s.prepOut, s.prepOk = s.latestIn, s.latestOut, s.ok
+}
+
+// commit moves the baseline to the sample of the heartbeat just delivered
+func (s *ioSample) commit() {
+	if s.prepOk {
+		s.in, s.out, s.prepOk = s.prepIn, s.prepOut, false
+	}
+}
+
+// mockable in tests
+var (
+	diskIOCounters  = disk.IOCounters
+	netIOCounters   = psnet.IOCounters
+	cpuInfoStats    = cpu.Info
+	cpuInfoFallback = processorIdentifier
+	virtualMemory   = mem.VirtualMemory
+	swapMemory      = mem.SwapMemory
+)
+
+// updateSystemMemory sets the memory and swap used on the machine. Swap is reported
+// as 0 if it cannot be read, as in some containers.
+func (dc *dcWrap) updateSystemMemory() error {
+	vm, err := virtualMemory()
+	if err != nil {
+		return fmt.Errorf("failed to get system memory: %s", err.Error())
+	}
+	dc.extra.SystemMemUsed = vm.Used / uint64(units.KiB)
+	dc.extra.SwapUsed = 0
+	if swap, err := swapMemory(); err == nil {
+		dc.extra.SwapUsed = swap.Used / uint64(units.KiB)
+	} else {
+		log.Debugf("failed to get swap memory: %s", err)
+	}
+	return nil
+}
+
+// cpuModel returns the model name of the first CPU. gopsutil may fail or find no
+// CPU on Windows, where the processor identifier is used instead.
+func cpuModel() (string, error) {
+	infoStats, err := cpuInfoStats()
+	if err == nil && len(infoStats) > 0 {
+		return infoStats[0].ModelName, nil
+	}
+	if model := cpuInfoFallback(); model != "" {
+		return model, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no cpu info found")
+	}
+	return "", err
+}
+
+// updateDiskIO sets the disk throughput since the last delivered heartbeat, summed
+// over all devices.
+func (dc *dcWrap) updateDiskIO() error {
+	counters, err := diskIOCounters()
+	if err != nil {
+		return fmt.Errorf("failed to get disk io counters: %s", err.Error())
+	}
+	var read, write uint64
+	for _, c := range counters {
+		read += c.ReadBytes
+		write += c.WriteBytes
+	}
+	dc.extra.DiskRead, dc.extra.DiskWrite = dc.diskSample.since(read, write)
+	return nil
+}
+
+// updateNetIO sets the network throughput since the last delivered heartbeat on
+// the interfaces the swarm listens on.
+func (dc *dcWrap) updateNetIO() error {
+	if dc.node.PeerHost == nil {
+		return nil
+	}
+	addrs, err := dc.node.PeerHost.Network().InterfaceListenAddresses()
+	if err != nil {
+		return fmt.Errorf("failed to get swarm listen addresses: %s", err.Error())
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ip, err := manet.ToIP(a); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	names, err := interfacesWithIPs(ips)
+	if err != nil {
+		return fmt.Errorf("failed to get network interfaces: %s", err.Error())
+	}
+	counters, err := netIOCounters(true)
+	if err != nil {
+		return fmt.Errorf("failed to get network io counters: %s", err.Error())
+	}
+	in, out := sumNetCounters(counters, names)
+	dc.extra.NetIn, dc.extra.NetOut = dc.netSample.since(in, out)
+	return nil
+}
+
+// interfacesWithIPs returns the names of the local interfaces holding any of ips.
+func interfacesWithIPs(ips []net.IP) (map[string]bool, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, ip := range ips {
+				if ipnet.IP.Equal(ip) {
+					names[iface.Name] = true
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// sumNetCounters adds up the bytes received and sent on the named interfaces.
+func sumNetCounters(counters []psnet.IOCountersStat, names map[string]bool) (uint64, uint64) {
+	var in, out uint64
+	for _, c := range counters {
+		if names[c.Name] {
+			in += c.BytesRecv
+			out += c.BytesSent
+		}
+	}
+	return in, out
+}
@@ -0,0 +1,1197 @@
+package spin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/TRON-US/go-btfs/core"
+	"github.com/TRON-US/go-btfs/repo/fsrepo"
+	mfsr "github.com/TRON-US/go-btfs/repo/fsrepo/migrations"
+
+	config "github.com/TRON-US/go-btfs-config"
+	pin "github.com/TRON-US/go-btfs-pinner"
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/ipfs/go-bitswap"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	util "github.com/ipfs/go-ipfs-util"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+	psnet "github.com/shirou/gopsutil/v3/net"
+)
+
+func TestUpdateDiskIO(t *testing.T) {
+	var counters map[string]disk.IOCountersStat
+	diskIOCounters = func(...string) (map[string]disk.IOCountersStat, error) {
+		return counters, nil
+	}
+	defer func() { diskIOCounters = disk.IOCounters }()
+
+	dc := &dcWrap{}
+	counters = map[string]disk.IOCountersStat{
+		"sda": {ReadBytes: 10 << 20, WriteBytes: 4 << 20},
+		"sdb": {ReadBytes: 1 << 20, WriteBytes: 1 << 20},
+	}
+	if err := dc.updateDiskIO(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.DiskRead != 0 || dc.extra.DiskWrite != 0 {
+		t.Fatalf("first sample should only set the baseline, got %d/%d", dc.extra.DiskRead, dc.extra.DiskWrite)
+	}
+
+	counters = map[string]disk.IOCountersStat{
+		"sda": {ReadBytes: 12 << 20, WriteBytes: 4 << 20},
+		"sdb": {ReadBytes: 1 << 20, WriteBytes: 2 << 20},
+	}
+	if err := dc.updateDiskIO(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.DiskRead != 2048 || dc.extra.DiskWrite != 1024 {
+		t.Fatalf("got disk read/write %d/%d KiB, want 2048/1024", dc.extra.DiskRead, dc.extra.DiskWrite)
+	}
+
+	// updates that are not delivered add up, a delivered one moves the baseline
+	counters = map[string]disk.IOCountersStat{
+		"sda": {ReadBytes: 13 << 20, WriteBytes: 4 << 20},
+		"sdb": {ReadBytes: 1 << 20, WriteBytes: 2 << 20},
+	}
+	if err := dc.updateDiskIO(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.DiskRead != 3072 || dc.extra.DiskWrite != 1024 {
+		t.Fatalf("got disk read/write %d/%d KiB, want 3072/1024 since the baseline", dc.extra.DiskRead, dc.extra.DiskWrite)
+	}
+	dc.diskSample.prepare()
+	dc.diskSample.commit()
+	if err := dc.updateDiskIO(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.DiskRead != 0 || dc.extra.DiskWrite != 0 {
+		t.Fatalf("got disk read/write %d/%d KiB after delivery, want 0/0", dc.extra.DiskRead, dc.extra.DiskWrite)
+	}
+
+	// a counter reset must not underflow
+	counters = map[string]disk.IOCountersStat{"sda": {ReadBytes: 1 << 20}}
+	if err := dc.updateDiskIO(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.DiskRead != 0 || dc.extra.DiskWrite != 0 {
+		t.Fatalf("got disk read/write %d/%d KiB after reset, want 0/0", dc.extra.DiskRead, dc.extra.DiskWrite)
+	}
+}
+
+func TestSumNetCountersFiltersInterfaces(t *testing.T) {
+	counters := []psnet.IOCountersStat{
+		{Name: "eth0", BytesRecv: 100, BytesSent: 10},
+		{Name: "eth1", BytesRecv: 200, BytesSent: 20},
+		{Name: "docker0", BytesRecv: 400, BytesSent: 40},
+	}
+	in, out := sumNetCounters(counters, map[string]bool{"eth0": true, "eth1": true})
+	if in != 300 || out != 30 {
+		t.Fatalf("got in/out %d/%d, want 300/30", in, out)
+	}
+	if in, out := sumNetCounters(counters, nil); in != 0 || out != 0 {
+		t.Fatalf("got in/out %d/%d without interfaces, want 0/0", in, out)
+	}
+}
+
+func TestInterfacesWithIPs(t *testing.T) {
+	names, err := interfacesWithIPs([]net.IP{net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		isLoopback := iface.Flags&net.FlagLoopback != 0
+		if names[iface.Name] && !isLoopback {
+			t.Errorf("non-loopback interface %s matched 127.0.0.1", iface.Name)
+		}
+	}
+	if len(names) == 0 {
+		t.Error("no interface found for 127.0.0.1")
+	}
+}
+
+func TestIOSampleSinceNeverNegative(t *testing.T) {
+	var s ioSample
+	if in, out := s.since(10<<10, 20<<10); in != 0 || out != 0 {
+		t.Fatalf("baseline sample returned %d/%d", in, out)
+	}
+	if in, out := s.since(15<<10, 5<<10); in != 5 || out != 0 {
+		t.Fatalf("got %d/%d, want 5/0", in, out)
+	}
+}
+
+func TestIOSampleMovesOnCommit(t *testing.T) {
+	var s ioSample
+	s.since(10<<10, 10<<10)
+	s.since(12<<10, 11<<10)
+	// not delivered yet
+	s.commit()
+	if in, out := s.since(14<<10, 12<<10); in != 4 || out != 2 {
+		t.Fatalf("got %d/%d, want 4/2 since the baseline", in, out)
+	}
+	s.prepare()
+	s.since(15<<10, 12<<10)
+	s.commit()
+	if in, out := s.since(16<<10, 13<<10); in != 2 || out != 1 {
+		t.Fatalf("got %d/%d, want 2/1 since the prepared sample", in, out)
+	}
+}
+
+func TestHealthAlertsPerEpoch(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestDcWrap(t)
+	dc.statusServerDomains = []string{addr}
+	dc.pending = newMetricsBuffer(defaultBufferSize)
+
+	dc.reportHealthAlert("first")
+	dc.reportHealthAlert("second")
+	rec := httptest.NewRecorder()
+	AnalyticsHandler(dc.node).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/analytics", nil))
+	var report struct {
+		HealthAlerts uint64 `json:"health_alerts"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.HealthAlerts != 2 {
+		t.Fatalf("got %d health alerts, want 2", report.HealthAlerts)
+	}
+
+	if err := dc.send(context.Background(), testMetrics(0), dc.newBackoff()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ss.metrics()) != 1 {
+		t.Fatal("heartbeat was not delivered")
+	}
+	if dc.extra.HealthAlerts != 0 {
+		t.Fatalf("health alerts not reset after delivery, got %d", dc.extra.HealthAlerts)
+	}
+}
+
+func TestAlertWindow(t *testing.T) {
+	for _, tc := range []struct {
+		alerts []uint64
+		want   float64
+	}{
+		{nil, 0},
+		{[]uint64{3}, 3},
+		{[]uint64{0, 0, 1}, 1.0 / 3},
+		{[]uint64{1, 2, 3, 4, 5}, 3},
+		// only the latest errorRateEpochs epochs count
+		{[]uint64{9, 9, 0, 0, 0, 0, 1}, 0.2},
+		{[]uint64{3, 3, 3, 3, 3, 0, 0, 0, 0, 0}, 0},
+	} {
+		var w alertWindow
+		for _, n := range tc.alerts {
+			w.current = n
+			w.endEpoch()
+		}
+		if got := w.rate(); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("alerts %v: got rate %v, want %v", tc.alerts, got, tc.want)
+		}
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	dc := newTestDcWrap(t)
+	var err error
+	if dc.node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []float64{3, 1.5, 1} {
+		if i == 0 {
+			for j := 0; j < 3; j++ {
+				dc.reportHealthAlert("flapping")
+			}
+		}
+		if _, _, err := dc.doPrepData(dc.node); err != nil {
+			t.Fatal(err)
+		}
+		if dc.extra.ErrorRate != want {
+			t.Fatalf("heartbeat %d: got error rate %v, want %v", i, dc.extra.ErrorRate, want)
+		}
+	}
+}
+
+func TestUpdateGoroutines(t *testing.T) {
+	dc := newTestDcWrap(t)
+	before := uint64(runtime.NumGoroutine())
+	dc.update(dc.node)
+	after := uint64(runtime.NumGoroutine())
+	if dc.extra.Goroutines == 0 {
+		t.Fatal("goroutine count not set")
+	}
+	lo, hi := before, after
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	if dc.extra.Goroutines < lo || dc.extra.Goroutines > hi {
+		t.Fatalf("got %d goroutines, want between %d and %d", dc.extra.Goroutines, lo, hi)
+	}
+}
+
+func TestUpdateMemoryLayout(t *testing.T) {
+	dc := newTestDcWrap(t)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() { <-stop }()
+	dc.update(dc.node)
+	if dc.pn.MemoryUsed == 0 || dc.extra.StackInUse == 0 || dc.extra.HeapIdle == 0 {
+		t.Fatalf("got memory used %d, stack in use %d, heap idle %d KiB, want all set",
+			dc.pn.MemoryUsed, dc.extra.StackInUse, dc.extra.HeapIdle)
+	}
+	if dc.extra.StackInUse >= dc.pn.MemoryUsed {
+		t.Errorf("got %d KiB of stacks out of %d KiB in use", dc.extra.StackInUse, dc.pn.MemoryUsed)
+	}
+}
+
+func TestUpdateGC(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.update(dc.node)
+	runtime.GC()
+	dc.update(dc.node)
+	if dc.extra.GCCount < 1 {
+		t.Fatalf("got %d GC cycles since the process start, want at least 1", dc.extra.GCCount)
+	}
+	if want := uint64(dc.gcSample.latestCount); dc.extra.GCCount != want {
+		t.Fatalf("got %d GC cycles, want %d since the process start", dc.extra.GCCount, want)
+	}
+
+	// undelivered updates add up until a heartbeat is delivered
+	dc.gcSample.prepare()
+	dc.gcSample.commit()
+	delivered := dc.gcSample.count
+	runtime.GC()
+	dc.update(dc.node)
+	runtime.GC()
+	dc.update(dc.node)
+	if dc.extra.GCCount < 2 {
+		t.Fatalf("got %d GC cycles since the delivered heartbeat, want at least 2", dc.extra.GCCount)
+	}
+	if want := uint64(dc.gcSample.latestCount - delivered); dc.extra.GCCount != want {
+		t.Fatalf("got %d GC cycles, want %d since the delivered heartbeat", dc.extra.GCCount, want)
+	}
+}
+
+func TestUpdateMemOverhead(t *testing.T) {
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}}
+	dc.updateMemOverhead()
+	if want := uint64(unsafe.Sizeof(dcWrap{})); dc.extra.AnalyticsMemOverhead != want {
+		t.Fatalf("got %d bytes without buffers, want %d", dc.extra.AnalyticsMemOverhead, want)
+	}
+
+	dc.pending = newMetricsBuffer(96)
+	dc.retrievals = newRetrievalStats(100)
+	dc.pending.push(testMetrics(0))
+	dc.updateMemOverhead()
+	want := unsafe.Sizeof(dcWrap{}) +
+		unsafe.Sizeof(metricsBuffer{}) + 96*unsafe.Sizeof(uintptr(0)) +
+		unsafe.Sizeof(RetrievalStats{}) + 100*unsafe.Sizeof(time.Duration(0))
+	if dc.extra.AnalyticsMemOverhead != uint64(want) {
+		t.Fatalf("got %d bytes, want %d", dc.extra.AnalyticsMemOverhead, want)
+	}
+}
+
+func TestSetPeerIDs(t *testing.T) {
+	peers := make([]string, 60)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("peer%d", i)
+	}
+
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}}
+	dc.setPeerIDs(peers)
+	if dc.extra.PeerIDs != nil {
+		t.Fatalf("peer list reported without opting in: %v", dc.extra.PeerIDs)
+	}
+
+	dc = &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(map[string]interface{}{includePeerListKey: true})}}
+	dc.setPeerIDs(peers)
+	if len(dc.extra.PeerIDs) != maxPeerIDs {
+		t.Fatalf("got %d peer ids, want %d", len(dc.extra.PeerIDs), maxPeerIDs)
+	}
+	for i, id := range dc.extra.PeerIDs {
+		if id != peers[i] {
+			t.Fatalf("peer id %d is %s, want %s", i, id, peers[i])
+		}
+	}
+	dc.setPeerIDs(peers[:3])
+	if len(dc.extra.PeerIDs) != 3 {
+		t.Fatalf("got %d peer ids, want 3", len(dc.extra.PeerIDs))
+	}
+}
+
+// testBlockstore lists n made up keys
+type testBlockstore struct {
+	bstore.GCBlockstore
+	n int
+}
+
+func (bs *testBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	keys := make(chan cid.Cid)
+	go func() {
+		defer close(keys)
+		for i := 0; i < bs.n; i++ {
+			c := cid.NewCidV1(cid.Raw, util.Hash([]byte(fmt.Sprint(i))))
+			select {
+			case keys <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return keys, nil
+}
+
+func TestCountBlocks(t *testing.T) {
+	dc := &dcWrap{node: &core.IpfsNode{Blockstore: &testBlockstore{n: 42}}}
+	n, err := dc.countBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == nil || *n != 42 {
+		t.Fatalf("got %v blocks, want 42", n)
+	}
+}
+
+// reputationRepo is a repo that knows the node's reputation
+type reputationRepo struct {
+	*testRepo
+	score float64
+	err   error
+}
+
+func (r *reputationRepo) Reputation() (float64, error) {
+	return r.score, r.err
+}
+
+func TestUpdateReputation(t *testing.T) {
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}, pn: &nodepb.Node{Reputation: 0.5}}
+	if err := dc.updateReputation(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.pn.Reputation != noReputation {
+		t.Fatalf("got reputation %v from a repo without it, want %v", dc.pn.Reputation, noReputation)
+	}
+
+	r := &reputationRepo{testRepo: newTestRepo(nil), score: 0.87}
+	dc.node.Repo = r
+	if err := dc.updateReputation(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.pn.Reputation != 0.87 {
+		t.Fatalf("got reputation %v, want 0.87", dc.pn.Reputation)
+	}
+	id, err := peer.Decode(testNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := dc.getPayload(&core.IpfsNode{Identity: id, Repo: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(b, info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Node.Reputation != 0.87 {
+		t.Fatalf("got reputation %v in the payload, want 0.87", info.Node.Reputation)
+	}
+
+	r.err = errors.New("hub unreachable")
+	if err := dc.updateReputation(); err == nil {
+		t.Fatal("expected failing reputation to be reported")
+	}
+	if dc.pn.Reputation != noReputation {
+		t.Fatalf("got reputation %v after failing to get it, want %v", dc.pn.Reputation, noReputation)
+	}
+}
+
+// testPinner pins keys recursively
+type testPinner struct {
+	pin.Pinner
+	keys []cid.Cid
+}
+
+func (p *testPinner) RecursiveKeys(ctx context.Context) ([]cid.Cid, error) {
+	return p.keys, nil
+}
+
+func TestCountPins(t *testing.T) {
+	bs := bstore.NewGCBlockstore(bstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), bstore.NewGCLocker())
+	pinner := &testPinner{}
+	var want uint64
+	for i := 0; i < 5; i++ {
+		leaf := merkledag.NewRawNode([]byte(fmt.Sprintf("leaf %d", i)))
+		root := merkledag.NodeWithData([]byte("root"))
+		if err := root.AddNodeLink("leaf", leaf); err != nil {
+			t.Fatal(err)
+		}
+		for _, nd := range []ipld.Node{leaf, root} {
+			if err := bs.Put(nd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		size, err := root.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinner.keys = append(pinner.keys, root.Cid())
+		want += size
+	}
+	for i := 0; i < 3; i++ {
+		leaf := merkledag.NewRawNode(make([]byte, 100*i))
+		if err := bs.Put(leaf); err != nil {
+			t.Fatal(err)
+		}
+		pinner.keys = append(pinner.keys, leaf.Cid())
+		want += uint64(100 * i)
+	}
+
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil), Pinning: pinner, Blockstore: bs}}
+	pins, err := dc.countPins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pins.objects != 8 || pins.bytes != 0 {
+		t.Fatalf("got %d pins of %d bytes, want 8 pins without bytes", pins.objects, pins.bytes)
+	}
+
+	dc.node.Repo = newTestRepo(map[string]interface{}{reportPinnedBytesKey: true})
+	if pins, err = dc.countPins(); err != nil {
+		t.Fatal(err)
+	}
+	if pins.objects != 8 || pins.bytes != want {
+		t.Fatalf("got %d pins of %d bytes, want 8 of %d", pins.objects, pins.bytes, want)
+	}
+
+	// a pin whose root block is missing is reported
+	pinner.keys = append(pinner.keys, cid.NewCidV1(cid.Raw, util.Hash([]byte("missing"))))
+	if pins, err = dc.countPins(); err == nil {
+		t.Fatal("expected missing pin root to be reported")
+	}
+	if pins == nil || pins.objects != 9 || pins.bytes != 0 {
+		t.Fatalf("got %+v, want the 9 pins counted without bytes", pins)
+	}
+}
+
+func TestDatastoreType(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{`{"type": "levelds", "path": "datastore", "compression": "none"}`, "levelds"},
+		{`{"type": "badgerds", "path": "badgerds", "syncWrites": true}`, "badgerds"},
+		{`{"type": "flatfs", "path": "blocks", "sync": true, "shardFunc": "/repo/flatfs/shard/v1/next-to-last/2"}`, "flatfs"},
+		{`{"type": "measure", "prefix": "leveldb.datastore", "child": {"type": "levelds", "path": "datastore"}}`, "levelds"},
+		// the default spec of a new repo
+		{`{"type": "mount", "mounts": [
+			{"mountpoint": "/blocks", "type": "measure", "prefix": "flatfs.datastore",
+				"child": {"type": "flatfs", "path": "blocks", "sync": true, "shardFunc": "/repo/flatfs/shard/v1/next-to-last/2"}},
+			{"mountpoint": "/", "type": "measure", "prefix": "leveldb.datastore",
+				"child": {"type": "levelds", "path": "datastore", "compression": "none"}}
+		]}`, "flatfs,levelds"},
+		{`{}`, ""},
+	} {
+		var spec map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.spec), &spec); err != nil {
+			t.Fatal(err)
+		}
+		if got := datastoreType(spec); got != tc.want {
+			t.Errorf("spec %s: got %q, want %q", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateDatastoreType(t *testing.T) {
+	dc := newTestDcWrap(t)
+	cfg, err := dc.node.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Datastore.Spec = map[string]interface{}{"type": "badgerds", "path": "badgerds"}
+	if err := dc.updateDatastoreType(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.DatastoreType != "badgerds" {
+		t.Fatalf("got datastore type %q, want badgerds", dc.extra.DatastoreType)
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	newConfig := func(peerID, privKey, swarmKey string) *config.Config {
+		cfg := &config.Config{}
+		cfg.Identity = config.Identity{PeerID: peerID, PrivKey: privKey, Mnemonic: "mnemonic of " + peerID}
+		cfg.Bootstrap = []string{"/ip4/1.2.3.4/tcp/4001/p2p/QmBootstrap"}
+		cfg.Swarm.SwarmKey = swarmKey
+		cfg.Datastore.Spec = map[string]interface{}{"type": "mount", "mounts": []interface{}{"a", "b"}}
+		return cfg
+	}
+	hash := func(cfg *config.Config) string {
+		h, err := configHash(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	base := hash(newConfig("QmA", "keyA", config.DefaultSwarmKey))
+	if len(base) != 64 {
+		t.Fatalf("got hash %q, want hex sha256", base)
+	}
+	if h := hash(newConfig("QmB", "keyB", config.DefaultSwarmKey)); h != base {
+		t.Error("nodes with the same config but different identities hash differently")
+	}
+	custom := hash(newConfig("QmA", "keyA", "/key/swarm/psk/1.0.0/\n/base16/\nsecret1"))
+	if custom == base {
+		t.Error("custom swarm key hashes like the default one")
+	}
+	if h := hash(newConfig("QmB", "keyB", "/key/swarm/psk/1.0.0/\n/base16/\nsecret2")); h != custom {
+		t.Error("custom swarm keys are not masked")
+	}
+	other := newConfig("QmA", "keyA", config.DefaultSwarmKey)
+	other.Bootstrap = nil
+	if hash(other) == base {
+		t.Error("different bootstrap peers hash the same")
+	}
+
+	cfg := newConfig("QmA", "keyA", config.DefaultSwarmKey)
+	hash(cfg)
+	if cfg.Identity.PrivKey != "keyA" || cfg.Identity.PeerID != "QmA" {
+		t.Error("hashing modified the config")
+	}
+}
+
+func TestBootstrapHash(t *testing.T) {
+	peers := []string{
+		"/ip4/1.2.3.4/tcp/4001/p2p/QmBootstrapA",
+		"/ip4/5.6.7.8/tcp/4001/p2p/QmBootstrapB",
+		"/dnsaddr/bootstrap.btfs.io/p2p/QmBootstrapC",
+	}
+	base := bootstrapHash(peers)
+	if len(base) != 64 {
+		t.Fatalf("got hash %q, want hex sha256", base)
+	}
+	if h := bootstrapHash(append([]string(nil), peers...)); h != base {
+		t.Error("the same bootstrap peers hash differently")
+	}
+	if h := bootstrapHash([]string{peers[2], peers[0], peers[1]}); h != base {
+		t.Error("the order of the bootstrap peers changed the hash")
+	}
+	if peers[0] != "/ip4/1.2.3.4/tcp/4001/p2p/QmBootstrapA" {
+		t.Error("hashing sorted the config")
+	}
+	if h := bootstrapHash(peers[:2]); h == base {
+		t.Error("different bootstrap peers hash the same")
+	}
+	// joined without a separator these would be the same
+	if bootstrapHash([]string{"/ip4/1.2.3.4", "/tcp/1"}) == bootstrapHash([]string{"/ip4/1.2.3.4/tcp/1"}) {
+		t.Error("peers are not separated before hashing")
+	}
+
+	// nodes with the same bootstrap list report the same hash
+	newDcWrap := func(peers ...string) *dcWrap {
+		r := newTestRepo(map[string]interface{}{reportBootstrapHashKey: true})
+		r.C.Bootstrap = peers
+		return &dcWrap{node: &core.IpfsNode{Repo: r}}
+	}
+	a, b := newDcWrap(peers...), newDcWrap(peers[1], peers[2], peers[0])
+	for _, dc := range []*dcWrap{a, b} {
+		if err := dc.updateBootstrapHash(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.extra.BootstrapHash != base || b.extra.BootstrapHash != base {
+		t.Errorf("got bootstrap hashes %q and %q, want %q", a.extra.BootstrapHash, b.extra.BootstrapHash, base)
+	}
+
+	off := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}}
+	if err := off.updateBootstrapHash(); err != nil || off.extra.BootstrapHash != "" {
+		t.Errorf("got bootstrap hash %q, %v without opting in", off.extra.BootstrapHash, err)
+	}
+}
+
+func TestMaskWalletAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr, want string
+	}{
+		{"TTACjzSeJ9jDHaxRxnho1n3mVK9JASNyr9", "TTACjz...Nyr9"},
+		{"TJCnKsPa7y5okkXvQAidZBzqx3QyQ6sxMW", "TJCnKs...sxMW"},
+		{"TTACjzSeJ9j", "TTACjz...eJ9j"},
+		{"TTACjzSeJ9", ""},
+		{"", ""},
+	} {
+		if got := maskWalletAddress(tc.addr); got != tc.want {
+			t.Errorf("masked %q to %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateWalletAddress(t *testing.T) {
+	r := newTestRepo(map[string]interface{}{reportWalletKey: true})
+	// the wallet at TTACjzSeJ9jDHaxRxnho1n3mVK9JASNyr9
+	r.C.Identity.PrivKey = "CAISILOZbORDZlczUlp5jdonb5y5SMZgaZy6OWp58SkS8jS8"
+	dc := &dcWrap{node: &core.IpfsNode{Repo: r}}
+	if err := dc.updateWalletAddress(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dc.extra.WalletAddress, "TTACjz...Nyr9"; got != want {
+		t.Errorf("got wallet %q, want %q", got, want)
+	}
+
+	r.keys = nil
+	if err := dc.updateWalletAddress(); err != nil || dc.extra.WalletAddress != "" {
+		t.Errorf("got wallet %q, %v without opting in", dc.extra.WalletAddress, err)
+	}
+
+	r.keys = map[string]interface{}{reportWalletKey: true}
+	r.C.Identity.PrivKey = "not a key"
+	if err := dc.updateWalletAddress(); err == nil {
+		t.Error("expected an error for an invalid private key")
+	}
+}
+
+func TestCPUModelFallback(t *testing.T) {
+	defer func() { cpuInfoStats, cpuInfoFallback = cpu.Info, processorIdentifier }()
+	cpuInfoFallback = func() string { return "Intel64 Family 6 Model 158 Stepping 10, GenuineIntel" }
+
+	cpuInfoStats = func() ([]cpu.InfoStat, error) { return []cpu.InfoStat{{ModelName: "Core i7"}}, nil }
+	if model, err := cpuModel(); err != nil || model != "Core i7" {
+		t.Fatalf("got cpu model %q, %v, want Core i7", model, err)
+	}
+	cpuInfoStats = func() ([]cpu.InfoStat, error) { return nil, nil }
+	if model, err := cpuModel(); err != nil || model != cpuInfoFallback() {
+		t.Fatalf("got cpu model %q, %v, want the fallback", model, err)
+	}
+	cpuInfoStats = func() ([]cpu.InfoStat, error) { return nil, errors.New("wmi unavailable") }
+	if model, err := cpuModel(); err != nil || model != cpuInfoFallback() {
+		t.Fatalf("got cpu model %q, %v, want the fallback", model, err)
+	}
+	cpuInfoFallback = func() string { return "" }
+	if _, err := cpuModel(); err == nil {
+		t.Fatal("expected an error without any cpu info")
+	}
+}
+
+func TestPublicAddrs(t *testing.T) {
+	addrs := []ma.Multiaddr{
+		ma.StringCast("/ip4/127.0.0.1/tcp/4001"),
+		ma.StringCast("/ip6/::1/tcp/4001"),
+		ma.StringCast("/ip4/10.0.0.2/tcp/4001"),
+		ma.StringCast("/ip4/192.168.1.1/udp/4001/quic"),
+	}
+	for i := 0; i < 12; i++ {
+		addrs = append(addrs, ma.StringCast(fmt.Sprintf("/ip4/8.8.8.%d/tcp/4001", i)))
+	}
+	got := publicAddrs(addrs)
+	if len(got) != maxAddresses {
+		t.Fatalf("got %d addresses, want %d", len(got), maxAddresses)
+	}
+	for i, a := range got {
+		if want := fmt.Sprintf("/ip4/8.8.8.%d/tcp/4001", i); a != want {
+			t.Errorf("address %d is %s, want %s", i, a, want)
+		}
+	}
+	if got := publicAddrs(addrs[:4]); len(got) != 0 {
+		t.Errorf("private and loopback addresses reported: %v", got)
+	}
+}
+
+func TestUpdateThroughput(t *testing.T) {
+	dc := &dcWrap{pn: &nodepb.Node{}}
+	start := time.Now()
+	dc.setBitswapStat(&bitswap.Stat{DataSent: 100 << 10, DataReceived: 300 << 10})
+	dc.updateThroughput(start)
+	if dc.extra.UploadBPS != 0 || dc.extra.DownloadBPS != 0 {
+		t.Fatalf("first epoch reported %f/%f B/s", dc.extra.UploadBPS, dc.extra.DownloadBPS)
+	}
+
+	// 400 KiB up and 800 KiB down in 20 seconds
+	dc.prev, dc.statTime = clonePayload(dc.pn), start
+	dc.setBitswapStat(&bitswap.Stat{DataSent: 500 << 10, DataReceived: 1100 << 10})
+	dc.updateThroughput(start.Add(20 * time.Second))
+	if want := float64(400<<10) / 20; dc.extra.UploadBPS != want {
+		t.Errorf("got upload %f B/s, want %f", dc.extra.UploadBPS, want)
+	}
+	if want := float64(800<<10) / 20; dc.extra.DownloadBPS != want {
+		t.Errorf("got download %f B/s, want %f", dc.extra.DownloadBPS, want)
+	}
+
+	// an update within the same second has no duration to divide by
+	dc.statTime = start.Add(20 * time.Second)
+	dc.updateThroughput(start.Add(20*time.Second + time.Millisecond))
+	if dc.extra.UploadBPS != 0 || dc.extra.DownloadBPS != 0 {
+		t.Errorf("zero length epoch reported %f/%f B/s", dc.extra.UploadBPS, dc.extra.DownloadBPS)
+	}
+}
+
+func TestUpdateOpenFDs(t *testing.T) {
+	dc := &dcWrap{}
+	if err := dc.updateOpenFDs(); err != nil {
+		t.Fatal(err)
+	}
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		if dc.extra.OpenFDs == 0 {
+			t.Fatal("no open file descriptors counted")
+		}
+	default:
+		if dc.extra.OpenFDs != 0 {
+			t.Fatalf("got %d open file descriptors on unsupported %s", dc.extra.OpenFDs, runtime.GOOS)
+		}
+	}
+}
+
+func TestUpdateSystemMemory(t *testing.T) {
+	defer func() { virtualMemory, swapMemory = mem.VirtualMemory, mem.SwapMemory }()
+	var vmErr, swapErr error
+	virtualMemory = func() (*mem.VirtualMemoryStat, error) {
+		return &mem.VirtualMemoryStat{Used: 8 << 30}, vmErr
+	}
+	swapMemory = func() (*mem.SwapMemoryStat, error) {
+		return &mem.SwapMemoryStat{Used: 3 << 20}, swapErr
+	}
+
+	dc := &dcWrap{}
+	if err := dc.updateSystemMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.SystemMemUsed != 8<<20 || dc.extra.SwapUsed != 3<<10 {
+		t.Fatalf("got memory %d KiB and swap %d KiB, want %d and %d", dc.extra.SystemMemUsed, dc.extra.SwapUsed, 8<<20, 3<<10)
+	}
+
+	// containers without swap report none
+	swapErr = errors.New("no swap")
+	if err := dc.updateSystemMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.SwapUsed != 0 {
+		t.Errorf("got swap %d KiB without swap", dc.extra.SwapUsed)
+	}
+
+	vmErr = errors.New("no memory info")
+	if err := dc.updateSystemMemory(); err == nil {
+		t.Error("expected failing memory info to be reported")
+	}
+}
+
+// testBandwidth returns fixed per-protocol statistics
+type testBandwidth map[protocol.ID]metrics.Stats
+
+func (b testBandwidth) GetBandwidthByProtocol() map[protocol.ID]metrics.Stats {
+	return b
+}
+
+// testPeers is a peerstore of connected peers and the agent versions they identified with
+type testPeers map[peer.ID]interface{}
+
+func (ps testPeers) Peers() []peer.ID {
+	res := make([]peer.ID, 0, len(ps))
+	for p := range ps {
+		res = append(res, p)
+	}
+	return res
+}
+
+func (ps testPeers) Get(p peer.ID, key string) (interface{}, error) {
+	v, ok := ps[p]
+	if key != "AgentVersion" || !ok || v == nil {
+		return nil, errors.New("item not found")
+	}
+	return v, nil
+}
+
+func TestUpdateDuplicateID(t *testing.T) {
+	self := peer.ID("self")
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil), Identity: self}}
+	dc.updateDuplicateID()
+	if dc.extra.DuplicateIDDetected {
+		t.Fatal("duplicate id detected without a host")
+	}
+
+	dc.peers = testPeers{"a": nil, "b": nil}
+	dc.updateDuplicateID()
+	if dc.extra.DuplicateIDDetected {
+		t.Fatal("duplicate id detected among other peers")
+	}
+
+	dc.peers = testPeers{"a": nil, self: "go-btfs/1.5.0"}
+	dc.updateDuplicateID()
+	if !dc.extra.DuplicateIDDetected {
+		t.Fatal("peer with the node's own id not detected")
+	}
+
+	// cleared once the clone disconnects
+	dc.peers = testPeers{"a": nil}
+	dc.updateDuplicateID()
+	if dc.extra.DuplicateIDDetected {
+		t.Fatal("duplicate id still reported after the peer disconnected")
+	}
+}
+
+func TestUpdatePeerVersions(t *testing.T) {
+	peers := testPeers{
+		"a": "go-btfs/1.5.0",
+		"b": "go-btfs/1.5.0",
+		"c": "go-btfs/1.4.0",
+		"d": "go-ipfs/0.7.0",
+		"e": nil,
+		"f": 42,
+	}
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}, peers: peers}
+	dc.updatePeerVersions()
+	if dc.extra.PeerVersions != nil {
+		t.Fatalf("got peer versions %v without opting in", dc.extra.PeerVersions)
+	}
+
+	dc.node.Repo = newTestRepo(map[string]interface{}{reportPeerVersionsKey: true})
+	dc.updatePeerVersions()
+	want := map[string]uint64{
+		"go-btfs/1.5.0":    2,
+		"go-btfs/1.4.0":    1,
+		"go-ipfs/0.7.0":    1,
+		unknownPeerVersion: 2,
+	}
+	if !reflect.DeepEqual(dc.extra.PeerVersions, want) {
+		t.Fatalf("got peer versions %v, want %v", dc.extra.PeerVersions, want)
+	}
+
+	// every peer on another version, the most common ones are kept
+	peers = testPeers{}
+	for i := 0; i < 2*maxPeerVersions; i++ {
+		peers[peer.ID("popular"+strconv.Itoa(i))] = "go-btfs/1.5.0"
+		peers[peer.ID("rare"+strconv.Itoa(i))] = "go-btfs/0.0." + strconv.Itoa(i)
+	}
+	dc.peers = peers
+	dc.updatePeerVersions()
+	if got := len(dc.extra.PeerVersions); got != maxPeerVersions {
+		t.Fatalf("got %d peer versions, want %d", got, maxPeerVersions)
+	}
+	if got := dc.extra.PeerVersions["go-btfs/1.5.0"]; got != 2*maxPeerVersions {
+		t.Errorf("got %d peers on the most common version, want %d", got, 2*maxPeerVersions)
+	}
+	var total uint64
+	for _, n := range dc.extra.PeerVersions {
+		total += n
+	}
+	if total != uint64(len(peers)) {
+		t.Errorf("counted %d peers, want %d", total, len(peers))
+	}
+	if got, want := dc.extra.PeerVersions[otherPeerVersion], uint64(2*maxPeerVersions-(maxPeerVersions-2)); got != want {
+		t.Errorf("got %d peers on other versions, want %d", got, want)
+	}
+}
+
+func TestUpdateProtocolStats(t *testing.T) {
+	dc := &dcWrap{bandwidth: testBandwidth{
+		"/ipfs/bitswap/1.2.0": {TotalOut: 9000, TotalIn: 1},
+		"/ipfs/kad/1.0.0":     {TotalOut: 5000},
+		"/ipfs/id/1.0.0":      {TotalOut: 300},
+		"/ipfs/ping/1.0.0":    {TotalOut: 40},
+		"/libp2p/circuit":     {TotalOut: 40},
+		"/meshsub/1.1.0":      {TotalOut: 20, TotalIn: 99999},
+		"/btfs/hub":           {TotalOut: 1},
+	}}
+	dc.updateProtocolStats()
+	want := map[string]uint64{
+		"/ipfs/bitswap/1.2.0": 9000,
+		"/ipfs/kad/1.0.0":     5000,
+		"/ipfs/id/1.0.0":      300,
+		"/ipfs/ping/1.0.0":    40,
+		"/libp2p/circuit":     40,
+	}
+	if !reflect.DeepEqual(dc.extra.ProtocolStats, want) {
+		t.Fatalf("got protocol stats %v, want %v", dc.extra.ProtocolStats, want)
+	}
+
+	dc.bandwidth = testBandwidth{}
+	dc.updateProtocolStats()
+	if len(dc.extra.ProtocolStats) != 0 {
+		t.Errorf("got protocol stats %v without traffic", dc.extra.ProtocolStats)
+	}
+}
+
+// testBlockCache reports fixed cache statistics
+type testBlockCache struct {
+	hits, misses uint64
+	ok           bool
+}
+
+func (c testBlockCache) CacheStats() (uint64, uint64, bool) {
+	return c.hits, c.misses, c.ok
+}
+
+func TestUpdateCacheHitRate(t *testing.T) {
+	dc := &dcWrap{}
+	for _, tc := range []struct {
+		cache blockCacheStats
+		want  float64
+	}{
+		{nil, -1},
+		{testBlockCache{ok: false}, -1},
+		{testBlockCache{ok: true}, 0},
+		{testBlockCache{hits: 3, misses: 1, ok: true}, 0.75},
+		{testBlockCache{hits: 0, misses: 5, ok: true}, 0},
+	} {
+		dc.blockCache = tc.cache
+		dc.updateCacheHitRate()
+		if dc.extra.CacheHitRate != tc.want {
+			t.Errorf("%+v: got hit rate %v, want %v", tc.cache, dc.extra.CacheHitRate, tc.want)
+		}
+	}
+}
+
+func TestUpdateCacheHitRateNode(t *testing.T) {
+	dc := newTestDcWrap(t)
+	if dc.node.BlockCache == nil {
+		t.Fatal("node has no block cache counters")
+	}
+	dc.blockCache = dc.node.BlockCache
+	blk := merkledag.NewRawNode([]byte("cached block"))
+	if err := dc.node.Blockstore.Put(blk); err != nil {
+		t.Fatal(err)
+	}
+	// the ARC cache remembers which blocks are stored, not their data
+	before, _, _ := dc.node.BlockCache.CacheStats()
+	if has, err := dc.node.Blockstore.Has(blk.Cid()); err != nil || !has {
+		t.Fatalf("stored block not found: %v", err)
+	}
+	if hits, _, _ := dc.node.BlockCache.CacheStats(); hits <= before {
+		t.Fatalf("got %d cache hits after looking up a stored block, had %d", hits, before)
+	}
+	dc.updateCacheHitRate()
+	if dc.extra.CacheHitRate <= 0 || dc.extra.CacheHitRate > 1 {
+		t.Fatalf("got hit rate %v", dc.extra.CacheHitRate)
+	}
+}
+
+func TestUpdateAnomalies(t *testing.T) {
+	update := func(dc *dcWrap, pn nodepb.Node) uint32 {
+		dc.pn = &pn
+		dc.updateAnomalies()
+		dc.collected = &dcReport{Node: clonePayload(dc.pn)}
+		return dc.extra.AnomalyFlags
+	}
+	normal := nodepb.Node{CpuUsed: 20, PeersConnected: 10, MemoryUsed: 1000}
+
+	t.Run("cpu", func(t *testing.T) {
+		dc := &dcWrap{}
+		busy := normal
+		busy.CpuUsed = 99
+		for i := 1; i < anomalyCPUEpochs; i++ {
+			if flags := update(dc, busy); flags != 0 {
+				t.Fatalf("update %d: got flags %b before %d busy updates", i, flags, anomalyCPUEpochs)
+			}
+		}
+		if flags := update(dc, busy); flags != anomalyCPU {
+			t.Fatalf("got flags %b, want %b", flags, anomalyCPU)
+		}
+		if flags := update(dc, normal); flags != 0 {
+			t.Fatalf("got flags %b once the CPU calmed down", flags)
+		}
+		if flags := update(dc, busy); flags != 0 {
+			t.Fatalf("got flags %b after a single busy update", flags)
+		}
+	})
+
+	t.Run("peers lost", func(t *testing.T) {
+		dc := &dcWrap{}
+		alone := normal
+		alone.PeersConnected = 0
+		if flags := update(dc, alone); flags != 0 {
+			t.Fatalf("got flags %b for a node that never had peers", flags)
+		}
+		update(dc, normal)
+		if flags := update(dc, alone); flags != anomalyPeersLost {
+			t.Fatalf("got flags %b, want %b", flags, anomalyPeersLost)
+		}
+	})
+
+	t.Run("memory spike", func(t *testing.T) {
+		dc := &dcWrap{}
+		update(dc, normal)
+		grown := normal
+		grown.MemoryUsed = 1500
+		if flags := update(dc, grown); flags != 0 {
+			t.Fatalf("got flags %b for 50%% growth", flags)
+		}
+		grown.MemoryUsed = 2300
+		if flags := update(dc, grown); flags != anomalyMemorySpike {
+			t.Fatalf("got flags %b, want %b", flags, anomalyMemorySpike)
+		}
+	})
+}
+
+func TestUpdatePeerChange(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{peerChangeThresholdKey: float64(10)})
+	stats := &testStats{st: &bitswap.Stat{}}
+	withPeers := func(n int) {
+		stats.st.Peers = make([]string, n)
+		for i := range stats.st.Peers {
+			stats.st.Peers[i] = fmt.Sprintf("peer%d", i)
+		}
+		st, _ := stats.Stat()
+		dc.setBitswapStat(st)
+		dc.updatePeerChange()
+	}
+	for _, tc := range []struct {
+		peers  int
+		delta  int64
+		alerts uint64
+	}{
+		{10, 0, 0},
+		// within the threshold
+		{20, 10, 0},
+		{50, 30, 1},
+		{45, -5, 1},
+		{5, -40, 2},
+	} {
+		withPeers(tc.peers)
+		if dc.extra.PeerDelta != tc.delta || dc.extra.HealthAlerts != tc.alerts {
+			t.Fatalf("%d peers: got delta %d and %d alerts, want %d and %d",
+				tc.peers, dc.extra.PeerDelta, dc.extra.HealthAlerts, tc.delta, tc.alerts)
+		}
+	}
+	if dc.alerts.current != 2 {
+		t.Fatalf("got %d alerts this epoch, want 2", dc.alerts.current)
+	}
+}
+
+func TestUpdateConfigModified(t *testing.T) {
+	dc := newTestDcWrap(t)
+	if err := dc.updateConfigModified(); err != nil || dc.extra.ConfigLastModified != 0 {
+		t.Fatalf("got %d, %v without a config file", dc.extra.ConfigLastModified, err)
+	}
+
+	dc.configPath = filepath.Join(t.TempDir(), config.DefaultConfigFile)
+	if err := dc.updateConfigModified(); err == nil {
+		t.Fatal("expected an error for a missing config file")
+	}
+	if err := ioutil.WriteFile(dc.configPath, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dc.configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.updateConfigModified(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.ConfigLastModified != fi.ModTime().Unix() {
+		t.Fatalf("got %d, want %d", dc.extra.ConfigLastModified, fi.ModTime().Unix())
+	}
+
+	// an old config reports when it was written rather than when it was read
+	written := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(dc.configPath, written, written); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.updateConfigModified(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.ConfigLastModified != written.Unix() {
+		t.Fatalf("got %d, want %d", dc.extra.ConfigLastModified, written.Unix())
+	}
+}
+
+func TestUpdateRepoVersion(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.extra.RepoVersion = 7
+	dc.updateRepoVersion()
+	if dc.extra.RepoVersion != 0 {
+		t.Fatalf("got repo version %d without a repo path", dc.extra.RepoVersion)
+	}
+
+	dc.repoPath = t.TempDir()
+	if err := mfsr.RepoPath(dc.repoPath).WriteVersion(fsrepo.RepoVersion); err != nil {
+		t.Fatal(err)
+	}
+	dc.updateRepoVersion()
+	if dc.extra.RepoVersion != uint32(fsrepo.RepoVersion) {
+		t.Fatalf("got repo version %d, want %d", dc.extra.RepoVersion, fsrepo.RepoVersion)
+	}
+
+	// a missing or corrupt version file does not keep the heartbeat from being sent
+	for _, content := range []string{"", "ten\n"} {
+		path := mfsr.RepoPath(dc.repoPath).VersionFile()
+		os.Remove(path)
+		if content != "" {
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dc.updateRepoVersion()
+		if dc.extra.RepoVersion != 0 {
+			t.Fatalf("got repo version %d from %q", dc.extra.RepoVersion, content)
+		}
+	}
+}
+
+func TestDiskIOFromDeliveredHeartbeat(t *testing.T) {
+	var read uint64
+	diskIOCounters = func(...string) (map[string]disk.IOCountersStat, error) {
+		return map[string]disk.IOCountersStat{"sda": {ReadBytes: read}}, nil
+	}
+	defer func() { diskIOCounters = disk.IOCounters }()
+
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	read = 1 << 20
+	if err := dc.sendData(context.Background(), dc.node, dc.newBackoff()); err != nil {
+		t.Fatal(err)
+	}
+	// a sampled out heartbeat is collected but not sent
+	read = 2 << 20
+	dc.update(dc.node)
+	read = 4 << 20
+	if err := dc.sendData(context.Background(), dc.node, dc.newBackoff()); err != nil {
+		t.Fatal(err)
+	}
+	sms := ss.metrics()
+	if len(sms) != 2 {
+		t.Fatalf("status server received %d heartbeats, want 2", len(sms))
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(sms[1].Payload, info); err != nil {
+		t.Fatal(err)
+	}
+	extra, ok, err := decodeExtraMetrics(info)
+	if err != nil || !ok {
+		t.Fatalf("no extra metrics: %v", err)
+	}
+	if extra.DiskRead != 3072 {
+		t.Fatalf("got %d KiB read, want 3072 since the delivered heartbeat", extra.DiskRead)
+	}
+}
@@ -0,0 +1,15 @@
+package spin
+
+import (
+	"io/ioutil"
+)
+
+// openFDs returns the number of file descriptors held by the daemon. gopsutil
+// does not implement OpenFiles on darwin, so they are listed from /dev/fd.
+func openFDs() (uint64, error) {
+	fds, err := ioutil.ReadDir("/dev/fd")
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(fds)), nil
+}
@@ -0,0 +1,20 @@
+package spin
+
+import (
+	"os"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// openFDs returns the number of file descriptors held by the daemon.
+func openFDs() (uint64, error) {
+	p, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		return 0, err
+	}
+	files, err := p.OpenFiles()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(files)), nil
+}
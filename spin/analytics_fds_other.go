@@ -0,0 +1,8 @@
+// +build !linux,!darwin
+
+package spin
+
+// openFDs is not supported on this platform and always reports 0.
+func openFDs() (uint64, error) {
+	return 0, nil
+}
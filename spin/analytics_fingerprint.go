@@ -0,0 +1,94 @@
+package spin
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+
+	ic "github.com/libp2p/go-libp2p-crypto"
+	"google.golang.org/grpc/metadata"
+)
+
+// gRPC metadata key carrying the fingerprint of the key the payload is signed
+// with, so the status server notices a node whose key was rotated
+const publicKeyFingerprintKey = "btfs-public-key-fingerprint"
+
+var (
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidSecp256k1      = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+)
+
+// subjectPublicKeyInfo is the PKIX structure x509 marshals public keys into
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// publicKeyDER returns the PKIX, ASN.1 DER form of pub. x509 cannot marshal
+// secp256k1 keys, which are encoded as EC keys with their compressed point.
+func publicKeyDER(pub ic.PubKey) ([]byte, error) {
+	raw, err := pub.Raw()
+	if err != nil {
+		return nil, err
+	}
+	switch pub.(type) {
+	case *ic.RsaPublicKey, *ic.ECDSAPublicKey:
+		// already PKIX DER
+		return raw, nil
+	case *ic.Ed25519PublicKey:
+		return x509.MarshalPKIXPublicKey(ed25519.PublicKey(raw))
+	case *ic.Secp256k1PublicKey:
+		params, err := asn1.Marshal(oidSecp256k1)
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(subjectPublicKeyInfo{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyECDSA, Parameters: asn1.RawValue{FullBytes: params}},
+			PublicKey: asn1.BitString{Bytes: raw, BitLength: 8 * len(raw)},
+		})
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// publicKeyFingerprint returns the hex sha256 of the DER form of pub.
+func publicKeyFingerprint(pub ic.PubKey) (string, error) {
+	der, err := publicKeyDER(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// updateFingerprint records the fingerprint of the node's key, unless privacy mode
+// keeps it from the status server.
+func (dc *dcWrap) updateFingerprint() error {
+	if dc.node.PrivateKey == nil || dc.privacyMode() {
+		dc.extra.PublicKeyFingerprint = ""
+		return nil
+	}
+	fp, err := publicKeyFingerprint(dc.node.PrivateKey.GetPublic())
+	if err != nil {
+		return fmt.Errorf("failed to fingerprint the node's public key: %s", err.Error())
+	}
+	dc.extra.PublicKeyFingerprint = fp
+	return nil
+}
+
+// withFingerprint adds the public key fingerprint, once known, to the outgoing
+// metadata of ctx, outside of privacy mode.
+func (dc *dcWrap) withFingerprint(ctx context.Context) context.Context {
+	dc.mu.RLock()
+	fp := dc.extra.PublicKeyFingerprint
+	dc.mu.RUnlock()
+	if fp == "" || dc.privacyMode() {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, publicKeyFingerprintKey, fp)
+}
@@ -0,0 +1,84 @@
+package spin
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"reflect"
+	"testing"
+
+	"github.com/cenkalti/backoff/v4"
+	ic "github.com/libp2p/go-libp2p-crypto"
+)
+
+func TestPublicKeyFingerprint(t *testing.T) {
+	for _, typ := range []int{ic.Secp256k1, ic.Ed25519, ic.ECDSA, ic.RSA} {
+		var fps []string
+		for i := 0; i < 2; i++ {
+			_, pub, err := ic.GenerateKeyPair(typ, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp, err := publicKeyFingerprint(pub)
+			if err != nil {
+				t.Fatalf("key type %d: %s", typ, err)
+			}
+			if again, err := publicKeyFingerprint(pub); err != nil || again != fp {
+				t.Errorf("key type %d: fingerprint changed from %s to %s", typ, fp, again)
+			}
+			if len(fp) != 64 {
+				t.Errorf("key type %d: got fingerprint %q, want hex sha256", typ, fp)
+			}
+			fps = append(fps, fp)
+
+			der, err := publicKeyDER(pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ == ic.Secp256k1 {
+				var spki subjectPublicKeyInfo
+				if rest, err := asn1.Unmarshal(der, &spki); err != nil || len(rest) != 0 {
+					t.Fatalf("secp256k1 key is not DER: %v", err)
+				}
+				raw, _ := pub.Raw()
+				if !reflect.DeepEqual(spki.PublicKey.Bytes, raw) {
+					t.Error("secp256k1 DER does not hold the key")
+				}
+			} else if _, err := x509.ParsePKIXPublicKey(der); err != nil {
+				t.Errorf("key type %d is not PKIX DER: %s", typ, err)
+			}
+		}
+		if fps[0] == fps[1] {
+			t.Errorf("key type %d: different keys share fingerprint %s", typ, fps[0])
+		}
+	}
+}
+
+func TestFingerprintMetadata(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	want, err := publicKeyFingerprint(dc.node.PrivateKey.GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.PublicKeyFingerprint != want {
+		t.Errorf("got fingerprint %q, want %q", dc.extra.PublicKeyFingerprint, want)
+	}
+	if got := ss.metadata(publicKeyFingerprintKey); !reflect.DeepEqual(got, [][]string{{want}}) {
+		t.Errorf("status server got fingerprints %q, want %q", got, want)
+	}
+
+	// a rotated key reports a new fingerprint
+	if dc.node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metadata(publicKeyFingerprintKey); len(got) != 2 || got[1][0] == want {
+		t.Errorf("got fingerprints %q after rotating the key", got)
+	}
+}
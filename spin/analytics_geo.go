@@ -0,0 +1,116 @@
+package spin
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// countryDBFile is where the IP to country database is looked up in the repo by default
+const countryDBFile = "IP2LOCATION-LITE-DB1.CSV"
+
+// countryRange maps the IPv4 addresses from start to end to a country code
+type countryRange struct {
+	start, end uint32
+	country    string
+}
+
+// countryDB is an IPv4 to country table sorted by range
+type countryDB []countryRange
+
+// loadCountryDB reads an IP2Location LITE DB1 CSV file, whose rows are
+// "ip_from","ip_to","country_code","country_name" with IPv4 addresses as numbers.
+func loadCountryDB(path string) (countryDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	var db countryDB
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read country database %s: %s", path, err)
+		}
+		if len(rec) < 3 {
+			return nil, fmt.Errorf("invalid country database %s: row %v has no country", path, rec)
+		}
+		start, err1 := strconv.ParseUint(rec[0], 10, 32)
+		end, err2 := strconv.ParseUint(rec[1], 10, 32)
+		if err1 != nil || err2 != nil || start > end {
+			return nil, fmt.Errorf("invalid country database %s: bad range in row %v", path, rec)
+		}
+		country := rec[2]
+		if country == "-" {
+			country = ""
+		}
+		db = append(db, countryRange{start: uint32(start), end: uint32(end), country: country})
+	}
+	sort.Slice(db, func(i, j int) bool { return db[i].start < db[j].start })
+	return db, nil
+}
+
+// country returns the country code of ip, empty if unknown or not IPv4.
+func (db countryDB) country(ip net.IP) string {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return ""
+	}
+	n := binary.BigEndian.Uint32(ip4)
+	i := sort.Search(len(db), func(i int) bool { return db[i].end >= n })
+	if i < len(db) && db[i].start <= n {
+		return db[i].country
+	}
+	return ""
+}
+
+// countryOf looks up the country of the first public IPv4 address in addrs.
+func (db countryDB) countryOf(addrs []ma.Multiaddr) string {
+	for _, a := range addrs {
+		if !manet.IsPublicAddr(a) {
+			continue
+		}
+		ip, err := manet.ToIP(a)
+		if err != nil || ip.To4() == nil {
+			continue
+		}
+		return db.country(ip)
+	}
+	return ""
+}
+
+// updateCountry sets the country the node announces itself from, if the operator
+// opted in with Analytics.ReportCountry. The database is loaded on first use.
+func (dc *dcWrap) updateCountry() error {
+	if !configBool(dc.node.Repo, reportCountryKey, false) {
+		dc.pn.CountryShort = ""
+		return nil
+	}
+	if !dc.countriesLoaded {
+		dc.countriesLoaded = true
+		db, err := loadCountryDB(dc.countryDBPath)
+		if err != nil {
+			return fmt.Errorf("failed to load country database: %s", err.Error())
+		}
+		dc.countries = db
+	}
+	if dc.countries == nil || dc.node.PeerHost == nil {
+		dc.pn.CountryShort = ""
+		return nil
+	}
+	dc.pn.CountryShort = dc.countries.countryOf(dc.node.PeerHost.Addrs())
+	return nil
+}
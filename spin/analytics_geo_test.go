@@ -0,0 +1,87 @@
+package spin
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const testCountryDB = `"0","16777215","-","-"
+"16777216","16777471","AU","Australia"
+"134744064","134744319","US","United States of America"
+"3232235520","3232301055","-","-"
+`
+
+func writeTestCountryDB(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), countryDBFile)
+	if err := ioutil.WriteFile(path, []byte(testCountryDB), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCountryDB(t *testing.T) {
+	db, err := loadCountryDB(writeTestCountryDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{
+		"1.0.0.1":     "AU",
+		"8.8.8.8":     "US",
+		"8.8.9.1":     "",
+		"0.0.0.1":     "",
+		"192.168.1.1": "",
+		"2001:4860::": "",
+	} {
+		if got := db.country(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: got country %q, want %q", ip, got, want)
+		}
+	}
+
+	addrs := []ma.Multiaddr{
+		ma.StringCast("/ip4/127.0.0.1/tcp/4001"),
+		ma.StringCast("/ip4/192.168.1.1/tcp/4001"),
+		ma.StringCast("/ip6/2001:4860::8888/tcp/4001"),
+		ma.StringCast("/ip4/8.8.8.8/tcp/4001"),
+		ma.StringCast("/ip4/1.0.0.1/tcp/4001"),
+	}
+	if got := db.countryOf(addrs); got != "US" {
+		t.Errorf("got country %q for the first public IPv4, want US", got)
+	}
+	if got := db.countryOf(addrs[:3]); got != "" {
+		t.Errorf("got country %q without public IPv4 addresses", got)
+	}
+}
+
+func TestUpdateCountry(t *testing.T) {
+	dc := &dcWrap{
+		node:          &core.IpfsNode{Repo: newTestRepo(map[string]interface{}{reportCountryKey: true})},
+		pn:            &nodepb.Node{Node_Geo: nodepb.Node_Geo{CountryShort: "US"}},
+		countryDBPath: filepath.Join(t.TempDir(), countryDBFile),
+	}
+	if err := dc.updateCountry(); err == nil {
+		t.Fatal("expected missing country database to be reported")
+	}
+	if err := dc.updateCountry(); err != nil {
+		t.Fatalf("missing country database reported again: %s", err)
+	}
+	if dc.pn.CountryShort != "" {
+		t.Fatalf("got country %q without a database", dc.pn.CountryShort)
+	}
+
+	dc = &dcWrap{
+		node:          &core.IpfsNode{Repo: newTestRepo(nil)},
+		pn:            &nodepb.Node{Node_Geo: nodepb.Node_Geo{CountryShort: "US"}},
+		countryDBPath: writeTestCountryDB(t),
+	}
+	if err := dc.updateCountry(); err != nil || dc.pn.CountryShort != "" || dc.countriesLoaded {
+		t.Fatalf("country reported without opting in: %q, %v", dc.pn.CountryShort, err)
+	}
+}
@@ -0,0 +1,49 @@
+package spin
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// gRPC metadata key carrying Analytics.NodeGroup. node.Node has no field for it.
+const nodeGroupMetadataKey = "btfs-node-group"
+
+// maxNodeGroupLen caps the group name sent with every call
+const maxNodeGroupLen = 64
+
+// updateNodeGroup sets the group the operator tagged the node with, if any. Names
+// that cannot be sent as metadata are not reported.
+func (dc *dcWrap) updateNodeGroup() {
+	group := strings.TrimSpace(configString(dc.node.Repo, nodeGroupKey, ""))
+	if !validNodeGroup(group) {
+		log.Warningf("Invalid %s %q, not reported", nodeGroupKey, group)
+		group = ""
+	}
+	dc.extra.NodeGroup = group
+}
+
+// validNodeGroup reports whether group is printable ASCII of at most maxNodeGroupLen.
+func validNodeGroup(group string) bool {
+	if len(group) > maxNodeGroupLen {
+		return false
+	}
+	for i := 0; i < len(group); i++ {
+		if group[i] < 0x20 || group[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// withNodeGroup adds the node's group, if it has one, to the outgoing metadata of ctx.
+func (dc *dcWrap) withNodeGroup(ctx context.Context) context.Context {
+	dc.mu.RLock()
+	group := dc.extra.NodeGroup
+	dc.mu.RUnlock()
+	if group == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, nodeGroupMetadataKey, group)
+}
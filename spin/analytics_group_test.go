@@ -0,0 +1,61 @@
+package spin
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+func TestNodeGroupMetadata(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	keys := map[string]interface{}{nodeGroupKey: " datacenter-us-east "}
+	dc.node.Repo.(*testRepo).keys = keys
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if dc.extra.NodeGroup != "datacenter-us-east" {
+		t.Errorf("got node group %q", dc.extra.NodeGroup)
+	}
+	if got := ss.metadata(nodeGroupMetadataKey); !reflect.DeepEqual(got, [][]string{{"datacenter-us-east"}}) {
+		t.Errorf("status server got node groups %q", got)
+	}
+
+	// an empty group is not sent at all
+	keys[nodeGroupKey] = ""
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metadata(nodeGroupMetadataKey); len(got) != 2 || got[1] != nil {
+		t.Errorf("status server got node groups %q without one configured", got)
+	}
+}
+
+func TestUpdateNodeGroup(t *testing.T) {
+	for _, tc := range []struct {
+		group interface{}
+		want  string
+	}{
+		{nil, ""},
+		{"edge", "edge"},
+		{"  ", ""},
+		{"bad\ngroup", ""},
+		{"zürich", ""},
+		{strings.Repeat("g", maxNodeGroupLen+1), ""},
+		{42.0, ""},
+	} {
+		dc := newTestDcWrap(t)
+		keys := map[string]interface{}{}
+		if tc.group != nil {
+			keys[nodeGroupKey] = tc.group
+		}
+		dc.node.Repo = newTestRepo(keys)
+		dc.updateNodeGroup()
+		if dc.extra.NodeGroup != tc.want {
+			t.Errorf("group %q: got %q, want %q", tc.group, dc.extra.NodeGroup, tc.want)
+		}
+	}
+}
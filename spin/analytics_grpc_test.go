@@ -0,0 +1,749 @@
+package spin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gogo/protobuf/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testStatusServer records the metrics it receives
+type testStatusServer struct {
+	pb.UnimplementedStatusServiceServer
+
+	mu       sync.Mutex
+	received []*pb.SignedMetrics
+	fail     bool
+	// noBatch makes the server behave like one without UpdateMetricsBatch
+	noBatch bool
+	// delay holds back every unary answer
+	delay   time.Duration
+	batches int
+	conns   int
+	// metadata of every call
+	mds []metadata.MD
+}
+
+func (s *testStatusServer) UpdateMetricsAndDiscovery(ctx context.Context, sm *pb.SignedMetrics) (*types.Empty, error) {
+	s.mu.Lock()
+	delay := s.delay
+	s.mu.Unlock()
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return nil, errors.New("status server unavailable")
+	}
+	s.received = append(s.received, sm)
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mds = append(s.mds, md)
+	return &types.Empty{}, nil
+}
+
+// updateMetricsBatch serves UpdateMetricsBatch, which the generated service does
+// not know about, as an unknown method.
+func (s *testStatusServer) updateMetricsBatch(srv interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	s.mu.Lock()
+	noBatch, fail := s.noBatch, s.fail
+	s.mu.Unlock()
+	if method != updateMetricsBatchMethod || noBatch {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+	if fail {
+		return errors.New("status server unavailable")
+	}
+	var batch []*pb.SignedMetrics
+	for {
+		sm := new(pb.SignedMetrics)
+		if err := stream.RecvMsg(sm); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		batch = append(batch, sm)
+	}
+	s.mu.Lock()
+	s.received = append(s.received, batch...)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.mds = append(s.mds, md)
+	s.batches++
+	s.mu.Unlock()
+	return stream.SendMsg(&types.Empty{})
+}
+
+func (s *testStatusServer) setDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+}
+
+func (s *testStatusServer) setNoBatch(noBatch bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noBatch = noBatch
+}
+
+func (s *testStatusServer) counts() (batches, conns int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches, s.conns
+}
+
+// countingListener records every connection accepted by the test server
+type countingListener struct {
+	net.Listener
+	ss *testStatusServer
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.ss.mu.Lock()
+		l.ss.conns++
+		l.ss.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (s *testStatusServer) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+// metadata returns the values of key in the metadata of every call
+func (s *testStatusServer) metadata(key string) [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res [][]string
+	for _, md := range s.mds {
+		res = append(res, md.Get(key))
+	}
+	return res
+}
+
+func (s *testStatusServer) metrics() []*pb.SignedMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*pb.SignedMetrics(nil), s.received...)
+}
+
+// startTestStatusServer serves a testStatusServer on a local port and returns its address.
+func startTestStatusServer(t *testing.T, opts ...grpc.ServerOption) (*testStatusServer, string) {
+	ss, _, addr := listenTestStatusServer(t, "127.0.0.1:0", opts...)
+	return ss, addr
+}
+
+// listenTestStatusServer serves a testStatusServer at addr and returns it along with
+// its grpc server and actual address.
+func listenTestStatusServer(t *testing.T, addr string, opts ...grpc.ServerOption) (*testStatusServer, *grpc.Server, string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &testStatusServer{}
+	srv := grpc.NewServer(append(opts, grpc.UnknownServiceHandler(ss.updateMetricsBatch))...)
+	pb.RegisterStatusServiceServer(srv, ss)
+	go srv.Serve(&countingListener{Listener: lis, ss: ss})
+	t.Cleanup(srv.Stop)
+	return ss, srv, lis.Addr().String()
+}
+
+// writeSelfSignedCert creates a self-signed certificate for 127.0.0.1 and returns
+// it along with the paths of its PEM encoded certificate and key.
+func writeSelfSignedCert(t *testing.T) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "status-test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPath, keyPath
+}
+
+func TestParseStatusServerDomain(t *testing.T) {
+	for _, tc := range []struct {
+		domain, scheme, addr string
+	}{
+		{"https://status.btfs.io", "https", "status.btfs.io:443"},
+		{"http://status.btfs.io", "http", "status.btfs.io:80"},
+		{"status.btfs.io:8080", "http", "status.btfs.io:8080"},
+		{"//127.0.0.1:9000", "http", "127.0.0.1:9000"},
+	} {
+		scheme, addr, err := parseStatusServerDomain(tc.domain)
+		if err != nil {
+			t.Errorf("%s: %s", tc.domain, err)
+			continue
+		}
+		if scheme != tc.scheme || addr != tc.addr {
+			t.Errorf("%s: got %s %s, want %s %s", tc.domain, scheme, addr, tc.scheme, tc.addr)
+		}
+	}
+	for _, domain := range []string{"", "ftp://status.btfs.io", "status.btfs.io", "https://", "127.0.0.1:"} {
+		if _, _, err := parseStatusServerDomain(domain); err == nil {
+			t.Errorf("%q: expected invalid domain error", domain)
+		}
+	}
+}
+
+func TestDoSendDataTLS(t *testing.T) {
+	cert, certPath, _ := writeSelfSignedCert(t)
+	ss, addr := startTestStatusServer(t, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+
+	r := newTestRepo(map[string]interface{}{
+		statusTLSKey:       true,
+		statusTLSCACertKey: certPath,
+	})
+	dc := &dcWrap{node: &core.IpfsNode{Repo: r}, statusServerDomains: []string{addr}}
+
+	sm := &pb.SignedMetrics{Payload: []byte("payload")}
+	if err := dc.doSendData(context.Background(), sm); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metrics(); len(got) != 1 || string(got[0].Payload) != "payload" {
+		t.Fatalf("status server received %v", got)
+	}
+
+	// without the CA bundle the self-signed certificate must be rejected, settings
+	// are only read when dialing
+	delete(r.keys, statusTLSCACertKey)
+	dc.closeConn()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := dc.doSendData(ctx, sm); err == nil {
+		t.Fatal("expected untrusted certificate to fail")
+	}
+}
+
+func TestDoSendDataPerInstanceDomain(t *testing.T) {
+	ss1, addr1 := startTestStatusServer(t)
+	ss2, addr2 := startTestStatusServer(t)
+	dc1 := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}, statusServerDomains: []string{addr1}}
+	dc2 := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}, statusServerDomains: []string{addr2}}
+
+	if err := dc1.doSendData(context.Background(), &pb.SignedMetrics{Payload: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc2.doSendData(context.Background(), &pb.SignedMetrics{Payload: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss1.metrics(); len(got) != 1 || string(got[0].Payload) != "1" {
+		t.Errorf("first status server received %v", got)
+	}
+	if got := ss2.metrics(); len(got) != 1 || string(got[0].Payload) != "2" {
+		t.Errorf("second status server received %v", got)
+	}
+}
+
+func TestSendFanout(t *testing.T) {
+	ss1, addr1 := startTestStatusServer(t)
+	ss2, addr2 := startTestStatusServer(t)
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+		statusServerDomains: []string{addr1, addr2},
+		pending:             newMetricsBuffer(defaultBufferSize),
+	}
+	defer dc.closeConn()
+
+	if err := dc.send(context.Background(), testMetrics(0), &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, ss := range []*testStatusServer{ss1, ss2} {
+		if got := ss.metrics(); len(got) != 1 || string(got[0].Payload) != string(testMetrics(0).Payload) {
+			t.Errorf("status server %d received %v", i+1, got)
+		}
+	}
+
+	// one endpoint failing is logged but neither an error nor a health alert
+	ss2.setFail(true)
+	if err := dc.send(context.Background(), testMetrics(1), &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ss1.metrics()); got != 2 {
+		t.Errorf("healthy status server has %d metrics, want 2", got)
+	}
+	if dc.pending.len() != 0 || dc.extra.HealthAlerts != 0 {
+		t.Errorf("partial failure left %d pending and %d alerts", dc.pending.len(), dc.extra.HealthAlerts)
+	}
+
+	ss1.setFail(true)
+	if err := dc.send(context.Background(), testMetrics(2), &backoff.StopBackOff{}); err == nil {
+		t.Fatal("expected sending to fail when every status server fails")
+	}
+	if dc.pending.len() != 1 || dc.extra.HealthAlerts != 1 {
+		t.Errorf("total failure left %d pending and %d alerts, want 1 and 1", dc.pending.len(), dc.extra.HealthAlerts)
+	}
+}
+
+func TestFanoutDialsInParallel(t *testing.T) {
+	// a status server that accepts connections but never answers the handshake
+	// keeps its dial blocked until the dial timeout
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	ss, addr := startTestStatusServer(t)
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+		statusServerDomains: []string{silent.Addr().String(), addr},
+		pending:             newMetricsBuffer(defaultBufferSize),
+		dialTimeout:         time.Minute,
+	}
+	defer dc.closeConn()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dialed := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := dc.grpcConn(ctx, silent.Addr().String())
+			dialed <- err
+		}()
+	}
+	select {
+	case c := <-accepted:
+		defer c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent status server was not dialed")
+	}
+
+	if _, err := dc.flushTo(context.Background(), addr, []*pb.SignedMetrics{testMetrics(0)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ss.metrics()); got != 1 {
+		t.Fatalf("healthy status server has %d metrics, want 1", got)
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Fatal("the second caller dialed the silent status server again")
+	default:
+	}
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-dialed; err == nil {
+			t.Fatal("expected the cancelled dials to fail")
+		}
+	}
+}
+
+func TestDoSendDataMutualTLS(t *testing.T) {
+	serverCert, serverCertPath, _ := writeSelfSignedCert(t)
+	_, clientCertPath, clientKeyPath := writeSelfSignedCert(t)
+	_, wrongCertPath, wrongKeyPath := writeSelfSignedCert(t)
+
+	clientCAs := x509.NewCertPool()
+	pem, err := ioutil.ReadFile(clientCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs.AppendCertsFromPEM(pem)
+	ss, addr := startTestStatusServer(t, grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})))
+
+	r := newTestRepo(map[string]interface{}{
+		statusTLSKey:        true,
+		statusTLSCACertKey:  serverCertPath,
+		statusClientCertKey: clientCertPath,
+		statusClientKeyKey:  clientKeyPath,
+	})
+	dc := &dcWrap{node: &core.IpfsNode{Repo: r}, statusServerDomains: []string{addr}}
+	sm := &pb.SignedMetrics{Payload: []byte("payload")}
+	if err := dc.doSendData(context.Background(), sm); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metrics(); len(got) != 1 {
+		t.Fatalf("status server received %d metrics, want 1", len(got))
+	}
+
+	// a certificate the server does not trust must be rejected
+	r.keys[statusClientCertKey] = wrongCertPath
+	r.keys[statusClientKeyKey] = wrongKeyPath
+	dc.closeConn()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := dc.doSendData(ctx, sm); err == nil {
+		t.Fatal("expected untrusted client certificate to fail")
+	}
+	if got := ss.metrics(); len(got) != 1 {
+		t.Fatalf("status server accepted metrics from an untrusted client")
+	}
+}
+
+func TestDoSendDataCallTimeout(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	ss.setDelay(time.Second)
+	r := newTestRepo(map[string]interface{}{callTimeoutKey: "10ms"})
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: r},
+		statusServerDomains: []string{addr},
+		callTimeout:         configDuration(r, callTimeoutKey, callTimeout),
+	}
+
+	start := time.Now()
+	err := dc.doSendData(context.Background(), &pb.SignedMetrics{Payload: []byte("slow")})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got error %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("call waited %s for the slow server", elapsed)
+	}
+	if len(ss.metrics()) != 0 {
+		t.Fatal("slow server should not have recorded metrics")
+	}
+}
+
+func TestSendReconnects(t *testing.T) {
+	ss1, srv1, addr := listenTestStatusServer(t, "127.0.0.1:0")
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+		statusServerDomains: []string{addr},
+		pending:             newMetricsBuffer(defaultBufferSize),
+		retryMaxInterval:    50 * time.Millisecond,
+	}
+	defer dc.closeConn()
+	if err := dc.send(context.Background(), testMetrics(0), dc.newBackoff()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.send(context.Background(), testMetrics(1), dc.newBackoff()); err != nil {
+		t.Fatal(err)
+	}
+	if _, conns := ss1.counts(); conns != 1 {
+		t.Fatalf("heartbeats sent over %d connections, want 1", conns)
+	}
+
+	// restart the status server on the same address
+	srv1.Stop()
+	ss2, _, _ := listenTestStatusServer(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := dc.send(ctx, testMetrics(2), dc.newBackoff()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss2.metrics(); len(got) != 1 || string(got[0].Payload) != "2" {
+		t.Fatalf("restarted status server received %v", got)
+	}
+}
+
+// testSocksProxy is a minimal unauthenticated SOCKS5 proxy supporting CONNECT.
+type testSocksProxy struct {
+	mu      sync.Mutex
+	targets []string
+}
+
+func startTestSocksProxy(t *testing.T) (*testSocksProxy, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	p := &testSocksProxy{}
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	return p, lis.Addr().String()
+}
+
+func (p *testSocksProxy) serve(c net.Conn) {
+	defer c.Close()
+	// greeting: version, number of methods, methods
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return
+	}
+	// request: version, command, reserved, address type
+	if _, err := io.ReadFull(c, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(c, buf[:n]); err != nil {
+			return
+		}
+		host = string(buf[:n])
+	default:
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, fmt.Sprint(int(buf[0])<<8|int(buf[1])))
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	if _, err := c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	go io.Copy(upstream, c)
+	io.Copy(c, upstream)
+}
+
+func (p *testSocksProxy) connects() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func TestSendMaxRetries(t *testing.T) {
+	for _, retries := range []int{1, 3, 5} {
+		var mu sync.Mutex
+		calls := 0
+		count := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler) (interface{}, error) {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			return handler(ctx, req)
+		})
+		ss, addr := startTestStatusServer(t, count)
+		ss.setFail(true)
+		dc := &dcWrap{
+			node:                &core.IpfsNode{Repo: newTestRepo(map[string]interface{}{maxRetriesKey: float64(retries)})},
+			statusServerDomains: []string{addr},
+			pending:             newMetricsBuffer(defaultBufferSize),
+			retryMaxInterval:    time.Millisecond,
+		}
+		dc.maxRetries = configInt(dc.node.Repo, maxRetriesKey, defaultMaxRetries)
+		if err := dc.send(context.Background(), testMetrics(0), dc.newBackoff()); err == nil {
+			t.Fatalf("%d retries: expected an error from a failing status server", retries)
+		}
+		dc.closeConn()
+		mu.Lock()
+		if calls != retries+1 {
+			t.Errorf("got %d calls with %d retries, want %d", calls, retries, retries+1)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestDoSendDataSocksProxy(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	p, proxyAddr := startTestSocksProxy(t)
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: newTestRepo(map[string]interface{}{statusServerProxyKey: "socks5://" + proxyAddr})},
+		statusServerDomains: []string{addr},
+	}
+	defer dc.closeConn()
+
+	if err := dc.doSendData(context.Background(), &pb.SignedMetrics{Payload: []byte("proxied")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metrics(); len(got) != 1 || string(got[0].Payload) != "proxied" {
+		t.Fatalf("status server received %v", got)
+	}
+	if got := p.connects(); len(got) != 1 || got[0] != addr {
+		t.Fatalf("proxy connected to %v, want [%s]", got, addr)
+	}
+}
+
+func TestStatusServerProxyInvalid(t *testing.T) {
+	for _, raw := range []string{"http://proxy.example.com:8080", "socks5://", "://bad"} {
+		dc := &dcWrap{
+			node:                &core.IpfsNode{Repo: newTestRepo(map[string]interface{}{statusServerProxyKey: raw})},
+			statusServerDomains: []string{"127.0.0.1:1"},
+		}
+		if err := dc.doSendData(context.Background(), &pb.SignedMetrics{}); err == nil {
+			t.Errorf("proxy %q: expected an error", raw)
+		}
+	}
+}
+
+func TestIdentityMetadata(t *testing.T) {
+	// reject calls that do not say which node made them
+	identify := grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if len(md.Get(nodeIDMetadataKey)) != 1 || len(md.Get(versionMetadataKey)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "missing node identity")
+		}
+		return handler(ctx, req)
+	})
+	ss, addr := startTestStatusServer(t, identify)
+	dc := newTestSendingDcWrap(t, addr)
+	dc.version = "1.2.3"
+	defer dc.closeConn()
+
+	if err := dc.doSendData(context.Background(), testMetrics(0)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ss.metadata(nodeIDMetadataKey), [][]string{{dc.node.Identity.Pretty()}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got node id %v, want %v", got, want)
+	}
+	if got, want := ss.metadata(versionMetadataKey), [][]string{{"1.2.3"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got version %v, want %v", got, want)
+	}
+
+	// the batch upload is a stream
+	conn, err := dc.grpcConn(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updateMetricsBatch(context.Background(), conn, []*pb.SignedMetrics{testMetrics(1), testMetrics(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metadata(versionMetadataKey); len(got) != 2 || !reflect.DeepEqual(got[1], []string{"1.2.3"}) {
+		t.Errorf("got versions %v, want the batch to carry one", got)
+	}
+
+	// privacy mode sends the pseudonymous id the payload reports
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{privacyModeKey: true}
+	dc.privacySecretPath = filepath.Join(t.TempDir(), "privacy.key")
+	if err := dc.doSendData(context.Background(), testMetrics(3)); err != nil {
+		t.Fatal(err)
+	}
+	want, err := dc.reportedNodeID(dc.node.Identity.Pretty())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metadata(nodeIDMetadataKey); len(got) != 3 || !reflect.DeepEqual(got[2], []string{want}) {
+		t.Errorf("got node ids %v, want %q last", got, want)
+	}
+}
+
+func TestStatusServerTLSFailsClosed(t *testing.T) {
+	r := newTestRepo(map[string]interface{}{statusTLSKey: true})
+	dc := &dcWrap{
+		node:          &core.IpfsNode{Repo: r},
+		tlsMarkerPath: filepath.Join(t.TempDir(), tlsMarkerFile),
+	}
+	if secure, err := dc.statusServerTLS(""); !secure || err != nil {
+		t.Fatalf("got %v, %v with %s set", secure, err, statusTLSKey)
+	}
+
+	// a config write lost the setting
+	r.keys = nil
+	if _, err := dc.statusServerTLS(""); err == nil {
+		t.Fatal("expected TLS to fail closed once configured")
+	}
+	if _, err := dc.getGrpcConn(context.Background(), "127.0.0.1:1"); err == nil {
+		t.Fatal("dialed the status server in plaintext")
+	}
+	if _, err := dc.newHTTPSender("127.0.0.1:1"); err == nil {
+		t.Fatal("created a plaintext HTTP sender")
+	}
+	if secure, err := dc.statusServerTLS("https"); !secure || err != nil {
+		t.Fatalf("got %v, %v for an https domain", secure, err)
+	}
+
+	// only an explicit opt out allows plaintext again
+	r.keys = map[string]interface{}{statusTLSKey: false}
+	if secure, err := dc.statusServerTLS(""); secure || err != nil {
+		t.Fatalf("got %v, %v with %s false", secure, err, statusTLSKey)
+	}
+	r.keys = nil
+	if secure, err := dc.statusServerTLS(""); secure || err != nil {
+		t.Fatalf("got %v, %v after opting out", secure, err)
+	}
+
+	// a CA bundle implies TLS
+	r.keys = map[string]interface{}{statusTLSCACertKey: "ca.pem"}
+	if secure, err := dc.statusServerTLS(""); !secure || err != nil {
+		t.Fatalf("got %v, %v with a CA bundle", secure, err)
+	}
+}
@@ -0,0 +1,148 @@
+package spin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/connectivity"
+)
+
+// healthCheckTimeout bounds how long HealthCheck tries to reach the status servers
+const healthCheckTimeout = 5 * time.Second
+
+// AnalyticsHealth describes the analytics of a node without sending anything
+type AnalyticsHealth struct {
+	// when the last heartbeat was attempted, zero if none was yet
+	LastSendTime time.Time
+	// why the last heartbeat failed, empty if it was delivered
+	LastSendError string
+	// whether any of the status servers, or the MQTT broker, can be connected to over
+	// the transport the heartbeats use
+	ServerReachable bool
+	// size of the payload that would be sent with the analytics collected last
+	CurrentPayloadBytes int
+	// round trip times of the status server calls since the last successful SendDataNow
+	LatencyHistogram LatencyHistogram
+}
+
+// AnalyticsStatus is the state of a node's collection agent
+type AnalyticsStatus struct {
+	// when the last heartbeat was attempted, zero if none was yet
+	LastSendTime time.Time
+	// why the last heartbeat failed, empty if it was delivered
+	LastSendError     string
+	HeartbeatInterval time.Duration
+	// whether the config currently consents to sending analytics
+	Enabled bool
+}
+
+// Status reports the agent's last heartbeat and settings.
+func (a *Agent) Status() (*AnalyticsStatus, error) {
+	if a == nil {
+		return nil, fmt.Errorf("analytics is not running")
+	}
+	dc := a.dc
+	st := &AnalyticsStatus{Enabled: dc.analyticsEnabled()}
+	dc.settingsMu.RLock()
+	st.HeartbeatInterval = dc.heartbeat
+	dc.settingsMu.RUnlock()
+	dc.mu.RLock()
+	st.LastSendTime = dc.lastSend
+	if dc.lastSendErr != nil {
+		st.LastSendError = dc.lastSendErr.Error()
+	}
+	dc.mu.RUnlock()
+	return st, nil
+}
+
+// HealthCheck reports the state of the agent's analytics. The status servers are
+// dialed to check they are reachable, but nothing is sent to them.
+func (a *Agent) HealthCheck(ctx context.Context) (*AnalyticsHealth, error) {
+	if a == nil {
+		return nil, fmt.Errorf("analytics is not running")
+	}
+	dc := a.dc
+	h := new(AnalyticsHealth)
+	dc.mu.RLock()
+	h.LastSendTime = dc.lastSend
+	if dc.lastSendErr != nil {
+		h.LastSendError = dc.lastSendErr.Error()
+	}
+	h.LatencyHistogram = dc.extra.StatusServerLatency
+	pn, extra := clonePayload(dc.pn), dc.extra
+	dc.mu.RUnlock()
+	// a slow peer listing must not hold up the heartbeats
+	payload, err := dc.payloadOf(dc.node.Identity.Pretty(), pn, &extra)
+	if err == nil && dc.compressionEnabled() {
+		payload, err = compressPayload(payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.CurrentPayloadBytes = len(payload)
+	h.ServerReachable = dc.serverReachable(ctx)
+	return h, nil
+}
+
+// serverReachable reports whether the status servers can be reached the way the
+// heartbeats are sent: the MQTT broker if one is set, any of the status servers
+// over the configured protocol and transport if not.
+func (dc *dcWrap) serverReachable(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if broker := configString(dc.node.Repo, statusServerMQTTBrokerKey, ""); broker != "" {
+		err := dc.probeMQTT(ctx, broker)
+		if err != nil {
+			log.Debug(err)
+		}
+		return err == nil
+	}
+	transport, err := dc.transport()
+	if err != nil {
+		log.Debug(err)
+		return false
+	}
+	for _, domain := range dc.domains() {
+		err := dc.probe(ctx, transport, domain)
+		if err == nil {
+			return true
+		}
+		log.Debug(err)
+	}
+	return false
+}
+
+// probe connects to the status server at domain over transport without sending it
+// anything. A gRPC connection is kept for the next heartbeat.
+func (dc *dcWrap) probe(ctx context.Context, transport, domain string) error {
+	switch transport {
+	case websocketTransport:
+		md, err := dc.withIdentity(ctx)
+		if err != nil {
+			return err
+		}
+		conn, err := dc.dialWebSocket(ctx, domain, metadataHeader(md))
+		if err != nil {
+			return err
+		}
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		return conn.Close()
+	case httpProtocol:
+		s, err := dc.newHTTPSender(domain)
+		if err != nil {
+			return err
+		}
+		defer s.close()
+		return s.probe(ctx)
+	}
+	conn, err := dc.grpcConn(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if conn.GetState() == connectivity.TransientFailure {
+		return fmt.Errorf("connection to status server %s failed", domain)
+	}
+	return nil
+}
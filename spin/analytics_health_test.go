@@ -0,0 +1,185 @@
+package spin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	iface "github.com/TRON-US/interface-go-btfs-core"
+
+	"github.com/cenkalti/backoff/v4"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+func TestHealthCheck(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestDcWrap(t)
+	dc.statusServerDomains = []string{addr}
+	defer dc.closeConn()
+	a := GetAgent(dc.node)
+
+	h, err := a.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.ServerReachable || !h.LastSendTime.IsZero() || h.LastSendError != "" || h.CurrentPayloadBytes == 0 {
+		t.Fatalf("unexpected health before any heartbeat: %+v", h)
+	}
+	if got := ss.metrics(); len(got) != 0 {
+		t.Fatalf("health check sent %d metrics", len(got))
+	}
+
+	dc.mu.Lock()
+	dc.lastSend, dc.lastSendErr = time.Now(), errors.New("status server unavailable")
+	dc.mu.Unlock()
+	if h, err = a.HealthCheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if h.LastSendTime.IsZero() || h.LastSendError != "status server unavailable" {
+		t.Fatalf("last send not reported: %+v", h)
+	}
+
+	if _, err := (*Agent)(nil).HealthCheck(context.Background()); err == nil {
+		t.Fatal("expected a health check without an agent to fail")
+	}
+}
+
+func TestHealthCheckServerOffline(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	dc := newTestDcWrap(t)
+	dc.statusServerDomains = []string{addr}
+	dc.dialTimeout = 100 * time.Millisecond
+	a := GetAgent(dc.node)
+	h, err := a.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ServerReachable {
+		t.Fatal("offline status server reported reachable")
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestDcWrap(t)
+	dc.statusServerDomains = []string{addr}
+	dc.pending = newMetricsBuffer(defaultBufferSize)
+	defer dc.closeConn()
+	var err error
+	if dc.node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	a := GetAgent(dc.node)
+
+	for _, delay := range []time.Duration{0, 200 * time.Millisecond, 1100 * time.Millisecond} {
+		ss.setDelay(delay)
+		if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := a.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (LatencyHistogram{Under100ms: 1, Under500ms: 1, Over1s: 1}); h.LatencyHistogram != want {
+		t.Fatalf("got latency histogram %+v, want %+v", h.LatencyHistogram, want)
+	}
+
+	ss.setDelay(0)
+	if err := a.SendDataNow(); err != nil {
+		t.Fatal(err)
+	}
+	if h, err = a.HealthCheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if h.LatencyHistogram != (LatencyHistogram{}) {
+		t.Errorf("latency histogram not cleared by SendDataNow: %+v", h.LatencyHistogram)
+	}
+}
+
+// slowSwarmAPI lists the swarm peers once release is closed
+type slowSwarmAPI struct {
+	iface.CoreAPI
+	iface.SwarmAPI
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (a *slowSwarmAPI) Swarm() iface.SwarmAPI { return a }
+
+func (a *slowSwarmAPI) Peers(ctx context.Context) ([]iface.ConnectionInfo, error) {
+	close(a.listing)
+	<-a.release
+	return nil, nil
+}
+
+func TestHealthCheckDoesNotBlockUpdates(t *testing.T) {
+	_, addr := startTestStatusServer(t)
+	dc := newTestDcWrap(t)
+	dc.statusServerDomains = []string{addr}
+	defer dc.closeConn()
+	api := &slowSwarmAPI{listing: make(chan struct{}), release: make(chan struct{})}
+	dc.api = api
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := GetAgent(dc.node).HealthCheck(context.Background())
+		done <- err
+	}()
+	<-api.listing
+	locked := make(chan struct{})
+	go func() {
+		dc.mu.Lock()
+		dc.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("health check held mu while listing the swarm peers")
+	}
+	close(api.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerReachableOverTransport(t *testing.T) {
+	_, grpcAddr := startTestStatusServer(t)
+	_, httpAddr := startTestHTTPServer(t)
+	_, wsAddr := startTestWebSocketServer(t)
+	_, broker := startTestBroker(t)
+	for _, tc := range []struct {
+		name   string
+		keys   map[string]interface{}
+		domain string
+		want   bool
+	}{
+		{"http", map[string]interface{}{statusServerProtocolKey: httpProtocol}, httpAddr, true},
+		{"http to a grpc server", map[string]interface{}{statusServerProtocolKey: httpProtocol}, grpcAddr, false},
+		{"websocket", map[string]interface{}{statusServerTransportKey: websocketTransport}, wsAddr, true},
+		{"websocket to an http server", map[string]interface{}{statusServerTransportKey: websocketTransport}, httpAddr, false},
+		{"mqtt", map[string]interface{}{statusServerMQTTBrokerKey: broker}, "127.0.0.1:1", true},
+		{"mqtt without a broker", map[string]interface{}{statusServerMQTTBrokerKey: "tcp://127.0.0.1:1"}, grpcAddr, false},
+		{"grpc", nil, grpcAddr, true},
+		{"grpc to an http server", nil, httpAddr, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dc := newTestSendingDcWrap(t, tc.domain)
+			dc.node.Repo.(*testRepo).keys = tc.keys
+			dc.dialTimeout = time.Second
+			defer dc.closeConn()
+			if got := dc.serverReachable(context.Background()); got != tc.want {
+				t.Fatalf("got reachable %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package spin
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// HistoryRecord is the analytics of one heartbeat kept in the local history at
+// Analytics.LocalDBPath
+type HistoryRecord struct {
+	CollectedAt time.Time
+	// the analytics as served by AnalyticsHandler
+	Report json.RawMessage
+}
+
+// QueryHistory returns the analytics recorded in the local history from from to to,
+// both included, oldest first. The history is only kept in builds with the sqlite tag.
+func (a *Agent) QueryHistory(from, to time.Time) ([]HistoryRecord, error) {
+	if a == nil {
+		return nil, fmt.Errorf("analytics is not running")
+	}
+	if configString(a.dc.node.Repo, localDBPathKey, "") == "" {
+		return nil, fmt.Errorf("%s is not set, no history is kept", localDBPathKey)
+	}
+	return a.dc.queryHistory(from, to)
+}
@@ -0,0 +1,21 @@
+package spin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryHistoryUnset(t *testing.T) {
+	var stopped *Agent
+	if _, err := stopped.QueryHistory(time.Time{}, time.Now()); err == nil {
+		t.Fatal("expected an error from a stopped agent")
+	}
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(nil)
+	if _, err := (&Agent{dc: dc}).QueryHistory(time.Time{}, time.Now()); err == nil {
+		t.Fatalf("expected an error without %s", localDBPathKey)
+	}
+	if err := dc.recordHistory(&dcReport{Node: dc.pn, extraMetrics: dc.extra}); err != nil {
+		t.Fatalf("nothing to record without %s: %v", localDBPathKey, err)
+	}
+}
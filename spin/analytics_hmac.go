@@ -0,0 +1,58 @@
+package spin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// gRPC metadata key listing the signature scheme of every payload sent in a call, in order
+	signatureSchemeKey = "btfs-signature-scheme"
+	hmacScheme         = "hmac-sha256"
+	// signed with the node's private key and verified with its PublicKey
+	nodeKeyScheme = "node-key"
+)
+
+// buildHMACSignedMetrics signs payload with the HMAC-SHA256 of key, for agents
+// that share analytics credentials instead of the node's private key. It carries
+// no public key, which is how the transports tell the two schemes apart.
+func buildHMACSignedMetrics(key string, payload []byte) *pb.SignedMetrics {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(payload)
+	return &pb.SignedMetrics{Payload: payload, Signature: mac.Sum(nil)}
+}
+
+// isHMACSigned reports whether sm was signed by buildHMACSignedMetrics.
+func isHMACSigned(sm *pb.SignedMetrics) bool {
+	return len(sm.PublicKey) == 0
+}
+
+// withSignatureScheme adds the signature scheme of each of sms to the outgoing
+// metadata of ctx. Calls signed with the node's key alone are left as they were,
+// so servers that predate HMAC signing see no difference.
+func withSignatureScheme(ctx context.Context, sms ...*pb.SignedMetrics) context.Context {
+	schemes := make([]string, 0, 2*len(sms))
+	signedHMAC := false
+	for _, sm := range sms {
+		scheme := nodeKeyScheme
+		if isHMACSigned(sm) {
+			scheme, signedHMAC = hmacScheme, true
+		}
+		schemes = append(schemes, signatureSchemeKey, scheme)
+	}
+	if !signedHMAC {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, schemes...)
+}
+
+// withPayloadMetadata adds how each of sms is encoded and signed to the outgoing
+// metadata of ctx.
+func withPayloadMetadata(ctx context.Context, sms ...*pb.SignedMetrics) context.Context {
+	return withSignatureScheme(withPayloadEncoding(ctx, sms...), sms...)
+}
@@ -0,0 +1,77 @@
+package spin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/testutil"
+
+	ic "github.com/libp2p/go-libp2p-crypto"
+)
+
+// sendToFakeServer signs payload as dc would and sends it to a fake status server,
+// returning the signed metrics and metadata the server received.
+func sendToFakeServer(t *testing.T, dc *dcWrap, payload []byte) (*testutil.FakeStatusServer, []string) {
+	fs := testutil.NewFakeStatusServer()
+	t.Cleanup(fs.Close)
+	conn, err := fs.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sm, err := dc.signPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&grpcSender{dc: dc, conn: conn}).Send(context.Background(), sm); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fs.ReceivedMetrics()); n != 1 {
+		t.Fatalf("status server received %d metrics, want 1", n)
+	}
+	return fs, fs.ReceivedMetadata()[0].Get(signatureSchemeKey)
+}
+
+func TestHMACSigning(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{hmacKeyKey: "shared"})
+	fs, schemes := sendToFakeServer(t, dc, []byte("payload"))
+
+	sm := fs.ReceivedMetrics()[0]
+	if len(sm.PublicKey) != 0 {
+		t.Fatal("HMAC signed metrics carry the node's public key")
+	}
+	mac := hmac.New(sha256.New, []byte("shared"))
+	mac.Write([]byte("payload"))
+	if !hmac.Equal(sm.Signature, mac.Sum(nil)) {
+		t.Fatalf("got signature %x, want the HMAC-SHA256 of the payload", sm.Signature)
+	}
+	if len(schemes) != 1 || schemes[0] != hmacScheme {
+		t.Fatalf("got signature schemes %v, want %s", schemes, hmacScheme)
+	}
+}
+
+func TestNodeKeySigning(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(nil)
+	var err error
+	if dc.node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	fs, schemes := sendToFakeServer(t, dc, []byte("payload"))
+
+	sm := fs.ReceivedMetrics()[0]
+	pub, err := ic.UnmarshalPublicKey(sm.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := pub.Verify(sm.Payload, sm.Signature); err != nil || !ok {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	// servers that predate HMAC signing get the metadata they always did
+	if len(schemes) != 0 {
+		t.Fatalf("got signature schemes %v for the node's key", schemes)
+	}
+}
@@ -0,0 +1,166 @@
+package spin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+const (
+	httpProtocol = "http"
+	// path the status server REST API accepts SignedMetrics on
+	httpMetricsPath = "/api/v1/metrics"
+	// content type of the protobuf encoded SignedMetrics posted to httpMetricsPath
+	protobufContentType = "application/x-protobuf"
+	// longest status server error body kept in the returned error
+	maxHTTPErrorBody = 512
+)
+
+// Sender delivers a single heartbeat to one status server.
+type Sender interface {
+	Send(ctx context.Context, sm *pb.SignedMetrics) error
+}
+
+// grpcSender calls UpdateMetricsAndDiscovery over conn
+type grpcSender struct {
+	dc   *dcWrap
+	conn *grpc.ClientConn
+}
+
+func (s *grpcSender) Send(ctx context.Context, sm *pb.SignedMetrics) error {
+	client := pb.NewStatusServiceClient(s.conn)
+	return s.dc.call(ctx, func(ctx context.Context) error {
+		_, err := client.UpdateMetricsAndDiscovery(withPayloadMetadata(ctx, sm), sm)
+		return err
+	})
+}
+
+// httpSender posts heartbeats to the REST API of the status server at url
+type httpSender struct {
+	dc     *dcWrap
+	client *http.Client
+	url    string
+}
+
+// newHTTPSender returns a sender for the status server at domain, over TLS as
+// statusServerTLS says.
+func (dc *dcWrap) newHTTPSender(domain string) (*httpSender, error) {
+	scheme, addr, err := parseStatusServerDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{Scheme: "http", Host: addr, Path: httpMetricsPath}
+	dialer := &net.Dialer{Timeout: dc.dialTimeoutOr()}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: dc.dialTimeoutOr(),
+	}
+	if d, err := dc.statusServerProxy(); err != nil {
+		return nil, err
+	} else if d != nil {
+		transport.Proxy, transport.DialContext = nil, d.DialContext
+	}
+	secure, err := dc.statusServerTLS(scheme)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		u.Scheme = "https"
+		transport.TLSClientConfig, err = statusServerTLSConfig(configString(dc.node.Repo, statusTLSCACertKey, ""),
+			configString(dc.node.Repo, statusClientCertKey, ""), configString(dc.node.Repo, statusClientKeyKey, ""))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &httpSender{dc: dc, client: &http.Client{Transport: transport}, url: u.String()}, nil
+}
+
+func (s *httpSender) Send(ctx context.Context, sm *pb.SignedMetrics) error {
+	data, err := proto.Marshal(sm)
+	if err != nil {
+		return fmt.Errorf("failed to marshal signed metrics: %s", err)
+	}
+	return s.dc.call(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		md, err := s.dc.withIdentity(withPayloadMetadata(ctx, sm))
+		if err != nil {
+			return err
+		}
+		// the same context the status server gets as gRPC metadata
+		req.Header = metadataHeader(md)
+		req.Header.Set("Content-Type", protobufContentType)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBody))
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("status server rejected metrics: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil
+	})
+}
+
+// probe asks the status server for the metrics endpoint without sending any. A
+// server error means it is not taking heartbeats, any other answer that it is up.
+func (s *httpSender) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.url, nil)
+	if err != nil {
+		return err
+	}
+	md, err := s.dc.withIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header = metadataHeader(md)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 5 {
+		return fmt.Errorf("status server unavailable: %s", resp.Status)
+	}
+	return nil
+}
+
+// close drops the idle connections kept for the heartbeats sent so far.
+func (s *httpSender) close() {
+	s.client.CloseIdleConnections()
+}
+
+// flushSender sends sms one by one and returns how many the status server took.
+func flushSender(ctx context.Context, s Sender, sms []*pb.SignedMetrics) (int, error) {
+	for i, sm := range sms {
+		if err := s.Send(ctx, sm); err != nil {
+			return i, err
+		}
+	}
+	return len(sms), nil
+}
+
+// flushHTTP posts sms to the status server at domain and returns how many it took.
+func (dc *dcWrap) flushHTTP(ctx context.Context, domain string, sms []*pb.SignedMetrics) (int, error) {
+	s, err := dc.newHTTPSender(domain)
+	if err != nil {
+		return 0, err
+	}
+	defer s.close()
+	return flushSender(ctx, s, sms)
+}
@@ -0,0 +1,217 @@
+package spin
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gogo/protobuf/proto"
+	ic "github.com/libp2p/go-libp2p-crypto"
+)
+
+// testHTTPServer collects the signed metrics posted to the status server REST API
+type testHTTPServer struct {
+	mu      sync.Mutex
+	sms     []*pb.SignedMetrics
+	headers []http.Header
+	reject  int
+}
+
+func (s *testHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != httpMetricsPath || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != protobufContentType {
+		http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	sm := new(pb.SignedMetrics)
+	if err := proto.Unmarshal(data, sm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reject != 0 {
+		http.Error(w, "bad signature", s.reject)
+		return
+	}
+	s.sms = append(s.sms, sm)
+	s.headers = append(s.headers, r.Header)
+}
+
+func (s *testHTTPServer) metrics() []*pb.SignedMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*pb.SignedMetrics(nil), s.sms...)
+}
+
+func startTestHTTPServer(t *testing.T) (*testHTTPServer, string) {
+	s := &testHTTPServer{}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func newTestHTTPDcWrap(t *testing.T, addr string) *dcWrap {
+	dc := newTestSendingDcWrap(t, addr)
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{statusServerProtocolKey: httpProtocol}
+	return dc
+}
+
+func TestHTTPProtocol(t *testing.T) {
+	hs, addr := startTestHTTPServer(t)
+	dc := newTestHTTPDcWrap(t, addr)
+	dc.version = "1.2.3"
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	sms := hs.metrics()
+	if len(sms) != 1 {
+		t.Fatalf("status server received %d metrics, want 1", len(sms))
+	}
+	pub, err := ic.UnmarshalPublicKey(sms[0].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := pub.Verify(sms[0].Payload, sms[0].Signature); err != nil || !ok {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if got, want := hs.headers[0].Get(payloadSchemaVersionKey), strconv.Itoa(payloadSchemaVersion); got != want {
+		t.Fatalf("got schema version %q, want %q", got, want)
+	}
+	if got, want := hs.headers[0].Get(nodeIDMetadataKey), dc.node.Identity.Pretty(); got != want {
+		t.Fatalf("got node id %q, want %q", got, want)
+	}
+	if got, want := hs.headers[0].Get(versionMetadataKey), "1.2.3"; got != want {
+		t.Fatalf("got version %q, want %q", got, want)
+	}
+}
+
+func TestHTTPProtocolFlushesPending(t *testing.T) {
+	hs, addr := startTestHTTPServer(t)
+	dc := newTestHTTPDcWrap(t, addr)
+	for i := 0; i < 3; i++ {
+		dc.pending.push(testMetrics(i))
+	}
+	if err := dc.flushPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := dc.pending.len(); n != 0 {
+		t.Fatalf("%d metrics still pending", n)
+	}
+	sms := hs.metrics()
+	if len(sms) != 3 {
+		t.Fatalf("status server received %d metrics, want 3", len(sms))
+	}
+	for i, sm := range sms {
+		if !proto.Equal(sm, testMetrics(i)) {
+			t.Fatalf("metrics %d out of order: %q", i, sm.Payload)
+		}
+	}
+}
+
+func TestHTTPProtocolRejected(t *testing.T) {
+	hs, addr := startTestHTTPServer(t)
+	hs.reject = http.StatusForbidden
+	dc := newTestHTTPDcWrap(t, addr)
+	dc.pending.push(testMetrics(0))
+	err := dc.flushPending(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Fatalf("got %v, want the status server's reason", err)
+	}
+	if n := dc.pending.len(); n != 1 {
+		t.Fatalf("got %d pending metrics, want the rejected one kept", n)
+	}
+}
+
+func TestHTTPSenderTLS(t *testing.T) {
+	cert, certPath, _ := writeSelfSignedCert(t)
+	hs := &testHTTPServer{}
+	srv := httptest.NewUnstartedServer(hs)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{statusTLSCACertKey: certPath})
+	s, err := dc.newHTTPSender("https://" + srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.Send(context.Background(), testMetrics(0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := hs.metrics(); len(got) != 1 || !proto.Equal(got[0], testMetrics(0)) {
+		t.Fatalf("status server received %v", got)
+	}
+}
+
+func TestGRPCSender(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(nil)
+	conn, err := dc.grpcConn(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.closeConn()
+
+	var s Sender = &grpcSender{dc: dc, conn: conn}
+	if err := s.Send(context.Background(), testMetrics(0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metrics(); len(got) != 1 || !proto.Equal(got[0], testMetrics(0)) {
+		t.Fatalf("status server received %v", got)
+	}
+	ss.setFail(true)
+	if err := s.Send(context.Background(), testMetrics(1)); err == nil {
+		t.Fatal("expected an error from a failing status server")
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		protocol, transport string
+		want                string
+		wantErr             bool
+	}{
+		{"", "", grpcTransport, false},
+		{"HTTP", "", httpProtocol, false},
+		{"http", websocketTransport, httpProtocol, false},
+		{"grpc", websocketTransport, websocketTransport, false},
+		{"websocket", "", "", true},
+	} {
+		keys := map[string]interface{}{}
+		if tc.protocol != "" {
+			keys[statusServerProtocolKey] = tc.protocol
+		}
+		if tc.transport != "" {
+			keys[statusServerTransportKey] = tc.transport
+		}
+		dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(keys)}}
+		got, err := dc.transport()
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("protocol %q, transport %q: got %q, %v, want %q", tc.protocol, tc.transport, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package spin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+const (
+	// measurement the analytics are written to
+	influxMeasurement = "btfs"
+	// path of the InfluxDB 2 write API, also served by InfluxDB 1.8
+	influxWritePath = "/api/v2/write"
+)
+
+// exportInflux writes report to InfluxDB at Analytics.InfluxDBURL, if set,
+// alongside the heartbeats sent to the status server. The numbers and flags are
+// fields, the node id, version and group tags. The point is written in the
+// background, a failed write is only logged.
+func (dc *dcWrap) exportInflux(report *dcReport) error {
+	base := configString(dc.node.Repo, influxDBURLKey, "")
+	if base == "" {
+		return nil
+	}
+	u, err := influxWriteURL(base, configString(dc.node.Repo, influxDBBucketKey, ""))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := encodeInflux(&buf, report, time.Now()); err != nil {
+		return fmt.Errorf("failed to encode analytics for InfluxDB: %s", err.Error())
+	}
+	dc.settingsMu.RLock()
+	timeout := durationOr(dc.callTimeout, callTimeout)
+	dc.settingsMu.RUnlock()
+	token := configString(dc.node.Repo, influxDBTokenKey, "")
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := postInflux(ctx, u, token, buf.Bytes()); err != nil {
+			log.Warning(err.Error())
+		}
+	}()
+	return nil
+}
+
+// influxWriteURL returns the write API of the InfluxDB server at base for bucket.
+// Query parameters of base, such as org, are kept.
+func influxWriteURL(base, bucket string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid %s %q", influxDBURLKey, base)
+	}
+	if bucket == "" {
+		return "", fmt.Errorf("%s is set without %s", influxDBURLKey, influxDBBucketKey)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + influxWritePath
+	q := u.Query()
+	q.Set("bucket", bucket)
+	q.Set("precision", "s")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// encodeInflux writes report as one line protocol point at t.
+func encodeInflux(w io.Writer, report *dcReport, t time.Time) error {
+	tags := map[string]string{}
+	for k, v := range map[string]string{
+		"node_id":      report.NodeId,
+		"btfs_version": report.BtfsVersion,
+		"node_group":   report.NodeGroup,
+	} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	fields := map[string]interface{}{}
+	walkCSVFields(reflect.ValueOf(report).Elem(), "", func(name string, v reflect.Value) {
+		switch v.Kind() {
+		case reflect.Bool:
+			fields[name] = v.Bool()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fields[name] = v.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fields[name] = v.Uint()
+		case reflect.Float32, reflect.Float64:
+			fields[name] = v.Float()
+		}
+	})
+	m, err := protocol.New(influxMeasurement, tags, fields, t)
+	if err != nil {
+		return err
+	}
+	enc := protocol.NewEncoder(w)
+	enc.SetFieldSortOrder(protocol.SortFields)
+	enc.SetFieldTypeSupport(protocol.UintSupport)
+	enc.SetPrecision(time.Second)
+	_, err = enc.Encode(m)
+	return err
+}
+
+// postInflux sends the line protocol in body to the write API at u.
+func postInflux(ctx context.Context, u, token string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write analytics to InfluxDB: %s", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBody))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("InfluxDB rejected analytics: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package spin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	protocol "github.com/influxdata/line-protocol"
+)
+
+func TestEncodeInflux(t *testing.T) {
+	report := &dcReport{
+		Node:         &nodepb.Node{NodeId: "QmNode", BtfsVersion: "1.0.0", CpuUsed: 12.5, PeersConnected: 7},
+		extraMetrics: extraMetrics{NodeGroup: "edge eu", PeerDelta: -2, IsRelay: true},
+	}
+	var buf bytes.Buffer
+	if err := encodeInflux(&buf, report, time.Unix(1600000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	line := buf.String()
+	if !strings.HasPrefix(line, `btfs,btfs_version=1.0.0,node_group=edge\ eu,node_id=QmNode `) {
+		t.Errorf("unexpected measurement and tags: %s", line)
+	}
+	if !strings.HasSuffix(line, " 1600000000\n") {
+		t.Errorf("unexpected timestamp: %s", line)
+	}
+	for _, field := range []string{"cpu_used=12.5", "peers_connected=7u", "peer_delta=-2i", "is_relay=true"} {
+		if !strings.Contains(line, field) {
+			t.Errorf("field %s missing from %s", field, line)
+		}
+	}
+	if strings.Contains(line, "os_type=") {
+		t.Errorf("string field written: %s", line)
+	}
+
+	// what InfluxDB would make of it
+	handler := protocol.NewMetricHandler()
+	if _, err := protocol.NewParser(handler).Parse(buf.Bytes()); err != nil {
+		t.Fatalf("invalid line protocol: %v", err)
+	}
+}
+
+func TestExportInflux(t *testing.T) {
+	type write struct {
+		query, auth string
+		body        string
+	}
+	writes := make(chan write, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != influxWritePath || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		writes <- write{r.URL.RawQuery, r.Header.Get("Authorization"), string(body)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{
+		influxDBURLKey:    srv.URL + "?org=btfs",
+		influxDBBucketKey: "analytics",
+		influxDBTokenKey:  "secret",
+	})
+	if err := dc.exportInflux(&dcReport{Node: dc.pn, extraMetrics: dc.extra}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-writes:
+		if got.query != "bucket=analytics&org=btfs&precision=s" {
+			t.Errorf("got query %q", got.query)
+		}
+		if got.auth != "Token secret" {
+			t.Errorf("got authorization %q", got.auth)
+		}
+		if !strings.HasPrefix(got.body, influxMeasurement+",") || !strings.Contains(got.body, "node_id="+dc.pn.NodeId) {
+			t.Errorf("unexpected point %q", got.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing written to InfluxDB")
+	}
+}
+
+func TestExportInfluxConfig(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(nil)
+	if err := dc.exportInflux(&dcReport{Node: dc.pn, extraMetrics: dc.extra}); err != nil {
+		t.Fatalf("export without a URL: %v", err)
+	}
+	dc.node.Repo = newTestRepo(map[string]interface{}{influxDBURLKey: "http://localhost:8086"})
+	if err := dc.exportInflux(&dcReport{Node: dc.pn, extraMetrics: dc.extra}); err == nil {
+		t.Fatal("expected an error without a bucket")
+	}
+}
@@ -0,0 +1,65 @@
+package spin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestSendLogsAttempt(t *testing.T) {
+	if err := logging.SetLogLevel("spin", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.SetLogLevel("spin", "error")
+	pipe := logging.NewPipeReader()
+	defer pipe.Close()
+	entries := make(chan map[string]interface{}, 100)
+	go func() {
+		scanner := bufio.NewScanner(pipe)
+		for scanner.Scan() {
+			var e map[string]interface{}
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				entries <- e
+			}
+		}
+	}()
+
+	_, addr := startTestStatusServer(t)
+	dc := &dcWrap{
+		node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+		statusServerDomains: []string{addr},
+		pending:             newMetricsBuffer(defaultBufferSize),
+		epoch:               7,
+	}
+	if err := dc.send(context.Background(), &pb.SignedMetrics{Payload: []byte("12345")}, dc.newBackoff()); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-entries:
+			if e["msg"] != "analytics send attempt" {
+				continue
+			}
+			if e["logger"] != "spin" || e["epoch"] != float64(7) || e["attempt"] != float64(1) ||
+				e["bytes"] != float64(5) || e["error"] != nil {
+				t.Fatalf("unexpected send attempt entry %v", e)
+			}
+			if _, ok := e["duration"].(string); !ok {
+				t.Fatalf("send attempt entry has no duration: %v", e)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no send attempt logged")
+		}
+	}
+}
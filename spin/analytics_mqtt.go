@@ -0,0 +1,132 @@
+package spin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	// topic prefix the heartbeats are published under, followed by the node id and
+	// the BTFS version, see mqttTopic
+	mqttTopicPrefix = "btfs/metrics/"
+	// at least once, the broker acknowledges every heartbeat it took
+	mqttQoS = 1
+	// milliseconds the client waits for in-flight work when it disconnects
+	mqttQuiesce = 250
+)
+
+// mqttSender publishes heartbeats to an MQTT broker, for edge nodes that have one but
+// cannot reach the status server over gRPC. MQTT 3.1.1 has no headers, so the call
+// metadata the other transports send is left out, but for the node identity the
+// topic carries.
+type mqttSender struct {
+	dc     *dcWrap
+	client mqtt.Client
+	topic  string
+}
+
+// newMQTTSender connects to the broker at the tcp://, ssl:// or ws:// URL broker.
+// ssl and wss brokers are verified like the status server.
+func (dc *dcWrap) newMQTTSender(ctx context.Context, broker string) (*mqttSender, error) {
+	id, err := dc.reportedNodeID(dc.node.Identity.Pretty())
+	if err != nil {
+		return nil, err
+	}
+	client, err := dc.connectMQTT(ctx, broker, "btfs-"+id)
+	if err != nil {
+		return nil, err
+	}
+	return &mqttSender{dc: dc, client: client, topic: mqttTopic(id, dc.version)}, nil
+}
+
+// connectMQTT connects to broker as clientID, see newMQTTSender.
+func (dc *dcWrap) connectMQTT(ctx context.Context, broker, clientID string) (mqtt.Client, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %s", statusServerMQTTBrokerKey, broker, err)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetConnectTimeout(dc.dialTimeoutOr()).
+		SetAutoReconnect(false)
+	if u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "wss" {
+		tc, err := statusServerTLSConfig(configString(dc.node.Repo, statusTLSCACertKey, ""),
+			configString(dc.node.Repo, statusClientCertKey, ""), configString(dc.node.Repo, statusClientKeyKey, ""))
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tc)
+	}
+	client := mqtt.NewClient(opts)
+	if err := waitMQTT(ctx, client.Connect()); err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker %s: %s", u.Host, err)
+	}
+	return client, nil
+}
+
+// probeMQTT connects to broker and disconnects again. It uses a client id of its
+// own, as a broker drops the session of a client when another connects with its id.
+func (dc *dcWrap) probeMQTT(ctx context.Context, broker string) error {
+	id, err := dc.reportedNodeID(dc.node.Identity.Pretty())
+	if err != nil {
+		return err
+	}
+	client, err := dc.connectMQTT(ctx, broker, "btfs-"+id+"-health")
+	if err != nil {
+		return err
+	}
+	client.Disconnect(mqttQuiesce)
+	return nil
+}
+
+// mqttTopic returns the topic the node with the reported id and BTFS version
+// publishes its heartbeats under, the one of the node id alone if the version is
+// not known.
+func mqttTopic(id, version string) string {
+	if version == "" {
+		return mqttTopicPrefix + id
+	}
+	return mqttTopicPrefix + id + "/" + version
+}
+
+func (s *mqttSender) Send(ctx context.Context, sm *pb.SignedMetrics) error {
+	data, err := proto.Marshal(sm)
+	if err != nil {
+		return fmt.Errorf("failed to marshal signed metrics: %s", err)
+	}
+	return s.dc.call(ctx, func(ctx context.Context) error {
+		return waitMQTT(ctx, s.client.Publish(s.topic, mqttQoS, false, data))
+	})
+}
+
+// close disconnects from the broker.
+func (s *mqttSender) close() {
+	s.client.Disconnect(mqttQuiesce)
+}
+
+// waitMQTT waits for tok to complete, until ctx is done.
+func waitMQTT(ctx context.Context, tok mqtt.Token) error {
+	select {
+	case <-tok.Done():
+		return tok.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushMQTT publishes sms to the broker and returns how many it took.
+func (dc *dcWrap) flushMQTT(ctx context.Context, broker string, sms []*pb.SignedMetrics) (int, error) {
+	s, err := dc.newMQTTSender(ctx, broker)
+	if err != nil {
+		return 0, err
+	}
+	defer s.close()
+	return flushSender(ctx, s, sms)
+}
@@ -0,0 +1,131 @@
+package spin
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gogo/protobuf/proto"
+)
+
+// testBroker is an MQTT broker that keeps what it is published and acknowledges it
+type testBroker struct {
+	mu        sync.Mutex
+	published []*packets.PublishPacket
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.published = append(b.published, p)
+			b.mu.Unlock()
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			}
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (b *testBroker) messages() []*packets.PublishPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*packets.PublishPacket(nil), b.published...)
+}
+
+func startTestBroker(t *testing.T) (*testBroker, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b := &testBroker{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b, "tcp://" + l.Addr().String()
+}
+
+func TestMQTTBroker(t *testing.T) {
+	b, broker := startTestBroker(t)
+	dc := newTestSendingDcWrap(t, "127.0.0.1:1")
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{statusServerMQTTBrokerKey: broker}
+	dc.version = "1.2.3"
+	for i := 0; i < 2; i++ {
+		dc.pending.push(testMetrics(i))
+	}
+	if err := dc.flushPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := dc.pending.len(); n != 0 {
+		t.Fatalf("%d metrics still pending", n)
+	}
+	msgs := b.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("broker received %d messages, want 2", len(msgs))
+	}
+	for i, msg := range msgs {
+		if want := mqttTopicPrefix + dc.node.Identity.Pretty() + "/1.2.3"; msg.TopicName != want {
+			t.Errorf("message %d published to %q, want %q", i, msg.TopicName, want)
+		}
+		if msg.Qos != mqttQoS {
+			t.Errorf("message %d published with QoS %d, want %d", i, msg.Qos, mqttQoS)
+		}
+		sm := new(pb.SignedMetrics)
+		if err := proto.Unmarshal(msg.Payload, sm); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(sm, testMetrics(i)) {
+			t.Errorf("message %d out of order: %q", i, sm.Payload)
+		}
+	}
+}
+
+func TestMQTTBrokerDown(t *testing.T) {
+	dc := newTestSendingDcWrap(t, "127.0.0.1:1")
+	// nothing listens on the port once the listener is closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := "tcp://" + l.Addr().String()
+	l.Close()
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{statusServerMQTTBrokerKey: broker}
+	dc.pending.push(testMetrics(0))
+	if err := dc.flushPending(context.Background()); err == nil {
+		t.Fatal("expected an error from an unreachable broker")
+	}
+	if n := dc.pending.len(); n != 1 {
+		t.Fatalf("got %d pending metrics, want the unsent one kept", n)
+	}
+}
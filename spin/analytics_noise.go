@@ -0,0 +1,86 @@
+package spin
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+)
+
+// defaultPrivacyEpsilon is the privacy budget of each noised field unless
+// Analytics.DifferentialPrivacyEpsilon says otherwise; smaller means more noise
+const defaultPrivacyEpsilon = 1.0
+
+// How much one node can change each noised field, the Laplace noise added is scaled
+// to it. Storage and transfers are in KiB.
+const (
+	peersSensitivity    = 1
+	storageSensitivity  = 1 << 20 // 1 GiB
+	transferSensitivity = 1 << 10 // 1 MiB
+)
+
+var (
+	// noiseRand draws the differential privacy noise, seeded like jitterRand
+	noiseRand = rand.New(rand.NewSource(cryptoSeed()))
+	noiseMu   sync.Mutex
+)
+
+// laplace returns a sample of the Laplace distribution centered on 0 with the given
+// scale, by inverting its CDF.
+func laplace(scale float64) float64 {
+	noiseMu.Lock()
+	u := noiseRand.Float64()
+	for u == 0 {
+		u = noiseRand.Float64()
+	}
+	noiseMu.Unlock()
+	// u is in (0, 1), u-0.5 in (-0.5, 0.5) keeps the logarithm finite
+	u -= 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+// addNoise returns v with Laplace noise of the given scale, rounded and kept from
+// going negative.
+func addNoise(v uint64, scale float64) uint64 {
+	n := math.Round(float64(v) + laplace(scale))
+	if n <= 0 {
+		return 0
+	}
+	return uint64(n)
+}
+
+// noised returns pn if Analytics.DifferentialPrivacy is off, otherwise a copy of
+// it with Laplace noise added to the connected peers, storage used and transfers,
+// so the status server cannot tell the exact figures of any one node. The total
+// transfers are noised too, the exact epoch transfers are their differences.
+func (dc *dcWrap) noised(pn *nodepb.Node) *nodepb.Node {
+	if !configBool(dc.node.Repo, differentialPrivacyKey, false) {
+		return pn
+	}
+	epsilon := configFloat(dc.node.Repo, privacyEpsilonKey, defaultPrivacyEpsilon)
+	n := *pn
+	n.PeersConnected = addNoise(n.PeersConnected, peersSensitivity/epsilon)
+	n.StorageUsed = addNoise(n.StorageUsed, storageSensitivity/epsilon)
+	n.Upload = addNoise(n.Upload, transferSensitivity/epsilon)
+	n.Download = addNoise(n.Download, transferSensitivity/epsilon)
+	n.TotalUpload = addNoise(n.TotalUpload, transferSensitivity/epsilon)
+	n.TotalDownload = addNoise(n.TotalDownload, transferSensitivity/epsilon)
+	return &n
+}
+
+// noisedExtra returns extra if Analytics.DifferentialPrivacy is off, otherwise a
+// copy of it without the throughput and network traffic, which give away the
+// exact transfers noised would hide.
+func (dc *dcWrap) noisedExtra(extra *extraMetrics) *extraMetrics {
+	if !configBool(dc.node.Repo, differentialPrivacyKey, false) {
+		return extra
+	}
+	e := *extra
+	e.UploadBPS, e.DownloadBPS = 0, 0
+	e.NetIn, e.NetOut = 0, 0
+	return &e
+}
@@ -0,0 +1,128 @@
+package spin
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+func seedNoise(t *testing.T, seed int64) {
+	noiseMu.Lock()
+	noiseRand = rand.New(rand.NewSource(seed))
+	noiseMu.Unlock()
+	t.Cleanup(func() {
+		noiseMu.Lock()
+		noiseRand = rand.New(rand.NewSource(cryptoSeed()))
+		noiseMu.Unlock()
+	})
+}
+
+func TestNoiseDisabled(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{privacyEpsilonKey: 0.5})
+	pn := &nodepb.Node{PeersConnected: 10, StorageUsed: 1 << 30, Upload: 500, Download: 700}
+	if got := dc.noised(pn); got != pn {
+		t.Fatalf("got %v, want the exact figures without %s", got, differentialPrivacyKey)
+	}
+	b, err := dc.marshalPayload(testNodeID, pn, nil, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(b, info); err != nil {
+		t.Fatal(err)
+	}
+	if n := info.Node; n.PeersConnected != 10 || n.StorageUsed != 1<<30 || n.Upload != 500 || n.Download != 700 {
+		t.Fatalf("payload changed the figures to %v", n)
+	}
+}
+
+func TestNoiseBounds(t *testing.T) {
+	seedNoise(t, 1)
+	const epsilon = 0.5
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{differentialPrivacyKey: true, privacyEpsilonKey: epsilon})
+	pn := &nodepb.Node{PeersConnected: 1000, StorageUsed: 1 << 40, Upload: 1 << 30, Download: 1 << 30,
+		TotalUpload: 1 << 40, TotalDownload: 1 << 40, BlocksUp: 7}
+	fields := []struct {
+		name  string
+		get   func(*nodepb.Node) uint64
+		scale float64
+	}{
+		{"peers", func(n *nodepb.Node) uint64 { return n.PeersConnected }, peersSensitivity / epsilon},
+		{"storage", func(n *nodepb.Node) uint64 { return n.StorageUsed }, storageSensitivity / epsilon},
+		{"upload", func(n *nodepb.Node) uint64 { return n.Upload }, transferSensitivity / epsilon},
+		{"download", func(n *nodepb.Node) uint64 { return n.Download }, transferSensitivity / epsilon},
+		{"total upload", func(n *nodepb.Node) uint64 { return n.TotalUpload }, transferSensitivity / epsilon},
+		{"total download", func(n *nodepb.Node) uint64 { return n.TotalDownload }, transferSensitivity / epsilon},
+	}
+	const draws = 2000
+	sums := make([]float64, len(fields))
+	changed := make([]bool, len(fields))
+	for i := 0; i < draws; i++ {
+		n := dc.noised(pn)
+		if n == pn || n.BlocksUp != 7 {
+			t.Fatal("noise changed the original or a field that is not noised")
+		}
+		for j, f := range fields {
+			d := float64(f.get(n)) - float64(f.get(pn))
+			// exceeded with probability exp(-15) per draw
+			if math.Abs(d) > 15*f.scale+1 {
+				t.Fatalf("%s noise %v is out of bounds for scale %v", f.name, d, f.scale)
+			}
+			sums[j] += d
+			changed[j] = changed[j] || d != 0
+		}
+	}
+	for j, f := range fields {
+		if !changed[j] {
+			t.Errorf("%s never noised", f.name)
+		}
+		// the standard deviation of the mean is about 0.03 of the scale
+		if mean := sums[j] / draws; math.Abs(mean) > 0.2*f.scale+1 {
+			t.Errorf("%s noise averages %v, want about 0 for scale %v", f.name, mean, f.scale)
+		}
+	}
+	if pn.PeersConnected != 1000 || pn.StorageUsed != 1<<40 {
+		t.Fatalf("noise changed the collected figures to %v", pn)
+	}
+}
+
+func TestAddNoiseNotNegative(t *testing.T) {
+	seedNoise(t, 2)
+	for i := 0; i < 1000; i++ {
+		// uint64 would wrap around on a negative result
+		if v := addNoise(0, 100); v > 100*20 {
+			t.Fatalf("got %d from noising 0", v)
+		}
+	}
+}
+
+func TestNoiseDropsExactTraffic(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{differentialPrivacyKey: true})
+	extra := &extraMetrics{UploadBPS: 100, DownloadBPS: 200, NetIn: 300, NetOut: 400, Goroutines: 5}
+	b, err := dc.marshalPayload(testNodeID, &nodepb.Node{Upload: 500}, extra, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(b, info); err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := decodeExtraMetrics(info)
+	if err != nil || !ok {
+		t.Fatalf("no extra metrics in the payload: %v", err)
+	}
+	if got.UploadBPS != 0 || got.DownloadBPS != 0 || got.NetIn != 0 || got.NetOut != 0 || got.Goroutines != 5 {
+		t.Fatalf("got %+v, want the throughput and traffic left out", got)
+	}
+	if extra.UploadBPS != 100 || extra.NetIn != 300 {
+		t.Fatalf("noise changed the collected figures to %+v", extra)
+	}
+}
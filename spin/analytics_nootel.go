@@ -0,0 +1,23 @@
+// +build !otel
+
+package spin
+
+import (
+	"context"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+)
+
+// tracingState is empty unless btfs is built with the otel tag.
+type tracingState struct{}
+
+// traceSend traces nothing unless btfs is built with the otel tag.
+func (dc *dcWrap) traceSend(ctx context.Context, domain string, sms []*pb.SignedMetrics) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
+
+// traceHealthAlert traces nothing unless btfs is built with the otel tag.
+func (dc *dcWrap) traceHealthAlert(msg string) {}
+
+// stopTracing has nothing to stop unless btfs is built with the otel tag.
+func (dc *dcWrap) stopTracing(ctx context.Context) {}
@@ -0,0 +1,16 @@
+// +build !prometheus
+
+package spin
+
+import (
+	"net/http"
+
+	"github.com/TRON-US/go-btfs/core"
+)
+
+// PrometheusHandler is unavailable unless btfs is built with the prometheus tag.
+func PrometheusHandler(node *core.IpfsNode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not built with prometheus support", http.StatusNotFound)
+	})
+}
@@ -0,0 +1,24 @@
+// +build !sqlite
+
+package spin
+
+import (
+	"fmt"
+	"time"
+)
+
+// recordHistory fails if a history is configured unless btfs is built with the
+// sqlite tag.
+func (dc *dcWrap) recordHistory(report *dcReport) error {
+	if configString(dc.node.Repo, localDBPathKey, "") == "" {
+		return nil
+	}
+	return fmt.Errorf("analytics history not recorded: not built with sqlite support")
+}
+
+func (dc *dcWrap) queryHistory(from, to time.Time) ([]HistoryRecord, error) {
+	return nil, fmt.Errorf("not built with sqlite support")
+}
+
+// closeHistory has nothing to close unless btfs is built with the sqlite tag.
+func (dc *dcWrap) closeHistory() {}
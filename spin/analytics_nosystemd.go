@@ -0,0 +1,6 @@
+// +build !systemd
+
+package spin
+
+// notifyWatchdog does nothing unless btfs is built with the systemd tag.
+func notifyWatchdog() {}
@@ -0,0 +1,133 @@
+// +build otel
+
+package spin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/label"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/TRON-US/go-btfs/spin"
+	// how long stopping a collector waits for its spans to be exported
+	tracingFlushTimeout = 5 * time.Second
+)
+
+// tracingState is the span exporter of a collector, set up from the
+// Analytics.OTLPEndpoint it was last used with. mu guards it.
+type tracingState struct {
+	mu       sync.Mutex
+	endpoint string
+	provider trace.TracerProvider
+	// exports the spans not exported yet and stops exporting, nil if nothing is exported
+	shutdown func(context.Context) error
+}
+
+// tracer returns the tracer of the analytics spans, one that records nothing
+// unless Analytics.OTLPEndpoint is set. A changed endpoint, as a config reload
+// brings, gets a new exporter.
+func (dc *dcWrap) tracer() trace.Tracer {
+	endpoint := configString(dc.node.Repo, otlpEndpointKey, "")
+	st := &dc.tracing
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.provider == nil || st.endpoint != endpoint {
+		if shutdown := st.shutdown; shutdown != nil {
+			go shutdownTracing(context.Background(), shutdown)
+		}
+		st.endpoint = endpoint
+		st.provider, st.shutdown = newTracerProvider(endpoint)
+	}
+	return st.provider.Tracer(tracerName)
+}
+
+// newTracerProvider returns the provider of spans exported to the OTLP collector at
+// endpoint and the function stopping it, a provider that records nothing and nil
+// if endpoint is empty.
+func newTracerProvider(endpoint string) (trace.TracerProvider, func(context.Context) error) {
+	if endpoint == "" {
+		return trace.NewNoopTracerProvider(), nil
+	}
+	exp, err := otlp.NewExporter(context.Background(),
+		otlpgrpc.NewDriver(otlpgrpc.WithEndpoint(endpoint), otlpgrpc.WithInsecure()))
+	if err != nil {
+		log.Warningf("Analytics will not be traced: failed to export to %s: %s", endpoint, err)
+		return trace.NewNoopTracerProvider(), nil
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	return tp, tp.Shutdown
+}
+
+// shutdownTracing runs shutdown, giving up after tracingFlushTimeout.
+func shutdownTracing(ctx context.Context, shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(ctx, tracingFlushTimeout)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		log.Warningf("Failed to export the analytics spans: %s", err)
+	}
+}
+
+// spanAttributes identifies the node in every analytics span, by the id its
+// privacy mode calls for.
+func (dc *dcWrap) spanAttributes() []label.KeyValue {
+	attrs := []label.KeyValue{label.String("btfs.version", dc.version)}
+	if dc.node.Identity != "" {
+		if id, err := dc.reportedNodeID(dc.node.Identity.Pretty()); err == nil {
+			attrs = append(attrs, label.String("node.id", id))
+		}
+	}
+	return attrs
+}
+
+// traceSend starts the span of sending sms to the status server at domain. The
+// returned function ends it with the outcome.
+func (dc *dcWrap) traceSend(ctx context.Context, domain string, sms []*pb.SignedMetrics) (context.Context, func(error)) {
+	bytes := 0
+	for _, sm := range sms {
+		bytes += len(sm.Payload)
+	}
+	attrs := append(dc.spanAttributes(),
+		label.String("server.domain", domain),
+		label.Int("payload.bytes", bytes),
+		label.Int("metrics.count", len(sms)))
+	ctx, span := dc.tracer().Start(ctx, "analytics.send",
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// traceHealthAlert records a span for a health alert.
+func (dc *dcWrap) traceHealthAlert(msg string) {
+	_, span := dc.tracer().Start(context.Background(), "analytics.health_alert",
+		trace.WithAttributes(append(dc.spanAttributes(), label.String("alert.message", msg))...))
+	span.SetStatus(codes.Error, msg)
+	span.End()
+}
+
+// stopTracing exports the spans of the collector not exported yet and stops
+// exporting them.
+func (dc *dcWrap) stopTracing(ctx context.Context) {
+	st := &dc.tracing
+	st.mu.Lock()
+	shutdown := st.shutdown
+	st.provider, st.shutdown = nil, nil
+	st.mu.Unlock()
+	if shutdown != nil {
+		shutdownTracing(ctx, shutdown)
+	}
+}
@@ -0,0 +1,123 @@
+// +build otel
+
+package spin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/oteltest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useTestRecorder makes dc record its spans in the returned recorder.
+func useTestRecorder(dc *dcWrap) *oteltest.StandardSpanRecorder {
+	sr := new(oteltest.StandardSpanRecorder)
+	dc.tracing.mu.Lock()
+	dc.tracing.endpoint = configString(dc.node.Repo, otlpEndpointKey, "")
+	dc.tracing.provider = oteltest.NewTracerProvider(oteltest.WithSpanRecorder(sr))
+	dc.tracing.mu.Unlock()
+	return sr
+}
+
+func TestTraceSend(t *testing.T) {
+	_, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	dc.version = "1.0.0"
+	defer dc.closeConn()
+	sr := useTestRecorder(dc)
+
+	sm := testMetrics(0)
+	if _, err := dc.flushTo(context.Background(), addr, []*pb.SignedMetrics{sm}); err != nil {
+		t.Fatal(err)
+	}
+	spans := sr.Completed()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "analytics.send" || span.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("got span %q of kind %s", span.Name(), span.SpanKind())
+	}
+	for key, want := range map[label.Key]label.Value{
+		"node.id":       label.StringValue(dc.node.Identity.Pretty()),
+		"btfs.version":  label.StringValue("1.0.0"),
+		"server.domain": label.StringValue(addr),
+		"payload.bytes": label.IntValue(len(sm.Payload)),
+	} {
+		if got, ok := span.Attributes()[key]; !ok || got != want {
+			t.Errorf("attribute %s: got %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+	if span.StatusCode() == codes.Error {
+		t.Fatalf("delivered send traced as failed: %s", span.StatusMessage())
+	}
+}
+
+func TestTraceSendFailure(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	ss.setFail(true)
+	dc := newTestSendingDcWrap(t, addr)
+	defer dc.closeConn()
+	sr := useTestRecorder(dc)
+
+	if _, err := dc.flushTo(context.Background(), addr, []*pb.SignedMetrics{testMetrics(0)}); err == nil {
+		t.Fatal("expected the failing status server to return an error")
+	}
+	spans := sr.Completed()
+	if len(spans) != 1 || spans[0].StatusCode() != codes.Error {
+		t.Fatalf("got spans %v, want one failed send", spans)
+	}
+}
+
+func TestTraceHealthAlert(t *testing.T) {
+	dc := newTestDcWrap(t)
+	sr := useTestRecorder(dc)
+	dc.reportHealthAlert("status server unreachable")
+
+	// traced apart from the alert
+	for deadline := time.Now().Add(5 * time.Second); len(sr.Completed()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	spans := sr.Completed()
+	if len(spans) != 1 || spans[0].Name() != "analytics.health_alert" {
+		t.Fatalf("got spans %v, want one health alert", spans)
+	}
+	if got := spans[0].Attributes()["alert.message"]; got.AsString() != "status server unreachable" {
+		t.Fatalf("got alert message %v", got.Emit())
+	}
+	if spans[0].StatusCode() != codes.Error || spans[0].StatusMessage() != "status server unreachable" {
+		t.Fatalf("got status %v: %s", spans[0].StatusCode(), spans[0].StatusMessage())
+	}
+}
+
+func TestTracerFollowsConfig(t *testing.T) {
+	dc := newTestDcWrap(t)
+	r := newTestRepo(map[string]interface{}{otlpEndpointKey: "127.0.0.1:4317"})
+	dc.node.Repo = r
+	other := newTestDcWrap(t)
+	defer dc.stopTracing(context.Background())
+
+	dc.tracer()
+	other.tracer()
+	if _, ok := dc.tracing.provider.(*sdktrace.TracerProvider); !ok {
+		t.Fatalf("got provider %T, want one exporting to the endpoint", dc.tracing.provider)
+	}
+	// each collector exports as its own config says
+	if _, ok := other.tracing.provider.(*sdktrace.TracerProvider); ok {
+		t.Fatal("collector without an endpoint exports its spans")
+	}
+
+	// a reloaded config without the endpoint stops exporting
+	r.keys = nil
+	dc.tracer()
+	if _, ok := dc.tracing.provider.(*sdktrace.TracerProvider); ok || dc.tracing.shutdown != nil {
+		t.Fatal("still exporting after the endpoint was removed")
+	}
+}
@@ -0,0 +1,152 @@
+package spin_test
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+	"github.com/TRON-US/go-btfs/repo"
+	"github.com/TRON-US/go-btfs/spin"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/gogo/protobuf/proto"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func newTestNode(t *testing.T) *core.IpfsNode {
+	_, pub, err := ic.GenerateKeyPair(ic.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &core.IpfsNode{Identity: id, Repo: &repo.Mock{}}
+}
+
+// roundTrip serializes pn and parses the payload again.
+func roundTrip(t *testing.T, node *core.IpfsNode, pn *nodepb.Node) *nodepb.PayLoadInfo {
+	b, err := spin.GetPayload(node, pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(b, info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// sameNode compares the fields of got and want, which proto.Equal cannot do for
+// their time.Time fields.
+func sameNode(got, want nodepb.Node) bool {
+	for _, n := range []*nodepb.Node{&got, &want} {
+		// only set on the side that was marshaled
+		n.XXX_sizecache = 0
+		n.Node_Settings.XXX_sizecache = 0
+		n.Node_Geo.XXX_sizecache = 0
+		n.Node_ExperimentalFlags.XXX_sizecache = 0
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+func TestGetPayload(t *testing.T) {
+	node := newTestNode(t)
+	for _, tc := range []struct {
+		name string
+		pn   *nodepb.Node
+	}{
+		{"zero values", &nodepb.Node{}},
+		{"empty strings", &nodepb.Node{NodeId: "", BtfsVersion: "", OsType: "", ArchType: "", CpuInfo: "", HVal: "", UpTime: 1}},
+		{"very large", &nodepb.Node{
+			UpTime:           math.MaxUint64,
+			StorageUsed:      math.MaxUint64,
+			StorageVolumeCap: math.MaxUint64,
+			MemoryUsed:       math.MaxUint64,
+			CpuUsed:          math.MaxFloat64,
+			Upload:           math.MaxUint64,
+			Download:         math.MaxUint64,
+			TotalUpload:      math.MaxUint64,
+			TotalDownload:    math.MaxUint64,
+			BlocksUp:         math.MaxUint64,
+			BlocksDown:       math.MaxUint64,
+			PeersConnected:   math.MaxUint64,
+			Node_Settings:    nodepb.Node_Settings{StoragePriceAsk: math.MaxUint64, StorageTimeMin: math.MaxUint64},
+		}},
+		{"typical", &nodepb.Node{
+			NodeId:         node.Identity.Pretty(),
+			BtfsVersion:    "1.5.0",
+			UpTime:         3600,
+			StorageUsed:    1 << 20,
+			MemoryUsed:     1 << 18,
+			CpuUsed:        12.5,
+			Upload:         100,
+			Download:       200,
+			TotalUpload:    1000,
+			TotalDownload:  2000,
+			BlocksUp:       10,
+			BlocksDown:     20,
+			OsType:         "linux",
+			ArchType:       "amd64",
+			CpuInfo:        "Core i7",
+			PeersConnected: 42,
+			TimeCreated:    time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC),
+			HVal:           "hval",
+			Node_Settings: nodepb.Node_Settings{
+				StoragePriceAsk: 125,
+				Roles:           []nodepb.NodeRole{nodepb.NodeRole_RENTER, nodepb.NodeRole_HOST},
+			},
+			Node_ExperimentalFlags: nodepb.Node_ExperimentalFlags{Analytics: true, StorageHostEnabled: true},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := *tc.pn
+			info := roundTrip(t, node, tc.pn)
+			if info.NodeId != node.Identity.Pretty() {
+				t.Errorf("got node id %q, want %q", info.NodeId, node.Identity.Pretty())
+			}
+			if len(info.DiscoveryNodes) != 0 {
+				t.Errorf("got discovery nodes %v without a core api", info.DiscoveryNodes)
+			}
+			if info.LastTime.IsZero() {
+				t.Error("last time not set")
+			}
+			if info.Node == nil || !sameNode(*info.Node, want) {
+				t.Errorf("got node %+v, want %+v", info.Node, &want)
+			}
+		})
+	}
+}
+
+func TestGetPayloadRoundTrip(t *testing.T) {
+	node := newTestNode(t)
+	f := func(version, cpu string, upload, storage, peers uint64, cpuUsed float64, created int64, roles []uint8) bool {
+		pn := &nodepb.Node{
+			BtfsVersion:    version,
+			CpuInfo:        cpu,
+			Upload:         upload,
+			StorageUsed:    storage,
+			PeersConnected: peers,
+			CpuUsed:        cpuUsed,
+			// within the range of a protobuf timestamp
+			TimeCreated: time.Unix(created%(1<<35), 0).UTC(),
+		}
+		for _, r := range roles {
+			pn.Roles = append(pn.Roles, nodepb.NodeRole(r%3))
+		}
+		want := *pn
+		info := roundTrip(t, node, pn)
+		return sameNode(*info.Node, want)
+	}
+	cfg := &quick.Config{Rand: rand.New(rand.NewSource(1)), MaxCount: 200}
+	if err := quick.Check(f, cfg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+package spin
+
+import (
+	"sync"
+)
+
+// MetricsPlugin lets a plugin add its own metrics to the analytics of the node,
+// without changing the metrics collected here.
+type MetricsPlugin interface {
+	// ExtraFields returns the plugin's metrics, it is called on every update
+	ExtraFields() map[string]string
+}
+
+// registered metrics plugins, in registration order
+var (
+	pluginsLock sync.Mutex
+	plugins     []MetricsPlugin
+)
+
+// RegisterPlugin adds the metrics of p to the analytics collected from now on.
+func RegisterPlugin(p MetricsPlugin) {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	plugins = append(plugins, p)
+}
+
+// updatePluginFields collects the metrics of the registered plugins. A field set by
+// several plugins keeps the value of the one registered last.
+func (dc *dcWrap) updatePluginFields() {
+	pluginsLock.Lock()
+	registered := append([]MetricsPlugin(nil), plugins...)
+	pluginsLock.Unlock()
+	if len(registered) == 0 {
+		dc.extra.PluginFields = nil
+		return
+	}
+	fields := make(map[string]string)
+	for _, p := range registered {
+		for k, v := range p.ExtraFields() {
+			if _, ok := fields[k]; ok {
+				log.Debugf("analytics plugin field %q is set by several plugins", k)
+			}
+			fields[k] = v
+		}
+	}
+	dc.extra.PluginFields = fields
+}
@@ -0,0 +1,46 @@
+package spin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testPlugin reports fixed metrics
+type testPlugin map[string]string
+
+func (p testPlugin) ExtraFields() map[string]string {
+	return p
+}
+
+func TestMetricsPlugins(t *testing.T) {
+	defer func(registered []MetricsPlugin) { plugins = registered }(plugins)
+	plugins = nil
+
+	dc := newTestDcWrap(t)
+	dc.updatePluginFields()
+	if dc.extra.PluginFields != nil {
+		t.Fatalf("got plugin fields %v without plugins", dc.extra.PluginFields)
+	}
+
+	RegisterPlugin(testPlugin{"cdn_hits": "42", "region": "eu"})
+	RegisterPlugin(testPlugin{"region": "us"})
+	dc.update(dc.node)
+	rec := httptest.NewRecorder()
+	AnalyticsHandler(dc.node).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/analytics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var report struct {
+		PluginFields map[string]string `json:"plugin_fields"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	// the plugin registered last wins
+	if want := map[string]string{"cdn_hits": "42", "region": "us"}; !reflect.DeepEqual(report.PluginFields, want) {
+		t.Fatalf("got plugin fields %v, want %v", report.PluginFields, want)
+	}
+}
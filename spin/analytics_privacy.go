@@ -0,0 +1,90 @@
+package spin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// privacySecretFile is stored in the repo root and keys the pseudonymous node id
+const privacySecretFile = "analytics.secret"
+
+// privacySecretSize is the length of the random key in bytes
+const privacySecretSize = 32
+
+// privacyMode reports whether Analytics.PrivacyMode keeps the peer id from the
+// status server.
+func (dc *dcWrap) privacyMode() bool {
+	return configBool(dc.node.Repo, privacyModeKey, false)
+}
+
+// reportedNodeID returns the node id to put in the payload. In privacy mode that is
+// a pseudonym, stable for as long as the repo keeps its secret. As the node's public
+// key would give the peer id away, privacy mode also signs with Analytics.HMACKey
+// only, see signPayload, and sends no key fingerprint.
+func (dc *dcWrap) reportedNodeID(id string) (string, error) {
+	if !dc.privacyMode() {
+		return id, nil
+	}
+	dc.privacyMu.Lock()
+	defer dc.privacyMu.Unlock()
+	if dc.privacySecret == nil {
+		secret, err := loadPrivacySecret(dc.privacySecretPath)
+		if err != nil {
+			return "", err
+		}
+		dc.privacySecret = secret
+	}
+	return pseudonymousID(dc.privacySecret, id), nil
+}
+
+// pseudonymousID returns the hex HMAC-SHA256 of id keyed with secret.
+func pseudonymousID(secret []byte, id string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadPrivacySecret reads the secret at path, creating a random one the first time.
+func loadPrivacySecret(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("analytics privacy secret path is not configured")
+	}
+	secret, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(secret) != privacySecretSize {
+			return nil, fmt.Errorf("invalid analytics privacy secret %s: %d bytes, want %d",
+				path, len(secret), privacySecretSize)
+		}
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read analytics privacy secret: %s", err)
+	}
+	secret = make([]byte, privacySecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate analytics privacy secret: %s", err)
+	}
+	// TempFile creates the file readable by the owner only
+	tmp, err := ioutil.TempFile(filepath.Dir(path), privacySecretFile+".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to save analytics privacy secret: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(secret); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to save analytics privacy secret: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to save analytics privacy secret: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, fmt.Errorf("failed to save analytics privacy secret: %s", err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,114 @@
+package spin
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gogo/protobuf/proto"
+)
+
+const testNodeID = "16Uiu2HAmGziL6oze6vrrUQBKhnnW8mxS85R2u8UFcP6F5RiHMrsd"
+
+func TestPseudonymousID(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, privacySecretSize)
+	id := pseudonymousID(secret, testNodeID)
+	if id == testNodeID {
+		t.Fatal("pseudonym is the raw node id")
+	}
+	if again := pseudonymousID(secret, testNodeID); again != id {
+		t.Fatalf("pseudonym changed from %s to %s with the same key", id, again)
+	}
+	if other := pseudonymousID(bytes.Repeat([]byte{2}, privacySecretSize), testNodeID); other == id {
+		t.Fatal("different keys give the same pseudonym")
+	}
+}
+
+func TestReportedNodeID(t *testing.T) {
+	r := newTestRepo(nil)
+	path := filepath.Join(t.TempDir(), privacySecretFile)
+	dc := &dcWrap{node: &core.IpfsNode{Repo: r}, privacySecretPath: path}
+	if id, err := dc.reportedNodeID(testNodeID); err != nil || id != testNodeID {
+		t.Fatalf("got %s (%v) without privacy mode, want the raw id", id, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("privacy secret created without privacy mode")
+	}
+
+	r.keys = map[string]interface{}{privacyModeKey: true}
+	id, err := dc.reportedNodeID(testNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == testNodeID {
+		t.Fatal("privacy mode reported the raw node id")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&077 != 0 {
+		t.Errorf("privacy secret is accessible by others: %s", fi.Mode())
+	}
+
+	// a restarted node loads the same secret and keeps its pseudonym
+	restarted := &dcWrap{node: &core.IpfsNode{Repo: r}, privacySecretPath: path}
+	if again, err := restarted.reportedNodeID(testNodeID); err != nil || again != id {
+		t.Fatalf("pseudonym changed from %s to %s (%v) across restarts", id, again, err)
+	}
+}
+
+func TestPrivacyModeHidesPublicKey(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	defer dc.closeConn()
+	dc.privacySecretPath = filepath.Join(t.TempDir(), privacySecretFile)
+	r := dc.node.Repo.(*testRepo)
+	r.keys = map[string]interface{}{privacyModeKey: true}
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err == nil {
+		t.Fatal("expected privacy mode without an HMAC key to fail")
+	}
+	if n := len(ss.metrics()); n != 0 {
+		t.Fatalf("status server received %d metrics signed with the node's key", n)
+	}
+
+	r.keys[hmacKeyKey] = "shared"
+	dc.pending = newMetricsBuffer(defaultBufferSize)
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	got := ss.metrics()
+	if len(got) != 1 {
+		t.Fatalf("status server received %d metrics", len(got))
+	}
+	if len(got[0].PublicKey) != 0 {
+		t.Error("privacy mode sent the node's public key")
+	}
+	for _, fp := range ss.metadata(publicKeyFingerprintKey) {
+		if len(fp) != 0 {
+			t.Errorf("privacy mode sent the key fingerprint %v", fp)
+		}
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(got[0].Payload, info); err != nil {
+		t.Fatal(err)
+	}
+	peerID := dc.node.Identity.Pretty()
+	if info.NodeId == peerID || info.Node.NodeId == peerID {
+		t.Error("privacy mode sent the peer id")
+	}
+	extra, _, err := decodeExtraMetrics(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra.PublicKeyFingerprint != "" {
+		t.Errorf("privacy mode sent the key fingerprint %s in the payload", extra.PublicKeyFingerprint)
+	}
+}
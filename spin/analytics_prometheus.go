@@ -0,0 +1,101 @@
+// +build prometheus
+
+package spin
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const prometheusNamespace = "btfs_analytics"
+
+// PrometheusHandler serves the latest analytics collected for node as Prometheus
+// gauges labeled with the node id. A scrape does not collect them again, so it
+// leaves the epoch the next heartbeat reports alone.
+func PrometheusHandler(node *core.IpfsNode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dc, ok := getDcWrap(node)
+		if !ok {
+			http.Error(w, "analytics is not running", http.StatusServiceUnavailable)
+			return
+		}
+		dc.mu.RLock()
+		report := dc.localReport()
+		c := &reportCollector{nodeID: report.NodeId}
+		gaugeFields(reflect.ValueOf(report.Node).Elem(), c.add)
+		gaugeFields(reflect.ValueOf(report.extraMetrics), c.add)
+		dc.mu.RUnlock()
+
+		reg := prometheus.NewRegistry()
+		if err := reg.Register(c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// reportCollector exposes one snapshot of the analytics. It describes no metrics up
+// front since they are derived from the report fields.
+type reportCollector struct {
+	nodeID string
+	names  []string
+	values []float64
+}
+
+func (c *reportCollector) add(name string, v float64) {
+	c.names = append(c.names, name)
+	c.values = append(c.values, v)
+}
+
+func (c *reportCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *reportCollector) Collect(ch chan<- prometheus.Metric) {
+	labels := prometheus.Labels{"node_id": c.nodeID}
+	for i, name := range c.names {
+		desc := prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", name),
+			"BTFS analytics field "+name, nil, labels)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, c.values[i])
+	}
+}
+
+// gaugeFields calls add with the json name and value of every numeric or boolean
+// field of the struct v, including those of embedded structs.
+func gaugeFields(v reflect.Value, add func(string, float64)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.Struct:
+			if f.Anonymous && f.Type != reflect.TypeOf(time.Time{}) {
+				gaugeFields(fv, add)
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			add(name, float64(fv.Uint()))
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			add(name, float64(fv.Int()))
+		case reflect.Float32, reflect.Float64:
+			add(name, fv.Float())
+		case reflect.Bool:
+			if fv.Bool() {
+				add(name, 1)
+			} else {
+				add(name, 0)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// +build prometheus
+
+package spin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.update(dc.node)
+	dc.mu.RLock()
+	collected := dc.collected
+	dc.mu.RUnlock()
+
+	rec := httptest.NewRecorder()
+	PrometheusHandler(dc.node).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"up_time", "storage_used", "memory_used", "cpu_used", "upload", "download",
+		"total_upload", "total_download", "blocks_up", "blocks_down", "peers_connected",
+		"storage_price_ask", "customized_pricing", "disk_read", "disk_write", "net_in",
+		"net_out", "goroutines", "health_alerts",
+	} {
+		mf, ok := families["btfs_analytics_"+name]
+		if !ok {
+			t.Errorf("missing gauge for %s", name)
+			continue
+		}
+		labels := mf.Metric[0].Label
+		if len(labels) != 1 || labels[0].GetName() != "node_id" || labels[0].GetValue() != dc.pn.NodeId {
+			t.Errorf("gauge for %s has labels %v", name, labels)
+		}
+	}
+	if v := families["btfs_analytics_storage_price_ask"].Metric[0].Gauge.GetValue(); v != 125 {
+		t.Errorf("got storage price ask %v, want 125", v)
+	}
+	if dc.collected != collected {
+		t.Error("scrape collected the analytics again")
+	}
+}
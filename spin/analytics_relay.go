@@ -0,0 +1,60 @@
+package spin
+
+import (
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// maxRelayPeerIDs caps the relays reported
+const maxRelayPeerIDs = 5
+
+// updateRelay records whether the node is announced through circuit relays, as
+// nodes behind NAT are. The relays are left out in privacy mode.
+func (dc *dcWrap) updateRelay() {
+	if dc.node.PeerHost == nil {
+		dc.setRelay(nil)
+		return
+	}
+	dc.setRelay(dc.node.PeerHost.Addrs())
+}
+
+// setRelay records the relays of the announced addrs.
+func (dc *dcWrap) setRelay(addrs []ma.Multiaddr) {
+	var ids []string
+	dc.extra.IsRelay, dc.extra.RelayHops, ids = relayInfo(addrs)
+	if configBool(dc.node.Repo, privacyModeKey, false) {
+		ids = nil
+	}
+	dc.extra.RelayPeerIDs = ids
+}
+
+// relayInfo returns whether any of addrs goes through a circuit relay, the most
+// relays any of them goes through and the first maxRelayPeerIDs relays.
+func relayInfo(addrs []ma.Multiaddr) (bool, uint64, []string) {
+	var (
+		maxHops uint64
+		ids     []string
+	)
+	seen := make(map[string]bool)
+	for _, a := range addrs {
+		var hops uint64
+		relay := ""
+		ma.ForEach(a, func(c ma.Component) bool {
+			switch c.Protocol().Code {
+			case ma.P_P2P:
+				relay = c.Value()
+			case ma.P_CIRCUIT:
+				hops++
+				if relay != "" && !seen[relay] && len(ids) < maxRelayPeerIDs {
+					seen[relay] = true
+					ids = append(ids, relay)
+				}
+				relay = ""
+			}
+			return true
+		})
+		if hops > maxHops {
+			maxHops = hops
+		}
+	}
+	return maxHops > 0, maxHops, ids
+}
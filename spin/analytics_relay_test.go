@@ -0,0 +1,82 @@
+package spin
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestRelayInfo(t *testing.T) {
+	const (
+		relay1 = "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+		relay2 = "QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa"
+	)
+	for _, tc := range []struct {
+		name  string
+		addrs []string
+		relay bool
+		hops  uint64
+		ids   []string
+	}{
+		{"direct", []string{"/ip4/1.2.3.4/tcp/4001", "/ip6/::1/udp/4001/quic"}, false, 0, nil},
+		{"relayed", []string{
+			"/ip4/10.0.0.2/tcp/4001",
+			"/ip4/5.6.7.8/tcp/4001/p2p/" + relay1 + "/p2p-circuit",
+		}, true, 1, []string{relay1}},
+		{"same relay twice", []string{
+			"/ip4/5.6.7.8/tcp/4001/p2p/" + relay1 + "/p2p-circuit",
+			"/ip4/5.6.7.8/udp/4001/quic/p2p/" + relay1 + "/p2p-circuit",
+		}, true, 1, []string{relay1}},
+		{"two hops", []string{
+			"/ip4/5.6.7.8/tcp/4001/p2p/" + relay1 + "/p2p-circuit/p2p/" + relay2 + "/p2p-circuit",
+		}, true, 2, []string{relay1, relay2}},
+		{"unknown relay", []string{"/p2p-circuit"}, true, 1, nil},
+	} {
+		var addrs []ma.Multiaddr
+		for _, s := range tc.addrs {
+			addrs = append(addrs, ma.StringCast(s))
+		}
+		relay, hops, ids := relayInfo(addrs)
+		if relay != tc.relay || hops != tc.hops || !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("%s: got %v, %d, %v, want %v, %d, %v", tc.name, relay, hops, ids, tc.relay, tc.hops, tc.ids)
+		}
+	}
+}
+
+func TestRelayInfoCapsPeerIDs(t *testing.T) {
+	relays := []string{
+		"QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+		"QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+		"QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+		"QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+		"QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
+		"QmSoLPppuBtQSGwKDZT2M73ULpjvfd3aZ6ha4oFGL1KrGM",
+	}
+	var addrs []ma.Multiaddr
+	for _, r := range relays {
+		addrs = append(addrs, ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/"+r+"/p2p-circuit"))
+	}
+	if _, _, ids := relayInfo(addrs); !reflect.DeepEqual(ids, relays[:maxRelayPeerIDs]) {
+		t.Fatalf("got relays %v, want the first %d", ids, maxRelayPeerIDs)
+	}
+}
+
+func TestSetRelayPrivacyMode(t *testing.T) {
+	const relay = "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/" + relay + "/p2p-circuit")}
+
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}}
+	dc.setRelay(addrs)
+	if !dc.extra.IsRelay || dc.extra.RelayHops != 1 || !reflect.DeepEqual(dc.extra.RelayPeerIDs, []string{relay}) {
+		t.Fatalf("got relay %v, %d hops, relays %v", dc.extra.IsRelay, dc.extra.RelayHops, dc.extra.RelayPeerIDs)
+	}
+
+	dc = &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(map[string]interface{}{privacyModeKey: true})}}
+	dc.setRelay(addrs)
+	if !dc.extra.IsRelay || dc.extra.RelayPeerIDs != nil {
+		t.Fatalf("got relay %v, relays %v in privacy mode", dc.extra.IsRelay, dc.extra.RelayPeerIDs)
+	}
+}
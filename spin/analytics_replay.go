@@ -0,0 +1,217 @@
+package spin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+)
+
+// replayBatchSize caps the heartbeats sent to the status server in one batch
+const replayBatchSize = 50
+
+// ReplayResult is the outcome of replaying a local analytics export
+type ReplayResult struct {
+	// heartbeats read from the export and accepted by the status server
+	Replayed int
+}
+
+// Replay sends the heartbeats recorded in the CSV export at path to the status
+// server in their original order, signed again with the node's key, so a node
+// that was cut off from the status server can backfill its analytics. Only the
+// fields of the signed payload are replayed.
+func (a *Agent) Replay(ctx context.Context, path string) (*ReplayResult, error) {
+	if a == nil {
+		return nil, fmt.Errorf("analytics is not running")
+	}
+	sms, err := a.dc.readReplay(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := a.dc.replay(ctx, sms)
+	return &ReplayResult{Replayed: n}, err
+}
+
+// readReplay signs a payload for every row of the CSV export at path.
+func (dc *dcWrap) readReplay(path string) ([]*pb.SignedMetrics, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open analytics export: %s", err.Error())
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read analytics export header: %s", err.Error())
+	}
+	self := dc.node.Identity.Pretty()
+	var sms []*pb.SignedMetrics
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			return sms, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read analytics export: %s", err.Error())
+		}
+		report, err := parseCSVRecord(header, row)
+		if err != nil {
+			return nil, fmt.Errorf("invalid analytics export line %d: %s", line, err.Error())
+		}
+		pn := report.Node
+		if pn.NodeId != self {
+			return nil, fmt.Errorf("analytics export line %d was recorded by node %s", line, pn.NodeId)
+		}
+		// the uptime is counted from when the analytics started, up to the collection
+		collected := pn.TimeCreated.Add(time.Duration(pn.UpTime) * time.Second)
+		payload, err := dc.marshalPayload(self, pn, &report.extraMetrics, make([]*nodepb.DiscoveryNode, 0), collected)
+		if err != nil {
+			return nil, err
+		}
+		sm, err := dc.signPayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		sms = append(sms, sm)
+	}
+}
+
+// replay sends sms in batches of replayBatchSize and returns how many were taken.
+// It stops at the first batch no status server took in full, as sending the rest
+// would leave a gap in the history.
+func (dc *dcWrap) replay(ctx context.Context, sms []*pb.SignedMetrics) (int, error) {
+	// heartbeats sent meanwhile would land in the middle of the history
+	dc.sendMu.Lock()
+	defer dc.sendMu.Unlock()
+	replayed := 0
+	for replayed < len(sms) {
+		batch := sms[replayed:]
+		if len(batch) > replayBatchSize {
+			batch = batch[:replayBatchSize]
+		}
+		if dc.dryRun() {
+			for _, sm := range batch {
+				if err := dc.writeDryRun(sm); err != nil {
+					return replayed, err
+				}
+				replayed++
+			}
+			continue
+		}
+		n, err := dc.fanout(ctx, func(ctx context.Context, domain string) (int, error) {
+			return dc.flushTo(ctx, domain, batch)
+		})
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+		if n < len(batch) {
+			return replayed, fmt.Errorf("status server took %d of %d replayed heartbeats", n, len(batch))
+		}
+	}
+	return replayed, nil
+}
+
+// parseCSVRecord reads the analytics back from a row written by exportCSV. Columns
+// this version does not know are ignored, missing ones left unset.
+func parseCSVRecord(header, row []string) (*dcReport, error) {
+	values := make(map[string]string, len(header))
+	for i, name := range header {
+		if i < len(row) {
+			values[name] = row[i]
+		}
+	}
+	report := &dcReport{Node: new(nodepb.Node)}
+	allocCSVFields(reflect.ValueOf(report).Elem())
+	var err error
+	walkCSVFields(reflect.ValueOf(report).Elem(), "", func(name string, v reflect.Value) {
+		s, ok := values[name]
+		if !ok || err != nil {
+			return
+		}
+		if perr := parseCSVValue(v, s); perr != nil {
+			err = fmt.Errorf("column %s: %s", name, perr.Error())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// allocCSVFields allocates the nil struct pointers walkCSVFields would otherwise
+// walk as read-only zero values.
+func allocCSVFields(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		fv := v.Field(i)
+		if !fv.CanSet() {
+			continue
+		}
+		if fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct {
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && fv.Type() != reflect.TypeOf(time.Time{}) {
+			allocCSVFields(fv)
+		}
+	}
+}
+
+// parseCSVValue sets v to s written by csvValue.
+func parseCSVValue(v reflect.Value, s string) error {
+	if !v.CanSet() {
+		return nil
+	}
+	if _, ok := v.Interface().(time.Time); ok {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		if s == "" {
+			return nil
+		}
+		return json.Unmarshal([]byte(s), v.Addr().Interface())
+	}
+	return nil
+}
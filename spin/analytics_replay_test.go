@@ -0,0 +1,136 @@
+package spin
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/gogo/protobuf/proto"
+	ic "github.com/libp2p/go-libp2p-crypto"
+)
+
+func TestParseCSVRecord(t *testing.T) {
+	pn := &nodepb.Node{
+		NodeId:           testNodeID,
+		BtfsVersion:      "1.5.0",
+		TimeCreated:      time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC),
+		UpTime:           3600,
+		CpuUsed:          12.5,
+		StorageUsed:      1 << 20,
+		StorageVolumeCap: 1 << 30,
+		Node_Settings:    nodepb.Node_Settings{StoragePriceAsk: 125, StorageTimeMin: 30},
+	}
+	header, row := csvRecord(&dcReport{Node: pn, extraMetrics: extraMetrics{Goroutines: 7}})
+	got, err := parseCSVRecord(header, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Node, pn) {
+		t.Errorf("got %+v, want %+v", got.Node, pn)
+	}
+	if got.Goroutines != 7 {
+		t.Errorf("got %d goroutines, want 7", got.Goroutines)
+	}
+
+	// columns of other versions are skipped, missing ones left unset
+	got, err = parseCSVRecord([]string{"node_id", "renamed_column"}, []string{testNodeID, "1"})
+	if err != nil || got.NodeId != testNodeID || got.UpTime != 0 {
+		t.Errorf("got %+v, %v", got.Node, err)
+	}
+	if _, err := parseCSVRecord([]string{"up_time"}, []string{"an hour"}); err == nil {
+		t.Error("expected an error for an invalid number")
+	}
+}
+
+// exportTestRows writes n rows with up times 1 to n and a storage price ask of
+// 125 to the export at path.
+func exportTestRows(t *testing.T, dc *dcWrap, path string, n int) {
+	t.Helper()
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{localExportPathKey: path}
+	dc.pn.TimeCreated = time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+	dc.pn.StoragePriceAsk = 125
+	for i := 1; i <= n; i++ {
+		dc.pn.UpTime = uint64(i)
+		if err := dc.exportCSV(&dcReport{Node: dc.pn, extraMetrics: dc.extra}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dc.node.Repo.(*testRepo).keys = nil
+}
+
+func TestReplay(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	path := filepath.Join(t.TempDir(), "analytics.csv")
+	const rows = replayBatchSize + 10
+	exportTestRows(t, dc, path, rows)
+
+	res, err := (&Agent{dc: dc}).Replay(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Replayed != rows {
+		t.Fatalf("replayed %d heartbeats, want %d", res.Replayed, rows)
+	}
+	if batches, _ := ss.counts(); batches != 2 {
+		t.Errorf("sent %d batches, want 2", batches)
+	}
+	sms := ss.metrics()
+	if len(sms) != rows {
+		t.Fatalf("status server received %d heartbeats, want %d", len(sms), rows)
+	}
+	pub := dc.node.PrivateKey.GetPublic()
+	for i, sm := range sms {
+		if ok, err := pub.Verify(sm.Payload, sm.Signature); err != nil || !ok {
+			t.Fatalf("heartbeat %d does not verify: %v", i, err)
+		}
+		if key, err := ic.UnmarshalPublicKey(sm.PublicKey); err != nil || !key.Equals(pub) {
+			t.Fatalf("heartbeat %d not signed by the node", i)
+		}
+		payload := new(nodepb.PayLoadInfo)
+		if err := proto.Unmarshal(sm.Payload, payload); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := payload.Node.UpTime, uint64(i+1); got != want {
+			t.Fatalf("heartbeat %d has up time %d, want %d", i, got, want)
+		}
+		if payload.NodeId != dc.node.Identity.Pretty() || payload.Node.StoragePriceAsk != 125 {
+			t.Fatalf("heartbeat %d has node %s with settings %+v", i, payload.NodeId, payload.Node.Node_Settings)
+		}
+		if want := payload.Node.TimeCreated.Add(time.Duration(i+1) * time.Second); !payload.LastTime.Equal(want) {
+			t.Fatalf("heartbeat %d collected at %s, want %s", i, payload.LastTime, want)
+		}
+	}
+}
+
+func TestReplayStopsAtFailedBatch(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	ss.setFail(true)
+	dc := newTestSendingDcWrap(t, addr)
+	path := filepath.Join(t.TempDir(), "analytics.csv")
+	exportTestRows(t, dc, path, 3)
+	res, err := (&Agent{dc: dc}).Replay(context.Background(), path)
+	if err == nil {
+		t.Fatal("expected an error from a failing status server")
+	}
+	if res.Replayed != 0 || len(ss.metrics()) != 0 {
+		t.Errorf("replayed %d heartbeats to a failing status server", res.Replayed)
+	}
+}
+
+func TestReplayOtherNode(t *testing.T) {
+	dc := newTestSendingDcWrap(t, "")
+	path := filepath.Join(t.TempDir(), "analytics.csv")
+	dc.pn.NodeId = testNodeID
+	exportTestRows(t, dc, path, 1)
+	if _, err := dc.readReplay(path); err == nil {
+		t.Error("replayed the export of another node")
+	}
+	if _, err := dc.readReplay(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("expected an error for a missing export")
+	}
+}
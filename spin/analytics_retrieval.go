@@ -0,0 +1,101 @@
+package spin
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+)
+
+// How many of the latest successful retrievals the TTFB percentiles cover by default
+const defaultRetrievalSamples = 100
+
+// RetrievalStats keeps the time to first byte of the latest successful retrievals
+// in a ring buffer.
+type RetrievalStats struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newRetrievalStats(size int) *RetrievalStats {
+	if size < 1 {
+		size = defaultRetrievalSamples
+	}
+	return &RetrievalStats{samples: make([]time.Duration, size)}
+}
+
+// observe records the time to first byte of a retrieval, replacing the oldest
+// one once the buffer is full.
+func (s *RetrievalStats) observe(ttfb time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[s.next] = ttfb
+	if s.next++; s.next == len(s.samples) {
+		s.next, s.full = 0, true
+	}
+}
+
+// percentiles returns the nearest-rank p50, p95 and p99 of the recorded times to
+// first byte in milliseconds, all zero if there are none yet.
+func (s *RetrievalStats) percentiles() (p50, p95, p99 uint64) {
+	s.mu.Lock()
+	n := s.next
+	if s.full {
+		n = len(s.samples)
+	}
+	sorted := append([]time.Duration(nil), s.samples[:n]...)
+	s.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(p int) uint64 {
+		// ceil(p/100 * n), 1-based
+		i := (p*len(sorted) + 99) / 100
+		return uint64(sorted[i-1].Milliseconds())
+	}
+	return rank(50), rank(95), rank(99)
+}
+
+// updateRetrievals reports the TTFB percentiles of the latest retrievals.
+func (dc *dcWrap) updateRetrievals() {
+	if dc.retrievals == nil {
+		return
+	}
+	dc.extra.P50TTFB, dc.extra.P95TTFB, dc.extra.P99TTFB = dc.retrievals.percentiles()
+}
+
+// TimeRetrieval times the retrieval started at start whose content r streams, for
+// the analytics of node. The time to first byte is recorded once r has been read
+// to the end without an error.
+func TimeRetrieval(node *core.IpfsNode, start time.Time, r io.Reader) io.Reader {
+	dc, ok := getDcWrap(node)
+	if !ok || dc.retrievals == nil || r == nil {
+		return r
+	}
+	return &ttfbReader{Reader: r, start: start, stats: dc.retrievals}
+}
+
+type ttfbReader struct {
+	io.Reader
+	start time.Time
+	ttfb  time.Duration
+	stats *RetrievalStats
+	done  bool
+}
+
+func (r *ttfbReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.ttfb == 0 {
+		r.ttfb = time.Since(r.start)
+	}
+	if err == io.EOF && !r.done && r.ttfb > 0 {
+		r.done = true
+		r.stats.observe(r.ttfb)
+	}
+	return n, err
+}
@@ -0,0 +1,102 @@
+package spin
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// errReader fails every read with err
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestRetrievalPercentiles(t *testing.T) {
+	s := newRetrievalStats(100)
+	if p50, p95, p99 := s.percentiles(); p50 != 0 || p95 != 0 || p99 != 0 {
+		t.Fatalf("got percentiles %d/%d/%d without samples, want zeros", p50, p95, p99)
+	}
+	// 1ms to 100ms, out of order
+	for i := 100; i > 0; i-- {
+		s.observe(time.Duration(i) * time.Millisecond)
+	}
+	if p50, p95, p99 := s.percentiles(); p50 != 50 || p95 != 95 || p99 != 99 {
+		t.Errorf("got percentiles %d/%d/%d, want 50/95/99", p50, p95, p99)
+	}
+
+	s = newRetrievalStats(10)
+	s.observe(7 * time.Millisecond)
+	if p50, p95, p99 := s.percentiles(); p50 != 7 || p95 != 7 || p99 != 7 {
+		t.Errorf("got percentiles %d/%d/%d of a single sample, want 7/7/7", p50, p95, p99)
+	}
+	for _, ms := range []int{1, 2, 3, 4} {
+		s.observe(time.Duration(ms) * time.Millisecond)
+	}
+	// 1, 2, 3, 4, 7
+	if p50, p95, p99 := s.percentiles(); p50 != 3 || p95 != 7 || p99 != 7 {
+		t.Errorf("got percentiles %d/%d/%d, want 3/7/7", p50, p95, p99)
+	}
+}
+
+func TestRetrievalStatsRollingWindow(t *testing.T) {
+	s := newRetrievalStats(4)
+	for i := 0; i < 4; i++ {
+		s.observe(time.Second)
+	}
+	// the slow retrievals roll out of the window
+	for i := 0; i < 4; i++ {
+		s.observe(10 * time.Millisecond)
+	}
+	if p50, p95, p99 := s.percentiles(); p50 != 10 || p95 != 10 || p99 != 10 {
+		t.Errorf("got percentiles %d/%d/%d, want only the latest samples", p50, p95, p99)
+	}
+	if s := newRetrievalStats(0); len(s.samples) != defaultRetrievalSamples {
+		t.Errorf("got %d samples for an invalid size, want %d", len(s.samples), defaultRetrievalSamples)
+	}
+}
+
+func TestTimeRetrieval(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.retrievals = newRetrievalStats(10)
+	start := time.Now().Add(-20 * time.Millisecond)
+	r := TimeRetrieval(dc.node, start, iotest.OneByteReader(strings.NewReader("content")))
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "content" {
+		t.Fatalf("got %q, %v, want the content", b, err)
+	}
+	if p50, _, _ := dc.retrievals.percentiles(); p50 < 20 {
+		t.Errorf("got p50 %dms, want at least 20ms", p50)
+	}
+	// reading past the end counts the retrieval once
+	r.Read(make([]byte, 1))
+	if n := dc.retrievals.next; n != 1 {
+		t.Errorf("got %d samples, want 1", n)
+	}
+
+	failed := TimeRetrieval(dc.node, start, io.MultiReader(strings.NewReader("partial"),
+		errReader{errors.New("peer went away")}))
+	if _, err := ioutil.ReadAll(failed); err == nil {
+		t.Fatal("expected the failing retrieval to fail")
+	}
+	empty := TimeRetrieval(dc.node, start, strings.NewReader(""))
+	ioutil.ReadAll(empty)
+	if n := dc.retrievals.next; n != 1 {
+		t.Errorf("got %d samples, want failed and empty retrievals skipped", n)
+	}
+
+	dc.updateRetrievals()
+	if dc.extra.P50TTFB == 0 || dc.extra.P99TTFB < dc.extra.P50TTFB {
+		t.Errorf("got TTFB percentiles %d/%d/%d", dc.extra.P50TTFB, dc.extra.P95TTFB, dc.extra.P99TTFB)
+	}
+
+	if r := TimeRetrieval(dc.node, start, nil); r != nil {
+		t.Error("nil reader wrapped")
+	}
+}
@@ -0,0 +1,21 @@
+package spin
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// payloadSchemaVersion is bumped on every incompatible change to the payload the
+// status server receives. node.Node has no field for it, so it travels in the
+// metadata of every call under payloadSchemaVersionKey.
+const payloadSchemaVersion = 1
+
+// gRPC metadata key carrying payloadSchemaVersion
+const payloadSchemaVersionKey = "btfs-payload-schema-version"
+
+// withSchemaVersion adds the payload schema version to the outgoing metadata of ctx.
+func withSchemaVersion(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, payloadSchemaVersionKey, strconv.Itoa(payloadSchemaVersion))
+}
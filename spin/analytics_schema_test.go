@@ -0,0 +1,64 @@
+package spin
+
+import (
+	"context"
+	"encoding/hex"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// payloadV1 is a payload sent by a 1.3.0 node, before the schema was versioned
+const payloadV1 = "0a3531365569753248416d477a694c366f7a65367672725551424b686e6e57386d785338355232753855466350364635526948" +
+	"4d7273641258123531365569753248416d477a694c366f7a65367672725551424b686e6e57386d78533835523275385546635036" +
+	"46355269484d7273641a05312e332e3020901c2880085880107a00c201060880f395f605d20100da0100220608908f96f605"
+
+func TestPayloadV1Compatible(t *testing.T) {
+	b, err := hex.DecodeString(payloadV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(b, info); err != nil {
+		t.Fatalf("current schema cannot read a v1 payload: %s", err)
+	}
+	if info.NodeId != testNodeID || info.Node.NodeId != testNodeID || info.Node.BtfsVersion != "1.3.0" {
+		t.Fatalf("v1 payload identity read as %s/%s %s", info.NodeId, info.Node.NodeId, info.Node.BtfsVersion)
+	}
+	if info.Node.UpTime != 3600 || info.Node.StorageUsed != 1024 || info.Node.TotalUpload != 2048 {
+		t.Errorf("v1 payload analytics read as %d/%d/%d", info.Node.UpTime, info.Node.StorageUsed, info.Node.TotalUpload)
+	}
+	if !info.Node.TimeCreated.Equal(time.Unix(1590000000, 0)) || !info.LastTime.Equal(time.Unix(1590003600, 0)) {
+		t.Errorf("v1 payload times read as %s and %s", info.Node.TimeCreated, info.LastTime)
+	}
+
+	// a field added by a later schema, number 1000, must not break older readers
+	b = append(b, 0xc0, 0x3e, 0x01)
+	later := new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(b, later); err != nil {
+		t.Fatalf("schema cannot read a payload with unknown fields: %s", err)
+	}
+	if !reflect.DeepEqual(later.Node, info.Node) {
+		t.Error("unknown field changed the known ones")
+	}
+}
+
+func TestSchemaVersionMetadata(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}, statusServerDomains: []string{addr}}
+	defer dc.closeConn()
+	if err := dc.doSendData(context.Background(), testMetrics(0)); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{strconv.Itoa(payloadSchemaVersion)}}
+	if got := ss.metadata(payloadSchemaVersionKey); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got schema versions %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package spin
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// where an effective analytics setting came from
+const (
+	configFileSource = "config file"
+	envSource        = "environment variable"
+	defaultSource    = "default"
+)
+
+// redacted replaces the value of settings that are secrets
+const redacted = "<redacted>"
+
+// the status server of go-btfs-config, used unless Analytics.StatusServerDomains is set
+const statusServerDomainKey = "Services.StatusServerDomain"
+
+// ConfigValue is an analytics setting as the running agent resolved it.
+type ConfigValue struct {
+	Value  interface{}
+	Source string
+}
+
+// EffectiveConfig returns the analytics settings the agent runs with by config key,
+// with where each came from. Durations are shown as duration strings and secrets
+// are redacted.
+func (a *Agent) EffectiveConfig() (map[string]ConfigValue, error) {
+	if a == nil {
+		return nil, fmt.Errorf("analytics is not running")
+	}
+	dc := a.dc
+	r := dc.node.Repo
+	res := make(map[string]ConfigValue)
+	set := func(key string, v interface{}) {
+		src := defaultSource
+		if _, err := configKey(r, key); err == nil {
+			src = configFileSource
+		}
+		res[key] = ConfigValue{Value: v, Source: src}
+	}
+	// defined by go-btfs-config, so always in the config file
+	typed := func(key string, v interface{}) {
+		res[key] = ConfigValue{Value: v, Source: configFileSource}
+	}
+	duration := func(d time.Duration) string { return d.String() }
+
+	typed("Experimental.Analytics", dc.analyticsEnabled())
+	if v, ok := os.LookupEnv(analyticsEnv); ok {
+		res[analyticsEnv] = ConfigValue{Value: v, Source: envSource}
+	}
+	dc.settingsMu.RLock()
+	if _, err := configKey(r, statusServerDomainsKey); err == nil {
+		set(statusServerDomainsKey, append([]string(nil), dc.statusServerDomains...))
+	} else if len(dc.statusServerDomains) != 0 {
+		typed(statusServerDomainKey, dc.statusServerDomains[0])
+	}
+	set(heartbeatKey, duration(dc.heartbeat))
+	set(jitterKey, duration(dc.jitter))
+	set(retryMaxIntervalKey, duration(dc.retryMaxInterval))
+	set(maxRetriesKey, dc.maxRetries)
+	set(dialTimeoutKey, duration(dc.dialTimeout))
+	set(callTimeoutKey, duration(dc.callTimeout))
+	dc.settingsMu.RUnlock()
+	set(circuitCooldownKey, duration(configDuration(r, circuitCooldownKey, defaultCircuitCooldown)))
+	set(bufferSizeKey, configInt(r, bufferSizeKey, defaultBufferSize))
+	set(retrievalSamplesKey, configInt(r, retrievalSamplesKey, defaultRetrievalSamples))
+
+	set(statusTLSKey, configBool(r, statusTLSKey, false))
+	set(statusTLSCACertKey, configString(r, statusTLSCACertKey, ""))
+	set(statusClientCertKey, configString(r, statusClientCertKey, ""))
+	set(statusClientKeyKey, configString(r, statusClientKeyKey, ""))
+	set(statusServerProxyKey, configString(r, statusServerProxyKey, ""))
+	set(statusServerProtocolKey, configString(r, statusServerProtocolKey, grpcTransport))
+	set(statusServerTransportKey, configString(r, statusServerTransportKey, grpcTransport))
+	set(statusServerMQTTBrokerKey, configString(r, statusServerMQTTBrokerKey, ""))
+
+	set(samplingRateKey, configFraction(r, samplingRateKey, 1))
+	set(loadThresholdKey, configFloat(r, loadThresholdKey, 0))
+	set(peerChangeThresholdKey, configInt(r, peerChangeThresholdKey, defaultPeerChangeThreshold))
+	set(dryRunKey, configBool(r, dryRunKey, false))
+	set(dryRunOutputPathKey, configString(r, dryRunOutputPathKey, ""))
+	set(privacyModeKey, configBool(r, privacyModeKey, false))
+	set(differentialPrivacyKey, configBool(r, differentialPrivacyKey, false))
+	set(privacyEpsilonKey, configFloat(r, privacyEpsilonKey, defaultPrivacyEpsilon))
+	set(compressPayloadKey, configBool(r, compressPayloadKey, false))
+	set(nodeGroupKey, configString(r, nodeGroupKey, ""))
+	for _, key := range []string{hmacKeyKey, influxDBTokenKey} {
+		secret := configString(r, key, "")
+		if secret != "" {
+			secret = redacted
+		}
+		set(key, secret)
+	}
+
+	for _, key := range []string{
+		includePeerListKey, reportAddressesKey, reportPeerVersionsKey, reportCountryKey,
+		reportConfigHashKey, reportPinnedBytesKey, reportBootstrapHashKey, reportWalletKey,
+	} {
+		set(key, configBool(r, key, false))
+	}
+	set(countryDBKey, dc.countryDBPath)
+	set(localExportPathKey, configString(r, localExportPathKey, ""))
+	set(localExportMaxSizeKey, configInt(r, localExportMaxSizeKey, defaultExportMaxSize))
+	set(localDBPathKey, configString(r, localDBPathKey, ""))
+	set(influxDBURLKey, configString(r, influxDBURLKey, ""))
+	set(influxDBBucketKey, configString(r, influxDBBucketKey, ""))
+	set(aggregatorAddrKey, configString(r, aggregatorAddrKey, ""))
+	set(aggregatorKey, configBool(r, aggregatorKey, false))
+	set(otlpEndpointKey, configString(r, otlpEndpointKey, ""))
+	return res, nil
+}
@@ -0,0 +1,109 @@
+package spin
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TRON-US/go-btfs/repo/fsrepo"
+
+	config "github.com/TRON-US/go-btfs-config"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	var stopped *Agent
+	if _, err := stopped.EffectiveConfig(); err == nil {
+		t.Fatal("expected an error from a stopped agent")
+	}
+
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{
+		heartbeatKey:     "1m",
+		samplingRateKey:  0.5,
+		hmacKeyKey:       "shared",
+		influxDBTokenKey: "secret",
+	})
+	cfg, err := dc.node.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.loadSettings(cfg)
+	defer os.Unsetenv(analyticsEnv)
+	os.Setenv(analyticsEnv, "1")
+	got, err := (&Agent{dc: dc}).EffectiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]ConfigValue{
+		heartbeatKey:          {"1m0s", configFileSource},
+		samplingRateKey:       {0.5, configFileSource},
+		hmacKeyKey:            {redacted, configFileSource},
+		influxDBTokenKey:      {redacted, configFileSource},
+		influxDBURLKey:        {"", defaultSource},
+		dialTimeoutKey:        {dialTimeout.String(), defaultSource},
+		dryRunKey:             {false, defaultSource},
+		statusServerDomainKey: {cfg.Services.StatusServerDomain, configFileSource},
+		analyticsEnv:          {"1", envSource},
+	} {
+		if got[key] != want {
+			t.Errorf("%s: got %+v, want %+v", key, got[key], want)
+		}
+	}
+	if _, ok := got[statusServerDomainsKey]; ok {
+		t.Errorf("got %s without it in the config", statusServerDomainsKey)
+	}
+}
+
+func TestConfigKeysSurviveSetConfig(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := config.Init(ioutil.Discard, 2048, "Ed25519", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the flatfs and levelds plugins are not loaded in tests
+	cfg.Datastore.Spec = map[string]interface{}{"type": "mem"}
+	if err := fsrepo.Init(dir, cfg); err != nil {
+		t.Fatal(err)
+	}
+	r, err := fsrepo.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.SetConfigKey(heartbeatKey, "1m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetConfigKey(statusTLSKey, true); err != nil {
+		t.Fatal(err)
+	}
+	// as the config commands and the daemon do
+	cfg, err = r.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Services.StatusServerDomain = "status.example.com:443"
+	if err := r.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := configDuration(r, heartbeatKey, heartBeat); d != time.Minute {
+		t.Errorf("got heartbeat %s after SetConfig, want 1m", d)
+	}
+	if !configBool(r, statusTLSKey, false) {
+		t.Errorf("%s lost by SetConfig", statusTLSKey)
+	}
+}
+
+func TestLegacyConfigKeys(t *testing.T) {
+	r := newTestRepo(map[string]interface{}{
+		legacyConfigKeys[heartbeatKey]: "2m",
+		legacyConfigKeys[jitterKey]:    "1s",
+		jitterKey:                      "3s",
+	})
+	if d := configDuration(r, heartbeatKey, heartBeat); d != 2*time.Minute {
+		t.Errorf("got heartbeat %s, want the legacy 2m", d)
+	}
+	if d := configDuration(r, jitterKey, 0); d != 3*time.Second {
+		t.Errorf("got jitter %s, want 3s over the legacy key", d)
+	}
+}
@@ -0,0 +1,69 @@
+package spin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// snapshotFile is stored in the repo root
+const snapshotFile = "analytics.json"
+
+// dcSnapshot is the part of the analytics state persisted across restarts
+type dcSnapshot struct {
+	TotalUpload   uint64
+	TotalDownload uint64
+}
+
+// loadSnapshot restores the transfer totals saved by the last run, if any.
+func (dc *dcWrap) loadSnapshot() error {
+	b, err := ioutil.ReadFile(dc.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read analytics snapshot: %s", err)
+	}
+	var snap dcSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return fmt.Errorf("failed to parse analytics snapshot: %s", err)
+	}
+	dc.baseUpload = snap.TotalUpload
+	dc.baseDownload = snap.TotalDownload
+	dc.pn.TotalUpload = snap.TotalUpload
+	dc.pn.TotalDownload = snap.TotalDownload
+	dc.prev = clonePayload(dc.pn)
+	return nil
+}
+
+// saveSnapshot atomically replaces the snapshot file with the current totals.
+func (dc *dcWrap) saveSnapshot() error {
+	if dc.snapshotPath == "" {
+		return nil
+	}
+	b, err := json.Marshal(&dcSnapshot{
+		TotalUpload:   dc.pn.TotalUpload,
+		TotalDownload: dc.pn.TotalDownload,
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dc.snapshotPath), snapshotFile+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save analytics snapshot: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save analytics snapshot: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save analytics snapshot: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), dc.snapshotPath); err != nil {
+		return fmt.Errorf("failed to save analytics snapshot: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package spin
+
+import (
+	"path/filepath"
+	"testing"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/ipfs/go-bitswap"
+)
+
+func TestSnapshotSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), snapshotFile)
+
+	dc := &dcWrap{pn: new(nodepb.Node), snapshotPath: path}
+	dc.setBitswapStat(&bitswap.Stat{DataSent: 300 * 1024, DataReceived: 500 * 1024})
+	if err := dc.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted node's bitswap counters start over from zero
+	restarted := &dcWrap{pn: new(nodepb.Node), snapshotPath: path}
+	if err := restarted.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.setBitswapStat(&bitswap.Stat{DataSent: 20 * 1024, DataReceived: 40 * 1024})
+	if restarted.pn.Upload != 20 || restarted.pn.Download != 40 {
+		t.Errorf("got epoch upload/download %d/%d, want 20/40", restarted.pn.Upload, restarted.pn.Download)
+	}
+	if restarted.pn.TotalUpload != 320 || restarted.pn.TotalDownload != 540 {
+		t.Errorf("got total upload/download %d/%d, want 320/540",
+			restarted.pn.TotalUpload, restarted.pn.TotalDownload)
+	}
+
+	restarted.prev = clonePayload(restarted.pn)
+	restarted.setBitswapStat(&bitswap.Stat{DataSent: 25 * 1024, DataReceived: 40 * 1024})
+	if restarted.pn.Upload != 5 || restarted.pn.Download != 0 {
+		t.Errorf("got epoch upload/download %d/%d, want 5/0", restarted.pn.Upload, restarted.pn.Download)
+	}
+}
+
+func TestLoadMissingSnapshot(t *testing.T) {
+	dc := &dcWrap{pn: new(nodepb.Node), snapshotPath: filepath.Join(t.TempDir(), snapshotFile)}
+	if err := dc.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if dc.baseUpload != 0 || dc.baseDownload != 0 {
+		t.Fatal("expected empty baseline without a snapshot")
+	}
+}
@@ -0,0 +1,138 @@
+// +build sqlite
+
+package spin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // driver for the local history
+)
+
+// historyMigrations create the local history schema, one statement per version.
+// Only ever append to them, the schema_version table records how many ran.
+var historyMigrations = []string{
+	`CREATE TABLE history (
+		collected_at INTEGER NOT NULL,
+		report TEXT NOT NULL
+	)`,
+	`CREATE INDEX history_collected_at ON history (collected_at)`,
+}
+
+// openHistory returns the database at Analytics.LocalDBPath, opening and migrating
+// it on first use or when the path changed.
+func (dc *dcWrap) openHistory() (*sql.DB, error) {
+	path := configString(dc.node.Repo, localDBPathKey, "")
+	dc.historyMu.Lock()
+	defer dc.historyMu.Unlock()
+	if dc.historyDB != nil && dc.historyPath == path {
+		return dc.historyDB, nil
+	}
+	if dc.historyDB != nil {
+		dc.historyDB.Close()
+		dc.historyDB = nil
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open analytics history: %s", err.Error())
+	}
+	if err := migrateHistory(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	dc.historyDB, dc.historyPath = db, path
+	return db, nil
+}
+
+// migrateHistory runs the historyMigrations db has not seen yet.
+func migrateHistory(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("failed to migrate analytics history: %s", err.Error())
+	}
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read analytics history schema: %s", err.Error())
+	}
+	if version > len(historyMigrations) {
+		return fmt.Errorf("analytics history schema %d is newer than this version supports", version)
+	}
+	for v := version; v < len(historyMigrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to migrate analytics history: %s", err.Error())
+		}
+		if _, err := tx.Exec(historyMigrations[v]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate analytics history to schema %d: %s", v+1, err.Error())
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, v+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate analytics history to schema %d: %s", v+1, err.Error())
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to migrate analytics history to schema %d: %s", v+1, err.Error())
+		}
+	}
+	return nil
+}
+
+// recordHistory adds report to the local history at Analytics.LocalDBPath, if set.
+func (dc *dcWrap) recordHistory(report *dcReport) error {
+	if configString(dc.node.Repo, localDBPathKey, "") == "" {
+		return nil
+	}
+	db, err := dc.openHistory()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode analytics history: %s", err.Error())
+	}
+	if _, err := db.Exec(`INSERT INTO history (collected_at, report) VALUES (?, ?)`,
+		time.Now().UnixNano(), string(b)); err != nil {
+		return fmt.Errorf("failed to record analytics history: %s", err.Error())
+	}
+	return nil
+}
+
+func (dc *dcWrap) queryHistory(from, to time.Time) ([]HistoryRecord, error) {
+	db, err := dc.openHistory()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT collected_at, report FROM history
+		WHERE collected_at >= ? AND collected_at <= ? ORDER BY collected_at`,
+		from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query analytics history: %s", err.Error())
+	}
+	defer rows.Close()
+	var res []HistoryRecord
+	for rows.Next() {
+		var (
+			at     int64
+			report string
+		)
+		if err := rows.Scan(&at, &report); err != nil {
+			return nil, fmt.Errorf("failed to read analytics history: %s", err.Error())
+		}
+		res = append(res, HistoryRecord{CollectedAt: time.Unix(0, at), Report: json.RawMessage(report)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read analytics history: %s", err.Error())
+	}
+	return res, nil
+}
+
+// closeHistory closes the local history, if it was opened.
+func (dc *dcWrap) closeHistory() {
+	dc.historyMu.Lock()
+	defer dc.historyMu.Unlock()
+	if dc.historyDB != nil {
+		dc.historyDB.Close()
+		dc.historyDB, dc.historyPath = nil, ""
+	}
+}
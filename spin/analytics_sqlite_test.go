@@ -0,0 +1,92 @@
+// +build sqlite
+
+package spin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestHistoryAgent(t *testing.T) (*Agent, string) {
+	path := filepath.Join(t.TempDir(), "analytics.db")
+	dc := newTestDcWrap(t)
+	dc.node.Repo = newTestRepo(map[string]interface{}{localDBPathKey: path})
+	t.Cleanup(dc.closeHistory)
+	return &Agent{dc: dc}, path
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	a, _ := newTestHistoryAgent(t)
+	from := time.Now()
+	for i := 0; i < 3; i++ {
+		a.dc.mu.Lock()
+		a.dc.extra.Goroutines = uint64(i)
+		err := a.dc.recordHistory(&dcReport{Node: a.dc.pn, extraMetrics: a.dc.extra})
+		a.dc.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, err := a.QueryHistory(from, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("got %d records, want 3", len(recs))
+	}
+	for i, rec := range recs {
+		var report dcReport
+		if err := json.Unmarshal(rec.Report, &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Goroutines != uint64(i) {
+			t.Fatalf("record %d out of order: %d goroutines", i, report.Goroutines)
+		}
+		if report.Node.BtfsVersion != "1.0.0" {
+			t.Fatalf("got version %q", report.Node.BtfsVersion)
+		}
+		if rec.CollectedAt.Before(from) {
+			t.Fatalf("record %d collected at %v, before %v", i, rec.CollectedAt, from)
+		}
+	}
+	if recs, err := a.QueryHistory(from.Add(-time.Hour), from.Add(-time.Minute)); err != nil || len(recs) != 0 {
+		t.Fatalf("got %d records, %v before the first heartbeat", len(recs), err)
+	}
+}
+
+func TestHistoryMigrations(t *testing.T) {
+	a, path := newTestHistoryAgent(t)
+	a.dc.mu.Lock()
+	err := a.dc.recordHistory(&dcReport{Node: a.dc.pn, extraMetrics: a.dc.extra})
+	a.dc.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.dc.closeHistory()
+
+	// reopening must not run the migrations again
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrateHistory(db); err != nil {
+		t.Fatal(err)
+	}
+	var versions, latest int
+	if err := db.QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_version`).Scan(&versions, &latest); err != nil {
+		t.Fatal(err)
+	}
+	if versions != len(historyMigrations) || latest != len(historyMigrations) {
+		t.Fatalf("got %d migrations up to %d, want %d", versions, latest, len(historyMigrations))
+	}
+	if _, err := db.Exec(`INSERT INTO schema_version (version) VALUES (?)`, len(historyMigrations)+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateHistory(db); err == nil {
+		t.Fatal("expected an error for a newer schema")
+	}
+}
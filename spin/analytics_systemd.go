@@ -0,0 +1,18 @@
+// +build systemd
+
+package spin
+
+import (
+	daemon "github.com/coreos/go-systemd/v22/daemon"
+)
+
+// sdNotify is replaced in tests
+var sdNotify = daemon.SdNotify
+
+// notifyWatchdog resets the systemd watchdog of a daemon run with WatchdogSec,
+// which must be longer than the heartbeat interval. It does nothing outside systemd.
+func notifyWatchdog() {
+	if _, err := sdNotify(false, daemon.SdNotifyWatchdog); err != nil {
+		log.Debugf("Failed to notify the systemd watchdog: %s", err)
+	}
+}
@@ -0,0 +1,37 @@
+// +build systemd
+
+package spin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	daemon "github.com/coreos/go-systemd/v22/daemon"
+)
+
+func TestHeartbeatNotifiesWatchdog(t *testing.T) {
+	var states []string
+	sdNotify = func(unsetEnvironment bool, state string) (bool, error) {
+		states = append(states, state)
+		return true, nil
+	}
+	defer func() { sdNotify = daemon.SdNotify }()
+
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	dc.sendHeartbeat(context.Background())
+	if want := []string{daemon.SdNotifyWatchdog}; !reflect.DeepEqual(states, want) {
+		t.Fatalf("got notifications %q, want %q", states, want)
+	}
+
+	// a node that cannot deliver its heartbeats leaves the watchdog to systemd
+	ss.setFail(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	dc.sendHeartbeat(ctx)
+	if len(states) != 1 {
+		t.Errorf("got notifications %q after a failed heartbeat", states)
+	}
+}
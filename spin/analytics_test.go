@@ -0,0 +1,1070 @@
+package spin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+	"github.com/TRON-US/go-btfs/core/commands/storage/helper"
+	unixtest "github.com/TRON-US/go-btfs/core/coreunix/test"
+	"github.com/TRON-US/go-btfs/repo"
+
+	config "github.com/TRON-US/go-btfs-config"
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gogo/protobuf/proto"
+	"github.com/ipfs/go-bitswap"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// testRepo serves optional config keys that repo.Mock does not support
+type testRepo struct {
+	*repo.Mock
+	keys map[string]interface{}
+	// mu lets tests change the config while an agent reads it
+	mu sync.Mutex
+}
+
+func (r *testRepo) Config() (*config.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg := r.C
+	return &cfg, nil
+}
+
+func (r *testRepo) SetConfig(updated *config.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.C = *updated
+	return nil
+}
+
+func (r *testRepo) GetConfigKey(key string) (interface{}, error) {
+	if v, ok := r.keys[key]; ok {
+		return v, nil
+	}
+	return nil, errors.New("key not found")
+}
+
+func newTestRepo(keys map[string]interface{}) *testRepo {
+	cfg := config.Config{}
+	cfg.Experimental.Analytics = true
+	return &testRepo{Mock: &repo.Mock{C: cfg}, keys: keys}
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	for _, tc := range []struct {
+		keys map[string]interface{}
+		want time.Duration
+	}{
+		{nil, heartBeat},
+		{map[string]interface{}{heartbeatKey: "1m"}, time.Minute},
+		{map[string]interface{}{heartbeatKey: "2h"}, 2 * time.Hour},
+		{map[string]interface{}{heartbeatKey: "bogus"}, heartBeat},
+		{map[string]interface{}{heartbeatKey: "-5s"}, heartBeat},
+		{map[string]interface{}{heartbeatKey: 60}, heartBeat},
+	} {
+		if got := configDuration(newTestRepo(tc.keys), heartbeatKey, heartBeat); got != tc.want {
+			t.Errorf("keys %v: got heartbeat %s, want %s", tc.keys, got, tc.want)
+		}
+	}
+}
+
+func TestValOrZero(t *testing.T) {
+	one, two := uint64(1), uint64(2)
+	for _, tc := range []struct {
+		x, want uint64
+	}{
+		{0, 0},
+		{1, 1},
+		{math.MaxUint64, math.MaxUint64},
+		// the dead x < 0 branch cannot catch a wrapped around difference
+		{one - two, math.MaxUint64},
+	} {
+		if got := valOrZero(tc.x); got != tc.want {
+			t.Errorf("valOrZero(%d) = %d, want %d", tc.x, got, tc.want)
+		}
+	}
+}
+
+func TestClonePayload(t *testing.T) {
+	pn := &nodepb.Node{TotalUpload: 10, XXX_unrecognized: []byte{1}}
+	pn.Roles = []nodepb.NodeRole{nodepb.NodeRole_HOST}
+	pn.Node_Geo.XXX_unrecognized = []byte{2}
+	n := clonePayload(pn)
+	pn.TotalUpload = 20
+	pn.Roles[0] = nodepb.NodeRole_RENTER
+	pn.XXX_unrecognized[0] = 3
+	pn.Node_Geo.XXX_unrecognized[0] = 4
+	if n.TotalUpload != 10 || n.Roles[0] != nodepb.NodeRole_HOST || n.XXX_unrecognized[0] != 1 ||
+		n.Node_Geo.XXX_unrecognized[0] != 2 {
+		t.Fatalf("clone changed with the original: %+v", n)
+	}
+}
+
+func TestSetBitswapStatEpochDeltas(t *testing.T) {
+	dc := &dcWrap{pn: new(nodepb.Node)}
+	dc.setBitswapStat(&bitswap.Stat{DataSent: 100 << 10, DataReceived: 200 << 10})
+	// reading the counters again in the same epoch measures from the same snapshot
+	dc.setBitswapStat(&bitswap.Stat{DataSent: 150 << 10, DataReceived: 200 << 10})
+	if dc.pn.Upload != 150 || dc.pn.Download != 200 {
+		t.Fatalf("got epoch upload/download %d/%d, want 150/200", dc.pn.Upload, dc.pn.Download)
+	}
+	dc.prev = clonePayload(dc.pn)
+	dc.setBitswapStat(&bitswap.Stat{DataSent: 170 << 10, DataReceived: 260 << 10})
+	if dc.pn.Upload != 20 || dc.pn.Download != 60 {
+		t.Fatalf("got epoch upload/download %d/%d, want 20/60", dc.pn.Upload, dc.pn.Download)
+	}
+}
+
+func TestEpochDeltasAcrossFailedSend(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	defer dc.closeConn()
+	stats := &testStats{st: &bitswap.Stat{DataSent: 100 << 10}}
+	dc.stats = stats
+	send := func(sent uint64) error {
+		stats.st = &bitswap.Stat{DataSent: sent << 10}
+		return dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{})
+	}
+
+	if err := send(100); err != nil {
+		t.Fatal(err)
+	}
+	ss.setFail(true)
+	if err := send(150); err == nil {
+		t.Fatal("expected the heartbeat to fail")
+	}
+	// a collection that is not sent, as for the local views or sampling
+	stats.st = &bitswap.Stat{DataSent: 160 << 10}
+	dc.update(dc.node)
+	if dc.prev.TotalUpload != 100 {
+		t.Fatalf("baseline moved to %d KiB without a heartbeat delivered", dc.prev.TotalUpload)
+	}
+
+	ss.setFail(false)
+	if err := send(170); err != nil {
+		t.Fatal(err)
+	}
+	if got := dc.collected.Upload; got != 70 {
+		t.Errorf("got epoch upload %d KiB, want the 70 since the last delivered heartbeat", got)
+	}
+	if dc.prev.TotalUpload != 170 {
+		t.Errorf("got baseline %d KiB after delivery, want 170", dc.prev.TotalUpload)
+	}
+}
+
+func TestDurationToSeconds(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want uint64
+	}{
+		{0, 0},
+		{time.Nanosecond, 0},
+		{999 * time.Millisecond, 0},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 1},
+		{90 * time.Minute, 5400},
+		{math.MaxInt64, uint64(math.MaxInt64 / int64(time.Second))},
+	} {
+		if got := durationToSeconds(tc.d); got != tc.want {
+			t.Errorf("durationToSeconds(%s) = %d, want %d", tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestRunAgentFiresPerTick(t *testing.T) {
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}}
+	tick := make(chan time.Time)
+	sent := make(chan struct{}, 10)
+	go dc.runAgent(context.Background(), tick, nil, func() {
+		sent <- struct{}{}
+	})
+
+	// one immediate send, then one per tick
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			tick <- time.Now()
+		}
+		select {
+		case <-sent:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no send after tick %d", i)
+		}
+	}
+	select {
+	case <-sent:
+		t.Fatal("unexpected send without tick")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRunAgentSendsWhenEnabled(t *testing.T) {
+	r := newTestRepo(nil)
+	r.C.Experimental.Analytics = false
+	dc := &dcWrap{node: &core.IpfsNode{Repo: r}}
+	poll := make(chan time.Time)
+	sent := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dc.runAgent(ctx, nil, poll, func() {
+		sent <- struct{}{}
+	})
+
+	expectSends := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case <-sent:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %d sends, want %d", i, n)
+			}
+		}
+		select {
+		case <-sent:
+			t.Fatalf("got more than %d sends", n)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	poll <- time.Now()
+	expectSends(0)
+
+	// turn analytics on the way btfs config does
+	cfg, err := r.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled := *cfg
+	enabled.Experimental.Analytics = true
+	if err := r.SetConfig(&enabled); err != nil {
+		t.Fatal(err)
+	}
+	poll <- time.Now()
+	expectSends(1)
+	// staying enabled waits for the next tick
+	poll <- time.Now()
+	expectSends(0)
+}
+
+func TestAgentStop(t *testing.T) {
+	r := newTestRepo(nil)
+	// keep the agent ticking without sending anything
+	r.C.Experimental.Analytics = false
+	dc := &dcWrap{node: &core.IpfsNode{Repo: r}, heartbeat: time.Millisecond}
+	stopped := make(chan struct{}, 1)
+	a := dc.start(context.Background())
+	if _, ok := getDcWrap(dc.node); !ok {
+		t.Fatal("started collector is not registered")
+	}
+	go func() {
+		a.Stop()
+		stopped <- struct{}{}
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	select {
+	case <-a.done:
+	default:
+		t.Fatal("collection agent still running after Stop")
+	}
+	if _, ok := getDcWrap(dc.node); ok {
+		t.Fatal("stopped collector is still registered")
+	}
+	// stopping twice or a nil agent is harmless
+	a.Stop()
+	(*Agent)(nil).Stop()
+	if err := (*Agent)(nil).SendDataNow(); err == nil {
+		t.Fatal("expected sending without an agent to fail")
+	}
+}
+
+// newTestDcWrap returns a registered collector for a mock node whose host storage
+// settings are stored locally, so update does not need to reach the hub.
+func newTestDcWrap(t *testing.T) *dcWrap {
+	node := unixtest.HelpTestMockRepo(t, nil)
+	if err := helper.PutHostStorageConfig(node, &nodepb.Node_Settings{StoragePriceAsk: 125}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := node.Repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := &dcWrap{
+		node: node,
+		pn: &nodepb.Node{
+			NodeId:      node.Identity.Pretty(),
+			BtfsVersion: "1.0.0",
+			OsType:      runtime.GOOS,
+			TimeCreated: time.Now(),
+		},
+		stats:     exchangeStats{node: node},
+		config:    cfg,
+		heartbeat: heartBeat,
+	}
+	agentsLock.Lock()
+	agents[node] = &Agent{dc: dc, ctx: context.Background()}
+	agentsLock.Unlock()
+	t.Cleanup(func() {
+		agentsLock.Lock()
+		delete(agents, node)
+		agentsLock.Unlock()
+	})
+	return dc
+}
+
+// newTestSendingDcWrap returns an enabled collector reporting to the status server
+// at addr whose agent sends right away and then not again for an hour.
+func newTestSendingDcWrap(t *testing.T, addr string) *dcWrap {
+	dc := newTestDcWrap(t)
+	r := &testRepo{Mock: dc.node.Repo.(*repo.Mock)}
+	r.C.Experimental.Analytics = true
+	dc.node.Repo = r
+	dc.statusServerDomains = []string{addr}
+	dc.pending = newMetricsBuffer(defaultBufferSize)
+	dc.heartbeat, dc.jitter = time.Hour, time.Nanosecond
+	var err error
+	if dc.node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func jsonTags(typ reflect.Type) map[string]bool {
+	tags := make(map[string]bool)
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			tags[name] = true
+		}
+	}
+	return tags
+}
+
+func TestAnalyticsHandler(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dc.update(dc.node)
+	dc.mu.RLock()
+	collected := dc.collected
+	dc.mu.RUnlock()
+
+	rec := httptest.NewRecorder()
+	AnalyticsHandler(dc.node).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/analytics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	tags := jsonTags(reflect.TypeOf(nodepb.Node{}))
+	for k := range jsonTags(reflect.TypeOf(extraMetrics{})) {
+		tags[k] = true
+	}
+	for k := range fields {
+		if !tags[k] {
+			t.Errorf("unexpected analytics field %q", k)
+		}
+	}
+	for _, k := range []string{"node_id", "settings", "time_created"} {
+		if _, ok := fields[k]; !ok {
+			t.Errorf("missing analytics field %q", k)
+		}
+	}
+	if settings, _ := fields["settings"].(map[string]interface{}); settings["storage_price_ask"] != float64(125) {
+		t.Errorf("handler did not serve the collected analytics, settings are %v", fields["settings"])
+	}
+	// reading the analytics leaves the epoch alone
+	if dc.collected != collected {
+		t.Error("handler collected the analytics again")
+	}
+}
+
+func TestAnalyticsHandlerNotRunning(t *testing.T) {
+	node := unixtest.HelpTestMockRepo(t, nil)
+	rec := httptest.NewRecorder()
+	AnalyticsHandler(node).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/analytics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestAnalyticsStream(t *testing.T) {
+	dc := newTestDcWrap(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dc.serveStream(w, r, 20*time.Millisecond)
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %q", ct)
+	}
+
+	dc.mu.RLock()
+	collected := dc.collected
+	dc.mu.RUnlock()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	// next returns the next event or comment of the stream
+	next := func() string {
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				return line
+			}
+		}
+		t.Fatalf("stream ended: %v", scanner.Err())
+		return ""
+	}
+	checkEvent := func(line string) {
+		if !strings.HasPrefix(line, "data: ") {
+			t.Fatalf("unexpected stream line %q", line)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &fields); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"node_id", "settings", "goroutines"} {
+			if _, ok := fields[k]; !ok {
+				t.Errorf("event is missing analytics field %q: %s", k, line)
+			}
+		}
+	}
+
+	// the stream starts with the report known so far and only keeps itself alive
+	// until an update, without collecting the analytics
+	checkEvent(next())
+	for i := 0; i < 2; i++ {
+		if line := next(); !strings.HasPrefix(line, ":") {
+			t.Fatalf("got %q, want a keepalive comment", line)
+		}
+	}
+	dc.mu.RLock()
+	if dc.collected != collected {
+		t.Error("stream collected the analytics")
+	}
+	dc.mu.RUnlock()
+
+	// updates collected elsewhere are sent as they happen
+	dc.update(dc.node)
+	for {
+		line := next()
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		checkEvent(line)
+		break
+	}
+}
+
+func TestAnalyticsStreamNotRunning(t *testing.T) {
+	node := unixtest.HelpTestMockRepo(t, nil)
+	rec := httptest.NewRecorder()
+	AnalyticsStreamHandler(node).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v0/analytics/stream", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestBackoffCap(t *testing.T) {
+	const maxWait = 20 * time.Millisecond
+	dc := &dcWrap{retryMaxInterval: maxWait}
+	attempts := 0
+	start := time.Now()
+	err := backoff.Retry(func() error {
+		attempts++
+		if attempts <= 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}, dc.newBackoff())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*maxWait+100*time.Millisecond {
+		t.Fatalf("3 retries took %s with a %s cap", elapsed, maxWait)
+	}
+
+	bo := dc.newBackoff()
+	for i := 0; i < 20; i++ {
+		if next := bo.NextBackOff(); next > maxWait {
+			t.Fatalf("retry %d waits %s, above the %s cap", i, next, maxWait)
+		}
+	}
+}
+
+// testStats returns fixed bitswap statistics
+type testStats struct {
+	st  *bitswap.Stat
+	err error
+}
+
+func (s *testStats) Stat() (*bitswap.Stat, error) {
+	return s.st, s.err
+}
+
+func TestUpdateStatsProvider(t *testing.T) {
+	dc := newTestDcWrap(t)
+	stats := &testStats{st: &bitswap.Stat{
+		DataSent:       3 << 20,
+		DataReceived:   5 << 20,
+		BlocksSent:     7,
+		BlocksReceived: 11,
+		Peers:          []string{"a", "b"},
+	}}
+	dc.stats = stats
+	for _, err := range dc.update(dc.node) {
+		t.Log(err)
+	}
+	if dc.pn.TotalUpload != 3072 || dc.pn.TotalDownload != 5120 {
+		t.Errorf("got totals %d/%d KiB, want 3072/5120", dc.pn.TotalUpload, dc.pn.TotalDownload)
+	}
+	if dc.pn.BlocksUp != 7 || dc.pn.BlocksDown != 11 || dc.pn.PeersConnected != 2 {
+		t.Errorf("got blocks %d/%d and %d peers, want 7/11 and 2", dc.pn.BlocksUp, dc.pn.BlocksDown, dc.pn.PeersConnected)
+	}
+
+	stats.st, stats.err = nil, errors.New("no exchange")
+	errs := dc.update(dc.node)
+	if len(errs) == 0 || errs[len(errs)-1] != stats.err {
+		t.Errorf("stats error not reported, got %v", errs)
+	}
+	if dc.pn.TotalUpload != 3072 {
+		t.Errorf("failed stats changed total upload to %d", dc.pn.TotalUpload)
+	}
+}
+
+// slowStats is a StatsProvider whose Stat blocks until released
+type slowStats struct {
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStats) Stat() (*bitswap.Stat, error) {
+	close(s.reading)
+	<-s.release
+	return &bitswap.Stat{}, nil
+}
+
+func TestPrepDataDoesNotHoldMuOnSlowSources(t *testing.T) {
+	dc := newTestSendingDcWrap(t, "")
+	stats := &slowStats{reading: make(chan struct{}), release: make(chan struct{})}
+	dc.stats = stats
+	api := &slowSwarmAPI{listing: make(chan struct{}), release: make(chan struct{})}
+	dc.api = api
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := dc.doPrepData(dc.node)
+		done <- err
+	}()
+	lockable := func(what string) {
+		t.Helper()
+		locked := make(chan struct{})
+		go func() {
+			dc.mu.Lock()
+			dc.mu.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("mu held while %s", what)
+		}
+	}
+	<-stats.reading
+	lockable("reading the exchange stats")
+	close(stats.release)
+	<-api.listing
+	lockable("listing the swarm peers")
+	close(api.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigStrings(t *testing.T) {
+	def := []string{"default"}
+	for _, tc := range []struct {
+		v    interface{}
+		want []string
+	}{
+		{nil, def},
+		{[]interface{}{"a:1", "https://b"}, []string{"a:1", "https://b"}},
+		{[]interface{}{}, []string{}},
+		{[]interface{}{"a:1", 2}, def},
+		{"a:1", def},
+	} {
+		keys := map[string]interface{}{}
+		if tc.v != nil {
+			keys[statusServerDomainsKey] = tc.v
+		}
+		if got := configStrings(newTestRepo(keys), statusServerDomainsKey, def); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("value %v: got %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestAdaptiveHeartbeat(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	defer dc.closeConn()
+	send := func() error {
+		return dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{})
+	}
+
+	// the status server is down, every heartbeat after the first failed one
+	// doubles the interval
+	ss.setFail(true)
+	interval := dc.heartbeat
+	for i := 0; interval < maxHeartbeat; i++ {
+		if err := send(); err == nil {
+			t.Fatal("expected failing status server to fail")
+		}
+		if i > 0 {
+			interval *= 2
+		}
+		if interval > maxHeartbeat {
+			interval = maxHeartbeat
+		}
+		if got := dc.nextHeartbeat(); got != interval {
+			t.Fatalf("got interval %s after %d failed heartbeats, want %s", got, i+1, interval)
+		}
+	}
+	if err := send(); err == nil {
+		t.Fatal("expected failing status server to fail")
+	}
+	if got := dc.nextHeartbeat(); got != maxHeartbeat {
+		t.Fatalf("got interval %s, want it capped at %s", got, maxHeartbeat)
+	}
+
+	// the status server is back, the heartbeat that reaches it restores the interval
+	ss.setFail(false)
+	// without waiting for the circuit opened by the failures to cool down
+	dc.circuit = circuitBreaker{}
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dc.nextHeartbeat(); got != dc.heartbeat {
+		t.Fatalf("got interval %s after a delivered heartbeat, want %s", got, dc.heartbeat)
+	}
+
+	// a configured interval beyond the cap is kept
+	dc.heartbeat = 2 * maxHeartbeat
+	dc.failedSends = 3
+	if got := dc.nextHeartbeat(); got != dc.heartbeat {
+		t.Fatalf("got interval %s, want the configured %s", got, dc.heartbeat)
+	}
+}
+
+func TestStartAgentReschedules(t *testing.T) {
+	r := newTestRepo(nil)
+	r.C.Experimental.Analytics = true
+	dc := &dcWrap{node: &core.IpfsNode{Repo: r}, heartbeat: 50 * time.Millisecond, jitter: time.Nanosecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sent := make(chan time.Time, 10)
+	go dc.startAgent(ctx, func() {
+		sent <- time.Now()
+		// every heartbeat fails, after the first the interval doubles each time
+		dc.sendMu.Lock()
+		dc.failedSends++
+		dc.sendMu.Unlock()
+	})
+	var times []time.Time
+	for len(times) < 4 {
+		select {
+		case at := <-sent:
+			times = append(times, at)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d heartbeats sent", len(times))
+		}
+	}
+	for i, want := range []time.Duration{dc.heartbeat, 2 * dc.heartbeat, 4 * dc.heartbeat} {
+		if got := times[i+1].Sub(times[i]); got < want {
+			t.Errorf("heartbeat %d sent %s after the previous one, want at least %s", i+2, got, want)
+		}
+	}
+}
+
+func TestSkipHeartbeatUnderLoad(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{loadThresholdKey: 90.0}
+	dc.pn.CpuUsed = 95
+	// the load only drops after the second skipped heartbeat
+	readings := []float64{95, 20}
+	cpuPercent = func() (float64, error) {
+		used := readings[0]
+		if len(readings) > 1 {
+			readings = readings[1:]
+		}
+		return used, nil
+	}
+	defer func() { cpuPercent = defaultCPUPercent }()
+
+	for i := 0; i < 2; i++ {
+		dc.sendHeartbeat(context.Background())
+		if len(ss.metrics()) != 0 {
+			t.Fatalf("heartbeat %d sent at 95%% CPU", i+1)
+		}
+	}
+	dc.sendHeartbeat(context.Background())
+	if n := len(ss.metrics()); n != 1 {
+		t.Fatalf("got %d heartbeats after the load dropped, want 1", n)
+	}
+
+	// without a threshold load never skips a heartbeat
+	dc.node.Repo.(*testRepo).keys = nil
+	dc.pn.CpuUsed = 100
+	if dc.overloaded() {
+		t.Error("heartbeat skipped without a load threshold")
+	}
+}
+
+func TestStartAgentJitter(t *testing.T) {
+	// a fixed seed makes the delays drawn by the agents deterministic
+	jitterRand = rand.New(rand.NewSource(1))
+	defer func() { jitterRand = rand.New(rand.NewSource(cryptoSeed())) }()
+
+	const (
+		agents  = 100
+		window  = 500 * time.Millisecond
+		buckets = 5
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sent := make(chan time.Duration, agents)
+	start := time.Now()
+	for i := 0; i < agents; i++ {
+		dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(nil)}, heartbeat: time.Hour, jitter: window}
+		once := false
+		go dc.startAgent(ctx, func() {
+			if !once {
+				once = true
+				sent <- time.Since(start)
+			}
+		})
+	}
+
+	var counts [buckets]int
+	for i := 0; i < agents; i++ {
+		select {
+		case d := <-sent:
+			if d > window+100*time.Millisecond {
+				t.Fatalf("first heartbeat after %s, beyond the %s jitter window", d, window)
+			}
+			b := int(d * buckets / window)
+			if b >= buckets {
+				b = buckets - 1
+			}
+			counts[b]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d agents sent a heartbeat", i, agents)
+		}
+	}
+	for b, n := range counts {
+		if n == 0 {
+			t.Errorf("no first heartbeat in %s..%s, got %v", window*time.Duration(b)/buckets,
+				window*time.Duration(b+1)/buckets, counts)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	dc := &dcWrap{pn: &nodepb.Node{Upload: 1, Download: 2, TotalUpload: 3, TotalDownload: 4, BlocksUp: 5}}
+	dc.extra = extraMetrics{
+		DiskRead: 1, DiskWrite: 2, NetIn: 3, NetOut: 4, UploadBPS: 5, DownloadBPS: 6,
+		GCPauseTotal: 7, GCCount: 8, HealthAlerts: 9, Goroutines: 10, BlockCount: 11,
+	}
+	dc.mu.Lock()
+	dc.reset()
+	dc.mu.Unlock()
+
+	if dc.pn.Upload != 0 || dc.pn.Download != 0 {
+		t.Errorf("epoch transfers not reset: %d/%d", dc.pn.Upload, dc.pn.Download)
+	}
+	if want := (extraMetrics{Goroutines: 10, BlockCount: 11}); !reflect.DeepEqual(dc.extra, want) {
+		t.Errorf("got extra metrics %+v after reset, want %+v", dc.extra, want)
+	}
+	if dc.pn.TotalUpload != 3 || dc.pn.TotalDownload != 4 || dc.pn.BlocksUp != 5 {
+		t.Errorf("cumulative analytics changed by reset: %+v", dc.pn)
+	}
+}
+
+// brokenRepo fails to read its config
+type brokenRepo struct {
+	*repo.Mock
+}
+
+func (brokenRepo) Config() (*config.Config, error) {
+	return nil, errors.New("config file is corrupt")
+}
+
+func TestAnalyticsErrors(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Experimental.Analytics = true
+	for _, tc := range []struct {
+		name string
+		node func() *core.IpfsNode
+		want string
+	}{
+		{"no node", func() *core.IpfsNode { return nil }, "without a node"},
+		{"no repo", func() *core.IpfsNode { return &core.IpfsNode{} }, "without a repo"},
+		{"broken repo", func() *core.IpfsNode {
+			node := unixtest.HelpTestMockRepo(t, cfg)
+			node.Repo = brokenRepo{node.Repo.(*repo.Mock)}
+			return node
+		}, "failed to read the config for analytics: config file is corrupt"},
+		{"no identity", func() *core.IpfsNode {
+			node := unixtest.HelpTestMockRepo(t, cfg)
+			node.Identity = ""
+			return node
+		}, "without an identity"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			node := tc.node()
+			a, err := Analytics(context.Background(), nil, t.TempDir(), node, "test", "")
+			if err == nil {
+				a.Stop()
+				t.Fatal("expected analytics to fail")
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %q, want it to mention %q", err, tc.want)
+			}
+			if a != nil || (node != nil && GetAgent(node) != nil) {
+				t.Error("failed analytics started the collection agent")
+			}
+		})
+	}
+}
+
+func TestAnalyticsEnvOptOut(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Experimental.Analytics = true
+	node := unixtest.HelpTestMockRepo(t, cfg)
+	defer os.Unsetenv(analyticsEnv)
+	for _, v := range []string{"0", "false", "FALSE"} {
+		os.Setenv(analyticsEnv, v)
+		if a, err := Analytics(context.Background(), nil, t.TempDir(), node, "test", ""); err != nil || a != nil || GetAgent(node) != nil {
+			a.Stop()
+			t.Fatalf("%s=%s started the collection agent", analyticsEnv, v)
+		}
+	}
+
+	for _, v := range []string{"", "1", "true"} {
+		os.Setenv(analyticsEnv, v)
+		if analyticsOptedOut() {
+			t.Errorf("%s=%q opted out of analytics", analyticsEnv, v)
+		}
+	}
+}
+
+func TestConcurrentSendAndRead(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestDcWrap(t)
+	r := &testRepo{Mock: dc.node.Repo.(*repo.Mock)}
+	r.C.Experimental.Analytics = true
+	dc.node.Repo = r
+	dc.statusServerDomains = []string{addr}
+	dc.pending = newMetricsBuffer(defaultBufferSize)
+	defer dc.closeConn()
+	var err error
+	if dc.node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	a := GetAgent(dc.node)
+
+	// the ticker and several callers send and read the analytics at the same time,
+	// run with -race to check they do it safely
+	ctx, cancel := context.WithCancel(context.Background())
+	tick := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dc.runAgent(ctx, tick, nil, func() {
+			// not ctx, so the heartbeat of the last tick is not abandoned
+			dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{})
+		})
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := a.SendDataNow(); err != nil {
+					t.Error(err)
+				}
+				if _, err := a.Status(); err != nil {
+					t.Error(err)
+				}
+				if _, err := a.HealthCheck(ctx); err != nil {
+					t.Error(err)
+				}
+				AnalyticsHandler(dc.node).ServeHTTP(httptest.NewRecorder(),
+					httptest.NewRequest(http.MethodGet, "/debug/analytics", nil))
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		tick <- time.Now()
+	}
+	wg.Wait()
+	cancel()
+	<-done
+
+	// one immediate send, one per tick and the ones on demand
+	if got := len(ss.metrics()); got != 1+5+4*5 {
+		t.Fatalf("status server received %d metrics, want %d", got, 1+5+4*5)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	ss1, addr1 := startTestStatusServer(t)
+	ss2, addr2 := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr1)
+	defer dc.closeConn()
+	a := &Agent{dc: dc}
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := dc.node.Repo.(*testRepo)
+	r.C.Services.StatusServerDomain = addr2
+	r.keys = map[string]interface{}{heartbeatKey: "30m", callTimeoutKey: "2s"}
+	if err := a.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ss1.metrics()); n != 1 {
+		t.Fatalf("old status server received %d heartbeats, want 1", n)
+	}
+	if n := len(ss2.metrics()); n != 1 {
+		t.Fatalf("new status server received %d heartbeats, want 1", n)
+	}
+	st, err := a.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.HeartbeatInterval != 30*time.Minute {
+		t.Fatalf("got heartbeat interval %s, want 30m", st.HeartbeatInterval)
+	}
+	if dc.callTimeout != 2*time.Second {
+		t.Fatalf("got call timeout %s, want 2s", dc.callTimeout)
+	}
+
+	var stopped *Agent
+	if err := stopped.ReloadConfig(); err == nil {
+		t.Fatal("expected an error without a running agent")
+	}
+}
+
+func TestSamplingRate(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestSendingDcWrap(t, addr)
+	defer dc.closeConn()
+
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{samplingRateKey: 0.0}
+	for i := 0; i < 3; i++ {
+		dc.extra.Goroutines = 0
+		dc.sendHeartbeat(context.Background())
+		if dc.extra.Goroutines == 0 {
+			t.Fatal("analytics not collected locally for a skipped heartbeat")
+		}
+	}
+	if n := len(ss.metrics()); n != 0 {
+		t.Fatalf("got %d heartbeats at sampling rate 0, want none", n)
+	}
+
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{samplingRateKey: 1.0}
+	for i := 0; i < 3; i++ {
+		dc.sendHeartbeat(context.Background())
+	}
+	if n := len(ss.metrics()); n != 3 {
+		t.Fatalf("got %d heartbeats at sampling rate 1, want 3", n)
+	}
+
+	// out of range rates send everything
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{samplingRateKey: 1.5}
+	if !dc.sampled() {
+		t.Fatal("heartbeat skipped with an invalid sampling rate")
+	}
+}
+
+func TestSamplingRateConverges(t *testing.T) {
+	dc := &dcWrap{node: &core.IpfsNode{Repo: newTestRepo(map[string]interface{}{samplingRateKey: 0.5})}}
+	const iterations = 1000
+	sent := 0
+	for i := 0; i < iterations; i++ {
+		if dc.sampled() {
+			sent++
+		}
+	}
+	// more than 6 standard deviations away from 500
+	if sent < 400 || sent > 600 {
+		t.Fatalf("sent %d of %d heartbeats at sampling rate 0.5", sent, iterations)
+	}
+}
+
+func TestMarshalBoundedPayload(t *testing.T) {
+	dc := newTestDcWrap(t)
+	dn := []*nodepb.DiscoveryNode{{ToNodeId: testNodeID, NodeConnectLatency: 20}}
+	info := new(nodepb.PayLoadInfo)
+	b, err := dc.marshalBoundedPayload(testNodeID, dc.pn, nil, dn, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proto.Unmarshal(b, info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.DiscoveryNodes) != 1 {
+		t.Fatalf("got %d discovery nodes in a small payload, want 1", len(info.DiscoveryNodes))
+	}
+
+	// about 60 bytes each, enough to pass maxPayloadBytes
+	for len(dn) < maxPayloadBytes/40 {
+		dn = append(dn, &nodepb.DiscoveryNode{ToNodeId: testNodeID, NodeConnectLatency: int32(len(dn))})
+	}
+	if b, err := dc.marshalPayload(testNodeID, dc.pn, nil, dn, time.Now()); err != nil || len(b) <= maxPayloadBytes {
+		t.Fatalf("test payload of %d bytes is not over the limit: %v", len(b), err)
+	}
+	b, err = dc.marshalBoundedPayload(testNodeID, dc.pn, nil, dn, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > maxPayloadBytes {
+		t.Fatalf("got %d bytes, want at most %d", len(b), maxPayloadBytes)
+	}
+	info = new(nodepb.PayLoadInfo)
+	if err := proto.Unmarshal(b, info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.DiscoveryNodes) != 0 {
+		t.Fatalf("got %d discovery nodes, want them dropped", len(info.DiscoveryNodes))
+	}
+	if info.NodeId != testNodeID || info.Node.BtfsVersion != dc.pn.BtfsVersion {
+		t.Fatalf("trimmed payload lost the node: %v", info.Node)
+	}
+}
@@ -0,0 +1,205 @@
+package spin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TRON-US/go-btfs/core"
+	"github.com/TRON-US/go-btfs/core/node"
+
+	"github.com/ipfs/go-bitswap"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	tn "github.com/ipfs/go-bitswap/testnet"
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	delay "github.com/ipfs/go-ipfs-delay"
+	mockrouting "github.com/ipfs/go-ipfs-routing/mock"
+	"github.com/libp2p/go-libp2p-core/peer"
+	tnet "github.com/libp2p/go-libp2p-testing/net"
+)
+
+// failingNetwork cannot send any blocks, like a bitswap whose partners keep disconnecting
+type failingNetwork struct {
+	bsnet.BitSwapNetwork
+}
+
+func (n failingNetwork) SendMessage(ctx context.Context, p peer.ID, msg bsmsg.BitSwapMessage) error {
+	if len(msg.Blocks()) != 0 {
+		return errors.New("stream reset")
+	}
+	return n.BitSwapNetwork.SendMessage(ctx, p, msg)
+}
+
+// newTestBitswap starts a bitswap on net, counting its traffic if traffic is set
+func newTestBitswap(t testing.TB, ctx context.Context, net tn.Network, traffic *node.BitswapTraffic) (*bitswap.Bitswap, bsnet.BitSwapNetwork) {
+	return newTestBitswapOn(t, ctx, net, traffic, false)
+}
+
+// newTestBitswapOn starts a bitswap on net like newTestBitswap, failing to send any
+// blocks if failSends is set
+func newTestBitswapOn(t testing.TB, ctx context.Context, net tn.Network, traffic *node.BitswapTraffic, failSends bool) (*bitswap.Bitswap, bsnet.BitSwapNetwork) {
+	id, err := tnet.RandIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := net.Adapter(id)
+	counted := adapter
+	if failSends {
+		counted = failingNetwork{counted}
+	}
+	if traffic != nil {
+		counted = traffic.Network(counted)
+	}
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := bitswap.New(ctx, counted, bs)
+	t.Cleanup(func() { exch.Close() })
+	return exch.(*bitswap.Bitswap), adapter
+}
+
+func TestExchangeStatsTraffic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(0))
+	traffic := node.NewBitswapTraffic()
+	local, localNet := newTestBitswap(t, ctx, net, traffic)
+	remote, remoteNet := newTestBitswap(t, ctx, net, nil)
+	if err := localNet.ConnectTo(ctx, remoteNet.Self()); err != nil {
+		t.Fatal(err)
+	}
+
+	up, down := blocks.NewBlock([]byte("uploaded block")), blocks.NewBlock([]byte("downloaded block data"))
+	if err := local.HasBlock(up); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.HasBlock(down); err != nil {
+		t.Fatal(err)
+	}
+	getCtx, getCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer getCancel()
+	if _, err := local.GetBlock(getCtx, down.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.GetBlock(getCtx, up.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := exchangeStats{node: &core.IpfsNode{Exchange: local, Traffic: traffic}}
+	var got, want *bitswap.Stat
+	// the sender counts a block once the message is out, which can be after the receiver got it
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if got, err = stats.Stat(); err != nil {
+			t.Fatal(err)
+		}
+		if want, err = local.Stat(); err != nil {
+			t.Fatal(err)
+		}
+		if got.BlocksSent == want.BlocksSent || time.Now().After(deadline) {
+			break
+		}
+	}
+	if got.BlocksSent != 1 || got.DataSent != uint64(len(up.RawData())) ||
+		got.BlocksReceived != 1 || got.DataReceived != uint64(len(down.RawData())) {
+		t.Errorf("got %d/%d blocks and %d/%d bytes sent/received, want 1/1 and %d/%d", got.BlocksSent, got.BlocksReceived,
+			got.DataSent, got.DataReceived, len(up.RawData()), len(down.RawData()))
+	}
+	if got.BlocksSent != want.BlocksSent || got.DataSent != want.DataSent ||
+		got.BlocksReceived != want.BlocksReceived || got.DataReceived != want.DataReceived {
+		t.Errorf("traffic %+v does not match bitswap %+v", got, want)
+	}
+	if !reflect.DeepEqual(got.Peers, want.Peers) {
+		t.Errorf("got peers %v, want %v", got.Peers, want.Peers)
+	}
+}
+
+func TestFailedTransfers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(0))
+	traffic := node.NewBitswapTraffic()
+	local, localNet := newTestBitswapOn(t, ctx, net, traffic, true)
+	remote, remoteNet := newTestBitswap(t, ctx, net, nil)
+	if err := localNet.ConnectTo(ctx, remoteNet.Self()); err != nil {
+		t.Fatal(err)
+	}
+
+	up, missing := blocks.NewBlock([]byte("never uploaded")), blocks.NewBlock([]byte("nobody has this"))
+	if err := local.HasBlock(up); err != nil {
+		t.Fatal(err)
+	}
+	// given up while the partner may still send it, not a failure
+	for _, get := range []struct {
+		exch *bitswap.Bitswap
+		blk  blocks.Block
+	}{{local, missing}, {remote, up}} {
+		getCtx, getCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		_, err := get.exch.GetBlock(getCtx, get.blk.Cid())
+		getCancel()
+		if err == nil {
+			t.Fatalf("got block %s that should have timed out", get.blk.Cid())
+		}
+	}
+	// the only partner it is wanted from disconnects, a failure
+	getCtx, getCancel := context.WithCancel(ctx)
+	defer getCancel()
+	lost := blocks.NewBlock([]byte("lost with the partner"))
+	go local.GetBlock(getCtx, lost.Cid())
+	time.Sleep(200 * time.Millisecond)
+	if err := localNet.DisconnectFrom(ctx, remoteNet.Self()); err != nil {
+		t.Fatal(err)
+	}
+
+	dc := newTestDcWrap(t)
+	dc.node.Traffic = traffic
+	// the cancels go out after GetBlock returns
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if ups, downs := traffic.Failed(); ups != 0 && downs != 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	dc.updateFailedTransfers()
+	if dc.extra.FailedUploads == 0 || dc.extra.FailedDownloads != 1 {
+		t.Fatalf("got %d failed uploads and %d failed downloads, want some and 1",
+			dc.extra.FailedUploads, dc.extra.FailedDownloads)
+	}
+	dc.updateFailedTransfers()
+	if dc.extra.FailedUploads != 0 || dc.extra.FailedDownloads != 0 {
+		t.Fatalf("got %d failed uploads and %d failed downloads in an epoch without transfers",
+			dc.extra.FailedUploads, dc.extra.FailedDownloads)
+	}
+}
+
+func BenchmarkExchangeStats(b *testing.B) {
+	for _, peers := range []int{10, 100} {
+		ctx, cancel := context.WithCancel(context.Background())
+		net := tn.VirtualNetwork(mockrouting.NewServer(), delay.Fixed(0))
+		traffic := node.NewBitswapTraffic()
+		local, localNet := newTestBitswap(b, ctx, net, traffic)
+		for i := 0; i < peers; i++ {
+			_, remoteNet := newTestBitswap(b, ctx, net, nil)
+			if err := localNet.ConnectTo(ctx, remoteNet.Self()); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for name, stats := range map[string]exchangeStats{
+			"bitswap": {node: &core.IpfsNode{Exchange: local}},
+			"traffic": {node: &core.IpfsNode{Exchange: local, Traffic: traffic}},
+		} {
+			b.Run(fmt.Sprintf("%s/peers=%d", name, peers), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := stats.Stat(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,59 @@
+package spin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// versionFile is stored in the repo root and keeps the version that last reported analytics
+const versionFile = "analytics.version"
+
+// gRPC metadata key carrying the version a node was upgraded from, sent until the
+// first heartbeat after the upgrade is delivered
+const previousVersionKey = "btfs-previous-version"
+
+// detectUpgrade compares version with the one stored in the repo. A different one
+// marks the analytics as an upgrade until the next heartbeat is delivered, see
+// saveVersion. A new repo just stores version.
+func (dc *dcWrap) detectUpgrade(version string) error {
+	b, err := ioutil.ReadFile(dc.versionPath)
+	if os.IsNotExist(err) {
+		return dc.saveVersion(version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read analytics version: %s", err)
+	}
+	if prev := strings.TrimSpace(string(b)); prev != version {
+		dc.extra.IsUpgrade = true
+		dc.extra.PreviousVersion = prev
+	}
+	return nil
+}
+
+// saveVersion stores version as the one that last reported analytics.
+func (dc *dcWrap) saveVersion(version string) error {
+	if dc.versionPath == "" {
+		return nil
+	}
+	if err := ioutil.WriteFile(dc.versionPath, []byte(version+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to save analytics version: %s", err)
+	}
+	return nil
+}
+
+// withUpgrade adds the previous version to the outgoing metadata of ctx while the
+// upgrade has not been reported.
+func (dc *dcWrap) withUpgrade(ctx context.Context) context.Context {
+	dc.mu.RLock()
+	prev, upgrade := dc.extra.PreviousVersion, dc.extra.IsUpgrade
+	dc.mu.RUnlock()
+	if !upgrade {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, previousVersionKey, prev)
+}
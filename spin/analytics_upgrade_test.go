@@ -0,0 +1,68 @@
+package spin
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/TRON-US/go-btfs/core"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+func TestDetectUpgrade(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	path := filepath.Join(t.TempDir(), versionFile)
+	newDc := func(version string) *dcWrap {
+		dc := &dcWrap{
+			node:                &core.IpfsNode{Repo: newTestRepo(nil)},
+			pn:                  &nodepb.Node{},
+			statusServerDomains: []string{addr},
+			pending:             newMetricsBuffer(defaultBufferSize),
+			versionPath:         path,
+			version:             version,
+		}
+		if err := dc.detectUpgrade(version); err != nil {
+			t.Fatal(err)
+		}
+		return dc
+	}
+
+	// a new repo only remembers its version
+	if dc := newDc("1.0.0"); dc.extra.IsUpgrade || dc.extra.PreviousVersion != "" {
+		t.Fatalf("first start reported an upgrade from %q", dc.extra.PreviousVersion)
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || strings.TrimSpace(string(b)) != "1.0.0" {
+		t.Fatalf("stored version is %q (%v)", b, err)
+	}
+
+	dc := newDc("1.1.0")
+	defer dc.closeConn()
+	if !dc.extra.IsUpgrade || dc.extra.PreviousVersion != "1.0.0" {
+		t.Fatalf("upgrade not detected: %+v", dc.extra)
+	}
+	if err := dc.send(context.Background(), testMetrics(0), &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ss.metadata(previousVersionKey), [][]string{{"1.0.0"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got previous versions %q, want %q", got, want)
+	}
+	if dc.extra.IsUpgrade || dc.extra.PreviousVersion != "" {
+		t.Fatalf("upgrade still reported after the first heartbeat: %+v", dc.extra)
+	}
+	if err := dc.send(context.Background(), testMetrics(1), &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metadata(previousVersionKey); len(got) != 2 || got[1] != nil {
+		t.Fatalf("later heartbeat announced an upgrade: %q", got)
+	}
+
+	if dc := newDc("1.1.0"); dc.extra.IsUpgrade {
+		t.Fatalf("restart without upgrade reported one from %q", dc.extra.PreviousVersion)
+	}
+}
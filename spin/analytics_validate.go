@@ -0,0 +1,32 @@
+package spin
+
+import (
+	"fmt"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+)
+
+// validate checks that the collected analytics are plausible enough to be sent,
+// so that a broken collector does not feed the status server garbage. The caller
+// must hold mu, reading is enough.
+func (dc *dcWrap) validate() error {
+	return validateNode(dc.pn)
+}
+
+func validateNode(pn *nodepb.Node) error {
+	switch {
+	case pn == nil:
+		return fmt.Errorf("no analytics collected")
+	case pn.NodeId == "":
+		return fmt.Errorf("node id is empty")
+	case pn.BtfsVersion == "":
+		return fmt.Errorf("btfs version is empty")
+	case pn.OsType == "":
+		return fmt.Errorf("os type is empty")
+	case pn.CpuUsed < 0 || pn.CpuUsed > 100:
+		return fmt.Errorf("cpu used %v is not a percentage", pn.CpuUsed)
+	case pn.MemoryUsed == 0:
+		return fmt.Errorf("memory used is 0")
+	}
+	return nil
+}
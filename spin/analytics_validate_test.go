@@ -0,0 +1,81 @@
+package spin
+
+import (
+	"context"
+	"testing"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+
+	"github.com/cenkalti/backoff/v4"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+func TestValidateNode(t *testing.T) {
+	valid := func() *nodepb.Node {
+		return &nodepb.Node{
+			NodeId:      testNodeID,
+			BtfsVersion: "1.0.0",
+			OsType:      "linux",
+			CpuUsed:     12.5,
+			MemoryUsed:  1024,
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(pn *nodepb.Node)
+		valid  bool
+	}{
+		{"valid", func(pn *nodepb.Node) {}, true},
+		{"idle cpu", func(pn *nodepb.Node) { pn.CpuUsed = 0 }, true},
+		{"busy cpu", func(pn *nodepb.Node) { pn.CpuUsed = 100 }, true},
+		{"no node id", func(pn *nodepb.Node) { pn.NodeId = "" }, false},
+		{"no version", func(pn *nodepb.Node) { pn.BtfsVersion = "" }, false},
+		{"no os type", func(pn *nodepb.Node) { pn.OsType = "" }, false},
+		{"negative cpu", func(pn *nodepb.Node) { pn.CpuUsed = -1 }, false},
+		{"cpu over 100", func(pn *nodepb.Node) { pn.CpuUsed = 100.5 }, false},
+		{"no memory", func(pn *nodepb.Node) { pn.MemoryUsed = 0 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pn := valid()
+			tt.modify(pn)
+			if err := validateNode(pn); (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+	if err := validateNode(nil); err == nil {
+		t.Fatal("expected missing analytics to be invalid")
+	}
+}
+
+func TestSendDataRejectsInvalid(t *testing.T) {
+	ss, addr := startTestStatusServer(t)
+	dc := newTestDcWrap(t)
+	dc.statusServerDomains = []string{addr}
+	dc.pending = newMetricsBuffer(defaultBufferSize)
+	var err error
+	if dc.node.PrivateKey, _, err = ic.GenerateKeyPair(ic.Ed25519, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer dc.closeConn()
+
+	dc.pn.BtfsVersion = ""
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err == nil {
+		t.Fatal("expected invalid analytics not to be sent")
+	}
+	if got := ss.metrics(); len(got) != 0 {
+		t.Fatalf("status server received %d heartbeats", len(got))
+	}
+	if dc.pending.len() != 0 {
+		t.Fatal("invalid heartbeat was buffered")
+	}
+
+	dc.pn.BtfsVersion = "1.0.0"
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ss.metrics(); len(got) != 1 {
+		t.Fatalf("status server received %d heartbeats, want 1", len(got))
+	}
+}
@@ -0,0 +1,158 @@
+package spin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	grpcTransport      = "grpc"
+	websocketTransport = "websocket"
+	// path the status server accepts analytics WebSocket connections on
+	websocketPath = "/metrics"
+	// text message the status server answers every SignedMetrics it took with,
+	// anything else is the reason it was rejected
+	websocketAck = "ok"
+)
+
+// transport returns how the collector talks to the status servers.
+func (dc *dcWrap) transport() (string, error) {
+	protocol := strings.ToLower(configString(dc.node.Repo, statusServerProtocolKey, grpcTransport))
+	switch protocol {
+	case httpProtocol:
+		return httpProtocol, nil
+	case grpcTransport:
+	default:
+		return "", fmt.Errorf("invalid %s %q, want %q or %q", statusServerProtocolKey, protocol,
+			grpcTransport, httpProtocol)
+	}
+	transport := strings.ToLower(configString(dc.node.Repo, statusServerTransportKey, grpcTransport))
+	switch transport {
+	case grpcTransport, websocketTransport:
+		return transport, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q, want %q or %q", statusServerTransportKey, transport,
+			grpcTransport, websocketTransport)
+	}
+}
+
+// websocketURL returns the analytics WebSocket endpoint of the status server at domain,
+// over TLS as statusServerTLS says.
+func (dc *dcWrap) websocketURL(domain string) (string, bool, error) {
+	scheme, addr, err := parseStatusServerDomain(domain)
+	if err != nil {
+		return "", false, err
+	}
+	secure, err := dc.statusServerTLS(scheme)
+	if err != nil {
+		return "", false, err
+	}
+	u := url.URL{Scheme: "ws", Host: addr, Path: websocketPath}
+	if secure {
+		u.Scheme = "wss"
+	}
+	return u.String(), secure, nil
+}
+
+// metadataHeader turns the outgoing gRPC metadata of ctx into HTTP headers, so the
+// status server gets the same context over every transport.
+func metadataHeader(ctx context.Context) http.Header {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	header := make(http.Header, len(md))
+	for k, vs := range md {
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+	return header
+}
+
+// dialWebSocket connects to the analytics endpoint of the status server at domain,
+// sending header with the handshake.
+func (dc *dcWrap) dialWebSocket(ctx context.Context, domain string, header http.Header) (*websocket.Conn, error) {
+	u, secure, err := dc.websocketURL(domain)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: dc.dialTimeoutOr(),
+	}
+	if d, err := dc.statusServerProxy(); err != nil {
+		return nil, err
+	} else if d != nil {
+		dialer.Proxy, dialer.NetDialContext = nil, d.DialContext
+	}
+	if secure {
+		dialer.TLSClientConfig, err = statusServerTLSConfig(configString(dc.node.Repo, statusTLSCACertKey, ""),
+			configString(dc.node.Repo, statusClientCertKey, ""), configString(dc.node.Repo, statusClientKeyKey, ""))
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, resp, err := dialer.DialContext(ctx, u, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to status server %s: %s: %s", domain, resp.Status, err)
+		}
+		return nil, fmt.Errorf("failed to connect to status server %s: %s", domain, err)
+	}
+	return conn, nil
+}
+
+// flushWebSocket sends sms to the status server at domain as protobuf messages over
+// one WebSocket connection and returns how many it took.
+func (dc *dcWrap) flushWebSocket(ctx context.Context, domain string, sms []*pb.SignedMetrics) (int, error) {
+	md, err := dc.withIdentity(dc.withMetadata(withPayloadMetadata(ctx, sms...)))
+	if err != nil {
+		return 0, err
+	}
+	conn, err := dc.dialWebSocket(ctx, domain, metadataHeader(md))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	for i, sm := range sms {
+		if err := dc.call(ctx, func(ctx context.Context) error {
+			return sendWebSocketMetrics(ctx, conn, sm)
+		}); err != nil {
+			return i, err
+		}
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return len(sms), nil
+}
+
+// sendWebSocketMetrics writes sm to conn and waits for the status server to take it,
+// until the deadline of ctx.
+func sendWebSocketMetrics(ctx context.Context, conn *websocket.Conn, sm *pb.SignedMetrics) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		conn.SetReadDeadline(deadline)
+	}
+	data, err := proto.Marshal(sm)
+	if err != nil {
+		return fmt.Errorf("failed to marshal signed metrics: %s", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return err
+	}
+	_, ack, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if string(ack) != websocketAck {
+		return fmt.Errorf("status server rejected metrics: %s", ack)
+	}
+	return nil
+}
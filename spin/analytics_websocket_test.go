@@ -0,0 +1,176 @@
+package spin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	ic "github.com/libp2p/go-libp2p-crypto"
+)
+
+// testWebSocketServer collects the signed metrics sent over the analytics WebSocket
+type testWebSocketServer struct {
+	mu      sync.Mutex
+	sms     []*pb.SignedMetrics
+	headers []http.Header
+	reject  string
+}
+
+func (s *testWebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != websocketPath {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.mu.Lock()
+	s.headers = append(s.headers, r.Header)
+	s.mu.Unlock()
+	for {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if typ != websocket.BinaryMessage {
+			conn.WriteMessage(websocket.TextMessage, []byte("want a binary message"))
+			continue
+		}
+		sm := new(pb.SignedMetrics)
+		if err := proto.Unmarshal(data, sm); err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+			continue
+		}
+		s.mu.Lock()
+		ack := s.reject
+		if ack == "" {
+			s.sms = append(s.sms, sm)
+			ack = websocketAck
+		}
+		s.mu.Unlock()
+		conn.WriteMessage(websocket.TextMessage, []byte(ack))
+	}
+}
+
+func (s *testWebSocketServer) metrics() []*pb.SignedMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*pb.SignedMetrics(nil), s.sms...)
+}
+
+func startTestWebSocketServer(t *testing.T) (*testWebSocketServer, string) {
+	s := &testWebSocketServer{}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func newTestWebSocketDcWrap(t *testing.T, addr string) *dcWrap {
+	dc := newTestSendingDcWrap(t, addr)
+	dc.node.Repo.(*testRepo).keys = map[string]interface{}{statusServerTransportKey: websocketTransport}
+	return dc
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	ws, addr := startTestWebSocketServer(t)
+	dc := newTestWebSocketDcWrap(t, addr)
+	dc.version = "1.2.3"
+	if err := dc.sendData(context.Background(), dc.node, &backoff.StopBackOff{}); err != nil {
+		t.Fatal(err)
+	}
+	sms := ws.metrics()
+	if len(sms) != 1 {
+		t.Fatalf("status server received %d metrics, want 1", len(sms))
+	}
+	pub, err := ic.UnmarshalPublicKey(sms[0].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := pub.Verify(sms[0].Payload, sms[0].Signature); err != nil || !ok {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	if !pub.Equals(dc.node.PrivateKey.GetPublic()) {
+		t.Fatal("metrics signed with another key")
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if got, want := ws.headers[0].Get(payloadSchemaVersionKey), strconv.Itoa(payloadSchemaVersion); got != want {
+		t.Fatalf("got schema version %q, want %q", got, want)
+	}
+	if got, want := ws.headers[0].Get(nodeIDMetadataKey), dc.node.Identity.Pretty(); got != want {
+		t.Fatalf("got node id %q, want %q", got, want)
+	}
+	if got, want := ws.headers[0].Get(versionMetadataKey), "1.2.3"; got != want {
+		t.Fatalf("got version %q, want %q", got, want)
+	}
+}
+
+func TestWebSocketTransportFlushesPending(t *testing.T) {
+	ws, addr := startTestWebSocketServer(t)
+	dc := newTestWebSocketDcWrap(t, addr)
+	for i := 0; i < 3; i++ {
+		dc.pending.push(testMetrics(i))
+	}
+	if err := dc.flushPending(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := dc.pending.len(); n != 0 {
+		t.Fatalf("%d metrics still pending", n)
+	}
+	sms := ws.metrics()
+	if len(sms) != 3 {
+		t.Fatalf("status server received %d metrics, want 3", len(sms))
+	}
+	for i, sm := range sms {
+		if !proto.Equal(sm, testMetrics(i)) {
+			t.Fatalf("metrics %d out of order: %q", i, sm.Payload)
+		}
+	}
+}
+
+func TestWebSocketTransportRejected(t *testing.T) {
+	ws, addr := startTestWebSocketServer(t)
+	ws.reject = "bad signature"
+	dc := newTestWebSocketDcWrap(t, addr)
+	dc.pending.push(testMetrics(0))
+	if err := dc.flushPending(context.Background()); err == nil {
+		t.Fatal("expected an error from a rejecting status server")
+	}
+	if n := dc.pending.len(); n != 1 {
+		t.Fatalf("got %d pending metrics, want the rejected one kept", n)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	for _, tc := range []struct {
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{nil, grpcTransport, false},
+		{"grpc", grpcTransport, false},
+		{"WebSocket", websocketTransport, false},
+		{"http", "", true},
+	} {
+		dc := newTestDcWrap(t)
+		keys := map[string]interface{}{}
+		if tc.value != nil {
+			keys[statusServerTransportKey] = tc.value
+		}
+		dc.node.Repo = newTestRepo(keys)
+		got, err := dc.transport()
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("transport %v: got %q, %v, want %q", tc.value, got, err, tc.want)
+		}
+	}
+}
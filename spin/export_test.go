@@ -0,0 +1,16 @@
+package spin
+
+import (
+	"github.com/TRON-US/go-btfs/core"
+
+	nodepb "github.com/tron-us/go-btfs-common/protos/node"
+)
+
+// GetPayload serializes pn as the collector of node would, for the tests of
+// package spin_test.
+func GetPayload(node *core.IpfsNode, pn *nodepb.Node) ([]byte, error) {
+	dc := &dcWrap{node: node, pn: pn}
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+	return dc.getPayload(node)
+}
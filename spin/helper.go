@@ -2,7 +2,10 @@ package spin
 
 import (
 	"context"
+	"sync"
 	"time"
+
+	"github.com/TRON-US/go-btfs/repo"
 )
 
 func periodicSync(period, timeout time.Duration, msg string, syncFunc func(context.Context) error) {
@@ -18,3 +21,177 @@ func periodicSync(period, timeout time.Duration, msg string, syncFunc func(conte
 		}
 	}
 }
+
+// durationOr returns d, or def if d is not set.
+func durationOr(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// legacyConfigKeys maps the analytics keys to where they were read from before they
+// moved to the Analytics section. The old keys are still read, but any SetConfig
+// drops them as go-btfs-config does not define them.
+var legacyConfigKeys = map[string]string{
+	heartbeatKey:              "Services.StatusServerHeartbeat",
+	jitterKey:                 "Services.StatusServerJitter",
+	statusServerDomainsKey:    "Services.StatusServerDomains",
+	statusTLSKey:              "Experimental.StatusServerTLS",
+	statusTLSCACertKey:        "Services.StatusServerTLSCACert",
+	statusClientCertKey:       "Services.StatusServerClientCert",
+	statusClientKeyKey:        "Services.StatusServerClientKey",
+	statusServerProxyKey:      "Services.StatusServerProxy",
+	statusServerProtocolKey:   "Services.StatusServerProtocol",
+	statusServerTransportKey:  "Services.StatusServerTransport",
+	statusServerMQTTBrokerKey: "Services.StatusServerMQTTBroker",
+	circuitCooldownKey:        "Services.StatusServerCooldown",
+	bufferSizeKey:             "Services.StatusServerBufferSize",
+	retryMaxIntervalKey:       "Services.StatusServerRetryMaxInterval",
+	maxRetriesKey:             "Services.StatusServerMaxRetries",
+	dialTimeoutKey:            "Services.StatusServerDialTimeout",
+	callTimeoutKey:            "Services.StatusServerCallTimeout",
+}
+
+// legacy keys already warned about
+var legacyWarned sync.Map
+
+// configKey reads key from the raw config, or from its legacy location if only that is set.
+func configKey(r repo.Repo, key string) (interface{}, error) {
+	v, err := r.GetConfigKey(key)
+	if err == nil {
+		return v, nil
+	}
+	legacy, ok := legacyConfigKeys[key]
+	if !ok {
+		return nil, err
+	}
+	v, lerr := r.GetConfigKey(legacy)
+	if lerr != nil {
+		return nil, err
+	}
+	if _, warned := legacyWarned.LoadOrStore(legacy, true); !warned {
+		log.Warningf("%s is deprecated and lost on the next config write, move it to %s", legacy, key)
+	}
+	return v, nil
+}
+
+// configDuration reads an optional duration string (e.g. "30s") from the raw config,
+// falling back to def when the key is absent or invalid.
+func configDuration(r repo.Repo, key string, def time.Duration) time.Duration {
+	v, err := configKey(r, key)
+	if err != nil {
+		return def
+	}
+	s, ok := v.(string)
+	if !ok {
+		log.Warningf("Invalid %s value %v, using default %s", key, v, def)
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Warningf("Invalid %s value %q, using default %s", key, s, def)
+		return def
+	}
+	return d
+}
+
+// configBool reads an optional boolean from the raw config, falling back to def.
+func configBool(r repo.Repo, key string, def bool) bool {
+	v, err := configKey(r, key)
+	if err != nil {
+		return def
+	}
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	default:
+		log.Warningf("Invalid %s value %v, using default %t", key, v, def)
+		return def
+	}
+}
+
+// configString reads an optional string from the raw config, falling back to def.
+func configString(r repo.Repo, key string, def string) string {
+	v, err := configKey(r, key)
+	if err != nil {
+		return def
+	}
+	s, ok := v.(string)
+	if !ok {
+		log.Warningf("Invalid %s value %v, using default %q", key, v, def)
+		return def
+	}
+	return s
+}
+
+// configInt reads an optional positive integer from the raw config, falling back to def.
+func configInt(r repo.Repo, key string, def int) int {
+	v, err := configKey(r, key)
+	if err != nil {
+		return def
+	}
+	// json numbers are decoded as float64
+	f, ok := v.(float64)
+	if !ok || f < 1 || f != float64(int(f)) {
+		log.Warningf("Invalid %s value %v, using default %d", key, v, def)
+		return def
+	}
+	return int(f)
+}
+
+// configFloat reads an optional positive number from the raw config, falling back to def.
+func configFloat(r repo.Repo, key string, def float64) float64 {
+	v, err := configKey(r, key)
+	if err != nil {
+		return def
+	}
+	f, ok := v.(float64)
+	if !ok || f <= 0 {
+		log.Warningf("Invalid %s value %v, using default %g", key, v, def)
+		return def
+	}
+	return f
+}
+
+// configFraction reads an optional number from 0 to 1 from the raw config, falling back to def.
+func configFraction(r repo.Repo, key string, def float64) float64 {
+	v, err := configKey(r, key)
+	if err != nil {
+		return def
+	}
+	f, ok := v.(float64)
+	if !ok || f < 0 || f > 1 {
+		log.Warningf("Invalid %s value %v, using default %g", key, v, def)
+		return def
+	}
+	return f
+}
+
+// configStrings reads an optional list of strings from the raw config, falling back to def.
+func configStrings(r repo.Repo, key string, def []string) []string {
+	v, err := configKey(r, key)
+	if err != nil {
+		return def
+	}
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				log.Warningf("Invalid %s value %v, using default %q", key, v, def)
+				return def
+			}
+			res = append(res, s)
+		}
+		return res
+	default:
+		log.Warningf("Invalid %s value %v, using default %q", key, v, def)
+		return def
+	}
+}
@@ -0,0 +1,48 @@
+package testutil
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/tron-us/go-btfs-common/protos/status"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestFakeStatusServer(t *testing.T) {
+	s := NewFakeStatusServer()
+	defer s.Close()
+	conn, err := s.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := pb.NewStatusServiceClient(conn)
+	sms := []*pb.SignedMetrics{
+		{Payload: []byte("first"), Signature: []byte("sig")},
+		{Payload: []byte("second"), PublicKey: []byte("key")},
+	}
+	if _, err := client.UpdateMetrics(context.Background(), sms[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.UpdateMetricsAndDiscovery(context.Background(), sms[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.ReceivedMetrics()
+	if len(got) != len(sms) {
+		t.Fatalf("got %d metrics, want %d", len(got), len(sms))
+	}
+	for i := range sms {
+		if !proto.Equal(got[i], sms[i]) {
+			t.Errorf("metrics %d: got %v, want %v", i, got[i], sms[i])
+		}
+	}
+
+	// the slice returned is a copy
+	got[0] = nil
+	if s.ReceivedMetrics()[0] == nil {
+		t.Fatal("ReceivedMetrics exposed the server's records")
+	}
+}